@@ -0,0 +1,125 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminPackagesPath is the admin API endpoint for the packages of the running config.
+const adminPackagesPath = "/gopkg/packages"
+
+// maxAdminBody limits the size of package configs sent to the admin API.
+const maxAdminBody = 1 << 20
+
+// adminAPI adds endpoints for the packages of the gopkg app to Caddy's admin API:
+//
+//     GET    /gopkg/packages         lists all packages
+//     PUT    /gopkg/packages/<path>  adds or replaces the package at <path>, served by gopkg_dynamic handlers
+//     DELETE /gopkg/packages/<path>  removes a package added with PUT
+//     GET    /gopkg/metrics          serves the request counters in the Prometheus text format
+//
+// PUT takes the JSON config of a package, as used by the handler, without the path.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.gopkg",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: adminPackagesPath, Handler: caddy.AdminHandlerFunc(a.handlePackages)},
+		{Pattern: adminPackagesPath + "/", Handler: caddy.AdminHandlerFunc(a.handlePackages)},
+		{Pattern: adminMetricsPath, Handler: caddy.AdminHandlerFunc(a.handleMetrics)},
+	}
+}
+
+// packageInfo describes a package in the listing of the admin API.
+type packageInfo struct {
+	Path    string `json:"path"`
+	Vcs     string `json:"vcs"`
+	URL     string `json:"url"`
+	Dynamic bool   `json:"dynamic,omitempty"`
+}
+
+// handlePackages serves the package endpoints.
+func (adminAPI) handlePackages(w http.ResponseWriter, r *http.Request) error {
+	running.RLock()
+	app := running.app
+	running.RUnlock()
+	if app == nil {
+		return caddy.APIError{Code: http.StatusServiceUnavailable, Err: fmt.Errorf("gopkg app is not running")}
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, adminPackagesPath)
+	if path == "/" || path == "" && r.Method != http.MethodGet {
+		return caddy.APIError{Code: http.StatusBadRequest, Err: fmt.Errorf("missing package path")}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if path != "" {
+			return caddy.APIError{Code: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+		}
+		return listPackages(w, app)
+
+	case http.MethodPut:
+		m := new(GoPackage)
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxAdminBody)).Decode(m); err != nil {
+			return caddy.APIError{Code: http.StatusBadRequest, Err: fmt.Errorf("decoding package: %v", err)}
+		}
+		m.Path = path
+		if err := app.SetPackage(m); err != nil {
+			return caddy.APIError{Code: http.StatusBadRequest, Err: err}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+
+	case http.MethodDelete:
+		ok, err := app.RemovePackage(path)
+		if err != nil {
+			return caddy.APIError{Code: http.StatusInternalServerError, Err: err}
+		}
+		if !ok {
+			return caddy.APIError{Code: http.StatusNotFound, Err: fmt.Errorf("no package added at %s", path)}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	return caddy.APIError{Code: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+}
+
+// listPackages responds with all packages of the app.
+func listPackages(w http.ResponseWriter, app *App) error {
+	dynamic := make(map[*GoPackage]bool)
+	for _, m := range app.packages.dynamicPackages() {
+		dynamic[m] = true
+	}
+
+	infos := []packageInfo{}
+	for _, m := range app.Packages() {
+		infos = append(infos, packageInfo{Path: m.MountPrefix + m.Path, Vcs: m.Vcs, URL: m.URL, Dynamic: dynamic[m]})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(infos)
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
@@ -0,0 +1,115 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// adminRequest sends a request to the gopkg admin API.
+func adminRequest(t *testing.T, method, target, body string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	return w, adminAPI{}.handlePackages(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+}
+
+// serveDynamic sends a GET request for target through the handler and returns the recorded response.
+func serveDynamic(t *testing.T, d *Dynamic, target string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	if err := d.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil), next); err != nil {
+		t.Fatalf("serving %s: %v", target, err)
+	}
+	return w
+}
+
+func TestAdminAPIPackages(t *testing.T) {
+	app, err := loadApp(testContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer app.Stop()
+
+	d := new(Dynamic)
+	if err := d.Provision(testContext); err != nil {
+		t.Fatal(err)
+	}
+	if code := serveDynamic(t, d, "http://example.com/dyn?go-get=1").Code; code != http.StatusTeapot {
+		t.Errorf("expected unknown package to pass to the next handler, got %d", code)
+	}
+
+	if w, err := adminRequest(t, http.MethodPut, "/gopkg/packages/dyn", `{"url": "github.com/example/dyn"}`); err != nil || w.Code != http.StatusNoContent {
+		t.Fatalf("expected package to be added, got %d: %v", w.Code, err)
+	}
+	w := serveDynamic(t, d, "http://example.com/dyn/pkg?go-get=1")
+	if want := `content="example.com/dyn git https://github.com/example/dyn"`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("expected added package to be served %s, got %s", want, w.Body.String())
+	}
+
+	w, err = adminRequest(t, http.MethodGet, "/gopkg/packages", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var infos []packageInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, info := range infos {
+		if info == (packageInfo{Path: "/dyn", Vcs: "git", URL: "https://github.com/example/dyn", Dynamic: true}) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected added package in listing, got %+v", infos)
+	}
+
+	if w, err := adminRequest(t, http.MethodPut, "/gopkg/packages/dyn", `{"vcs": "hg", "url": "https://hg.example.com/dyn"}`); err != nil || w.Code != http.StatusNoContent {
+		t.Fatalf("expected package to be replaced, got %d: %v", w.Code, err)
+	}
+	w = serveDynamic(t, d, "http://example.com/dyn?go-get=1")
+	if want := `content="example.com/dyn hg https://hg.example.com/dyn"`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("expected replaced package to be served %s, got %s", want, w.Body.String())
+	}
+
+	if w, err := adminRequest(t, http.MethodDelete, "/gopkg/packages/dyn", ""); err != nil || w.Code != http.StatusNoContent {
+		t.Fatalf("expected package to be removed, got %d: %v", w.Code, err)
+	}
+	if code := serveDynamic(t, d, "http://example.com/dyn?go-get=1").Code; code != http.StatusTeapot {
+		t.Errorf("expected removed package to pass to the next handler, got %d", code)
+	}
+
+	tests := []struct {
+		method, target, body string
+		wantCode             int
+	}{
+		{http.MethodDelete, "/gopkg/packages/dyn", "", http.StatusNotFound},
+		{http.MethodPut, "/gopkg/packages/bad", `{"url": "https://github.com/example/bad", "meta_status": 404}`, http.StatusBadRequest},
+		{http.MethodPut, "/gopkg/packages/bad", `{`, http.StatusBadRequest},
+		{http.MethodPut, "/gopkg/packages", `{"url": "https://github.com/example/foo"}`, http.StatusBadRequest},
+		{http.MethodPost, "/gopkg/packages/foo", "", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		_, err := adminRequest(t, test.method, test.target, test.body)
+		var apiErr caddy.APIError
+		if !errors.As(err, &apiErr) || apiErr.Code != test.wantCode {
+			t.Errorf("%s %s: expected API error with status %d, got %v", test.method, test.target, test.wantCode, err)
+		}
+	}
+}
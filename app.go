@@ -0,0 +1,204 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(App{})
+}
+
+// App is the gopkg app, which keeps a registry of all packages of the loaded config. Packages register themselves
+// with it when they are provisioned, so features spanning all packages can look them up.
+//
+// The app needs no configuration. It is loaded by the first package that is provisioned, if it is not configured
+// explicitly.
+//
+// Packages added at runtime are persisted in Caddy's storage, so they survive restarts and config reloads, and
+// instances sharing the storage in a cluster serve them once they load their config.
+type App struct {
+	packages *registry
+	ctx      caddy.Context
+	storage  packageStorage
+	logger   *zap.Logger
+}
+
+// packageStorage is the part of Caddy's storage used to persist packages.
+type packageStorage interface {
+	Store(key string, value []byte) error
+	Load(key string) ([]byte, error)
+	Delete(key string) error
+	List(prefix string, recursive bool) ([]string, error)
+}
+
+// storagePrefix is the prefix of the storage keys of the packages added at runtime.
+const storagePrefix = "gopkg/packages"
+
+// running is the app of the running config, which the admin API operates on.
+var running struct {
+	sync.RWMutex
+	app *App
+}
+
+// CaddyModule returns the Caddy module information.
+func (App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "gopkg",
+		New: func() caddy.Module {
+			return new(App)
+		},
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (a *App) Provision(ctx caddy.Context) error {
+	a.packages = new(registry)
+	a.ctx = ctx
+	a.storage = ctx.Storage()
+	a.logger = ctx.Logger(a)
+	return nil
+}
+
+// Start implements caddy.App. Packages are served by their HTTP handlers, so it only restores the packages added at
+// runtime and makes the app available to the admin API.
+//
+// The packages are restored here rather than in Provision, as provisioning them needs the provisioned app.
+func (a *App) Start() error {
+	a.loadStoredPackages()
+
+	running.Lock()
+	running.app = a
+	running.Unlock()
+	return nil
+}
+
+// Stop implements caddy.App. The new app of a reloaded config is started before the old one is stopped, so it is
+// only removed from the admin API if it has not been replaced yet.
+func (a *App) Stop() error {
+	running.Lock()
+	if running.app == a {
+		running.app = nil
+	}
+	running.Unlock()
+	return nil
+}
+
+// Packages returns the packages registered with the app, in the order they were provisioned.
+func (a *App) Packages() []*GoPackage {
+	return a.packages.list()
+}
+
+// SetPackage provisions a package and serves it in addition to the configured packages, replacing a package added
+// before with the same path. The package is only served by `gopkg_dynamic` handlers. It is persisted in Caddy's
+// storage and restored when the app is started again.
+//
+// The package is fully provisioned before it replaces the previous one, so requests are served by either of them.
+func (a *App) SetPackage(m *GoPackage) error {
+	// Persist the config as given, not as completed by provisioning
+	config, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := provisionPackage(a.ctx, m); err != nil {
+		return err
+	}
+	if a.storage != nil {
+		if err := a.storage.Store(packageStorageKey(m.Path), config); err != nil {
+			m.Cleanup()
+			return fmt.Errorf("storing package: %v", err)
+		}
+	}
+	return a.setDynamic(m)
+}
+
+// setDynamic serves a provisioned package added at runtime, and cleans up the package it replaces.
+func (a *App) setDynamic(m *GoPackage) error {
+	if replaced := a.packages.setDynamic(m); replaced != nil {
+		return replaced.Cleanup()
+	}
+	return nil
+}
+
+// RemovePackage stops serving the package added with SetPackage at the path and removes it from the storage. ok is
+// false if there is none.
+func (a *App) RemovePackage(path string) (ok bool, err error) {
+	m := a.packages.removeDynamic(path)
+	if m == nil {
+		return false, nil
+	}
+	if a.storage != nil {
+		if err := a.storage.Delete(packageStorageKey(path)); err != nil {
+			m.Cleanup()
+			return true, fmt.Errorf("deleting stored package: %v", err)
+		}
+	}
+	return true, m.Cleanup()
+}
+
+// packageStorageKey returns the storage key of a package added at runtime. The path is escaped into a single key
+// segment, as storages keeping keys as files cannot hold both `/foo` and `/foo/bar` otherwise.
+func packageStorageKey(path string) string {
+	return storagePrefix + "/" + url.PathEscape(path)
+}
+
+// loadStoredPackages provisions and serves the packages persisted by SetPackage. A package that fails to load is
+// logged and skipped, so it cannot prevent Caddy from starting.
+func (a *App) loadStoredPackages() {
+	if a.storage == nil {
+		return
+	}
+	keys, err := a.storage.List(storagePrefix, false)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			a.logger.Warn("listing stored packages", zap.Error(err))
+		}
+		return
+	}
+
+	for _, key := range keys {
+		if err := a.loadStoredPackage(key); err != nil {
+			a.logger.Warn("loading stored package", zap.String("key", key), zap.Error(err))
+		}
+	}
+}
+
+// loadStoredPackage provisions and serves the package stored at the key.
+func (a *App) loadStoredPackage(key string) error {
+	config, err := a.storage.Load(key)
+	if err != nil {
+		return err
+	}
+	m := new(GoPackage)
+	if err := json.Unmarshal(config, m); err != nil {
+		return err
+	}
+	if packageStorageKey(m.Path) != key {
+		return fmt.Errorf("package path %q does not match the key", m.Path)
+	}
+	if err := provisionPackage(a.ctx, m); err != nil {
+		return err
+	}
+	return a.setDynamic(m)
+}
+
+// loadApp returns the gopkg app of the config being provisioned.
+func loadApp(ctx caddy.Context) (*App, error) {
+	app, err := ctx.App("gopkg")
+	if err != nil {
+		return nil, err
+	}
+	return app.(*App), nil
+}
+
+// Interface guards
+var (
+	_ caddy.App         = (*App)(nil)
+	_ caddy.Provisioner = (*App)(nil)
+)
@@ -0,0 +1,134 @@
+package gopkg
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// memoryStorage is a packageStorage keeping the values in memory.
+type memoryStorage struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{values: make(map[string][]byte)}
+}
+
+func (s *memoryStorage) Store(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	return nil
+}
+
+func (s *memoryStorage) Load(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return value, nil
+}
+
+func (s *memoryStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+func (s *memoryStorage) List(prefix string, recursive bool) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.values {
+		if strings.HasPrefix(key, prefix+"/") {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, os.ErrNotExist
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func TestAppPackages(t *testing.T) {
+	foo := provision(t, New("/foo", "", "https://github.com/example/foo"))
+	bar := provision(t, New("/bar", "", "https://github.com/example/bar"))
+	defer foo.Cleanup()
+	defer bar.Cleanup()
+
+	if foo.app == nil || foo.app != bar.app {
+		t.Fatalf("expected packages of a config to share one app, got %p and %p", foo.app, bar.app)
+	}
+
+	app, err := loadApp(testContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []*GoPackage
+	for _, p := range app.Packages() {
+		if p == foo || p == bar {
+			found = append(found, p)
+		}
+	}
+	if len(found) != 2 || found[0] != foo || found[1] != bar {
+		t.Errorf("expected both packages in provisioning order, got %v", found)
+	}
+}
+
+func TestAppStoredPackages(t *testing.T) {
+	app, err := loadApp(testContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := app.storage.(*memoryStorage)
+
+	if err := app.SetPackage(New("/stored", "", "https://github.com/example/stored")); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.SetPackage(New("/stored/nested", "", "github.com/example/nested")); err != nil {
+		t.Fatal(err)
+	}
+	defer app.RemovePackage("/stored")
+
+	// The config is stored as given, before provisioning completed the url
+	config, err := storage.Load("gopkg/packages/%2Fstored%2Fnested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(config), `"url":"github.com/example/nested"`) {
+		t.Errorf("expected the config as given, got %s", config)
+	}
+	if ok, err := app.RemovePackage("/stored/nested"); !ok || err != nil {
+		t.Fatalf("expected package to be removed, got %v, %v", ok, err)
+	}
+	if _, err := storage.Load("gopkg/packages/%2Fstored%2Fnested"); err == nil {
+		t.Error("expected removed package to be deleted from the storage")
+	}
+
+	// A new app restores the stored packages when it is started, skipping broken ones
+	storage.Store("gopkg/packages/%2Fbroken", []byte(`{"path": "/other", "url": "https://github.com/example/broken"}`))
+	defer storage.Delete("gopkg/packages/%2Fbroken")
+
+	restarted := &App{packages: new(registry), ctx: testContext, storage: storage, logger: zap.NewNop()}
+	restarted.loadStoredPackages()
+	defer func() {
+		for _, m := range restarted.packages.dynamicPackages() {
+			m.Cleanup()
+		}
+	}()
+
+	dynamic := restarted.packages.dynamicPackages()
+	if len(dynamic) != 1 || dynamic[0].Path != "/stored" || dynamic[0].URL != "https://github.com/example/stored" {
+		t.Errorf("expected the stored package to be restored, got %d packages", len(dynamic))
+	}
+}
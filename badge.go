@@ -0,0 +1,66 @@
+package gopkg
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+// badgeFile is the file name of the version badge below the path of a package or submodule.
+const badgeFile = "badge.svg"
+
+// badgeTemplate renders a shields.io-style badge with a label and a value.
+var badgeTemplate = template.Must(template.New("Badge").Parse(`<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="20" role="img" aria-label="{{.Label}}: {{.Value}}">
+<title>{{.Label}}: {{.Value}}</title>
+<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="{{.Width}}" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)">
+<rect width="{{.LabelWidth}}" height="20" fill="#555"/>
+<rect x="{{.LabelWidth}}" width="{{.ValueWidth}}" height="20" fill="{{.Color}}"/>
+<rect width="{{.Width}}" height="20" fill="url(#s)"/>
+</g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="{{.LabelX}}" y="14">{{.Label}}</text>
+<text x="{{.ValueX}}" y="14">{{.Value}}</text>
+</g>
+</svg>
+`))
+
+// badgeData is the data passed to badgeTemplate.
+type badgeData struct {
+	Label, Value, Color           string
+	Width, LabelWidth, ValueWidth int
+	LabelX, ValueX                int
+}
+
+// newBadgeData lays out a badge. The text width is estimated, as the font is not known.
+func newBadgeData(label, value, color string) badgeData {
+	textWidth := func(s string) int {
+		return 7*len(s) + 10
+	}
+	b := badgeData{Label: label, Value: value, Color: color, LabelWidth: textWidth(label), ValueWidth: textWidth(value)}
+	b.Width = b.LabelWidth + b.ValueWidth
+	b.LabelX = b.LabelWidth / 2
+	b.ValueX = b.LabelWidth + b.ValueWidth/2
+	return b
+}
+
+// serveBadge responds with a badge showing the latest version of the module at importPath.
+func (m GoPackage) serveBadge(w http.ResponseWriter, r *http.Request, importPath string) error {
+	data := newBadgeData("go module", "unknown", "#9f9f9f")
+	if version := m.latestVersion(r, importPath); version != "" {
+		data = newBadgeData("go module", version, "#007ec6")
+	}
+
+	var buf bytes.Buffer
+	if err := badgeTemplate.Execute(&buf, data); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	// Badges are embedded on other sites, which should pick up new versions
+	w.Header().Set("Cache-Control", "max-age=300")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	return writeBody(w, r, buf.Bytes())
+}
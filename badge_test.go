@@ -0,0 +1,65 @@
+package gopkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeHTTPBadge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/example.com/foo/@latest":
+			w.Write([]byte(`{"Version": "v1.2.3", "Time": "2020-05-04T10:20:30Z"}`))
+		case "/example.com/foo/!bar/@latest":
+			w.Write([]byte(`{"Version": "v0.1.0"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	m := New("/foo", "", "https://github.com/example/foo").
+		WithSubmodule("/Bar", "https://github.com/example/bar").
+		WithSubmodule("/baz", "https://github.com/example/baz")
+	m.Hosts = []string{"example.com"}
+	m.Badge = true
+	m.LatestVersion = &LatestVersion{Proxy: srv.URL}
+	provision(t, m)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/foo/badge.svg", ">v1.2.3</text>"},
+		{"http://example.com/foo/Bar/badge.svg", ">v0.1.0</text>"},
+		{"http://example.com/foo/baz/badge.svg", ">unknown</text>"},
+	}
+	for _, test := range tests {
+		// The version is looked up in the background, so the first badges show it as unknown
+		var w *httptest.ResponseRecorder
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if w = serve(t, m, http.MethodGet, test.target); strings.Contains(w.Body.String(), test.want) {
+				break
+			}
+		}
+		if got := w.Header().Get("Content-Type"); got != "image/svg+xml" {
+			t.Errorf("%s: expected an SVG image, got %q", test.target, got)
+		}
+		if !strings.Contains(w.Body.String(), test.want) {
+			t.Errorf("%s: expected badge to contain %q, got %q", test.target, test.want, w.Body.String())
+		}
+	}
+
+	if w := serve(t, m, http.MethodHead, "http://example.com/foo/badge.svg"); w.Body.Len() != 0 || w.Header().Get("Content-Length") == "" {
+		t.Errorf("expected HEAD to get the Content-Length without a body, got %d bytes", w.Body.Len())
+	}
+
+	// Without badge, the path is just a subpath of the package
+	m = provision(t, New("/foo", "", "https://github.com/example/foo"))
+	if w := serve(t, m, http.MethodGet, "http://example.com/foo/badge.svg"); w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected badge path to be redirected without badge, got %d", w.Code)
+	}
+}
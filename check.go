@@ -0,0 +1,351 @@
+package gopkg
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/mschneider82/gopkg/gopkgtest"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "gopkg-check",
+		Func:  cmdCheck,
+		Usage: "[--config <path>] [--adapter <name>] [--host <host>] [--offline] [--timeout <duration>]",
+		Short: "Checks the go-import responses of the configured packages",
+		Long: `
+Loads and provisions the config like the validate command, then simulates
+'go get' for the import path of every configured package and submodule. For
+each import path it prints the go-import response that would be served, and
+whether the repository it points to resolves.
+
+Packages are served for the host of their site block. Sites without a host,
+or with a wildcard host, use --host instead. Packages with path variables
+and packages discovered at runtime cannot be enumerated and are not checked.
+
+The exit code is non-zero if any import path fails to resolve.`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("gopkg-check", flag.ExitOnError)
+			fs.String("config", "", "Input configuration file")
+			fs.String("adapter", "", "Name of config adapter")
+			fs.String("host", "localhost", "Host of sites without one")
+			fs.Bool("offline", false, "Do not check whether the repositories resolve")
+			fs.Duration("timeout", time.Duration(DefaultValidateURLTimeout), "Timeout of each repository check")
+			return fs
+		}(),
+	})
+}
+
+// checkConfig is the config loaded to provision the checked packages. It only runs the gopkg app, so no listeners
+// are started.
+const checkConfig = `{"admin": {"disabled": true, "config": {"persist": false}}, "apps": {"gopkg": {}}}`
+
+// CheckOptions configure a check of the packages of a config, see Check.
+type CheckOptions struct {
+	// Host is the host the packages of sites without a host are requested for.
+	Host string
+
+	// Offline skips checking whether the repositories resolve.
+	Offline bool
+
+	// Timeout bounds the check of each repository.
+	Timeout time.Duration
+}
+
+// cmdCheck implements the gopkg-check command.
+func cmdCheck(fl caddycmd.Flags) (int, error) {
+	cfgJSON, err := loadCheckConfig(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	var cfg *caddy.Config
+	if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding config: %v", err)
+	}
+	if err := caddy.Validate(cfg); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if err := caddy.Load([]byte(checkConfig), true); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer caddy.Stop()
+
+	running.RLock()
+	app := running.app
+	running.RUnlock()
+
+	failed, err := Check(app.ctx, os.Stdout, cfgJSON, CheckOptions{
+		Host:    fl.String("host"),
+		Offline: fl.Bool("offline"),
+		Timeout: fl.Duration("timeout"),
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if failed > 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("%d import paths failed", failed)
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// loadCheckConfig reads the config file and adapts it to JSON, like the commands of Caddy do. Without a config file,
+// the Caddyfile of the working directory is used.
+func loadCheckConfig(configFile, adapterName string) ([]byte, error) {
+	if configFile == "" {
+		if adapterName != "" {
+			return nil, fmt.Errorf("cannot adapt config without config file (use --config)")
+		}
+		configFile = "Caddyfile"
+	}
+	if adapterName == "" && strings.HasPrefix(filepath.Base(configFile), "Caddyfile") &&
+		filepath.Ext(configFile) != ".json" {
+		adapterName = "caddyfile"
+	}
+
+	config, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %v", err)
+	}
+	if adapterName == "" {
+		return config, nil
+	}
+
+	cfgAdapter := caddyconfig.GetAdapter(adapterName)
+	if cfgAdapter == nil {
+		return nil, fmt.Errorf("unrecognized config adapter: %s", adapterName)
+	}
+	adapted, warnings, err := cfgAdapter.Adapt(config, map[string]interface{}{"filename": configFile})
+	if err != nil {
+		return nil, fmt.Errorf("adapting config using %s: %v", adapterName, err)
+	}
+	for _, warn := range warnings {
+		fmt.Fprintf(os.Stderr, "[WARNING][%s] %s:%d: %s\n", adapterName, warn.File, warn.Line, warn.Message)
+	}
+	return adapted, nil
+}
+
+// checkRoute is the part of an HTTP route of the config that locates the packages and their host.
+type checkRoute struct {
+	Match []struct {
+		Host []string `json:"host"`
+	} `json:"match"`
+	Handle []json.RawMessage `json:"handle"`
+}
+
+// checkedPackage is a package found in the config with the host it is served for.
+type checkedPackage struct {
+	host    string
+	handler string
+	raw     json.RawMessage
+
+	// packagesHost selects the packages of a host of a gopkg_packages handler.
+	packagesHost string
+}
+
+// Check provisions the packages of the HTTP servers of a JSON config with ctx, and writes the go-import response of
+// every import path of the packages and their submodules to w. Unless opts.Offline is set, it also checks whether the
+// repositories of the responses resolve. It returns the number of import paths that failed.
+func Check(ctx caddy.Context, w io.Writer, cfgJSON []byte, opts CheckOptions) (int, error) {
+	var cfg struct {
+		Apps struct {
+			HTTP struct {
+				Servers map[string]struct {
+					Routes []checkRoute `json:"routes"`
+				} `json:"servers"`
+			} `json:"http"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+		return 0, fmt.Errorf("decoding config: %v", err)
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Duration(DefaultValidateURLTimeout)
+	}
+
+	var found []checkedPackage
+	for _, srv := range cfg.Apps.HTTP.Servers {
+		found = append(found, findPackages(srv.Routes, opts.Host)...)
+	}
+
+	failed := 0
+	for _, p := range found {
+		packages, err := p.provision(ctx)
+		if err != nil {
+			return failed, err
+		}
+		for _, m := range packages {
+			failed += checkPackage(ctx, w, p.host, m, opts)
+			m.Cleanup()
+		}
+	}
+	return failed, nil
+}
+
+// findPackages returns the package handlers of the routes and their subroutes. Packages are served for the first
+// host the route matches, or host if it has none.
+func findPackages(routes []checkRoute, host string) []checkedPackage {
+	var found []checkedPackage
+	for _, route := range routes {
+		routeHost := host
+		if len(route.Match) > 0 && len(route.Match[0].Host) > 0 && !strings.ContainsAny(route.Match[0].Host[0], "*{") {
+			routeHost = route.Match[0].Host[0]
+		}
+
+		for _, raw := range route.Handle {
+			var handler struct {
+				Handler string       `json:"handler"`
+				Routes  []checkRoute `json:"routes"`
+			}
+			if err := json.Unmarshal(raw, &handler); err != nil {
+				continue
+			}
+			switch handler.Handler {
+			case "subroute":
+				found = append(found, findPackages(handler.Routes, routeHost)...)
+			case "gopkg", "gopkg_packages", "gopkg_file":
+				found = append(found, checkedPackage{host: routeHost, handler: handler.Handler, raw: raw})
+				// The packages of each host of gopkg_packages are checked with that host
+				var ps Packages
+				if handler.Handler != "gopkg_packages" || json.Unmarshal(raw, &ps) != nil {
+					break
+				}
+				hosts := make([]string, 0, len(ps.Hosts))
+				for packagesHost := range ps.Hosts {
+					hosts = append(hosts, packagesHost)
+				}
+				sort.Strings(hosts)
+				for _, packagesHost := range hosts {
+					found = append(found, checkedPackage{host: packagesHost, handler: handler.Handler, raw: raw,
+						packagesHost: packagesHost})
+				}
+			}
+		}
+	}
+	return found
+}
+
+// provision decodes and provisions the packages of the handler.
+func (p checkedPackage) provision(ctx caddy.Context) ([]*GoPackage, error) {
+	var packages []*GoPackage
+	switch p.handler {
+	case "gopkg":
+		m := new(GoPackage)
+		if err := json.Unmarshal(p.raw, m); err != nil {
+			return nil, err
+		}
+		packages = []*GoPackage{m}
+	case "gopkg_packages":
+		var ps Packages
+		if err := json.Unmarshal(p.raw, &ps); err != nil {
+			return nil, err
+		}
+		packages = ps.Packages
+		if p.packagesHost != "" {
+			packages = ps.Hosts[p.packagesHost]
+		}
+	case "gopkg_file":
+		var pf PackageFile
+		if err := json.Unmarshal(p.raw, &pf); err != nil {
+			return nil, err
+		}
+		var err error
+		if packages, err = LoadPackageFile(pf.File); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, m := range packages {
+		if err := provisionPackage(ctx, m); err != nil {
+			for _, provisioned := range packages[:i] {
+				provisioned.Cleanup()
+			}
+			return nil, fmt.Errorf("package %q: %v", m.Path, err)
+		}
+	}
+	return packages, nil
+}
+
+// checkPackage checks the import paths of the package and its submodules, and returns the number of failures.
+func checkPackage(ctx context.Context, w io.Writer, host string, m *GoPackage, opts CheckOptions) int {
+	if len(m.pathVars) > 0 {
+		fmt.Fprintf(w, "%s%s: skipped, path variables\n", host, m.Path)
+		return 0
+	}
+
+	paths := []string{m.Path}
+	for _, s := range m.Submodules {
+		// Reserved submodules are not served on purpose
+		if s.Path != WildcardSubmodule && s.pathPattern == nil && !s.Reserved {
+			paths = append(paths, m.Path+s.Path)
+		}
+	}
+
+	failed := 0
+	for _, path := range paths {
+		if err := checkImport(ctx, w, host, path, m, opts); err != nil {
+			fmt.Fprintf(w, "%s%s: FAIL %v\n", host, path, err)
+			failed++
+		}
+	}
+	return failed
+}
+
+// checkImport requests the import path like `go get` does, and checks the repository of the response.
+func checkImport(ctx context.Context, w io.Writer, host, path string, m *GoPackage, opts CheckOptions) error {
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+m.MountPrefix+path+"?go-get=1", nil)
+	rec := httptest.NewRecorder()
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("not handled"))
+	})
+	if err := m.ServeHTTP(rec, req, next); err != nil {
+		return err
+	}
+	if rec.Code != m.MetaStatus {
+		return fmt.Errorf("unexpected status %d", rec.Code)
+	}
+
+	importHost, importPath, vcs, u, err := gopkgtest.ParseGoImport(rec.Body.String())
+	if err != nil {
+		return err
+	}
+	prefix := importHost + importPath
+	if !strings.HasPrefix(host+path+"/", prefix+"/") {
+		return fmt.Errorf("import prefix %s does not match", prefix)
+	}
+
+	status := "ok"
+	switch {
+	case opts.Offline:
+		status = "not resolved"
+	case !(strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")):
+		status = "not resolved, no HTTP(S) url"
+	default:
+		probe := headURL
+		if vcs == "git" {
+			probe = probeGitRepo
+		}
+		if err := probe(ctx, u, opts.Timeout); err != nil {
+			return fmt.Errorf("%s %s %s: repository does not resolve: %v", prefix, vcs, u, err)
+		}
+	}
+
+	fmt.Fprintf(w, "%s%s: %s %s %s, %s\n", host, path, prefix, vcs, u, status)
+	return nil
+}
@@ -0,0 +1,92 @@
+package gopkg
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+)
+
+func TestCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/example/foo/info/refs" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", gitAdvertisement)
+	}))
+	defer srv.Close()
+
+	caddyfile := `{
+	order gopkg first
+	order gopkg_packages first
+}
+
+example.com {
+	gopkg /foo ` + srv.URL + `/example/foo {
+		submodule /bar ` + srv.URL + `/example/bar
+		submodule /old -
+		meta_status 203
+	}
+	gopkg /{user}/* ` + srv.URL + `/{user}/{1}
+}
+
+:8080 {
+	gopkg /baz ` + srv.URL + `/example/foo
+	gopkg_packages {
+		host go.example.org {
+			/qux ` + srv.URL + `/example/foo
+		}
+	}
+}
+`
+	cfgJSON, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(caddyfile), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	failed, err := Check(testContext, &out, cfgJSON, CheckOptions{Host: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed != 1 {
+		t.Errorf("expected 1 failed import path, got %d", failed)
+	}
+
+	for _, want := range []string{
+		"example.com/foo: example.com/foo git " + srv.URL + "/example/foo, ok\n",
+		"example.com/foo/bar: FAIL example.com/foo/bar git " + srv.URL + "/example/bar: repository does not resolve",
+		"example.com/{user}/{1}: skipped, path variables\n",
+		"localhost/baz: localhost/baz git " + srv.URL + "/example/foo, ok\n",
+		"go.example.org/qux: go.example.org/qux git " + srv.URL + "/example/foo, ok\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "example.com/foo/old") {
+		t.Errorf("expected reserved submodule not to be checked, got:\n%s", out.String())
+	}
+
+	out.Reset()
+	if failed, err := Check(testContext, &out, cfgJSON, CheckOptions{Host: "localhost", Offline: true}); err != nil || failed != 0 {
+		t.Errorf("expected offline check to pass, got %d failed, %v", failed, err)
+	}
+	if !strings.Contains(out.String(), "example.com/foo/bar: example.com/foo/bar git "+srv.URL+"/example/bar, not resolved\n") {
+		t.Errorf("expected unresolved submodule in offline output, got:\n%s", out.String())
+	}
+
+	app, err := loadApp(testContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range app.Packages() {
+		if m.Path == "/baz" {
+			t.Error("expected checked packages to be deregistered")
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package gopkg
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(ConsulPackages{})
+	httpcaddyfile.RegisterDirective("gopkg_consul", parseConsulPackages)
+}
+
+// DefaultConsulAddress is the Consul agent packages are loaded from if none is configured.
+const DefaultConsulAddress = "http://127.0.0.1:8500"
+
+// DefaultKVPrefix is the prefix of the Consul and etcd keys holding packages if none is configured.
+const DefaultKVPrefix = "gopkg/"
+
+// consulWait is how long a blocking query waits for a change of the keys before it returns unchanged.
+const consulWait = 5 * time.Minute
+
+// kvRetryInterval is how long watching a key-value store pauses after a failure before it retries.
+const kvRetryInterval = 10 * time.Second
+
+// ConsulPackages serves the packages stored in the key-value store of Consul. Each package is stored as the JSON
+// config of a package at a key of the prefix and its path, e.g.
+//
+//     consul kv put gopkg/foo '{"url": "https://github.com/example/foo"}'
+//
+// The keys are watched with blocking queries, so packages added, changed or removed in Consul are served right away
+// without reloading the config. If Consul is unreachable or a package is invalid, the previous packages keep being
+// served. Requests not matching any of the packages are passed to the next handler.
+type ConsulPackages struct {
+	// Address is the URL of the HTTP API of the Consul agent.
+	//
+	// If empty, the default is `http://127.0.0.1:8500`.
+	Address string `json:"address,omitempty"`
+
+	// Token is the ACL token of the requests. It may be a placeholder like `{env.CONSUL_HTTP_TOKEN}`.
+	Token string `json:"token,omitempty"`
+
+	// Prefix is the prefix of the keys holding the packages, which is followed by the package path.
+	//
+	// If empty, the default is `gopkg/`.
+	Prefix string `json:"prefix,omitempty"`
+
+	client *http.Client
+	token  string
+	logger *zap.Logger
+	kvPackages
+}
+
+// consulEntry is a key with its value as returned by the KV API of Consul.
+type consulEntry struct {
+	Key   string `json:"Key"`
+	Value string `json:"Value"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (ConsulPackages) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.gopkg_consul",
+		New: func() caddy.Module {
+			return new(ConsulPackages)
+		},
+	}
+}
+
+// parseConsulPackages parses the gopkg_consul directive in a caddyfile. Syntax:
+//
+//     gopkg_consul [<address>] {
+//         token <token>
+//         prefix <prefix>
+//     }
+//
+// Without an address, the local agent at `http://127.0.0.1:8500` is used.
+func parseConsulPackages(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	p := new(ConsulPackages)
+	for h.Next() {
+		if h.NextArg() {
+			p.Address = h.Val()
+		}
+		if h.NextArg() {
+			return nil, h.ArgErr()
+		}
+		for h.NextBlock(0) {
+			switch h.Val() {
+			case "token":
+				if !h.Args(&p.Token) {
+					return nil, h.ArgErr()
+				}
+			case "prefix":
+				if !h.Args(&p.Prefix) {
+					return nil, h.ArgErr()
+				}
+			default:
+				return nil, h.Errf("unrecognized gopkg_consul subdirective '%s'", h.Val())
+			}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+		}
+	}
+
+	return h.NewRoute(nil, p), nil
+}
+
+// Provision implements caddy.Provisioner. It loads the packages and starts watching them. A failure to load them is
+// logged rather than failing the config, as Consul may only be unreachable for a while.
+func (p *ConsulPackages) Provision(ctx caddy.Context) error {
+	if p.Address == "" {
+		p.Address = DefaultConsulAddress
+	}
+	if p.Prefix == "" {
+		p.Prefix = DefaultKVPrefix
+	}
+	// Blocking queries are held open by Consul for up to the wait time plus some jitter
+	p.client = &http.Client{Timeout: consulWait + time.Minute}
+	p.token = caddy.NewReplacer().ReplaceAll(p.Token, "")
+	p.logger = ctx.Logger(p)
+	p.init(ctx)
+
+	index, err := p.load(0)
+	if err != nil {
+		p.logger.Warn("loading packages from consul", zap.String("address", p.Address), zap.Error(err))
+	}
+	go p.watch(index)
+
+	return nil
+}
+
+// load reads the packages from Consul and, if they changed, provisions them and replaces the served ones with them.
+// With a non-zero index, the request blocks until the keys change after the index or the wait time elapsed. It
+// returns the index of the keys read.
+func (p *ConsulPackages) load(index uint64) (uint64, error) {
+	query := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", consulWait.String())
+	}
+	u := strings.TrimSuffix(p.Address, "/") + "/v1/kv/" + strings.TrimPrefix(p.Prefix, "/") + "?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	if p.token != "" {
+		req.Header.Set("X-Consul-Token", p.token)
+	}
+
+	resp, err := p.client.Do(req.WithContext(p.ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Consul responds with 404 if no key has the prefix
+	var entries []consulEntry
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			return 0, fmt.Errorf("decoding keys: %v", err)
+		}
+	case http.StatusNotFound:
+	default:
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	newIndex, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid X-Consul-Index: %v", err)
+	}
+
+	values := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		value, err := base64.StdEncoding.DecodeString(entry.Value)
+		if err != nil {
+			return 0, fmt.Errorf("key %s: %v", entry.Key, err)
+		}
+		// Keys ending in a slash are folders without a package
+		if !strings.HasSuffix(entry.Key, "/") {
+			values[entry.Key] = string(value)
+		}
+	}
+
+	if err := p.apply(strings.TrimPrefix(p.Prefix, "/"), values); err != nil {
+		// Return the index anyway, so the watch waits for the invalid package to change
+		return newIndex, err
+	}
+	return newIndex, nil
+}
+
+// watch reloads the packages whenever they change, until the config is unloaded.
+func (p *ConsulPackages) watch(index uint64) {
+	for {
+		newIndex, err := p.load(index)
+		if p.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			p.logger.Warn("watching packages in consul, keeping the previous packages",
+				zap.String("address", p.Address),
+				zap.Error(err))
+		}
+		if newIndex == index || newIndex == 0 {
+			// Pause after a failure, or if the index did not move
+			if !sleepContext(p.ctx, kvRetryInterval) {
+				return
+			}
+		}
+		// Consul resets the index if it goes backwards, e.g. after a restore of a snapshot
+		if newIndex < index {
+			newIndex = 0
+		}
+		index = newIndex
+	}
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (p *ConsulPackages) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	return p.serve(w, r, next)
+}
+
+// Cleanup implements caddy.CleanerUpper. It deregisters the packages.
+func (p *ConsulPackages) Cleanup() error {
+	p.cleanup()
+	return nil
+}
+
+// sleepContext waits for the duration, and returns false if the context is done before.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*ConsulPackages)(nil)
+	_ caddy.CleanerUpper          = (*ConsulPackages)(nil)
+	_ caddyhttp.MiddlewareHandler = (*ConsulPackages)(nil)
+)
@@ -0,0 +1,154 @@
+package gopkg
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// fakeConsul is a Consul agent serving the recursive blocking queries of the KV API used by ConsulPackages.
+type fakeConsul struct {
+	mu     sync.Mutex
+	index  uint64
+	values map[string]string
+	token  string
+}
+
+func (f *fakeConsul) set(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.index++
+	if value == "" {
+		delete(f.values, key)
+	} else {
+		f.values[key] = value
+	}
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Consul-Token") != f.token {
+		http.Error(w, "ACL not found", http.StatusForbidden)
+		return
+	}
+	prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+	// Block until the index moves past the requested one
+	for {
+		f.mu.Lock()
+		if f.index > index {
+			break
+		}
+		f.mu.Unlock()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	defer f.mu.Unlock()
+
+	var entries []consulEntry
+	for key, value := range f.values {
+		if strings.HasPrefix(key, prefix) {
+			entries = append(entries, consulEntry{Key: key, Value: base64.StdEncoding.EncodeToString([]byte(value))})
+		}
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	if len(entries) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+func TestConsulPackages(t *testing.T) {
+	consul := &fakeConsul{index: 1, token: "secret", values: map[string]string{
+		"gopkg/foo":  `{"url": "https://github.com/example/foo"}`,
+		"gopkg/dir/": "",
+		"other/bar":  `{"url": "https://github.com/example/bar"}`,
+	}}
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	ctx, cancel := caddy.NewContext(testContext)
+	defer cancel()
+
+	p := &ConsulPackages{Address: server.URL, Token: "secret"}
+	if err := p.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Cleanup()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+	serveConsul := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		if err := p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil), next); err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		return w
+	}
+	waitConsul := func(target string, code int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for serveConsul(target).Code != code {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: expected %d", target, code)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	want := `content="example.com/foo git https://github.com/example/foo"`
+	if body := serveConsul("http://example.com/foo/pkg?go-get=1").Body.String(); !strings.Contains(body, want) {
+		t.Errorf("expected %s, got %s", want, body)
+	}
+	if w := serveConsul("http://example.com/bar?go-get=1"); w.Code != http.StatusTeapot {
+		t.Errorf("expected key of another prefix to pass to the next handler, got %d", w.Code)
+	}
+
+	// Changes are applied by the watch
+	consul.set("gopkg/baz", `{"vcs": "hg", "url": "https://hg.example.com/baz"}`)
+	waitConsul("http://example.com/baz?go-get=1", http.StatusOK)
+	consul.set("gopkg/foo", "")
+	waitConsul("http://example.com/foo?go-get=1", http.StatusTeapot)
+}
+
+func TestParseConsulPackages(t *testing.T) {
+	input := `gopkg_consul http://consul:8500 {
+		token {env.CONSUL_HTTP_TOKEN}
+		prefix go/
+	}`
+	blocks, err := caddyfile.Parse("Caddyfile", []byte(":80 {\n"+input+"\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := parseConsulPackages(httpcaddyfile.Helper{Dispenser: caddyfile.NewDispenser(blocks[0].Segments[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := new(ConsulPackages)
+	if err := json.Unmarshal(routes[0].Value.(caddyhttp.Route).HandlersRaw[0], p); err != nil {
+		t.Fatal(err)
+	}
+	want := ConsulPackages{Address: "http://consul:8500", Token: "{env.CONSUL_HTTP_TOKEN}", Prefix: "go/"}
+	if !reflect.DeepEqual(*p, want) {
+		t.Errorf("expected %+v, got %+v", want, *p)
+	}
+}
@@ -0,0 +1,58 @@
+package gopkg
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func init() {
+	httpcaddyfile.RegisterDirective("gopkg_defaults", parseDefaults)
+}
+
+// defaultsStateKey is the key of the defaults set by gopkg_defaults in the state of the Caddyfile adapter.
+const defaultsStateKey = "gopkg_defaults"
+
+// parseDefaults parses the gopkg_defaults directive in a caddyfile. Syntax:
+//
+//     gopkg_defaults [<vcs>] {
+//         <options>
+//     }
+//
+// The options are those of the gopkg directive. They are the defaults of all gopkg directives following in the
+// Caddyfile, including those of later site blocks, which can still override them. The global options block cannot
+// be extended by plugins, so this is a directive of its own, which produces no route.
+func parseDefaults(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	defaults := new(GoPackage)
+	for h.Next() {
+		args := h.RemainingArgs()
+		switch len(args) {
+		case 1:
+			defaults.Vcs = args[0]
+		case 0:
+		default:
+			return nil, h.ArgErr()
+		}
+
+		if err := defaults.unmarshalOptions(h.Dispenser); err != nil {
+			return nil, err
+		}
+	}
+
+	h.State[defaultsStateKey] = defaults
+	return nil, nil
+}
+
+// packageDefaults returns a new GoPackage with the defaults set by a preceding gopkg_defaults directive, if any.
+func packageDefaults(h httpcaddyfile.Helper) *GoPackage {
+	defaults, ok := h.State[defaultsStateKey].(*GoPackage)
+	if !ok {
+		return new(GoPackage)
+	}
+
+	// Don't let the directive append to the slices of the defaults
+	m := *defaults
+	m.Submodules = append([]Submodule(nil), m.Submodules...)
+	m.Mirrors = append([]string(nil), m.Mirrors...)
+	m.Hosts = append([]string(nil), m.Hosts...)
+	m.TrustedProxies = append([]string(nil), m.TrustedProxies...)
+	return &m
+}
@@ -0,0 +1,74 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestParseDefaults(t *testing.T) {
+	blocks, err := caddyfile.Parse("Caddyfile", []byte(`:80 {
+		gopkg /plain https://github.com/example/plain
+		gopkg_defaults hg {
+			browser_redirect https://pkg.go.dev/example.com
+			template /etc/caddy/gopkg.html
+			mirror https://mirror.example.com/shared
+		}
+		gopkg /foo https://hg.example.com/foo {
+			mirror https://mirror.example.com/foo
+		}
+		gopkg /bar git https://github.com/example/bar {
+			browser_redirect https://example.com/bar
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := make(map[string]interface{})
+	var packages []GoPackage
+	for _, segment := range blocks[0].Segments {
+		h := httpcaddyfile.Helper{Dispenser: caddyfile.NewDispenser(segment), State: state}
+		parse := parseCaddyFile
+		if segment.Directive() == "gopkg_defaults" {
+			parse = parseDefaults
+		}
+		routes, err := parse(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, route := range routes {
+			var m GoPackage
+			if err := json.Unmarshal(route.Value.(caddyhttp.Route).HandlersRaw[0], &m); err != nil {
+				t.Fatal(err)
+			}
+			packages = append(packages, m)
+		}
+	}
+	if len(packages) != 3 {
+		t.Fatalf("expected 3 packages, got %d", len(packages))
+	}
+
+	if plain := packages[0]; plain.Vcs != "" || plain.BrowserRedirect != "" || plain.TemplateFile != "" {
+		t.Errorf("expected package before the defaults to be unaffected, got %+v", plain)
+	}
+
+	foo := packages[1]
+	if foo.Vcs != "hg" || foo.BrowserRedirect != "https://pkg.go.dev/example.com" || foo.TemplateFile != "/etc/caddy/gopkg.html" {
+		t.Errorf("expected package to inherit the defaults, got %+v", foo)
+	}
+	if len(foo.Mirrors) != 2 || foo.Mirrors[0] != "https://mirror.example.com/shared" || foo.Mirrors[1] != "https://mirror.example.com/foo" {
+		t.Errorf("expected mirrors to be added to the default mirrors, got %v", foo.Mirrors)
+	}
+
+	bar := packages[2]
+	if bar.Vcs != "git" || bar.BrowserRedirect != "https://example.com/bar" || bar.TemplateFile != "/etc/caddy/gopkg.html" {
+		t.Errorf("expected package to override the defaults, got %+v", bar)
+	}
+	if len(bar.Mirrors) != 1 {
+		t.Errorf("expected mirrors of another package not to leak, got %v", bar.Mirrors)
+	}
+}
@@ -0,0 +1,120 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DiscoverSubmodules finds the modules nested in the repository of a package when the config is loaded, and adds
+// them as submodules, so the modules of a monorepo don't have to be listed by hand.
+//
+// The go.mod files of the default branch are listed using a GitHub compatible API. Each directory with a go.mod file
+// below the repository root becomes a submodule at the same subpath, e.g. `/sub` with Dir `sub` for `sub/go.mod`.
+// Directories the go tool ignores, like `testdata`, `vendor` or those starting with `.` or `_`, are skipped.
+// Configured submodules take precedence over discovered ones. If the listing fails, only the configured submodules
+// are served.
+type DiscoverSubmodules struct {
+	// API is the base URL of the GitHub compatible API used to list the files of the repository.
+	//
+	// If empty, the default is `https://api.github.com`.
+	API string `json:"api,omitempty"`
+}
+
+// discover lists the directories of the nested modules in the repository at repoURL.
+func (ds *DiscoverSubmodules) discover(repoURL string) ([]string, error) {
+	repo, err := repoName(repoURL)
+	if err != nil {
+		return nil, err
+	}
+
+	api := ds.API
+	if api == "" {
+		api = DefaultGitHubAPI
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(api, "/") + "/repos/" + repo + "/git/trees/HEAD?recursive=1")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var tree struct {
+		Tree []struct {
+			Path string `json:"path"`
+			Type string `json:"type"`
+		} `json:"tree"`
+		Truncated bool `json:"truncated"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tree); err != nil {
+		return nil, fmt.Errorf("decoding tree: %v", err)
+	}
+	if tree.Truncated {
+		return nil, fmt.Errorf("tree of %s is too large to be listed", repo)
+	}
+
+	var dirs []string
+	for _, entry := range tree.Tree {
+		if entry.Type != "blob" || path.Base(entry.Path) != "go.mod" {
+			continue
+		}
+		if dir := path.Dir(entry.Path); dir != "." && !ignoredModuleDir(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// ignoredModuleDir reports whether the go tool ignores the directory, or it is a vendored copy.
+func ignoredModuleDir(dir string) bool {
+	for _, segment := range strings.Split(dir, "/") {
+		switch {
+		case segment == "testdata", segment == "vendor":
+			return true
+		case strings.HasPrefix(segment, "."), strings.HasPrefix(segment, "_"):
+			return true
+		}
+	}
+	return false
+}
+
+// discoverSubmodules adds the discovered modules of the package's repository to its submodules. A failed listing is
+// logged rather than failing the config, as the API may only be unreachable for a while.
+func (m *GoPackage) discoverSubmodules() error {
+	if pathVarRegexp.MatchString(m.URL) || placeholderRegexp.MatchString(m.URL) {
+		return fmt.Errorf("discover_submodules requires a url without variables or placeholders")
+	}
+
+	dirs, err := m.DiscoverSubmodules.discover(m.URL)
+	if err != nil {
+		m.logger.Warn("discovering submodules",
+			zap.String("url", m.URL),
+			zap.Error(err))
+		return nil
+	}
+
+	configured := m.Submodules
+	for _, dir := range dirs {
+		exists := false
+		for _, submodule := range configured {
+			if m.samePath(submodule.Path, "/"+dir) {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			m.Submodules = append(m.Submodules, Submodule{Path: "/" + dir, Dir: dir})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package gopkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDiscoverSubmodules(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/example/foo/git/trees/HEAD" || r.FormValue("recursive") != "1" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"tree": [
+			{"path": "go.mod", "type": "blob"},
+			{"path": "client", "type": "tree"},
+			{"path": "client/go.mod", "type": "blob"},
+			{"path": "client/v2/go.mod", "type": "blob"},
+			{"path": "tools/go.mod", "type": "blob"},
+			{"path": "internal/testdata/mod/go.mod", "type": "blob"},
+			{"path": "vendor/example.com/dep/go.mod", "type": "blob"},
+			{"path": "_examples/go.mod", "type": "blob"},
+			{"path": "docs/go.mod.md", "type": "blob"}
+		], "truncated": false}`))
+	}))
+	defer srv.Close()
+
+	m := New("/foo", "", "https://github.com/example/foo").WithSubmodule("/tools", "https://github.com/example/tools")
+	m.DiscoverSubmodules = &DiscoverSubmodules{API: srv.URL}
+	provision(t, m)
+
+	var paths []string
+	for _, submodule := range m.Submodules {
+		paths = append(paths, submodule.Path)
+	}
+	if got, want := strings.Join(paths, " "), "/tools /client /client/v2"; got != want {
+		t.Fatalf("expected submodules %s, got %s", want, got)
+	}
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/foo/client/pkg?go-get=1", `content="example.com/foo/client git https://github.com/example/foo"`},
+		{"http://example.com/foo/client/v2?go-get=1", `content="example.com/foo/client/v2 git https://github.com/example/foo"`},
+		{"http://example.com/foo/tools?go-get=1", `content="example.com/foo/tools git https://github.com/example/tools"`},
+	}
+	for _, test := range tests {
+		if body := serve(t, m, http.MethodGet, test.target).Body.String(); !strings.Contains(body, test.want) {
+			t.Errorf("%s: expected %s, got %s", test.target, test.want, body)
+		}
+	}
+
+	// A failed listing leaves the configured submodules
+	m = New("/bar", "", "https://github.com/example/bar")
+	m.DiscoverSubmodules = &DiscoverSubmodules{API: srv.URL}
+	provision(t, m)
+	if len(m.Submodules) != 0 {
+		t.Errorf("expected no submodules, got %+v", m.Submodules)
+	}
+
+	m = New("/x/*", "", "https://github.com/example/{1}")
+	m.DiscoverSubmodules = &DiscoverSubmodules{API: srv.URL}
+	if err := m.Provision(testContext); err == nil {
+		t.Error("expected error for url with variables")
+	}
+}
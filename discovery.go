@@ -0,0 +1,110 @@
+package gopkg
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// DefaultDiscoveryRefresh is how often discovered repositories are listed again if no interval is configured.
+const DefaultDiscoveryRefresh = caddy.Duration(10 * time.Minute)
+
+// discoveredRepo is a repository listed by a forge API.
+type discoveredRepo struct {
+	// path is the path of the repository below the prefix, e.g. `sub/repo` for a repository in a subgroup.
+	path        string
+	url         string
+	description string
+
+	// language is the main language of the repository as detected by the forge, if it is listed.
+	language string
+}
+
+// discovery serves a package for every repository listed by a forge API, and lists them again at an interval. It is
+// shared by the handlers discovering the repositories of GitHub organizations and GitLab groups.
+type discovery struct {
+	packages *packageSet
+	prefix   string
+	source   string
+	list     func() ([]discoveredRepo, error)
+	ctx      caddy.Context
+	logger   *zap.Logger
+}
+
+// start lists the repositories and starts refreshing them at the interval. A failure to list them is logged rather
+// than returned, as the API may only be unreachable for a while.
+func (d *discovery) start(ctx caddy.Context, logger *zap.Logger, interval time.Duration) {
+	d.ctx = ctx
+	d.logger = logger
+	d.packages = new(packageSet)
+
+	if err := d.load(); err != nil {
+		d.logger.Warn("listing repositories", zap.String("source", d.source), zap.Error(err))
+	}
+	go d.refresh(interval)
+}
+
+// load lists the repositories and replaces the served packages with a package for each of them.
+func (d *discovery) load() error {
+	repos, err := d.list()
+	if err != nil {
+		return err
+	}
+
+	packages := make([]*GoPackage, 0, len(repos))
+	for _, repo := range repos {
+		m := New(d.prefix+"/"+repo.path, "git", repo.url)
+		m.Description = repo.description
+		if err := provisionPackage(d.ctx, m); err != nil {
+			for _, provisioned := range packages {
+				provisioned.Cleanup()
+			}
+			return fmt.Errorf("repository %s: %v", repo.path, err)
+		}
+		packages = append(packages, m)
+	}
+
+	for _, m := range d.packages.swap(sortMostSpecific(packages)) {
+		m.Cleanup()
+	}
+	return nil
+}
+
+// refresh reloads the repositories at the interval, until the config is unloaded.
+func (d *discovery) refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := d.load(); err != nil {
+			d.logger.Warn("refreshing repositories, keeping the previous packages",
+				zap.String("source", d.source),
+				zap.Error(err))
+		}
+	}
+}
+
+// serve serves the request with the package of the repository it is for, or passes it to the next handler.
+func (d *discovery) serve(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	return servePackages(d.packages.get(), w, r, next)
+}
+
+// cleanup deregisters the packages of the repositories.
+func (d *discovery) cleanup() {
+	if d.packages == nil {
+		return
+	}
+	for _, m := range d.packages.swap(nil) {
+		m.Cleanup()
+	}
+}
@@ -0,0 +1,115 @@
+package gopkg
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(Dynamic{})
+	httpcaddyfile.RegisterDirective("gopkg_dynamic", parseDynamic)
+}
+
+// Dynamic serves the packages added at runtime through the admin API of the gopkg app. Requests not matching any of
+// them are passed to the next handler.
+type Dynamic struct {
+	app *App
+}
+
+// CaddyModule returns the Caddy module information.
+func (Dynamic) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.gopkg_dynamic",
+		New: func() caddy.Module {
+			return new(Dynamic)
+		},
+	}
+}
+
+// parseDynamic parses the gopkg_dynamic directive in a caddyfile. Syntax:
+//
+//     gopkg_dynamic
+//
+// Unlike gopkg, the handler is not mounted at a path, as the paths of the packages are not known in advance. The same
+// goes for the other handlers serving packages found at runtime: gopkg_remote, gopkg_redis, gopkg_consul, gopkg_etcd,
+// gopkg_github, gopkg_gitlab and gopkg_gitea.
+func parseDynamic(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	d := new(Dynamic)
+	if err := d.UnmarshalCaddyfile(h.Dispenser); err != nil {
+		return nil, err
+	}
+	return h.NewRoute(nil, d), nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (d *Dynamic) UnmarshalCaddyfile(disp *caddyfile.Dispenser) error {
+	for disp.Next() {
+		if disp.NextArg() || disp.NextBlock(0) {
+			return disp.ArgErr()
+		}
+	}
+	return nil
+}
+
+// Provision implements caddy.Provisioner.
+func (d *Dynamic) Provision(ctx caddy.Context) error {
+	app, err := loadApp(ctx)
+	if err != nil {
+		return err
+	}
+	d.app = app
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (d Dynamic) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	return servePackages(d.app.packages.dynamicPackages(), w, r, next)
+}
+
+// servePackages serves the request with the first of the packages that handles its path, or passes it to the next
+// handler if none does.
+func servePackages(packages []*GoPackage, w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	for _, m := range packages {
+		if m.handles(r.URL.Path) {
+			return m.ServeHTTP(w, r, next)
+		}
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// sortMostSpecific sorts packages by descending length of their mount path, so that servePackages picks the most
+// specific package for a request. It returns the sorted slice.
+func sortMostSpecific(packages []*GoPackage) []*GoPackage {
+	sort.SliceStable(packages, func(i, j int) bool {
+		return len(packages[i].MountPrefix+packages[i].Path) > len(packages[j].MountPrefix+packages[j].Path)
+	})
+	return packages
+}
+
+// handles reports whether the request path is the path of the package or below it, like the route generated for a
+// gopkg directive matches.
+func (m GoPackage) handles(reqPath string) bool {
+	if m.MountPrefix != "" {
+		if !strings.HasPrefix(reqPath, m.MountPrefix) {
+			return false
+		}
+		reqPath = reqPath[len(m.MountPrefix):]
+	}
+	if m.pathPattern != nil {
+		return m.pathPattern.MatchString(reqPath)
+	}
+	return m.samePath(reqPath, m.Path) || len(reqPath) > len(m.Path) && m.samePath(reqPath[:len(m.Path)+1], m.Path+"/")
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Dynamic)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Dynamic)(nil)
+	_ caddyfile.Unmarshaler       = (*Dynamic)(nil)
+)
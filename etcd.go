@@ -0,0 +1,393 @@
+package gopkg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(EtcdPackages{})
+	httpcaddyfile.RegisterDirective("gopkg_etcd", parseEtcdPackages)
+}
+
+// DefaultEtcdEndpoint is the etcd endpoint packages are loaded from if none is configured.
+const DefaultEtcdEndpoint = "http://127.0.0.1:2379"
+
+// EtcdPackages serves the packages stored in etcd. Each package is stored as the JSON config of a package at a key of
+// the prefix and its path, e.g.
+//
+//     etcdctl put gopkg/foo '{"url": "https://github.com/example/foo"}'
+//
+// The keys are watched, so packages added, changed or removed in etcd are served right away without reloading the
+// config. If etcd is unreachable or a package is invalid, the previous packages keep being served. Requests not
+// matching any of the packages are passed to the next handler.
+//
+// etcd is accessed through its JSON gRPC gateway, which is served by etcd 3.4 and later.
+type EtcdPackages struct {
+	// Endpoint is the URL of the client API of an etcd member.
+	//
+	// If empty, the default is `http://127.0.0.1:2379`.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Prefix is the prefix of the keys holding the packages, which is followed by the package path.
+	//
+	// If empty, the default is `gopkg/`.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Username and Password authenticate the requests if etcd has authentication enabled. They may be placeholders
+	// like `{env.ETCD_PASSWORD}`.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	client *http.Client
+	token  string
+	logger *zap.Logger
+	kvPackages
+}
+
+// etcdHeader is the header of the responses of etcd.
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+// etcdRangeResponse is the response of etcd reading a range of keys. The keys and values are base64 encoded.
+type etcdRangeResponse struct {
+	Header etcdHeader `json:"header"`
+	KVs    []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"kvs"`
+}
+
+// etcdWatchResponse is a message of the stream of etcd watching a range of keys.
+type etcdWatchResponse struct {
+	Result *struct {
+		Header   etcdHeader        `json:"header"`
+		Events   []json.RawMessage `json:"events"`
+		Canceled bool              `json:"canceled"`
+		Reason   string            `json:"cancel_reason"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (EtcdPackages) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.gopkg_etcd",
+		New: func() caddy.Module {
+			return new(EtcdPackages)
+		},
+	}
+}
+
+// parseEtcdPackages parses the gopkg_etcd directive in a caddyfile. Syntax:
+//
+//     gopkg_etcd [<endpoint>] {
+//         prefix <prefix>
+//         username <username>
+//         password <password>
+//     }
+//
+// The username and password are only needed if authentication is enabled in etcd.
+func parseEtcdPackages(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	p := new(EtcdPackages)
+	for h.Next() {
+		if h.NextArg() {
+			p.Endpoint = h.Val()
+		}
+		if h.NextArg() {
+			return nil, h.ArgErr()
+		}
+		for h.NextBlock(0) {
+			switch h.Val() {
+			case "prefix":
+				if !h.Args(&p.Prefix) {
+					return nil, h.ArgErr()
+				}
+			case "username":
+				if !h.Args(&p.Username) {
+					return nil, h.ArgErr()
+				}
+			case "password":
+				if !h.Args(&p.Password) {
+					return nil, h.ArgErr()
+				}
+			default:
+				return nil, h.Errf("unrecognized gopkg_etcd subdirective '%s'", h.Val())
+			}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+		}
+	}
+
+	return h.NewRoute(nil, p), nil
+}
+
+// Provision implements caddy.Provisioner. It loads the packages and starts watching them. A failure to load them is
+// logged rather than failing the config, as etcd may only be unreachable for a while.
+func (p *EtcdPackages) Provision(ctx caddy.Context) error {
+	if p.Endpoint == "" {
+		p.Endpoint = DefaultEtcdEndpoint
+	}
+	if p.Prefix == "" {
+		p.Prefix = DefaultKVPrefix
+	}
+	if p.Username == "" && p.Password != "" {
+		return fmt.Errorf("password without username")
+	}
+	// The watch stream is held open, so only connecting is bounded
+	p.client = &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 10 * time.Second,
+	}}
+	p.logger = ctx.Logger(p)
+	p.init(ctx)
+
+	revision, err := p.load()
+	if err != nil {
+		p.logger.Warn("loading packages from etcd", zap.String("endpoint", p.Endpoint), zap.Error(err))
+	}
+	go p.watch(revision)
+
+	return nil
+}
+
+// load reads the packages from etcd and, if they changed, provisions them and replaces the served ones with them. It
+// returns the revision of the keys read.
+func (p *EtcdPackages) load() (int64, error) {
+	var resp etcdRangeResponse
+	err := p.call("/v3/kv/range", map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(p.Prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(etcdRangeEnd(p.Prefix)),
+	}, &resp)
+	if err != nil {
+		return 0, err
+	}
+
+	values := make(map[string]string, len(resp.KVs))
+	for _, kv := range resp.KVs {
+		key, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			return 0, fmt.Errorf("decoding key: %v", err)
+		}
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return 0, fmt.Errorf("key %s: %v", key, err)
+		}
+		values[string(key)] = string(value)
+	}
+
+	if err := p.apply(p.Prefix, values); err != nil {
+		// Return the revision anyway, so the watch waits for the invalid package to change
+		return resp.Header.Revision, err
+	}
+	return resp.Header.Revision, nil
+}
+
+// watch reloads the packages whenever they change after the revision, until the config is unloaded. If the watch
+// fails, the packages are reloaded and watched again after a pause.
+func (p *EtcdPackages) watch(revision int64) {
+	for {
+		if revision > 0 {
+			err := p.watchChanges(revision)
+			if p.ctx.Err() != nil {
+				return
+			}
+			p.logger.Warn("watching packages in etcd", zap.String("endpoint", p.Endpoint), zap.Error(err))
+		}
+		if !sleepContext(p.ctx, kvRetryInterval) {
+			return
+		}
+
+		var err error
+		revision, err = p.load()
+		if err != nil {
+			p.logger.Warn("reloading packages from etcd, keeping the previous packages",
+				zap.String("endpoint", p.Endpoint),
+				zap.Error(err))
+		}
+	}
+}
+
+// watchChanges reloads the packages whenever etcd reports a change of the keys after the revision. It returns when
+// the watch fails.
+func (p *EtcdPackages) watchChanges(revision int64) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"create_request": map[string]string{
+			"key":            base64.StdEncoding.EncodeToString([]byte(p.Prefix)),
+			"range_end":      base64.StdEncoding.EncodeToString(etcdRangeEnd(p.Prefix)),
+			"start_revision": strconv.FormatInt(revision+1, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := p.post("/v3/watch", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg etcdWatchResponse
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("etcd: %s", msg.Error.Message)
+		}
+		if msg.Result == nil {
+			continue
+		}
+		if msg.Result.Canceled {
+			return fmt.Errorf("watch canceled: %s", msg.Result.Reason)
+		}
+		if len(msg.Result.Events) == 0 {
+			continue
+		}
+
+		// Rather than applying the events, all keys are read again, which keeps the packages consistent
+		if _, err := p.load(); err != nil {
+			p.logger.Warn("reloading packages from etcd, keeping the previous packages",
+				zap.String("endpoint", p.Endpoint),
+				zap.Error(err))
+		}
+	}
+}
+
+// call posts the request in JSON to the etcd API at the path and decodes the response into v.
+func (p *EtcdPackages) call(path string, request, v interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := p.post(path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// post posts the body to the etcd API at the path, authenticating first if a username is configured. Responses other
+// than 200 OK are returned as errors.
+func (p *EtcdPackages) post(path string, body []byte) (*http.Response, error) {
+	if p.Username != "" && p.token == "" {
+		if err := p.authenticate(); err != nil {
+			return nil, fmt.Errorf("authenticating: %v", err)
+		}
+	}
+
+	resp, err := p.send(path, body, p.token)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && p.Username != "" {
+		// The token expired, so authenticate again
+		resp.Body.Close()
+		if err := p.authenticate(); err != nil {
+			return nil, fmt.Errorf("authenticating: %v", err)
+		}
+		if resp, err = p.send(path, body, p.token); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// send posts the body to the etcd API at the path with the token.
+func (p *EtcdPackages) send(path string, body []byte, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(p.Endpoint, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return p.client.Do(req.WithContext(p.ctx))
+}
+
+// authenticate requests a token for the username and password.
+func (p *EtcdPackages) authenticate() error {
+	repl := caddy.NewReplacer()
+	body, err := json.Marshal(map[string]string{
+		"name":     repl.ReplaceAll(p.Username, ""),
+		"password": repl.ReplaceAll(p.Password, ""),
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := p.send("/v3/auth/authenticate", body, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return err
+	}
+	if auth.Token == "" {
+		return fmt.Errorf("no token")
+	}
+	p.token = auth.Token
+	return nil
+}
+
+// etcdRangeEnd returns the end of the range of the keys with the prefix, which is the prefix with its last byte
+// incremented.
+func etcdRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// The prefix is all 0xff bytes, so the range extends to the end of the keys
+	return []byte{0}
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (p *EtcdPackages) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	return p.serve(w, r, next)
+}
+
+// Cleanup implements caddy.CleanerUpper. It deregisters the packages.
+func (p *EtcdPackages) Cleanup() error {
+	p.cleanup()
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*EtcdPackages)(nil)
+	_ caddy.CleanerUpper          = (*EtcdPackages)(nil)
+	_ caddyhttp.MiddlewareHandler = (*EtcdPackages)(nil)
+)
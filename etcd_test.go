@@ -0,0 +1,203 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// fakeEtcd is an etcd member serving the range, watch and authentication requests of the gateway used by
+// EtcdPackages.
+type fakeEtcd struct {
+	mu       sync.Mutex
+	revision int64
+	values   map[string]string
+	password string
+}
+
+func (f *fakeEtcd) set(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revision++
+	if value == "" {
+		delete(f.values, key)
+	} else {
+		f.values[key] = value
+	}
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Path == "/v3/auth/authenticate" {
+		var password string
+		json.Unmarshal(req["password"], &password)
+		if password != f.password {
+			http.Error(w, `{"error": "authentication failed"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"token": "token"}`)
+		return
+	}
+	if r.Header.Get("Authorization") != "token" {
+		http.Error(w, `{"error": "invalid auth token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var key, rangeEnd []byte
+		json.Unmarshal(req["key"], &key)
+		json.Unmarshal(req["range_end"], &rangeEnd)
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		type kv struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		}
+		var kvs []kv
+		for k, v := range f.values {
+			if k >= string(key) && k < string(rangeEnd) {
+				kvs = append(kvs, kv{[]byte(k), []byte(v)})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"header": map[string]string{"revision": strconv.FormatInt(f.revision, 10)},
+			"kvs":    kvs,
+		})
+	case "/v3/watch":
+		var create struct {
+			StartRevision int64 `json:"start_revision,string"`
+		}
+		json.Unmarshal(req["create_request"], &create)
+		fmt.Fprint(w, `{"result": {"header": {}, "created": true}}`+"\n")
+		w.(http.Flusher).Flush()
+
+		// Report an event for each revision from the start
+		for revision := create.StartRevision; ; {
+			f.mu.Lock()
+			current := f.revision
+			f.mu.Unlock()
+			for ; revision <= current; revision++ {
+				fmt.Fprintf(w, `{"result": {"header": {"revision": "%d"}, "events": [{}]}}`+"\n", revision)
+				w.(http.Flusher).Flush()
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestEtcdPackages(t *testing.T) {
+	etcd := &fakeEtcd{revision: 1, password: "secret", values: map[string]string{
+		"gopkg/foo": `{"url": "https://github.com/example/foo"}`,
+		"gopkh":     `{"url": "https://github.com/example/gopkh"}`,
+	}}
+	server := httptest.NewServer(etcd)
+	defer server.Close()
+
+	ctx, cancel := caddy.NewContext(testContext)
+	defer cancel()
+
+	p := &EtcdPackages{Endpoint: server.URL, Username: "root", Password: "secret"}
+	if err := p.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Cleanup()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+	serveEtcd := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		if err := p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil), next); err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		return w
+	}
+	waitEtcd := func(target string, code int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for serveEtcd(target).Code != code {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: expected %d", target, code)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	want := `content="example.com/foo git https://github.com/example/foo"`
+	if body := serveEtcd("http://example.com/foo/pkg?go-get=1").Body.String(); !strings.Contains(body, want) {
+		t.Errorf("expected %s, got %s", want, body)
+	}
+	if w := serveEtcd("http://example.com/h?go-get=1"); w.Code != http.StatusTeapot {
+		t.Errorf("expected key after the prefix to pass to the next handler, got %d", w.Code)
+	}
+
+	// Changes are applied by the watch
+	etcd.set("gopkg/bar", `{"vcs": "hg", "url": "https://hg.example.com/bar"}`)
+	waitEtcd("http://example.com/bar?go-get=1", http.StatusOK)
+	etcd.set("gopkg/foo", "")
+	waitEtcd("http://example.com/foo?go-get=1", http.StatusTeapot)
+}
+
+func TestEtcdRangeEnd(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"gopkg/":    "gopkg0",
+		"a\xff":     "b",
+		"\xff\xff":  "\x00",
+		"gopkg/a\n": "gopkg/a\v",
+	} {
+		if got := string(etcdRangeEnd(prefix)); got != want {
+			t.Errorf("%q: expected %q, got %q", prefix, want, got)
+		}
+	}
+}
+
+func TestParseEtcdPackages(t *testing.T) {
+	input := `gopkg_etcd http://etcd:2379 {
+		prefix go/
+		username gopkg
+		password {env.ETCD_PASSWORD}
+	}`
+	blocks, err := caddyfile.Parse("Caddyfile", []byte(":80 {\n"+input+"\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := parseEtcdPackages(httpcaddyfile.Helper{Dispenser: caddyfile.NewDispenser(blocks[0].Segments[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := new(EtcdPackages)
+	if err := json.Unmarshal(routes[0].Value.(caddyhttp.Route).HandlersRaw[0], p); err != nil {
+		t.Fatal(err)
+	}
+	want := EtcdPackages{Endpoint: "http://etcd:2379", Prefix: "go/", Username: "gopkg",
+		Password: "{env.ETCD_PASSWORD}"}
+	if !reflect.DeepEqual(*p, want) {
+		t.Errorf("expected %+v, got %+v", want, *p)
+	}
+}
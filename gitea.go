@@ -0,0 +1,218 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(GiteaOwner{})
+	httpcaddyfile.RegisterDirective("gopkg_gitea", parseGiteaOwner)
+}
+
+// giteaPageSize is the number of repositories requested per page, the maximum a Gitea instance allows by default.
+const giteaPageSize = 50
+
+// maxGiteaPages bounds the number of pages listed, in case the API keeps returning full pages.
+const maxGiteaPages = 200
+
+// GiteaOwner serves a package for every repository of an organization or user on a Gitea or Forgejo instance. The
+// repositories are listed using the API of the instance when the config is loaded and then again at an interval, so
+// new repositories are served without editing the config.
+//
+// If listing the repositories fails, the previous packages keep being served. Requests not matching any of the
+// packages are passed to the next handler.
+type GiteaOwner struct {
+	// Owner is the organization, or the user if User is set, whose repositories are served.
+	Owner string `json:"owner"`
+
+	// User lists the repositories of the user Owner instead of an organization.
+	User bool `json:"user,omitempty"`
+
+	// Prefix is the path the repositories are served below, e.g. `/libs`.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Token is an access token, which includes private repositories. It may be a placeholder like
+	// `{env.GITEA_TOKEN}`.
+	Token string `json:"token,omitempty"`
+
+	// URL is the base URL of the instance, e.g. `https://git.example.com`.
+	URL string `json:"url"`
+
+	// Refresh is how often the repositories are listed again.
+	//
+	// If zero, the default is 10 minutes.
+	Refresh caddy.Duration `json:"refresh,omitempty"`
+
+	client *http.Client
+	token  string
+	discovery
+}
+
+// giteaRepo is a repository as listed by the Gitea API.
+type giteaRepo struct {
+	Name        string `json:"name"`
+	HTMLURL     string `json:"html_url"`
+	Description string `json:"description"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (GiteaOwner) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.gopkg_gitea",
+		New: func() caddy.Module {
+			return new(GiteaOwner)
+		},
+	}
+}
+
+// parseGiteaOwner parses the gopkg_gitea directive in a caddyfile. Syntax:
+//
+//     gopkg_gitea <prefix> <owner> {
+//         url <base_url>
+//         user
+//         token <token>
+//         refresh <interval>
+//     }
+//
+// The url of the instance is required, as there is no default instance.
+func parseGiteaOwner(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	g := new(GiteaOwner)
+	for h.Next() {
+		if !h.Args(&g.Prefix, &g.Owner) {
+			return nil, h.ArgErr()
+		}
+		if h.NextArg() {
+			return nil, h.ArgErr()
+		}
+		for h.NextBlock(0) {
+			switch h.Val() {
+			case "url":
+				if !h.Args(&g.URL) {
+					return nil, h.ArgErr()
+				}
+			case "user":
+				g.User = true
+			case "token":
+				if !h.Args(&g.Token) {
+					return nil, h.ArgErr()
+				}
+			case "refresh":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				d, err := time.ParseDuration(h.Val())
+				if err != nil || d <= 0 {
+					return nil, h.Errf("invalid refresh interval '%s'", h.Val())
+				}
+				g.Refresh = caddy.Duration(d)
+			default:
+				return nil, h.Errf("unrecognized gopkg_gitea subdirective '%s'", h.Val())
+			}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+		}
+	}
+	if g.URL == "" {
+		return nil, h.Err("gopkg_gitea requires the url of the instance")
+	}
+	g.Prefix = strings.TrimSuffix(g.Prefix, "/")
+
+	return h.NewRoute(nil, g), nil
+}
+
+// Provision implements caddy.Provisioner. It lists the repositories and starts refreshing them. A failure to list
+// them is logged rather than failing the config, as the instance may only be unreachable for a while.
+func (g *GiteaOwner) Provision(ctx caddy.Context) error {
+	if g.Owner == "" {
+		return fmt.Errorf("missing owner")
+	}
+	if g.URL == "" {
+		return fmt.Errorf("missing url")
+	}
+	if g.Refresh == 0 {
+		g.Refresh = DefaultDiscoveryRefresh
+	}
+	g.client = &http.Client{Timeout: 10 * time.Second}
+	g.token = caddy.NewReplacer().ReplaceAll(g.Token, "")
+
+	g.prefix = g.Prefix
+	g.source = g.URL + "/" + g.Owner
+	g.list = g.fetch
+	g.start(ctx, ctx.Logger(g), time.Duration(g.Refresh))
+
+	return nil
+}
+
+// fetch lists all repositories of the owner.
+func (g *GiteaOwner) fetch() ([]discoveredRepo, error) {
+	scope := "orgs"
+	if g.User {
+		scope = "users"
+	}
+
+	var repos []discoveredRepo
+	for page := 1; page <= maxGiteaPages; page++ {
+		u := fmt.Sprintf("%s/api/v1/%s/%s/repos?limit=%d&page=%d",
+			strings.TrimSuffix(g.URL, "/"), scope, url.PathEscape(g.Owner), giteaPageSize, page)
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if g.token != "" {
+			req.Header.Set("Authorization", "token "+g.token)
+		}
+
+		resp, err := g.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var pageRepos []giteaRepo
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		} else if err = json.NewDecoder(resp.Body).Decode(&pageRepos); err != nil {
+			err = fmt.Errorf("decoding repositories: %v", err)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, repo := range pageRepos {
+			if repo.Name != "" && repo.HTMLURL != "" {
+				repos = append(repos, discoveredRepo{path: repo.Name, url: repo.HTMLURL, description: repo.Description})
+			}
+		}
+		if len(pageRepos) < giteaPageSize {
+			break
+		}
+	}
+	return repos, nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (g GiteaOwner) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	return g.serve(w, r, next)
+}
+
+// Cleanup implements caddy.CleanerUpper. It deregisters the packages of the owner.
+func (g *GiteaOwner) Cleanup() error {
+	g.cleanup()
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*GiteaOwner)(nil)
+	_ caddy.CleanerUpper          = (*GiteaOwner)(nil)
+	_ caddyhttp.MiddlewareHandler = (*GiteaOwner)(nil)
+)
@@ -0,0 +1,66 @@
+package gopkg
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func TestGiteaOwner(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/users/alice/repos" || r.Header.Get("Authorization") != "token secret" {
+			http.NotFound(w, r)
+			return
+		}
+
+		// A full first page and one more repository on the second
+		page, _ := strconv.Atoi(r.FormValue("page"))
+		n := map[int]int{1: giteaPageSize, 2: 1}[page]
+		var repos []string
+		for i := 0; i < n; i++ {
+			name := fmt.Sprintf("repo%d", (page-1)*giteaPageSize+i)
+			repos = append(repos, fmt.Sprintf(`{"name": %q, "html_url": "https://git.example.com/alice/%s"}`, name, name))
+		}
+		w.Write([]byte("[" + strings.Join(repos, ",") + "]"))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := caddy.NewContext(testContext)
+	defer cancel()
+
+	g := &GiteaOwner{Owner: "alice", User: true, Prefix: "/go", Token: "secret", URL: srv.URL}
+	if err := g.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Cleanup()
+
+	if n := len(g.packages.get()); n != giteaPageSize+1 {
+		t.Fatalf("expected %d packages, got %d", giteaPageSize+1, n)
+	}
+
+	w := httptest.NewRecorder()
+	if err := g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/go/repo50/pkg?go-get=1", nil), nil); err != nil {
+		t.Fatal(err)
+	}
+	want := `content="example.com/go/repo50 git https://git.example.com/alice/repo50"`
+	if body := w.Body.String(); !strings.Contains(body, want) {
+		t.Errorf("expected %s, got %s", want, body)
+	}
+}
+
+func TestParseGiteaOwnerRequiresURL(t *testing.T) {
+	blocks, err := caddyfile.Parse("Caddyfile", []byte(":80 {\ngopkg_gitea /go myorg\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseGiteaOwner(httpcaddyfile.Helper{Dispenser: caddyfile.NewDispenser(blocks[0].Segments[0])}); err == nil {
+		t.Error("expected error without url")
+	}
+}
@@ -0,0 +1,216 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(GitHubOrg{})
+	httpcaddyfile.RegisterDirective("gopkg_github", parseGitHubOrg)
+}
+
+// DefaultGitHubAPI is the GitHub API used to list repositories and look up their contents if none is configured.
+const DefaultGitHubAPI = "https://api.github.com"
+
+// githubPageSize is the number of repositories requested per page, the maximum the API allows.
+const githubPageSize = 100
+
+// maxGitHubPages bounds the number of pages listed, in case the API keeps returning full pages.
+const maxGitHubPages = 100
+
+// GitHubOrg serves a package for every repository of a GitHub organization, e.g. `/libs/<repo>` for each repo of
+// `myorg`. The repositories are listed using the GitHub API when the config is loaded and then again at an interval,
+// so new repositories are served without editing the config.
+//
+// If listing the repositories fails, the previous packages keep being served. Requests not matching any of the
+// packages are passed to the next handler.
+type GitHubOrg struct {
+	// Org is the GitHub organization whose repositories are served.
+	Org string `json:"org"`
+
+	// Prefix is the path the repositories are served below, e.g. `/libs`.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Token authenticates the API requests, which raises the rate limit and includes private repositories. It may be
+	// a placeholder like `{env.GITHUB_TOKEN}`.
+	Token string `json:"token,omitempty"`
+
+	// API is the base URL of the GitHub compatible API.
+	//
+	// If empty, the default is `https://api.github.com`.
+	API string `json:"api,omitempty"`
+
+	// Refresh is how often the repositories are listed again.
+	//
+	// If zero, the default is 10 minutes.
+	Refresh caddy.Duration `json:"refresh,omitempty"`
+
+	client *http.Client
+	token  string
+	discovery
+}
+
+// githubRepo is a repository as listed by the GitHub API.
+type githubRepo struct {
+	Name        string `json:"name"`
+	HTMLURL     string `json:"html_url"`
+	Description string `json:"description"`
+	Language    string `json:"language"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (GitHubOrg) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.gopkg_github",
+		New: func() caddy.Module {
+			return new(GitHubOrg)
+		},
+	}
+}
+
+// parseGitHubOrg parses the gopkg_github directive in a caddyfile. Syntax:
+//
+//     gopkg_github <prefix> <org> {
+//         token <token>
+//         api <url>
+//         refresh <interval>
+//     }
+//
+// The token is optional for public repositories, but raises the rate limit of the API.
+func parseGitHubOrg(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	g := new(GitHubOrg)
+	for h.Next() {
+		if !h.Args(&g.Prefix, &g.Org) {
+			return nil, h.ArgErr()
+		}
+		if h.NextArg() {
+			return nil, h.ArgErr()
+		}
+		for h.NextBlock(0) {
+			switch h.Val() {
+			case "token":
+				if !h.Args(&g.Token) {
+					return nil, h.ArgErr()
+				}
+			case "api":
+				if !h.Args(&g.API) {
+					return nil, h.ArgErr()
+				}
+			case "refresh":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				d, err := time.ParseDuration(h.Val())
+				if err != nil || d <= 0 {
+					return nil, h.Errf("invalid refresh interval '%s'", h.Val())
+				}
+				g.Refresh = caddy.Duration(d)
+			default:
+				return nil, h.Errf("unrecognized gopkg_github subdirective '%s'", h.Val())
+			}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+		}
+	}
+	g.Prefix = strings.TrimSuffix(g.Prefix, "/")
+
+	return h.NewRoute(nil, g), nil
+}
+
+// Provision implements caddy.Provisioner. It lists the repositories and starts refreshing them. A failure to list
+// them is logged rather than failing the config, as the API may only be unreachable for a while.
+func (g *GitHubOrg) Provision(ctx caddy.Context) error {
+	if g.Org == "" {
+		return fmt.Errorf("missing org")
+	}
+	if g.API == "" {
+		g.API = DefaultGitHubAPI
+	}
+	if g.Refresh == 0 {
+		g.Refresh = DefaultDiscoveryRefresh
+	}
+	g.client = &http.Client{Timeout: 10 * time.Second}
+	g.token = caddy.NewReplacer().ReplaceAll(g.Token, "")
+
+	g.prefix = g.Prefix
+	g.source = g.Org
+	g.list = g.fetch
+	g.start(ctx, ctx.Logger(g), time.Duration(g.Refresh))
+
+	return nil
+}
+
+// fetch lists all repositories of the organization.
+func (g *GitHubOrg) fetch() ([]discoveredRepo, error) {
+	var repos []discoveredRepo
+	for page := 1; page <= maxGitHubPages; page++ {
+		u := fmt.Sprintf("%s/orgs/%s/repos?per_page=%d&page=%d",
+			strings.TrimSuffix(g.API, "/"), url.PathEscape(g.Org), githubPageSize, page)
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/vnd.github.v3+json")
+		if g.token != "" {
+			req.Header.Set("Authorization", "token "+g.token)
+		}
+
+		resp, err := g.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var pageRepos []githubRepo
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		} else if err = json.NewDecoder(resp.Body).Decode(&pageRepos); err != nil {
+			err = fmt.Errorf("decoding repositories: %v", err)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, repo := range pageRepos {
+			if repo.Name != "" && repo.HTMLURL != "" {
+				repos = append(repos, discoveredRepo{
+					path:        repo.Name,
+					url:         repo.HTMLURL,
+					description: repo.Description,
+					language:    repo.Language,
+				})
+			}
+		}
+		if len(pageRepos) < githubPageSize {
+			break
+		}
+	}
+	return repos, nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (g GitHubOrg) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	return g.serve(w, r, next)
+}
+
+// Cleanup implements caddy.CleanerUpper. It deregisters the packages of the organization.
+func (g *GitHubOrg) Cleanup() error {
+	g.cleanup()
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*GitHubOrg)(nil)
+	_ caddy.CleanerUpper          = (*GitHubOrg)(nil)
+	_ caddyhttp.MiddlewareHandler = (*GitHubOrg)(nil)
+)
@@ -0,0 +1,69 @@
+package gopkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestGitHubOrg(t *testing.T) {
+	status := int32(http.StatusOK)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/orgs/myorg/repos" || r.Header.Get("Authorization") != "token secret" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		w.Write([]byte(`[
+			{"name": "foo", "html_url": "https://github.com/myorg/foo", "description": "Foo does things"},
+			{"name": "bar", "html_url": "https://github.com/myorg/bar"}
+		]`))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := caddy.NewContext(testContext)
+	defer cancel()
+
+	g := &GitHubOrg{Org: "myorg", Prefix: "/libs", Token: "secret", API: srv.URL}
+	if err := g.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Cleanup()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+	serveOrg := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		if err := g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil), next); err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		return w
+	}
+
+	want := `content="example.com/libs/foo git https://github.com/myorg/foo"`
+	if body := serveOrg("http://example.com/libs/foo/pkg?go-get=1").Body.String(); !strings.Contains(body, want) {
+		t.Errorf("expected %s, got %s", want, body)
+	}
+	if w := serveOrg("http://example.com/libs/baz?go-get=1"); w.Code != http.StatusTeapot {
+		t.Errorf("expected unknown repository to pass to the next handler, got %d", w.Code)
+	}
+	if packages := g.packages.get(); len(packages) != 2 || packages[0].Description != "Foo does things" {
+		t.Errorf("expected the repositories with their descriptions, got %d packages", len(packages))
+	}
+
+	// The previous packages are kept if listing the repositories fails
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	if err := g.load(); err == nil {
+		t.Error("expected error listing repositories")
+	}
+	if w := serveOrg("http://example.com/libs/bar?go-get=1"); w.Code != http.StatusOK {
+		t.Errorf("expected previous packages to be served, got %d", w.Code)
+	}
+}
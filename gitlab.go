@@ -0,0 +1,254 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(GitLabGroup{})
+	httpcaddyfile.RegisterDirective("gopkg_gitlab", parseGitLabGroup)
+}
+
+// DefaultGitLabURL is the GitLab instance whose groups are discovered if none is configured.
+const DefaultGitLabURL = "https://gitlab.com"
+
+// gitlabPageSize is the number of projects requested per page, the maximum the API allows.
+const gitlabPageSize = 100
+
+// maxGitLabPages bounds the number of pages listed, in case the API keeps returning full pages.
+const maxGitLabPages = 100
+
+// GitLabGroup serves a package for every project of a GitLab group and its subgroups. Projects in subgroups are
+// served at nested paths, e.g. `/libs/sub/<project>` for a project in `mygroup/sub`. The projects are listed using
+// the GitLab API when the config is loaded and then again at an interval, so new projects are served without editing
+// the config.
+//
+// If listing the projects fails, the previous packages keep being served. Requests not matching any of the packages
+// are passed to the next handler.
+type GitLabGroup struct {
+	// Group is the full path of the GitLab group whose projects are served, e.g. `mygroup` or `mygroup/sub`.
+	Group string `json:"group"`
+
+	// Prefix is the path the projects are served below, e.g. `/libs`.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Token is a personal or group access token, which includes private projects. It may be a placeholder like
+	// `{env.GITLAB_TOKEN}`.
+	Token string `json:"token,omitempty"`
+
+	// URL is the base URL of the GitLab instance, e.g. `https://gitlab.example.com` for a self-hosted one.
+	//
+	// If empty, the default is `https://gitlab.com`.
+	URL string `json:"url,omitempty"`
+
+	// Refresh is how often the projects are listed again.
+	//
+	// If zero, the default is 10 minutes.
+	Refresh caddy.Duration `json:"refresh,omitempty"`
+
+	client *http.Client
+	token  string
+	discovery
+}
+
+// gitlabProject is a project as listed by the GitLab API.
+type gitlabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	WebURL            string `json:"web_url"`
+	Description       string `json:"description"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (GitLabGroup) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.gopkg_gitlab",
+		New: func() caddy.Module {
+			return new(GitLabGroup)
+		},
+	}
+}
+
+// parseGitLabGroup parses the gopkg_gitlab directive in a caddyfile. Syntax:
+//
+//     gopkg_gitlab <prefix> <group> {
+//         token <token>
+//         url <base_url>
+//         refresh <interval>
+//     }
+//
+// The group may be a subgroup like `group/subgroup`. Without a url, `https://gitlab.com` is used.
+func parseGitLabGroup(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	g := new(GitLabGroup)
+	for h.Next() {
+		if !h.Args(&g.Prefix, &g.Group) {
+			return nil, h.ArgErr()
+		}
+		if h.NextArg() {
+			return nil, h.ArgErr()
+		}
+		for h.NextBlock(0) {
+			switch h.Val() {
+			case "token":
+				if !h.Args(&g.Token) {
+					return nil, h.ArgErr()
+				}
+			case "url":
+				if !h.Args(&g.URL) {
+					return nil, h.ArgErr()
+				}
+			case "refresh":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				d, err := time.ParseDuration(h.Val())
+				if err != nil || d <= 0 {
+					return nil, h.Errf("invalid refresh interval '%s'", h.Val())
+				}
+				g.Refresh = caddy.Duration(d)
+			default:
+				return nil, h.Errf("unrecognized gopkg_gitlab subdirective '%s'", h.Val())
+			}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+		}
+	}
+	g.Prefix = strings.TrimSuffix(g.Prefix, "/")
+
+	return h.NewRoute(nil, g), nil
+}
+
+// Provision implements caddy.Provisioner. It lists the projects and starts refreshing them. A failure to list them
+// is logged rather than failing the config, as the API may only be unreachable for a while.
+func (g *GitLabGroup) Provision(ctx caddy.Context) error {
+	g.Group = strings.Trim(g.Group, "/")
+	if g.Group == "" {
+		return fmt.Errorf("missing group")
+	}
+	if g.URL == "" {
+		g.URL = DefaultGitLabURL
+	}
+	if g.Refresh == 0 {
+		g.Refresh = DefaultDiscoveryRefresh
+	}
+	g.client = &http.Client{Timeout: 10 * time.Second}
+	g.token = caddy.NewReplacer().ReplaceAll(g.Token, "")
+
+	g.prefix = g.Prefix
+	g.source = g.Group
+	g.list = g.fetch
+	g.start(ctx, ctx.Logger(g), time.Duration(g.Refresh))
+
+	return nil
+}
+
+// fetch lists all projects of the group and its subgroups, with their paths relative to the group.
+func (g *GitLabGroup) fetch() ([]discoveredRepo, error) {
+	var repos []discoveredRepo
+	for page := 1; page <= maxGitLabPages; page++ {
+		u := fmt.Sprintf("%s/api/v4/groups/%s/projects?include_subgroups=true&per_page=%d&page=%d",
+			strings.TrimSuffix(g.URL, "/"), url.PathEscape(g.Group), gitlabPageSize, page)
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if g.token != "" {
+			req.Header.Set("PRIVATE-TOKEN", g.token)
+		}
+
+		resp, err := g.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var projects []gitlabProject
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		} else if err = json.NewDecoder(resp.Body).Decode(&projects); err != nil {
+			err = fmt.Errorf("decoding projects: %v", err)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, project := range projects {
+			// Group paths are case-insensitive, so the configured group may differ in case
+			p := project.PathWithNamespace
+			if project.WebURL == "" || len(p) <= len(g.Group)+1 || !strings.EqualFold(p[:len(g.Group)+1], g.Group+"/") {
+				continue
+			}
+			repos = append(repos, discoveredRepo{
+				path:        p[len(g.Group)+1:],
+				url:         project.WebURL,
+				description: project.Description,
+			})
+		}
+		if len(projects) < gitlabPageSize {
+			break
+		}
+	}
+	return repos, nil
+}
+
+// language returns the main language of a project listed by fetch. The languages are not part of the project list,
+// so they are requested per project.
+func (g *GitLabGroup) language(repo discoveredRepo) (string, error) {
+	u := fmt.Sprintf("%s/api/v4/projects/%s/languages", strings.TrimSuffix(g.URL, "/"),
+		url.PathEscape(g.Group+"/"+repo.path))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	if g.token != "" {
+		req.Header.Set("PRIVATE-TOKEN", g.token)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	// The languages are given as percentages of the code
+	var languages map[string]float64
+	if err := json.NewDecoder(resp.Body).Decode(&languages); err != nil {
+		return "", fmt.Errorf("decoding languages: %v", err)
+	}
+	var main string
+	for language, share := range languages {
+		if main == "" || share > languages[main] || share == languages[main] && language < main {
+			main = language
+		}
+	}
+	return main, nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (g GitLabGroup) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	return g.serve(w, r, next)
+}
+
+// Cleanup implements caddy.CleanerUpper. It deregisters the packages of the group.
+func (g *GitLabGroup) Cleanup() error {
+	g.cleanup()
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*GitLabGroup)(nil)
+	_ caddy.CleanerUpper          = (*GitLabGroup)(nil)
+	_ caddyhttp.MiddlewareHandler = (*GitLabGroup)(nil)
+)
@@ -0,0 +1,67 @@
+package gopkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestGitLabGroup(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/api/v4/groups/mygroup%2Fgo/projects" || r.FormValue("include_subgroups") != "true" ||
+			r.Header.Get("PRIVATE-TOKEN") != "secret" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[
+			{"path_with_namespace": "mygroup/go/foo", "web_url": "https://gitlab.example.com/mygroup/go/foo"},
+			{"path_with_namespace": "mygroup/go/sub", "web_url": "https://gitlab.example.com/mygroup/go/sub"},
+			{"path_with_namespace": "mygroup/go/sub/bar", "web_url": "https://gitlab.example.com/mygroup/go/sub/bar"},
+			{"path_with_namespace": "other/baz", "web_url": "https://gitlab.example.com/other/baz"}
+		]`))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := caddy.NewContext(testContext)
+	defer cancel()
+
+	g := &GitLabGroup{Group: "mygroup/go", Prefix: "/libs", Token: "secret", URL: srv.URL}
+	if err := g.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Cleanup()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/libs/foo?go-get=1", "example.com/libs/foo git https://gitlab.example.com/mygroup/go/foo"},
+		{"http://example.com/libs/sub/pkg?go-get=1", "example.com/libs/sub git https://gitlab.example.com/mygroup/go/sub"},
+		{"http://example.com/libs/sub/bar/pkg?go-get=1", "example.com/libs/sub/bar git https://gitlab.example.com/mygroup/go/sub/bar"},
+		{"http://example.com/libs/baz?go-get=1", ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		if err := g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.target, nil), next); err != nil {
+			t.Fatalf("%s: %v", test.target, err)
+		}
+		if test.want == "" {
+			if w.Code != http.StatusTeapot {
+				t.Errorf("%s: expected request to pass to the next handler, got %d", test.target, w.Code)
+			}
+			continue
+		}
+		if body := w.Body.String(); !strings.Contains(body, `content="`+test.want+`"`) {
+			t.Errorf("%s: expected go-import %q, got %s", test.target, test.want, body)
+		}
+	}
+}
@@ -2,4 +2,8 @@ module github.com/mschneider82/gopkg
 
 go 1.14
 
-require github.com/caddyserver/caddy/v2 v2.0.0
+require (
+	github.com/caddyserver/caddy/v2 v2.0.0
+	github.com/russross/blackfriday v1.5.2
+	go.uber.org/zap v1.14.1
+)
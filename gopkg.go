@@ -13,35 +13,103 @@
 // the path would be "/caddy/gopkg".
 // The <vcs> argument is optional, and defaults to "git". If it is specified, it is used to indicate which version
 // control system is being used to manage the source.
-// The <uri> argument corresponds to the URL/URL of the source code repository. Any format supported by the given VCS
-// and the "go get" tool is can be used, as gopkg does not attempt to validate it.
+// The <uri> argument corresponds to the URL of the source code repository. It is completed with a scheme if it has
+// none, and must then include a host. When the config is loaded, gopkg rejects an unsupported VCS and a uri whose
+// scheme the go tool cannot fetch with the VCS, e.g. an "hg" package with a "git://" uri. Whether the repository
+// exists is only checked if the validate_url or verify_repo option is set.
 package gopkg
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
 	"html/template"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // DefaultTemplate is the default HTML template used as a response.
 const DefaultTemplate = `<html>
 <head>
 <meta name="go-import" content="{{.Host}}{{.Path}} {{.Vcs}} {{.URL}}">
+{{if .NoIndex}}<meta name="robots" content="noindex">
+{{end}}{{with .Source}}<meta name="go-source" content="{{$.Host}}{{$.Path}} {{.Home}} {{.Dir}} {{.File}}">
+{{end}}</head>
+<body>
+{{if .Insecure}}GOINSECURE={{.Host}}{{.Path}} {{end}}go get {{.Host}}{{.Path}}{{.GetSuffix}}
+{{if .Mirrors}}<p>Mirrors:{{range .Mirrors}} <a href="{{.}}">{{.}}</a>{{end}}</p>
+{{end}}</body>
+</html>
+`
+
+// DefaultGroupTemplate is the default HTML template used as a response in group mode. It contains one go-import tag
+// per import.
+const DefaultGroupTemplate = `<html>
+<head>
+{{range .Imports}}<meta name="go-import" content="{{$.Host}}{{.Path}} {{.Vcs}} {{.URL}}">
+{{end}}{{if .NoIndex}}<meta name="robots" content="noindex">
+{{end}}{{with .Source}}<meta name="go-source" content="{{$.Host}}{{$.Path}} {{.Home}} {{.Dir}} {{.File}}">
+{{end}}</head>
+<body>
+{{if .Insecure}}GOINSECURE={{.Host}}{{.Path}} {{end}}go get {{.Host}}{{.Path}}{{.GetSuffix}}
+{{if .Mirrors}}<p>Mirrors:{{range .Mirrors}} <a href="{{.}}">{{.}}</a>{{end}}</p>
+{{end}}</body>
+</html>
+`
+
+// DefaultLandingTemplate is the HTML template of the landing page rendered for browsers in landing mode. It shows the
+// commands to fetch the package and links to its documentation and source.
+const DefaultLandingTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="go-import" content="{{.Host}}{{.Path}} {{.Vcs}} {{.URL}}">
+{{if .NoIndex}}<meta name="robots" content="noindex">
+{{end}}{{with .Source}}<meta name="go-source" content="{{$.Host}}{{$.Path}} {{.Home}} {{.Dir}} {{.File}}">
+{{end}}<title>{{.Host}}{{.Path}}</title>
 </head>
 <body>
-go get {{.Host}}{{.Path}}
-</body>
+<h1>{{.Host}}{{.Path}}</h1>
+{{with .Description}}<p>{{.}}</p>
+{{end}}{{with .LatestVersion}}<p>Latest version: {{.}}</p>
+{{end}}<pre>{{if .Insecure}}GOINSECURE={{.Host}}{{.Path}} {{end}}go get {{.Host}}{{.Path}}{{.GetSuffix}}
+{{if .Insecure}}GOINSECURE={{.Host}}{{.Path}} {{end}}go install {{.Host}}{{.Path}}{{or .GetSuffix "@latest"}}</pre>
+<ul>
+<li><a href="https://pkg.go.dev/{{.Host}}{{.Path}}">Documentation</a></li>
+<li><a href="{{.URL}}">Source</a></li>
+{{range .Mirrors}}<li><a href="{{.}}">Mirror</a></li>
+{{end}}</ul>
+{{with .Readme}}<article>
+{{.}}</article>
+{{end}}</body>
 </html>
 `
 
+// The default templates are parsed once and shared by all packages without their own template, which is safe as
+// templates are read-only once parsed.
+var (
+	defaultTemplate      = template.Must(template.New("Package").Parse(DefaultTemplate))
+	defaultGroupTemplate = template.Must(template.New("Package").Parse(DefaultGroupTemplate))
+	landingTemplate      = template.Must(template.New("Landing").Parse(DefaultLandingTemplate))
+)
+
 func init() {
 	caddy.RegisterModule(GoPackage{})
 	httpcaddyfile.RegisterDirective("gopkg", parseCaddyFile)
+	httpcaddyfile.RegisterDirective("gopkg_file", parsePackageFile)
 }
 
 // GoPackage implements vanity go package import paths.
@@ -50,40 +118,461 @@ func init() {
 // the import path. It also gives flexibility to developers by allowing them to change a project's source code hosting
 // platform without requiring the project to be renamed. Finally, it allows projects hosted on various platforms to be
 // grouped under a common import path.
+//
+// After Provision, ServeHTTP only reads the configuration, so a GoPackage can serve concurrent requests. State shared
+// between requests, like the commit time cache of LastModified, is guarded by its own lock.
 type GoPackage struct {
 	// Path is the HTTP path component of the vanity import path.
 	//
 	// Given a vanity import path of `web.site/package/name`, the path would be `/package/name`.
+	//
+	// The path may contain variables like `{user}` in `/~{user}/lib`, which match a single path segment. Their
+	// values are substituted into the same variables in URL and the submodule URLs. A wildcard segment `*` is a
+	// positional variable, numbered from `{1}` in the order of the wildcards, like in `/x/*` with URL
+	// `https://github.com/myorg/{1}`. Caddy placeholders not depending on a request, like `{env.PREFIX}`, are
+	// replaced when the config is loaded.
 	Path string `json:"path"`
 
 	// Vcs is the version control system used by the package.
 	//
 	// If empty, the default is `git`.
-	// Valid values include `git`, `hg`, `svn`, `bzr`, `cvs`. Basically, any version control system that go knows how to address.
+	// Valid values are `git`, `hg`, `svn`, `bzr`, `fossil` and `mod`, the version control systems go knows how to
+	// address. It may also be a Caddy placeholder, which is resolved per request.
 	Vcs string `json:"vcs,omitempty"`
 
 	// URL is the URL of the package's source.
 	//
-	// This is where the go tool will go to download the source code.
+	// This is where the go tool will go to download the source code. A URL without a scheme, like
+	// `github.com/example/repo`, is completed with `https://`, or `http://` if Insecure is set.
+	//
+	// Caddy placeholders like `{http.vars.gopkg_url}`, `{http.request.host.labels.1}` or `{env.GIT_HOST}` are
+	// resolved per request, so the URL can be looked up by a preceding handler or differ between environments.
+	// Environment variables like `{$GITLAB_BASE}` are replaced when the config is loaded, in the Mirrors and the
+	// submodule URLs too, and fail it if they are not set.
 	URL string `json:"url"`
 
+	// Mirrors are alternative URLs of the package's source, in order of preference. The go-import tag always
+	// advertises URL, since go only accepts one; the mirrors are listed on the page for humans.
+	Mirrors []string `json:"mirrors,omitempty"`
+
 	// Submodules contains optional submodule configurations for packages with multiple modules.
 	//
 	// Each submodule entry maps a subpath to its specific source URL. If URL is empty,
 	// it defaults to the parent package URL.
 	Submodules []Submodule `json:"submodules,omitempty"`
 
-	// Template is the template used when returning a response (instead of redirecting).
+	// MountPrefix is a path prefix under which the handler is mounted by the surrounding route.
+	//
+	// If the request path starts with it, it is stripped before matching the package and submodules, and prepended
+	// again to the path advertised in the go-import tag.
+	MountPrefix string `json:"mount_prefix,omitempty"`
+
+	// DiscoverSubmodules adds the modules nested in the source repository as submodules when the config is loaded.
+	DiscoverSubmodules *DiscoverSubmodules `json:"discover_submodules,omitempty"`
+
+	// LastModified enables a Last-Modified header on go-import responses based on the latest commit in the source
+	// repository.
+	LastModified *LastModified `json:"last_modified,omitempty"`
+
+	// TemplateFile is the path of an HTML template file used as Template, e.g. to add branding or links to the
+	// documentation. It receives TemplateData and is parsed when the config is loaded. It is ignored if Template is
+	// set.
+	TemplateFile string `json:"template_file,omitempty"`
+
+	// ErrorTemplate is the path of an HTML template file rendered with status 500 if rendering Template fails.
+	//
+	// The template receives the same data as Template plus the rendering error. If empty, the error is passed on to
+	// Caddy's error handling.
+	ErrorTemplate string `json:"error_template,omitempty"`
+
+	// LenientTemplates makes provisioning fall back to the default behavior with a logged warning if a template file
+	// fails to parse, instead of failing. This keeps one broken template from preventing the server from starting.
+	LenientTemplates bool `json:"lenient_templates,omitempty"`
+
+	// Compress enables gzip compression of go-import responses for clients that accept it.
+	Compress bool `json:"compress,omitempty"`
+
+	// CORSOrigin enables CORS for browser-based tooling by sending it as Access-Control-Allow-Origin and answering
+	// preflight requests. If empty, CORS is disabled.
+	CORSOrigin string `json:"cors_origin,omitempty"`
+
+	// Fallthrough passes browser requests for subpaths that match no submodule on to the next handler instead of
+	// redirecting them, so that a website can be served under the same prefix as the package. Requests with methods
+	// other than GET and HEAD are passed on too, instead of being rejected with 405.
+	Fallthrough bool `json:"fallthrough,omitempty"`
+
+	// Passthrough passes browser requests for subpaths that match no submodule, like `/mypkg/docs/logo.png`, on to
+	// the next handler like Fallthrough, so a file server can serve assets under the same prefix. Unlike Fallthrough
+	// it leaves the handling of other methods and hosts as is.
+	Passthrough bool `json:"passthrough,omitempty"`
+
+	// Host pins the host advertised in the go-import tag, instead of taking it from the request.
+	Host string `json:"host,omitempty"`
+
+	// Hosts are the hostnames the package is served for. Requests for any other host are rejected with 421
+	// Misdirected Request, redirected if RedirectHosts is set, or passed on to the next handler if Fallthrough is
+	// set, so the go-import tag never advertises an arbitrary host.
+	//
+	// If empty, all hosts are served.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// RedirectHosts permanently redirects requests for hosts other than Hosts to the same path on the first of Hosts,
+	// the canonical host, instead of rejecting them. Requires Hosts.
+	RedirectHosts bool `json:"redirect_hosts,omitempty"`
+
+	// TrustedProxies are the IP addresses or CIDR ranges of reverse proxies whose X-Forwarded-Host header is used as
+	// the advertised host, and whose X-Forwarded-Proto header is used as the scheme of redirects to other hosts and
+	// of sitemaps. The headers are ignored for requests from any other address.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// BrowserRedirect is where browsers are redirected to, e.g. the documentation of the package. Submodules can
+	// override it with their BrowserURL.
+	//
+	// Besides a URL, it can be BrowserRedirectRepo for the source URL, or BrowserRedirectPkgsite for the
+	// documentation of the resolved package on pkg.go.dev. Caddy placeholders like `{http.request.host}` in the
+	// redirect URLs are replaced at request time.
+	//
+	// If empty, browsers are redirected to the source URL.
+	BrowserRedirect string `json:"browser_redirect,omitempty"`
+
+	// DisableRedirect renders the go-import page for browser requests too, instead of redirecting them to the source.
+	// This is useful if the source is not reachable from the public internet.
+	DisableRedirect bool `json:"disable_redirect,omitempty"`
+
+	// Landing renders a landing page for browser requests instead of redirecting them, with the commands to fetch
+	// the package, its Description and links to its documentation and source. See DefaultLandingTemplate.
+	Landing bool `json:"landing,omitempty"`
+
+	// Description is a short description of the package shown on the landing page.
+	Description string `json:"description,omitempty"`
+
+	// Readme shows the README of the source repository on the landing page.
+	Readme *Readme `json:"readme,omitempty"`
+
+	// Canonicalize permanently redirects browser requests for the package or a submodule to the configured path, if
+	// the requested path differs from it only in case or by a trailing slash. Requests of the go tool are exempt.
+	Canonicalize bool `json:"canonicalize,omitempty"`
+
+	// Group advertises the package and all of its submodules in the response for the package path, with one
+	// go-import tag each. This pre-seeds the module cache with related modules.
+	//
+	// If Template is not set, DefaultGroupTemplate is used.
+	Group bool `json:"group,omitempty"`
+
+	// Insecure marks the source as only reachable via plain HTTP. URLs without a scheme are completed with `http://`
+	// and the response mentions the GOINSECURE setting go needs to fetch the package.
+	Insecure bool `json:"insecure,omitempty"`
+
+	// CaseInsensitive makes request paths match the package and submodule paths regardless of case. The go-import
+	// tag still advertises the paths as configured.
+	CaseInsensitive bool `json:"case_insensitive,omitempty"`
+
+	// ValidateURL checks at provision time that the source URLs are reachable.
+	ValidateURL *ValidateURL `json:"validate_url,omitempty"`
+
+	// GetSuffix is appended to the go get command shown in the body of the default templates, e.g. `@latest` or a
+	// version. It is never part of the go-import tag.
+	GetSuffix string `json:"get_suffix,omitempty"`
+
+	// ImportPath is advertised as the path of the package in the go-import tag instead of the matched path, e.g. if
+	// a rewrite maps an internal route to the package. It is joined with the host, so it must be an absolute path
+	// like `/foo`. Submodules below the package keep their subpath, unless they set their own ImportPath.
+	ImportPath string `json:"import_path,omitempty"`
+
+	// StripPrefix makes URL a base that the resolved path, without StripPrefix, is appended to, e.g. for vanity
+	// paths like `/go/<repo>` of repositories `<repo>` in one organization. With Path `/go`, URL
+	// `https://github.com/org` and StripPrefix `/go`, the submodule `/foo` is served from
+	// `https://github.com/org/foo`. It applies to the package and the submodules without a URL of their own, and to
+	// the mirrors, but never to the path advertised in the go-import tag. It must be a prefix of Path.
+	StripPrefix string `json:"strip_prefix,omitempty"`
+
+	// CanonicalLink adds a `Link` header to responses pointing to the documentation of the resolved package on
+	// pkg.go.dev as the canonical page, which helps search engines consolidate on it.
+	CanonicalLink bool `json:"canonical_link,omitempty"`
+
+	// Match restricts the route generated by the Caddyfile adapter. With MatchGoGet, requests below the package path
+	// are only handled if they come from the go tool, so other handlers can serve e.g. documentation at subpaths.
+	//
+	// If empty, the whole path is handled.
+	Match string `json:"match,omitempty"`
+
+	// FormGoGet also detects requests of the go tool by a go-get=1 parameter in a form body, as earlier versions
+	// did. By default only the query string is looked at, so request bodies are never parsed.
+	FormGoGet bool `json:"form_go_get,omitempty"`
+
+	// QuietBrowserAssets responds to browser requests for well-known assets below the package path, like
+	// `favicon.ico` and `robots.txt`, with 204 No Content instead of redirecting them to the source.
+	QuietBrowserAssets bool `json:"quiet_browser_assets,omitempty"`
+
+	// NoIndex asks search engines not to index the package, e.g. for internal modules exposed on a public vanity
+	// host. Responses get an `X-Robots-Tag: noindex` header, the default templates a robots meta tag, and the package
+	// is left out of sitemaps and disallowed by the robots.txt of the gopkg_robots handler.
+	NoIndex bool `json:"noindex,omitempty"`
+
+	// DebugHeaders adds the resolved target to every response in `X-Gopkg-*` headers. This exposes the source URLs,
+	// so it is meant for diagnosing go get failures.
+	DebugHeaders bool `json:"debug_headers,omitempty"`
+
+	// Proxy enables serving the module proxy protocol (GOPROXY) for the package and its submodules. It requires Host
+	// or Hosts, and only the modules below those hosts are served.
+	Proxy *Proxy `json:"proxy,omitempty"`
+
+	// Badge serves a badge with the latest version of the package at `badge.svg` below its path, and of each
+	// submodule below the submodule path, for projects to embed in their READMEs. The version is looked up with
+	// LatestVersion.
+	Badge bool `json:"badge,omitempty"`
+
+	// LatestVersion configures how the latest version of a module is looked up. If set, it is passed to templates
+	// as TemplateData.LatestVersion. If nil and Badge is set, the defaults are used. Modules are looked up below Host
+	// or the one of Hosts requested, never below a host only the client chose, so one of them is required.
+	LatestVersion *LatestVersion `json:"latest_version,omitempty"`
+
+	// Source adds a go-source tag to the response, which links documentation tools to the source.
+	Source *Source `json:"source,omitempty"`
+
+	// RedirectCode is the status code of browser redirects: 301 or 308 for permanent redirects on a stable vanity
+	// domain, or 302 or 307 for temporary ones.
+	//
+	// If zero, the default is 307.
+	RedirectCode int `json:"redirect_code,omitempty"`
+
+	// MetaStatus is the status code of go-import responses. It must be a 2xx code, e.g. 203 for proxies that treat
+	// non-authoritative responses differently.
+	//
+	// If zero, the default is 200.
+	MetaStatus int `json:"meta_status,omitempty"`
+
+	// CacheControl sets the Cache-Control header of responses, so CDNs and browsers can cache them. If nil, no
+	// Cache-Control header is sent.
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
+
+	// Template is the template used when returning a response (instead of redirecting). Responses to the go tool
+	// are rendered once per host and target and then served from a cache.
 	Template *template.Template
+
+	pathPattern       *regexp.Regexp
+	pathVars          []string
+	errorTemplate     *template.Template
+	trustedProxies    []*net.IPNet
+	submoduleIndex    *submoduleTrie
+	wildcard          *Submodule
+	submodulePatterns []*Submodule
+	responses         *responseCache
+	app               *App
+	logger            *zap.Logger
+}
+
+// WildcardSubmodule is the path of a catch-all submodule. It matches the first segment of any subpath that no other
+// submodule matches.
+const WildcardSubmodule = "*"
+
+// browserAssets are the files browsers request on their own, which QuietBrowserAssets answers with no content.
+var browserAssets = map[string]bool{
+	"favicon.ico": true,
+	"robots.txt":  true,
+}
+
+// majorVersionRegexp matches the major version suffix of a module path, like `v2`.
+var majorVersionRegexp = regexp.MustCompile(`^v([2-9]|[1-9][0-9]+)$`)
+
+// MatchGoGet is the Match mode that handles only the package path itself and requests of the go tool below it.
+const MatchGoGet = "go-get"
+
+// Request variables set by ServeHTTP, which lets the handlers wrapping a package, e.g. for logging, read what a
+// request resolved to with caddyhttp.GetVar once it is served. Handlers applying deferred response headers can use
+// them as placeholders like `{http.vars.gopkg_response}`.
+const (
+	// VarPackage is the path of the package that handled the request.
+	VarPackage = "gopkg_package"
+
+	// VarSubmodule is the path of the submodule the request resolved to, if any.
+	VarSubmodule = "gopkg_submodule"
+
+	// VarVcs is the version control system of the resolved package.
+	VarVcs = "gopkg_vcs"
+
+	// VarResponse is the type of the response, one of the Response constants.
+	VarResponse = "gopkg_response"
+)
+
+// Values of VarResponse.
+const (
+	ResponseMeta     = "meta"
+	ResponseLanding  = "landing"
+	ResponseRedirect = "redirect"
+	ResponseJSON     = "json"
+	ResponseProxy    = "proxy"
+)
+
+// Keywords of BrowserRedirect and BrowserURL.
+const (
+	// BrowserRedirectRepo redirects browsers to the source URL of the resolved package.
+	BrowserRedirectRepo = "repo"
+
+	// BrowserRedirectPkgsite redirects browsers to the documentation of the resolved package on pkg.go.dev.
+	BrowserRedirectPkgsite = "pkgsite"
+)
+
+// CacheControl holds the Cache-Control header values of the responses of a package. An empty value sends no header.
+type CacheControl struct {
+	// Meta is sent with go-import, landing and JSON responses, e.g. `public, max-age=3600`.
+	Meta string `json:"meta,omitempty"`
+
+	// Redirect is sent with browser redirects. Permanent redirects are cached by browsers regardless, so this is
+	// mostly useful to cache temporary redirects, or to prevent caching with `no-store`.
+	Redirect string `json:"redirect,omitempty"`
 }
 
 // Submodule represents a submodule within a go package.
 type Submodule struct {
-	// Path is the submodule path relative to the parent package path.
+	// Path is the submodule path relative to the parent package path, or WildcardSubmodule.
+	//
+	// Like the package path it may contain variables and `*` segments, e.g. `/tools/*`, which cover all submodules
+	// following a naming convention. Its wildcards are numbered after those of the package path. Literal submodules
+	// take precedence over patterns matching the same subpath.
 	Path string `json:"path"`
 
 	// URL is the URL of the submodule's source. If empty, defaults to parent package URL.
 	URL string `json:"url,omitempty"`
+
+	// Vcs is the version control system of the submodule's source, e.g. for an hg repository below a package in
+	// git. It requires URL to be set. If empty, the Vcs of the parent package is used.
+	Vcs string `json:"vcs,omitempty"`
+
+	// Reserved makes the submodule path resolve to nothing (404) instead of falling back to the parent package. This
+	// reserves a path that is not published yet.
+	Reserved bool `json:"reserved,omitempty"`
+
+	// BrowserURL is where browsers are redirected to for the submodule, with the same values as BrowserRedirect. If
+	// empty, the BrowserRedirect of the parent package is used.
+	BrowserURL string `json:"browser_url,omitempty"`
+
+	// Dir is the directory of the repository the submodule lives in, if the repository is shared with the parent
+	// package, e.g. `sub` for a module with its go.mod at `sub/go.mod`. The go-import tag still points at the
+	// repository root, while detected go-source links point into the directory.
+	Dir string `json:"dir,omitempty"`
+
+	// ImportPath is advertised as the path of the submodule in the go-import tag instead of the matched path. It is
+	// joined with the host, so it must be an absolute path like `/bar`.
+	ImportPath string `json:"import_path,omitempty"`
+
+	// TemplateFile is the path of an HTML template file rendered for the submodule instead of the template of the
+	// package, e.g. with other landing content or go-source tags. In landing mode it is rendered for browsers too.
+	TemplateFile string `json:"template_file,omitempty"`
+
+	template    *template.Template
+	pathPattern *regexp.Regexp
+	pathVars    []string
+}
+
+// Target is the package or submodule a request resolves to.
+type Target struct {
+	// Path is the HTTP path component of the vanity import path, e.g. `/package/name/submodule`.
+	Path string
+
+	// Vcs is the version control system used by the target.
+	Vcs string
+
+	// URL is the URL of the target's source.
+	URL string
+
+	// Reserved is set if the target is a reserved submodule, which is not served.
+	Reserved bool
+
+	// BrowserURL is where browsers are redirected to, if it differs from URL.
+	BrowserURL string
+
+	// Dir is the directory of the repository the target lives in, or empty for the repository root.
+	Dir string
+
+	// Submodule is the submodule rule that matched, or nil if the request resolved to the parent package.
+	Submodule *Submodule
+}
+
+// New returns a GoPackage serving the given path from the source at url. If vcs is empty, `git` is used once the
+// package is provisioned.
+func New(path, vcs, url string) *GoPackage {
+	return &GoPackage{
+		Path: path,
+		Vcs:  vcs,
+		URL:  url,
+	}
+}
+
+// WithSubmodule adds a submodule at the given subpath to the package. If url is empty, the submodule is served from
+// the package's source.
+func (m *GoPackage) WithSubmodule(path, url string) *GoPackage {
+	m.Submodules = append(m.Submodules, Submodule{Path: path, URL: url})
+	return m
+}
+
+// WithTemplate sets the template used to render go-import responses instead of DefaultTemplate.
+func (m *GoPackage) WithTemplate(tpl *template.Template) *GoPackage {
+	m.Template = tpl
+	return m
+}
+
+// TemplateData is the data passed to templates when rendering a response.
+type TemplateData struct {
+	// Host is the host of the request, e.g. `web.site`.
+	Host string
+
+	// Path is the HTTP path component of the resolved vanity import path, e.g. `/package/name`.
+	Path string
+
+	// Vcs is the version control system of the resolved package.
+	Vcs string
+
+	// URL is the source URL of the resolved package.
+	URL string
+
+	// Dir is the directory of the repository the resolved package lives in, or empty for the repository root.
+	Dir string
+
+	// Submodule is the submodule rule the request matched, or nil for the package itself.
+	Submodule *Submodule
+
+	// Insecure is set if the source is only reachable via plain HTTP.
+	Insecure bool
+
+	// GetSuffix is appended to the go get command shown in the body, e.g. `@latest`.
+	GetSuffix string
+
+	// Description is the description of the package.
+	Description string
+
+	// NoIndex is set if search engines should not index the package.
+	NoIndex bool
+
+	// LatestVersion is the latest version of the resolved package, or empty if LatestVersion is not configured or
+	// the version is unknown. Like Readme, it is only looked up for browser requests.
+	LatestVersion string
+
+	// Readme is the rendered README of the resolved package, or empty if Readme is not configured or the README has
+	// not been fetched yet. It is only looked up for browser requests.
+	Readme template.HTML
+
+	// Mirrors are the alternative source URLs of the package, in order of preference.
+	Mirrors []string
+
+	// Source are the go-source templates of the resolved package, or nil if go-source is not configured.
+	Source *Source
+
+	// Imports are the imports to advertise. In group mode this is the package and all of its submodules for requests
+	// of the package path, otherwise it only contains the resolved package.
+	Imports []Target
+
+	// Error is the error that occurred while rendering the response. It is only set for ErrorTemplate.
+	Error error
+
+	request *http.Request
+}
+
+// Placeholder returns the value of a Caddy placeholder for the request, e.g. `{{.Placeholder "env.GIT_HOST"}}` or
+// `{{.Placeholder "http.request.host.labels.1"}}`, or the empty string if it is unknown. Responses to the go tool are
+// cached per host and target, so their templates should not use placeholders that differ between requests otherwise.
+func (d TemplateData) Placeholder(name string) string {
+	return replacePlaceholders(d.request, "{"+name+"}")
 }
 
 func (m GoPackage) CaddyModule() caddy.ModuleInfo {
@@ -107,24 +596,118 @@ func parseCaddyFile(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error)
 	// Pretend the lookahead never happened
 	h.Reset()
 
-	var m = new(GoPackage)
+	var m = packageDefaults(h)
 	err := m.UnmarshalCaddyfile(h.Dispenser)
 	if err != nil {
 		return nil, err
 	}
 
+	return packageRoute(h, m), nil
+
+}
+
+// packageRoute returns a route that mounts the package at its path.
+func packageRoute(h httpcaddyfile.Helper, m *GoPackage) []httpcaddyfile.ConfigValue {
+	// Path variables match any single segment
+	mountPath := pathVarRegexp.ReplaceAllString(m.MountPrefix+m.Path, "*")
+	if m.CaseInsensitive {
+		// The path matcher compares against the lower-cased request path
+		mountPath = strings.ToLower(mountPath)
+	}
 	matcher := caddy.ModuleMap{
-		"path": h.JSON(caddyhttp.MatchPath{m.Path, m.Path + "/", m.Path + "/*"}),
+		"path": h.JSON(caddyhttp.MatchPath{mountPath, mountPath + "/", mountPath + "/*"}),
+	}
+	if m.Match != MatchGoGet {
+		return h.NewRoute(matcher, m)
 	}
 
-	return h.NewRoute(matcher, m), nil
+	// Only take the subtree for the go tool, and leave other requests below the package path to other handlers
+	matcher["query"] = h.JSON(caddyhttp.MatchQuery{"go-get": {"1"}})
+	routes := h.NewRoute(matcher, m)
+	if len(routes) == 0 {
+		return nil
+	}
+	route := routes[0].Value.(caddyhttp.Route)
+	route.MatcherSetsRaw = append(route.MatcherSetsRaw, caddy.ModuleMap{
+		"path": h.JSON(caddyhttp.MatchPath{mountPath, mountPath + "/"}),
+	})
+	if m.Proxy != nil {
+		proxyPaths := caddyhttp.MatchPath{mountPath + "/@v/*", mountPath + "/" + latestFile}
+		for _, submodule := range m.Submodules {
+			if submodule.Path != WildcardSubmodule && !submodule.Reserved {
+				subPath := mountPath + pathVarRegexp.ReplaceAllString(submodule.Path, "*")
+				proxyPaths = append(proxyPaths, subPath+"/@v/*", subPath+"/"+latestFile)
+			}
+		}
+		route.MatcherSetsRaw = append(route.MatcherSetsRaw, caddy.ModuleMap{"path": h.JSON(proxyPaths)})
+	}
+	if m.Badge {
+		badgePaths := caddyhttp.MatchPath{mountPath + "/" + badgeFile}
+		for _, submodule := range m.Submodules {
+			if submodule.Path != WildcardSubmodule && !submodule.Reserved {
+				badgePaths = append(badgePaths, mountPath+pathVarRegexp.ReplaceAllString(submodule.Path, "*")+"/"+badgeFile)
+			}
+		}
+		route.MatcherSetsRaw = append(route.MatcherSetsRaw, caddy.ModuleMap{"path": h.JSON(badgePaths)})
+	}
+	routes[0].Value = route
 
+	return routes
 }
 
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
 //
 //     gopkg <path> [<vcs>] <uri> {
-//         submodule <subpath> [<suburi>]
+//         submodule <subpath>|* [[<vcs>] <suburi>|-] {
+//             browser_url <url>
+//             dir <dir>
+//             import_path <path>
+//             template <file>
+//         }
+//         mirror <uri>
+//         mount_prefix <prefix>
+//         discover_submodules [<api>]
+//         last_modified [<api> [<ttl>]]
+//         template <file>
+//         error_template <file>
+//         lenient_templates
+//         compress
+//         cors [<origin>]
+//         fallthrough
+//         passthrough
+//         group
+//         proxy [<cache_dir>] {
+//             upstream <url>
+//         }
+//         badge [<proxy> [<ttl>]]
+//         latest_version [<proxy> [<ttl>]]
+//         case_insensitive
+//         insecure
+//         redirect on|off|landing
+//         description <text>
+//         readme [<url> [<ttl>]]
+//         browser_redirect repo|pkgsite|<url>
+//         canonicalize
+//         debug_headers
+//         quiet_browser_assets
+//         noindex
+//         match go-get
+//         form_go_get
+//         canonical_link
+//         get_suffix <suffix>
+//         import_path <path>
+//         strip_prefix <prefix>
+//         import_prefix <host>[/<path>]
+//         validate_url [strict] [<timeout>]
+//         verify_repo [strict] [<timeout>]
+//         host <host>
+//         hosts <hostnames...>
+//         redirect_hosts
+//         trusted_proxies <ranges...>
+//         redirect_code <code>
+//         meta_status <code>
+//         cache_control [meta|redirect] <value>
+//         source auto|<home> <dir> <file>
 //     }
 //
 func (m *GoPackage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
@@ -132,113 +715,1827 @@ func (m *GoPackage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		if !d.Args(&m.Path) {
 			return d.ArgErr()
 		}
-
-		args := d.RemainingArgs()
-		switch len(args) {
-		case 2:
-			m.Vcs = args[0]
-			args = args[1:]
-			fallthrough
-		case 1:
-			m.URL = args[0]
-		default:
-			return d.ArgErr()
+		if err := m.unmarshalPackage(d); err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
+
+// unmarshalPackage parses the repo uri, optionally preceded by the vcs, and the block of options following the path
+// of a package.
+func (m *GoPackage) unmarshalPackage(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	switch len(args) {
+	case 2:
+		m.Vcs = args[0]
+		args = args[1:]
+		fallthrough
+	case 1:
+		m.URL = args[0]
+	default:
+		return d.ArgErr()
+	}
+
+	// Parse optional block for submodules and options
+	return m.unmarshalOptions(d)
+}
+
+// unmarshalOptions parses the block of submodules and options of a directive.
+func (m *GoPackage) unmarshalOptions(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "submodule":
+			submodule := Submodule{}
+			if !d.Args(&submodule.Path) {
+				return d.ArgErr()
+			}
+
+			// Optional submodule URL with its vcs, or - to reserve the path
+			switch remainingArgs := d.RemainingArgs(); len(remainingArgs) {
+			case 2:
+				submodule.Vcs = remainingArgs[0]
+				submodule.URL = remainingArgs[1]
+			case 1:
+				submodule.URL = remainingArgs[0]
+			case 0:
+			default:
+				return d.ArgErr()
+			}
+			if submodule.URL == "-" {
+				submodule.URL = ""
+				submodule.Reserved = true
+			}
 
-		// Parse optional block for submodules
-		for d.NextBlock(0) {
-			switch d.Val() {
-			case "submodule":
-				submodule := Submodule{}
-				if !d.Args(&submodule.Path) {
-					return d.ArgErr()
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "browser_url":
+					if !d.Args(&submodule.BrowserURL) || d.NextArg() {
+						return d.ArgErr()
+					}
+				case "dir":
+					if !d.Args(&submodule.Dir) || d.NextArg() {
+						return d.ArgErr()
+					}
+				case "import_path":
+					if !d.Args(&submodule.ImportPath) || d.NextArg() {
+						return d.ArgErr()
+					}
+				case "template":
+					if !d.Args(&submodule.TemplateFile) || d.NextArg() {
+						return d.ArgErr()
+					}
+				default:
+					return d.Errf("unrecognized submodule subdirective '%s'", d.Val())
+				}
+			}
+
+			m.Submodules = append(m.Submodules, submodule)
+		case "mirror":
+			var mirror string
+			if !d.Args(&mirror) || d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Mirrors = append(m.Mirrors, mirror)
+		case "mount_prefix":
+			if !d.Args(&m.MountPrefix) || d.NextArg() {
+				return d.ArgErr()
+			}
+		case "template":
+			if !d.Args(&m.TemplateFile) || d.NextArg() {
+				return d.ArgErr()
+			}
+		case "error_template":
+			if !d.Args(&m.ErrorTemplate) || d.NextArg() {
+				return d.ArgErr()
+			}
+		case "lenient_templates":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.LenientTemplates = true
+		case "compress":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Compress = true
+		case "cors":
+			m.CORSOrigin = "*"
+			d.Args(&m.CORSOrigin)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "fallthrough":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Fallthrough = true
+		case "passthrough":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Passthrough = true
+		case "group":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Group = true
+		case "get_suffix":
+			if !d.Args(&m.GetSuffix) || d.NextArg() {
+				return d.ArgErr()
+			}
+		case "strip_prefix":
+			if !d.Args(&m.StripPrefix) || d.NextArg() {
+				return d.ArgErr()
+			}
+		case "import_path":
+			if !d.Args(&m.ImportPath) || d.NextArg() {
+				return d.ArgErr()
+			}
+		case "import_prefix":
+			// Shorthand for host and import_path
+			var prefix string
+			if !d.Args(&prefix) || d.NextArg() {
+				return d.ArgErr()
+			}
+			if strings.Contains(prefix, "://") {
+				return d.Errf("import_prefix %s must not have a scheme", prefix)
+			}
+			m.Host = prefix
+			if i := strings.IndexByte(prefix, '/'); i >= 0 {
+				m.Host, m.ImportPath = prefix[:i], prefix[i:]
+			}
+			if m.Host == "" {
+				return d.Errf("import_prefix %s has no host", prefix)
+			}
+		case "canonical_link":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.CanonicalLink = true
+		case "match":
+			if !d.Args(&m.Match) || d.NextArg() {
+				return d.ArgErr()
+			}
+			if m.Match != MatchGoGet {
+				return d.Errf("match must be '%s', got '%s'", MatchGoGet, m.Match)
+			}
+		case "form_go_get":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.FormGoGet = true
+		case "quiet_browser_assets":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.QuietBrowserAssets = true
+		case "noindex":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.NoIndex = true
+		case "debug_headers":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.DebugHeaders = true
+		case "canonicalize":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Canonicalize = true
+		case "source":
+			args := d.RemainingArgs()
+			switch {
+			case len(args) == 1 && args[0] == "auto":
+				m.Source = &Source{Auto: true}
+			case len(args) == 3:
+				m.Source = &Source{
+					Home: args[0],
+					Dir:  sourceTemplateReplacer.Replace(args[1]),
+					File: sourceTemplateReplacer.Replace(args[2]),
+				}
+			default:
+				return d.ArgErr()
+			}
+		case "proxy":
+			m.Proxy = new(Proxy)
+			d.Args(&m.Proxy.CacheDir)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "upstream":
+					if !d.Args(&m.Proxy.Upstream) || d.NextArg() {
+						return d.ArgErr()
+					}
+				default:
+					return d.Errf("unrecognized proxy subdirective '%s'", d.Val())
 				}
-				
-				// Optional submodule URL
-				remainingArgs := d.RemainingArgs()
-				if len(remainingArgs) > 0 {
-					submodule.URL = remainingArgs[0]
+			}
+		case "case_insensitive":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.CaseInsensitive = true
+		case "insecure":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Insecure = true
+		case "redirect":
+			var state string
+			if !d.Args(&state) || d.NextArg() {
+				return d.ArgErr()
+			}
+			switch state {
+			case "on":
+				m.DisableRedirect, m.Landing = false, false
+			case "off":
+				m.DisableRedirect, m.Landing = true, false
+			case "landing":
+				m.DisableRedirect, m.Landing = false, true
+			default:
+				return d.Errf("redirect must be 'on', 'off' or 'landing', got '%s'", state)
+			}
+		case "description":
+			if !d.Args(&m.Description) || d.NextArg() {
+				return d.ArgErr()
+			}
+		case "meta_status":
+			var code string
+			if !d.Args(&code) || d.NextArg() {
+				return d.ArgErr()
+			}
+			status, err := strconv.Atoi(code)
+			if err != nil {
+				return d.Errf("parsing meta_status: %v", err)
+			}
+			m.MetaStatus = status
+		case "redirect_code":
+			var code string
+			if !d.Args(&code) || d.NextArg() {
+				return d.ArgErr()
+			}
+			status, err := strconv.Atoi(code)
+			if err != nil {
+				return d.Errf("parsing redirect_code: %v", err)
+			}
+			m.RedirectCode = status
+		case "cache_control":
+			args := d.RemainingArgs()
+			if m.CacheControl == nil {
+				m.CacheControl = new(CacheControl)
+			}
+			switch {
+			case len(args) == 1:
+				m.CacheControl.Meta, m.CacheControl.Redirect = args[0], args[0]
+			case len(args) == 2 && args[0] == "meta":
+				m.CacheControl.Meta = args[1]
+			case len(args) == 2 && args[0] == "redirect":
+				m.CacheControl.Redirect = args[1]
+			default:
+				return d.ArgErr()
+			}
+		case "browser_redirect":
+			if !d.Args(&m.BrowserRedirect) || d.NextArg() {
+				return d.ArgErr()
+			}
+		case "host":
+			if !d.Args(&m.Host) || d.NextArg() {
+				return d.ArgErr()
+			}
+		case "hosts":
+			hosts := d.RemainingArgs()
+			if len(hosts) == 0 {
+				return d.ArgErr()
+			}
+			m.Hosts = append(m.Hosts, hosts...)
+		case "redirect_hosts":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.RedirectHosts = true
+		case "trusted_proxies":
+			ranges := d.RemainingArgs()
+			if len(ranges) == 0 {
+				return d.ArgErr()
+			}
+			m.TrustedProxies = append(m.TrustedProxies, ranges...)
+		case "validate_url", "verify_repo":
+			name := d.Val()
+			m.ValidateURL = &ValidateURL{Repo: name == "verify_repo"}
+			args := d.RemainingArgs()
+			if len(args) > 0 && args[0] == "strict" {
+				m.ValidateURL.Strict = true
+				args = args[1:]
+			}
+			switch len(args) {
+			case 1:
+				timeout, err := time.ParseDuration(args[0])
+				if err != nil {
+					return d.Errf("parsing %s timeout: %v", name, err)
+				}
+				m.ValidateURL.Timeout = caddy.Duration(timeout)
+			case 0:
+			default:
+				return d.ArgErr()
+			}
+		case "readme":
+			m.Readme = new(Readme)
+			args := d.RemainingArgs()
+			switch len(args) {
+			case 2:
+				ttl, err := time.ParseDuration(args[1])
+				if err != nil {
+					return d.Errf("parsing readme ttl: %v", err)
+				}
+				m.Readme.TTL = caddy.Duration(ttl)
+				fallthrough
+			case 1:
+				m.Readme.URL = args[0]
+			case 0:
+			default:
+				return d.ArgErr()
+			}
+		case "badge", "latest_version":
+			name := d.Val()
+			m.Badge = m.Badge || name == "badge"
+			m.LatestVersion = new(LatestVersion)
+			args := d.RemainingArgs()
+			switch len(args) {
+			case 2:
+				ttl, err := time.ParseDuration(args[1])
+				if err != nil {
+					return d.Errf("parsing %s ttl: %v", name, err)
+				}
+				m.LatestVersion.TTL = caddy.Duration(ttl)
+				fallthrough
+			case 1:
+				m.LatestVersion.Proxy = args[0]
+			case 0:
+			default:
+				return d.ArgErr()
+			}
+		case "discover_submodules":
+			m.DiscoverSubmodules = new(DiscoverSubmodules)
+			switch args := d.RemainingArgs(); len(args) {
+			case 1:
+				m.DiscoverSubmodules.API = args[0]
+			case 0:
+			default:
+				return d.ArgErr()
+			}
+		case "last_modified":
+			m.LastModified = new(LastModified)
+			args := d.RemainingArgs()
+			switch len(args) {
+			case 2:
+				ttl, err := time.ParseDuration(args[1])
+				if err != nil {
+					return d.Errf("parsing last_modified ttl: %v", err)
 				}
-				
-				m.Submodules = append(m.Submodules, submodule)
+				m.LastModified.TTL = caddy.Duration(ttl)
+				fallthrough
+			case 1:
+				m.LastModified.API = args[0]
+			case 0:
 			default:
-				return d.Errf("unrecognized subdirective '%s'", d.Val())
+				return d.ArgErr()
 			}
+		default:
+			return d.Errf("unrecognized subdirective '%s'", d.Val())
 		}
 	}
 
 	return nil
 }
 
-func (m *GoPackage) Provision(ctx caddy.Context) error {
-	if m.Vcs == "" {
-		m.Vcs = "git"
+// ParseDirective parses a single gopkg directive, as it would appear in a site block of a Caddyfile, into a
+// GoPackage. Malformed input results in an error.
+func ParseDirective(input string) (*GoPackage, error) {
+	blocks, err := caddyfile.Parse("Caddyfile", []byte(":80 {\n"+input+"\n}\n"))
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) != 1 || len(blocks[0].Segments) != 1 {
+		return nil, fmt.Errorf("expected exactly one directive")
 	}
 
-	if m.Template == nil {
-		tpl, err := template.New("Package").Parse(DefaultTemplate)
-		if err != nil {
-			return fmt.Errorf("parsing default gopkg template: %v", err)
-		}
-		m.Template = tpl
+	segment := blocks[0].Segments[0]
+	if segment.Directive() != "gopkg" {
+		return nil, fmt.Errorf("expected gopkg directive, got '%s'", segment.Directive())
 	}
 
-	return nil
+	m := new(GoPackage)
+	if err := m.UnmarshalCaddyfile(caddyfile.NewDispenser(segment)); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
-func (m GoPackage) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	// Determine the best match for the request path
-	targetPath := m.Path
-	targetURL := m.URL
-	
-	// Find the best (longest) matching submodule
-	bestMatch := ""
-	bestURL := ""
+// MarshalCaddyfile is the inverse of UnmarshalCaddyfile. It renders the package as a gopkg directive, including a
+// block with the submodules and options if there are any, so that parsing the output yields an equivalent GoPackage.
+func (m GoPackage) MarshalCaddyfile() ([]byte, error) {
+	var b strings.Builder
+
+	b.WriteString("gopkg " + quoteCaddyfileToken(m.Path))
+	if m.Vcs != "" {
+		b.WriteString(" " + quoteCaddyfileToken(m.Vcs))
+	}
+	b.WriteString(" " + quoteCaddyfileToken(m.URL))
+
+	var block []string
 	for _, submodule := range m.Submodules {
-		submodulePath := m.Path + submodule.Path
-		if (r.URL.Path == submodulePath || 
-		    r.URL.Path == submodulePath+"/" ||
-		    strings.HasPrefix(r.URL.Path, submodulePath+"/")) &&
-		   len(submodulePath) > len(bestMatch) {
-			bestMatch = submodulePath
-			if submodule.URL != "" {
-				bestURL = submodule.URL
+		line := "submodule " + quoteCaddyfileToken(submodule.Path)
+		if submodule.Vcs != "" {
+			if submodule.URL == "" || submodule.Reserved {
+				return nil, fmt.Errorf("submodule %s with a vcs but without url cannot be expressed in a Caddyfile", submodule.Path)
 			}
+			line += " " + quoteCaddyfileToken(submodule.Vcs)
 		}
-	}
-	
-	// Use best match if found
-	if bestMatch != "" {
-		targetPath = bestMatch
-		if bestURL != "" {
-			targetURL = bestURL
+		if submodule.Reserved {
+			line += " -"
+		} else if submodule.URL != "" {
+			line += " " + quoteCaddyfileToken(submodule.URL)
+		}
+		var options []string
+		if submodule.BrowserURL != "" {
+			options = append(options, "browser_url "+quoteCaddyfileToken(submodule.BrowserURL))
+		}
+		if submodule.Dir != "" {
+			options = append(options, "dir "+quoteCaddyfileToken(submodule.Dir))
 		}
+		if submodule.ImportPath != "" {
+			options = append(options, "import_path "+quoteCaddyfileToken(submodule.ImportPath))
+		}
+		if submodule.TemplateFile != "" {
+			options = append(options, "template "+quoteCaddyfileToken(submodule.TemplateFile))
+		}
+		if len(options) > 0 {
+			line += " {\n\t\t" + strings.Join(options, "\n\t\t") + "\n\t}"
+		}
+		block = append(block, line)
 	}
-
-	// If go-get is not present, it's most likely a browser request. So let's redirect.
-	if r.FormValue("go-get") != "1" {
-		http.Redirect(w, r, targetURL, http.StatusTemporaryRedirect)
-		return nil
+	for _, mirror := range m.Mirrors {
+		block = append(block, "mirror "+quoteCaddyfileToken(mirror))
 	}
-
-	err := m.Template.Execute(w, struct {
-		Host string
-		Path string
-		Vcs  string
-		URL  string
-	}{r.Host, targetPath, m.Vcs, targetURL})
-
-	if err != nil {
+	if m.MountPrefix != "" {
+		block = append(block, "mount_prefix "+quoteCaddyfileToken(m.MountPrefix))
+	}
+	if ds := m.DiscoverSubmodules; ds != nil {
+		line := "discover_submodules"
+		if ds.API != "" {
+			line += " " + quoteCaddyfileToken(ds.API)
+		}
+		block = append(block, line)
+	}
+	if lm := m.LastModified; lm != nil {
+		line := "last_modified"
+		if lm.API != "" || lm.TTL != 0 {
+			line += " " + quoteCaddyfileToken(lm.API)
+		}
+		if lm.TTL != 0 {
+			line += " " + time.Duration(lm.TTL).String()
+		}
+		block = append(block, line)
+	}
+	if m.TemplateFile != "" {
+		block = append(block, "template "+quoteCaddyfileToken(m.TemplateFile))
+	}
+	if m.ErrorTemplate != "" {
+		block = append(block, "error_template "+quoteCaddyfileToken(m.ErrorTemplate))
+	}
+	if m.LenientTemplates {
+		block = append(block, "lenient_templates")
+	}
+	if m.Compress {
+		block = append(block, "compress")
+	}
+	if m.CORSOrigin == "*" {
+		block = append(block, "cors")
+	} else if m.CORSOrigin != "" {
+		block = append(block, "cors "+quoteCaddyfileToken(m.CORSOrigin))
+	}
+	if m.Fallthrough {
+		block = append(block, "fallthrough")
+	}
+	if m.Passthrough {
+		block = append(block, "passthrough")
+	}
+	if m.Host != "" {
+		block = append(block, "host "+quoteCaddyfileToken(m.Host))
+	}
+	if len(m.Hosts) > 0 {
+		line := "hosts"
+		for _, host := range m.Hosts {
+			line += " " + quoteCaddyfileToken(host)
+		}
+		block = append(block, line)
+	}
+	if m.RedirectHosts {
+		block = append(block, "redirect_hosts")
+	}
+	if len(m.TrustedProxies) > 0 {
+		line := "trusted_proxies"
+		for _, ipRange := range m.TrustedProxies {
+			line += " " + quoteCaddyfileToken(ipRange)
+		}
+		block = append(block, line)
+	}
+	if m.DisableRedirect {
+		block = append(block, "redirect off")
+	}
+	if m.Landing {
+		block = append(block, "redirect landing")
+	}
+	if m.Description != "" {
+		block = append(block, "description "+quoteCaddyfileToken(m.Description))
+	}
+	if rm := m.Readme; rm != nil {
+		line := "readme"
+		if rm.URL != "" || rm.TTL != 0 {
+			line += " " + quoteCaddyfileToken(rm.URL)
+		}
+		if rm.TTL != 0 {
+			line += " " + time.Duration(rm.TTL).String()
+		}
+		block = append(block, line)
+	}
+	if m.BrowserRedirect != "" {
+		block = append(block, "browser_redirect "+quoteCaddyfileToken(m.BrowserRedirect))
+	}
+	if m.Canonicalize {
+		block = append(block, "canonicalize")
+	}
+	if m.GetSuffix != "" {
+		block = append(block, "get_suffix "+quoteCaddyfileToken(m.GetSuffix))
+	}
+	if m.ImportPath != "" {
+		block = append(block, "import_path "+quoteCaddyfileToken(m.ImportPath))
+	}
+	if m.StripPrefix != "" {
+		block = append(block, "strip_prefix "+quoteCaddyfileToken(m.StripPrefix))
+	}
+	if m.Match != "" {
+		block = append(block, "match "+quoteCaddyfileToken(m.Match))
+	}
+	if m.FormGoGet {
+		block = append(block, "form_go_get")
+	}
+	if m.QuietBrowserAssets {
+		block = append(block, "quiet_browser_assets")
+	}
+	if m.NoIndex {
+		block = append(block, "noindex")
+	}
+	if m.DebugHeaders {
+		block = append(block, "debug_headers")
+	}
+	if m.CanonicalLink {
+		block = append(block, "canonical_link")
+	}
+	if v := m.ValidateURL; v != nil {
+		line := "validate_url"
+		if v.Repo {
+			line = "verify_repo"
+		}
+		if v.Strict {
+			line += " strict"
+		}
+		if v.Timeout != 0 {
+			line += " " + time.Duration(v.Timeout).String()
+		}
+		block = append(block, line)
+	}
+	if m.Group {
+		block = append(block, "group")
+	}
+	if m.CaseInsensitive {
+		block = append(block, "case_insensitive")
+	}
+	if m.Insecure {
+		block = append(block, "insecure")
+	}
+	if m.RedirectCode != 0 {
+		block = append(block, "redirect_code "+strconv.Itoa(m.RedirectCode))
+	}
+	if m.MetaStatus != 0 {
+		block = append(block, "meta_status "+strconv.Itoa(m.MetaStatus))
+	}
+	if cc := m.CacheControl; cc != nil {
+		if cc.Meta == cc.Redirect {
+			block = append(block, "cache_control "+quoteCaddyfileToken(cc.Meta))
+		} else {
+			if cc.Meta != "" {
+				block = append(block, "cache_control meta "+quoteCaddyfileToken(cc.Meta))
+			}
+			if cc.Redirect != "" {
+				block = append(block, "cache_control redirect "+quoteCaddyfileToken(cc.Redirect))
+			}
+		}
+	}
+	if src := m.Source; src != nil {
+		switch {
+		case src.Auto && src.Home == "" && src.Dir == "" && src.File == "":
+			block = append(block, "source auto")
+		case src.Auto:
+			return nil, fmt.Errorf("source with auto and explicit templates cannot be expressed in a Caddyfile")
+		default:
+			block = append(block, "source "+quoteCaddyfileToken(src.Home)+" "+quoteCaddyfileToken(src.Dir)+" "+
+				quoteCaddyfileToken(src.File))
+		}
+	}
+	if m.Badge || m.LatestVersion != nil {
+		line := "latest_version"
+		if m.Badge {
+			line = "badge"
+		}
+		if lv := m.LatestVersion; lv != nil && (lv.Proxy != "" || lv.TTL != 0) {
+			line += " " + quoteCaddyfileToken(lv.Proxy)
+			if lv.TTL != 0 {
+				line += " " + time.Duration(lv.TTL).String()
+			}
+		}
+		block = append(block, line)
+	}
+	if m.Proxy != nil {
+		line := "proxy"
+		if m.Proxy.CacheDir != "" {
+			line += " " + quoteCaddyfileToken(m.Proxy.CacheDir)
+		}
+		if m.Proxy.Upstream != "" {
+			line += " {\n\t\tupstream " + quoteCaddyfileToken(m.Proxy.Upstream) + "\n\t}"
+		}
+		block = append(block, line)
+	}
+
+	if len(block) > 0 {
+		b.WriteString(" {\n")
+		for _, line := range block {
+			b.WriteString("\t" + line + "\n")
+		}
+		b.WriteString("}")
+	}
+	b.WriteString("\n")
+
+	return []byte(b.String()), nil
+}
+
+// quoteCaddyfileToken quotes a token if the caddyfile lexer would otherwise split or drop it.
+func quoteCaddyfileToken(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\r\n\"{}#") {
+		return s
+	}
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+func (m *GoPackage) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger(m)
+
+	// Placeholders not depending on a request, like `{env.PREFIX}`, are replaced once
+	m.Path = caddy.NewReplacer().ReplaceKnown(m.Path, "")
+
+	// During a config reload the previous instance keeps serving requests. Copy everything provisioning writes to, so
+	// nothing is shared with it in case both were created from the same configuration.
+	m.Submodules = append([]Submodule(nil), m.Submodules...)
+	if lm := m.LastModified; lm != nil {
+		m.LastModified = &LastModified{API: lm.API, TTL: lm.TTL}
+	}
+	if ds := m.DiscoverSubmodules; ds != nil {
+		m.DiscoverSubmodules = &DiscoverSubmodules{API: ds.API}
+	}
+	if p := m.Proxy; p != nil {
+		m.Proxy = &Proxy{CacheDir: p.CacheDir, GoBin: p.GoBin, Upstream: p.Upstream, fetcher: p.fetcher}
+	}
+	if rm := m.Readme; rm != nil {
+		m.Readme = &Readme{URL: rm.URL, TTL: rm.TTL}
+	}
+	if lv := m.LatestVersion; lv != nil {
+		m.LatestVersion = &LatestVersion{Proxy: lv.Proxy, TTL: lv.TTL}
+	} else if m.Badge {
+		m.LatestVersion = new(LatestVersion)
+	}
+
+	if m.Vcs == "" {
+		m.Vcs = "git"
+	}
+
+	if m.RedirectCode == 0 {
+		m.RedirectCode = http.StatusTemporaryRedirect
+	}
+	switch m.RedirectCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("redirect_code must be 301, 302, 307 or 308, got %d", m.RedirectCode)
+	}
+
+	if m.MetaStatus == 0 {
+		m.MetaStatus = http.StatusOK
+	}
+	if m.MetaStatus < 200 || m.MetaStatus > 299 {
+		return fmt.Errorf("meta_status must be a 2xx status code, got %d", m.MetaStatus)
+	}
+
+	if m.RedirectHosts && len(m.Hosts) == 0 {
+		return fmt.Errorf("redirect_hosts requires hosts")
+	}
+
+	for _, ipRange := range m.TrustedProxies {
+		if !strings.Contains(ipRange, "/") {
+			if strings.Contains(ipRange, ":") {
+				ipRange += "/128"
+			} else {
+				ipRange += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(ipRange)
+		if err != nil {
+			return fmt.Errorf("parsing trusted proxy: %v", err)
+		}
+		m.trustedProxies = append(m.trustedProxies, ipNet)
+	}
+
+	// Environment variables in the source URLs are resolved once, like in a Caddyfile, so packages loaded from JSON
+	// can be promoted across environments too
+	m.Mirrors = append([]string(nil), m.Mirrors...)
+	urls := []*string{&m.URL}
+	for i := range m.Mirrors {
+		urls = append(urls, &m.Mirrors[i])
+	}
+	for i := range m.Submodules {
+		urls = append(urls, &m.Submodules[i].URL)
+	}
+	for _, u := range urls {
+		expanded, err := expandEnv(*u)
+		if err != nil {
+			return err
+		}
+		*u = expanded
+	}
+
+	m.URL = m.completeURL(m.URL)
+	for i := range m.Mirrors {
+		m.Mirrors[i] = m.completeURL(m.Mirrors[i])
+	}
+	for i := range m.Submodules {
+		m.Submodules[i].URL = m.completeURL(m.Submodules[i].URL)
+	}
+	if m.DiscoverSubmodules != nil {
+		if err := m.discoverSubmodules(); err != nil {
+			return err
+		}
+	}
+
+	sources := []Target{{Vcs: m.Vcs, URL: m.URL}}
+	for _, submodule := range m.Submodules {
+		if submodule.Vcs != "" && submodule.URL == "" {
+			return fmt.Errorf("submodule %s has a vcs but no url", submodule.Path)
+		}
+		if submodule.URL != "" {
+			sources = append(sources, Target{Vcs: submodule.vcs(m.Vcs), URL: submodule.URL})
+		}
+	}
+	for _, source := range sources {
+		// Placeholders are only resolved per request
+		if placeholderRegexp.MatchString(source.Vcs + source.URL) {
+			continue
+		}
+		if err := validateVcs(source.Vcs, source.URL); err != nil {
+			return err
+		}
+	}
+
+	if err := checkImportPathOverride(m.ImportPath); err != nil {
+		return err
+	}
+	if m.StripPrefix != "" {
+		prefix := strings.TrimSuffix(m.StripPrefix, "/")
+		if !strings.HasPrefix(m.StripPrefix, "/") || pathVarRegexp.MatchString(prefix) || strings.Contains(prefix, "*") ||
+			len(m.Path) < len(prefix) || !m.samePath(m.Path[:len(prefix)], prefix) ||
+			len(m.Path) > len(prefix) && m.Path[len(prefix)] != '/' {
+			return fmt.Errorf("strip_prefix %s must be a literal prefix of the path %s", m.StripPrefix, m.Path)
+		}
+	}
+	for _, submodule := range m.Submodules {
+		if submodule.ImportPath == "" {
+			continue
+		}
+		if submodule.Path == WildcardSubmodule {
+			return fmt.Errorf("wildcard submodule cannot have an import_path")
+		}
+		if err := checkImportPathOverride(submodule.ImportPath); err != nil {
+			return err
+		}
+	}
+
+	if err := m.compilePathVars(); err != nil {
+		return err
+	}
+	m.indexSubmodules()
+
+	if m.ValidateURL != nil {
+		if err := m.ValidateURL.check(ctx, m.logger, sources); err != nil {
+			return err
+		}
+	}
+
+	if m.Template == nil {
+		fallback := defaultTemplate
+		if m.Group {
+			fallback = defaultGroupTemplate
+		}
+		m.Template = fallback
+
+		if m.TemplateFile != "" {
+			tpl, err := m.parseTemplateFile(m.TemplateFile, fallback)
+			if err != nil {
+				return fmt.Errorf("parsing gopkg template: %v", err)
+			}
+			m.Template = tpl
+		}
+	}
+
+	for i, submodule := range m.Submodules {
+		if submodule.TemplateFile == "" {
+			continue
+		}
+		// If the template is lenient, the submodule falls back to the template of the package
+		tpl, err := m.parseTemplateFile(submodule.TemplateFile, nil)
+		if err != nil {
+			return fmt.Errorf("parsing gopkg template of submodule %s: %v", submodule.Path, err)
+		}
+		m.Submodules[i].template = tpl
+	}
+
+	if m.ErrorTemplate != "" {
+		tpl, err := m.parseTemplateFile(m.ErrorTemplate, nil)
+		if err != nil {
+			return fmt.Errorf("parsing gopkg error template: %v", err)
+		}
+		m.errorTemplate = tpl
+	}
+
+	m.responses = newResponseCache()
+
+	if m.LastModified != nil {
+		m.LastModified.provision(m.logger)
+	}
+
+	if m.Readme != nil {
+		m.Readme.provision(m.logger)
+	}
+
+	if m.LatestVersion != nil {
+		m.LatestVersion.provision(m.logger)
+	}
+
+	if m.Proxy != nil {
+		m.Proxy.provision(m.logger)
+	}
+
+	if m.Source != nil {
+		if err := m.Source.provision(); err != nil {
+			return err
+		}
+	}
+
+	app, err := loadApp(ctx)
+	if err != nil {
+		return err
+	}
+	m.app = app
+	m.app.packages.add(m)
+
+	return nil
+}
+
+// Validate implements caddy.Validator. It rejects misconfigurations that would otherwise only show up as failing
+// requests of the go tool: a package path that is empty or relative, repo uris without a host, and submodule paths
+// that are relative, end in a slash or are defined more than once, and a proxy, badge or latest version without Host
+// or Hosts. The vcs of each repo uri is checked in Provision.
+func (m *GoPackage) Validate() error {
+	if !strings.HasPrefix(m.Path, "/") {
+		return fmt.Errorf("path %q must start with /", m.Path)
+	}
+	if m.Proxy != nil && m.Host == "" && len(m.Hosts) == 0 {
+		return fmt.Errorf("proxy of %s requires host or hosts", m.Path)
+	}
+	if m.LatestVersion != nil && m.Host == "" && len(m.Hosts) == 0 {
+		return fmt.Errorf("latest version of %s requires host or hosts", m.Path)
+	}
+
+	urls := append([]string{m.URL}, m.Mirrors...)
+	for _, u := range append(urls, submoduleURLs(m.Submodules)...) {
+		// Variables and placeholders are only resolved per request
+		if pathVarRegexp.MatchString(u) || placeholderRegexp.MatchString(u) {
+			continue
+		}
+		if parsed, err := url.Parse(u); err != nil || parsed.Host == "" {
+			return fmt.Errorf("url %q must be absolute, including a host", u)
+		}
+	}
+
+	seen := make(map[string]bool, len(m.Submodules))
+	for _, submodule := range m.Submodules {
+		if err := validateSubmodulePath(submodule.Path); err != nil {
+			return err
+		}
+
+		key := submodule.Path
+		if m.CaseInsensitive {
+			key = strings.ToLower(key)
+		}
+		if seen[key] {
+			return fmt.Errorf("submodule %s is defined more than once", submodule.Path)
+		}
+		seen[key] = true
+	}
+
+	return nil
+}
+
+// validateSubmodulePath checks that a submodule path is a subpath starting with /, or WildcardSubmodule.
+func validateSubmodulePath(p string) error {
+	if p == WildcardSubmodule {
+		return nil
+	}
+	if !strings.HasPrefix(p, "/") || p == "/" {
+		return fmt.Errorf("submodule path %q must start with / followed by a subpath, or be %s", p, WildcardSubmodule)
+	}
+	if strings.HasSuffix(p, "/") {
+		return fmt.Errorf("submodule path %q must not end with /", p)
+	}
+	return nil
+}
+
+// provisionPackage provisions and validates a package that is not loaded by Caddy itself, e.g. one defined in a
+// package file. If it is invalid, it is deregistered again.
+func provisionPackage(ctx caddy.Context, m *GoPackage) error {
+	if err := m.Provision(ctx); err != nil {
+		return err
+	}
+	if err := m.Validate(); err != nil {
+		m.Cleanup()
+		return err
+	}
+	return nil
+}
+
+// completeURL adds a scheme to a source URL without one, which go requires in go-import tags.
+func (m *GoPackage) completeURL(u string) string {
+	if u == "" || strings.Contains(u, "://") || placeholderRegexp.MatchString(u) {
+		return u
+	}
+	if m.Insecure {
+		return "http://" + u
+	}
+	return "https://" + u
+}
+
+// Cleanup implements caddy.CleanerUpper. It deregisters the package when its config is unloaded.
+func (m *GoPackage) Cleanup() error {
+	if m.app != nil {
+		m.app.packages.remove(m)
+	}
+	return nil
+}
+
+// vcs returns the version control system of the submodule, given the one of its parent package.
+func (s Submodule) vcs(parent string) string {
+	if s.Vcs != "" {
+		return s.Vcs
+	}
+	return parent
+}
+
+// submoduleURLs returns the URLs set for the submodules.
+func submoduleURLs(submodules []Submodule) []string {
+	var urls []string
+	for _, submodule := range submodules {
+		if submodule.URL != "" {
+			urls = append(urls, submodule.URL)
+		}
+	}
+	return urls
+}
+
+// parseTemplateFile parses the template file at path. If that fails and LenientTemplates is set, a warning is logged
+// and fallback is returned instead of the error.
+func (m *GoPackage) parseTemplateFile(path string, fallback *template.Template) (*template.Template, error) {
+	tpl, err := template.ParseFiles(path)
+	if err != nil && m.LenientTemplates {
+		m.logger.Warn("falling back after failing to parse template",
+			zap.String("file", path),
+			zap.Error(err))
+		return fallback, nil
+	}
+	return tpl, err
+}
+
+// ResolveTarget determines the target for a request path relative to the mount prefix. The longest matching
+// submodule wins; if none matches, the package itself is the target.
+func (m GoPackage) ResolveTarget(reqPath string) Target {
+	target := Target{Path: m.Path, Vcs: m.Vcs, URL: m.URL}
+
+	// Find the best (longest) matching submodule
+	var bestMatch string
+	var best, wildcard *Submodule
+	if m.submoduleIndex != nil {
+		bestMatch, best = m.submoduleIndex.lookup(m, reqPath)
+		wildcard = m.wildcard
+	} else {
+		bestMatch, best, wildcard = m.scanSubmodules(reqPath)
+	}
+
+	// The wildcard claims the first segment of any subpath no other submodule matched
+	if best == nil && wildcard != nil && len(reqPath) > len(m.Path)+1 && m.samePath(reqPath[:len(m.Path)+1], m.Path+"/") {
+		segment := strings.SplitN(reqPath[len(m.Path)+1:], "/", 2)[0]
+		if segment != "" {
+			bestMatch = m.Path + "/" + segment
+			best = wildcard
+		}
+	}
+
+	// A major version below the matched submodule is part of its import path, e.g. `/client/v2` for `/client`
+	if best != nil && len(reqPath) > len(bestMatch)+1 && reqPath[len(bestMatch)] == '/' {
+		segment := strings.SplitN(reqPath[len(bestMatch)+1:], "/", 2)[0]
+		if m.CaseInsensitive {
+			segment = strings.ToLower(segment)
+		}
+		if majorVersionRegexp.MatchString(segment) {
+			bestMatch = reqPath[:len(bestMatch)+1+len(segment)]
+		}
+	}
+
+	// Use best match if found
+	if best != nil {
+		target.Path = bestMatch
+		target.Reserved = best.Reserved
+		target.BrowserURL = best.BrowserURL
+		target.Dir = best.Dir
+		target.Submodule = best
+		target.Vcs = best.vcs(m.Vcs)
+		if best.URL != "" {
+			target.URL = best.URL
+		}
+	}
+
+	return target
+}
+
+// scanSubmodules finds the longest submodule matching the request path, and the wildcard submodule, by comparing the
+// path with every submodule.
+func (m GoPackage) scanSubmodules(reqPath string) (string, *Submodule, *Submodule) {
+	if m.CaseInsensitive {
+		reqPath = strings.ToLower(reqPath)
+	}
+
+	bestMatch := ""
+	var best, wildcard *Submodule
+	for i, submodule := range m.Submodules {
+		if submodule.Path == WildcardSubmodule {
+			if wildcard == nil {
+				wildcard = &m.Submodules[i]
+			}
+			continue
+		}
+
+		submodulePath := m.Path + submodule.Path
+		matchPath := submodulePath
+		if m.CaseInsensitive {
+			matchPath = strings.ToLower(matchPath)
+		}
+		if (reqPath == matchPath ||
+			reqPath == matchPath+"/" ||
+			strings.HasPrefix(reqPath, matchPath+"/")) &&
+			len(submodulePath) > len(bestMatch) {
+			bestMatch = submodulePath
+			best = &m.Submodules[i]
+		}
+	}
+
+	return bestMatch, best, wildcard
+}
+
+func (m GoPackage) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if m.CORSOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", m.CORSOrigin)
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	}
+
+	// Vanity paths are only read
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		if m.Fallthrough {
+			return next.ServeHTTP(w, r)
+		}
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+
+	if !m.allowedHost(r) {
+		if m.RedirectHosts {
+			canonical := url.URL{Scheme: m.requestScheme(r), Host: m.Hosts[0], Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+			caddyhttp.SetVar(r.Context(), VarResponse, ResponseRedirect)
+			http.Redirect(w, r, canonical.String(), http.StatusMovedPermanently)
+			return nil
+		}
+		if m.Fallthrough {
+			return next.ServeHTTP(w, r)
+		}
+		return caddyhttp.Error(http.StatusMisdirectedRequest, fmt.Errorf("host %s not served", m.clientHost(r)))
+	}
+
+	if m.NoIndex {
+		w.Header().Set("X-Robots-Tag", "noindex")
+	}
+
+	reqPath := r.URL.Path
+	if m.MountPrefix != "" && strings.HasPrefix(reqPath, m.MountPrefix) {
+		reqPath = reqPath[len(m.MountPrefix):]
+	}
+
+	if m.Proxy != nil {
+		if modPath, file, ok := splitProxyPath(reqPath); ok {
+			caddyhttp.SetVar(r.Context(), VarPackage, m.MountPrefix+m.Path)
+			caddyhttp.SetVar(r.Context(), VarResponse, ResponseProxy)
+			return m.serveProxy(w, r, modPath, file)
+		}
+	}
+
+	// Paths with variables are resolved in their generic form, e.g. `/~{user}/lib`
+	reqPath, vars, ok := m.matchPathVars(reqPath)
+	if !ok {
+		return next.ServeHTTP(w, r)
+	}
+	reqPath, vars = m.matchSubmoduleVars(reqPath, vars)
+
+	target := m.ResolveTarget(reqPath)
+	if target.Submodule != nil {
+		m.logger.Debug("resolved submodule",
+			zap.String("path", reqPath),
+			zap.String("submodule", target.Submodule.Path),
+			zap.String("target", target.Path))
+	} else {
+		m.logger.Debug("resolved parent package", zap.String("path", reqPath))
+	}
+	if target.Reserved {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("%s is reserved", target.Path))
+	}
+	if target.Submodule != nil {
+		metrics.submoduleHits.Add(m.MountPrefix+m.Path+target.Submodule.Path, 1)
+	}
+	targetPath := m.MountPrefix + expandPathVars(target.Path, vars)
+	importPath := expandPathVars(m.importPath(target), vars)
+
+	if m.Badge && m.samePath(reqPath, target.Path+"/"+badgeFile) {
+		return m.serveBadge(w, r, importPath)
+	}
+
+	// Dynamic targets are looked up per request, e.g. from variables set by a preceding handler. Placeholders are
+	// replaced before the path variables are expanded, so the request path cannot inject any.
+	targetURL := target.URL
+	if placeholderRegexp.MatchString(targetURL) {
+		targetURL = m.completeURL(replacePlaceholders(r, targetURL))
+		if targetURL == "" {
+			return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("url %s of %s resolved to nothing", target.URL, targetPath))
+		}
+	}
+	targetURL = expandPathVars(targetURL, vars)
+	repoPath := expandPathVars(target.Path, vars)
+	if target.Submodule == nil || target.Submodule.URL == "" {
+		targetURL = m.stripPrefixURL(targetURL, repoPath)
+	}
+	if placeholderRegexp.MatchString(target.Vcs) {
+		if target.Vcs = replacePlaceholders(r, target.Vcs); target.Vcs == "" {
+			target.Vcs = "git"
+		}
+	}
+
+	caddyhttp.SetVar(r.Context(), VarPackage, m.MountPrefix+m.Path)
+	if target.Submodule != nil {
+		caddyhttp.SetVar(r.Context(), VarSubmodule, m.MountPrefix+m.Path+target.Submodule.Path)
+	}
+	caddyhttp.SetVar(r.Context(), VarVcs, target.Vcs)
+
+	if m.DebugHeaders {
+		w.Header().Set("X-Gopkg-Path", importPath)
+		w.Header().Set("X-Gopkg-Vcs", target.Vcs)
+		w.Header().Set("X-Gopkg-URL", targetURL)
+		if target.Path != m.Path {
+			w.Header().Set("X-Gopkg-Submodule", expandPathVars(target.Path[len(m.Path):], vars))
+		}
+	}
+
+	if m.CanonicalLink {
+		w.Header().Set("Link", fmt.Sprintf(`<https://pkg.go.dev/%s%s>; rel="canonical"`, m.requestHost(r), importPath))
+	}
+
+	if wantsJSON(r) {
+		caddyhttp.SetVar(r.Context(), VarResponse, ResponseJSON)
+		m.setCacheControl(w, ResponseJSON)
+		var submodules []Target
+		if target.Submodule == nil {
+			submodules = m.groupImports(vars)[1:]
+		}
+		return m.serveJSON(w, r, Target{Path: importPath, Vcs: target.Vcs, URL: targetURL}, submodules)
+	}
+
+	goGet := m.isGoGet(r)
+	if goGet {
+		metrics.goGet.Add(m.MountPrefix+m.Path, 1)
+
+		fields := []zap.Field{
+			zap.String("import_path", m.requestHost(r)+importPath),
+			zap.String("url", targetURL),
+		}
+		if target.Submodule != nil {
+			fields = append(fields, zap.String("submodule", target.Submodule.Path))
+		}
+		m.logger.Info("resolved go-get request", append(fields, zap.String("user_agent", r.UserAgent()))...)
+	}
+
+	// If go-get is not present, it's most likely a browser request. So let's redirect, unless the go-import page
+	// should always be rendered.
+	if !goGet {
+		if m.QuietBrowserAssets && browserAssets[path.Base(reqPath)] {
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+
+		if m.Canonicalize && r.URL.Path != targetPath && strings.EqualFold(strings.TrimSuffix(r.URL.Path, "/"), targetPath) {
+			canonical := url.URL{Path: targetPath, RawQuery: r.URL.RawQuery}
+			caddyhttp.SetVar(r.Context(), VarResponse, ResponseRedirect)
+			m.setCacheControl(w, ResponseRedirect)
+			http.Redirect(w, r, canonical.String(), http.StatusMovedPermanently)
+			return nil
+		}
+
+		unmatched := target.Path == m.Path && !m.samePath(reqPath, m.Path) && !m.samePath(reqPath, m.Path+"/")
+		if unmatched && (m.Fallthrough || m.Passthrough) {
+			return next.ServeHTTP(w, r)
+		}
+
+		if !m.DisableRedirect && !m.Landing {
+			browserURL := m.BrowserRedirect
+			if target.BrowserURL != "" {
+				browserURL = target.BrowserURL
+			}
+
+			var redirectURL string
+			switch browserURL {
+			case "", BrowserRedirectRepo:
+				redirectURL = targetURL
+			case BrowserRedirectPkgsite:
+				redirectURL = "https://pkg.go.dev/" + m.requestHost(r) + importPath
+			default:
+				redirectURL = expandPathVars(replacePlaceholders(r, browserURL), vars)
+			}
+			metrics.browserRedirects.Add(m.MountPrefix+m.Path, 1)
+			caddyhttp.SetVar(r.Context(), VarResponse, ResponseRedirect)
+			m.setCacheControl(w, ResponseRedirect)
+			http.Redirect(w, r, withQuery(redirectURL, r.URL.Query()), m.RedirectCode)
+			return nil
+		}
+	}
+
+	tpl, status, response := m.Template, m.MetaStatus, ResponseMeta
+	if m.Landing && !goGet {
+		tpl, status, response = landingTemplate, http.StatusOK, ResponseLanding
+	}
+	if target.Submodule != nil && target.Submodule.template != nil {
+		tpl = target.Submodule.template
+	}
+	caddyhttp.SetVar(r.Context(), VarResponse, response)
+	m.setCacheControl(w, response)
+
+	if m.LastModified != nil {
+		if modTime := m.LastModified.CommitTime(targetURL); !modTime.IsZero() {
+			w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+			// If-None-Match takes precedence, and is checked against the ETag of the rendered response
+			if r.Header.Get("If-None-Match") == "" && notModified(r, modTime) {
+				w.WriteHeader(http.StatusNotModified)
+				return nil
+			}
+		}
+	}
+
+	host := m.requestHost(r)
+	m.checkImportPath(r, host+importPath)
+
+	// Responses to the go tool are the same for every request of a target, so they are only rendered once
+	cacheKey := responseKey{host: host, path: targetPath, vcs: target.Vcs, url: targetURL}
+	cacheable := response == ResponseMeta && goGet
+	if cacheable {
+		if body, ok := m.responses.get(cacheKey); ok {
+			return m.writeResponse(w, r, status, body)
+		}
+	}
+
+	data := TemplateData{
+		Host:        host,
+		Path:        importPath,
+		Vcs:         target.Vcs,
+		URL:         targetURL,
+		Dir:         target.Dir,
+		Submodule:   target.Submodule,
+		Insecure:    m.Insecure,
+		GetSuffix:   m.GetSuffix,
+		Description: m.Description,
+		NoIndex:     m.NoIndex,
+		Imports:     []Target{{Path: importPath, Vcs: target.Vcs, URL: targetURL}},
+		request:     r,
+	}
+	if m.Group && target.Path == m.Path {
+		data.Imports = m.groupImports(vars)
+	}
+	if m.Readme != nil && !goGet {
+		if rawURL := m.Readme.rawURL(targetURL, vars); rawURL != "" {
+			data.Readme = m.Readme.HTML(rawURL)
+		}
+	}
+	if m.LatestVersion != nil && !goGet {
+		data.LatestVersion = m.latestVersion(r, importPath)
+	}
+	// Submodules with their own repository don't share the mirrors of the package's repository
+	if target.URL == m.URL {
+		for _, mirror := range m.Mirrors {
+			data.Mirrors = append(data.Mirrors, m.stripPrefixURL(expandPathVars(mirror, vars), repoPath))
+		}
+	}
+	if m.Source != nil {
+		if src, ok := m.Source.resolve(targetURL, target.Dir); ok {
+			src.Home = expandPathVars(src.Home, vars)
+			src.Dir = expandPathVars(src.Dir, vars)
+			src.File = expandPathVars(src.File, vars)
+			data.Source = &src
+		}
+	}
+
+	// Render into a buffer first, so nothing is written if the template fails halfway
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		metrics.templateErrors.Add(m.MountPrefix+m.Path, 1)
+		return m.serveError(w, r, data, err)
+	}
+	if cacheable {
+		m.responses.put(cacheKey, buf.Bytes())
+	}
+
+	return m.writeResponse(w, r, status, buf.Bytes())
+}
+
+// stripPrefixURL appends the resolved path p, without StripPrefix and a major version suffix, to the repo URL u.
+// Without StripPrefix, u is returned as is.
+func (m GoPackage) stripPrefixURL(u, p string) string {
+	if m.StripPrefix == "" {
+		return u
+	}
+	rest := p[len(strings.TrimSuffix(m.StripPrefix, "/")):]
+	// A major version is part of the import path, but not of the repository path
+	if i := strings.LastIndex(rest, "/"); i > 0 && majorVersionRegexp.MatchString(strings.ToLower(rest[i+1:])) {
+		rest = rest[:i]
+	}
+	if rest == "" {
+		return u
+	}
+	return strings.TrimSuffix(u, "/") + rest
+}
+
+// checkImportPathOverride checks that an ImportPath joined with the host yields a valid import path, e.g. that it
+// is not a full import path including a host itself.
+func checkImportPathOverride(importPath string) error {
+	if importPath == "" {
+		return nil
+	}
+	if !strings.HasPrefix(importPath, "/") {
+		return fmt.Errorf("import_path %s must start with /, the host is prepended to it", importPath)
+	}
+	if importPath == "/" || path.Clean(importPath) != importPath || strings.ContainsAny(importPath, " \t\"'<>?#\\") {
+		return fmt.Errorf("import_path %s is not a valid import path", importPath)
+	}
+	return nil
+}
+
+// importPath returns the path advertised in the go-import tag for the target: its ImportPath override if set, or
+// the matched path below the mount prefix otherwise.
+func (m GoPackage) importPath(target Target) string {
+	switch {
+	case target.Submodule != nil && target.Submodule.ImportPath != "":
+		// Keep a major version suffix below the submodule
+		return target.Submodule.ImportPath + target.Path[len(m.Path+target.Submodule.Path):]
+	case m.ImportPath != "":
+		return m.ImportPath + target.Path[len(m.Path):]
+	}
+	return m.MountPrefix + target.Path
+}
+
+// allowedHost reports whether the host of the request is one of Hosts, ignoring the port.
+func (m GoPackage) allowedHost(r *http.Request) bool {
+	if len(m.Hosts) == 0 {
+		return true
+	}
+
+	_, ok := m.matchHost(r, m.Hosts)
+	return ok
+}
+
+// matchHost returns the one of hosts the client requested, ignoring the port.
+func (m GoPackage) matchHost(r *http.Request, hosts []string) (string, bool) {
+	host := m.clientHost(r)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, allowed := range hosts {
+		if strings.EqualFold(host, allowed) {
+			return allowed, true
+		}
+	}
+	return "", false
+}
+
+// requestHost returns the host to advertise for the request: the pinned Host, the X-Forwarded-Host header set by a
+// trusted proxy, or the Host of the request itself.
+func (m GoPackage) requestHost(r *http.Request) string {
+	if m.Host != "" {
+		return m.Host
+	}
+	return m.clientHost(r)
+}
+
+// clientHost returns the host the client requested: the X-Forwarded-Host header set by a trusted proxy, or the Host
+// of the request itself.
+func (m GoPackage) clientHost(r *http.Request) string {
+	if fwdHost := forwardedHeader(r, m.trustedProxies, "X-Forwarded-Host"); fwdHost != "" {
+		return fwdHost
+	}
+	return r.Host
+}
+
+// requestScheme returns the scheme the client requested: https for TLS connections, the X-Forwarded-Proto header set
+// by a trusted proxy, or http.
+func (m GoPackage) requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if proto := forwardedHeader(r, m.trustedProxies, "X-Forwarded-Proto"); proto == "https" || proto == "http" {
+		return proto
+	}
+	return "http"
+}
+
+// forwardedHeader returns the original value of a forwarding header like X-Forwarded-Host, or an empty string if the
+// request does not come from one of trustedProxies.
+func forwardedHeader(r *http.Request, trustedProxies []*net.IPNet, name string) string {
+	value := r.Header.Get(name)
+	if value == "" || len(trustedProxies) == 0 {
+		return ""
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if remoteIP := net.ParseIP(ip); remoteIP != nil {
+		for _, ipNet := range trustedProxies {
+			if ipNet.Contains(remoteIP) {
+				// The header may contain a list if there are several proxies; the first entry is the original value
+				return strings.TrimSpace(strings.Split(value, ",")[0])
+			}
+		}
+	}
+	return ""
+}
+
+// checkImportPath logs a warning if the advertised import path is not a prefix of the import path go requested, which
+// guarantees that go get fails. This usually means the package is mounted on the wrong host or path. The path is
+// taken from the request before any rewrite, and a pinned Host is taken as the requested host, as both usually map
+// an internal route to the public import path.
+func (m GoPackage) checkImportPath(r *http.Request, importPath string) {
+	reqPath := r.URL.Path
+	if orig, ok := r.Context().Value(caddyhttp.OriginalRequestCtxKey).(http.Request); ok {
+		reqPath = orig.URL.Path
+	}
+	requested := m.requestHost(r) + reqPath
+	if requested == importPath || strings.HasPrefix(requested, importPath+"/") {
+		return
+	}
+
+	m.logger.Warn("advertised import path does not match the requested import path",
+		zap.String("requested", requested),
+		zap.String("advertised", importPath))
+}
+
+// ImportMetadata is the machine-readable form of a go-import response.
+type ImportMetadata struct {
+	Host string `json:"host"`
+	Path string `json:"path"`
+	Vcs  string `json:"vcs"`
+	URL  string `json:"url"`
+
+	// Submodules are the submodules of the package, if the package itself was requested. Submodules with path
+	// variables cannot be enumerated and are left out.
+	Submodules []ImportMetadata `json:"submodules,omitempty"`
+}
+
+// isGoGet reports whether the request comes from the go tool, i.e. has a go-get=1 parameter. Most requests have no
+// query at all, so the query is only parsed if it can contain the parameter.
+func (m GoPackage) isGoGet(r *http.Request) bool {
+	if m.FormGoGet {
+		return r.FormValue("go-get") == "1"
+	}
+	if !strings.Contains(r.URL.RawQuery, "go-get") {
+		return false
+	}
+	return r.URL.Query().Get("go-get") == "1"
+}
+
+// wantsJSON reports whether the request asks for JSON rather than HTML, like tooling and monitoring scripts do, with
+// its Accept header or the query `format=json`. Like in isGoGet, the query is only parsed if it can contain the
+// parameter.
+func wantsJSON(r *http.Request) bool {
+	if strings.Contains(r.URL.RawQuery, "format") && r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// serveJSON responds with the metadata of the resolved target as JSON. The submodules are listed if the target is
+// the package itself.
+func (m GoPackage) serveJSON(w http.ResponseWriter, r *http.Request, target Target, submodules []Target) error {
+	host := m.requestHost(r)
+	metadata := ImportMetadata{
+		Host: host,
+		Path: target.Path,
+		Vcs:  target.Vcs,
+		URL:  target.URL,
+	}
+	for _, submodule := range submodules {
+		metadata.Submodules = append(metadata.Submodules, ImportMetadata{
+			Host: host,
+			Path: submodule.Path,
+			Vcs:  submodule.Vcs,
+			URL:  submodule.URL,
+		})
+	}
+
+	body, err := json.Marshal(metadata)
+	if err != nil {
 		return caddyhttp.Error(http.StatusInternalServerError, err)
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	return writeBody(w, r, body)
+}
+
+// envRegexp matches an environment variable like `{$GITLAB_BASE}`, in the notation of the Caddyfile.
+var envRegexp = regexp.MustCompile(`\{\$([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the environment variables like `{$GITLAB_BASE}` in s with their values. It fails if a variable
+// is not set, as the URL would silently point elsewhere otherwise.
+func expandEnv(s string) (string, error) {
+	var err error
+	expanded := envRegexp.ReplaceAllStringFunc(s, func(v string) string {
+		name := envRegexp.FindStringSubmatch(v)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s in %s is not set", name, s)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// placeholderRegexp matches a Caddy placeholder like `{http.vars.gopkg_url}`.
+var placeholderRegexp = regexp.MustCompile(`\{[A-Za-z_][A-Za-z0-9_-]*\.[^{}]+\}`)
+
+// replacePlaceholders replaces the Caddy placeholders in s using the replacer of the request, or the global
+// placeholders like `{env.GIT_HOST}` outside of a request. Unknown placeholders are replaced with the empty string,
+// while path variables like `{user}` are kept.
+func replacePlaceholders(r *http.Request, s string) string {
+	var repl *caddy.Replacer
+	if r != nil {
+		repl, _ = r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	}
+	if repl == nil {
+		repl = caddy.NewReplacer()
+	}
+	return placeholderRegexp.ReplaceAllString(repl.ReplaceKnown(s, ""), "")
+}
+
+// withQuery adds the query parameters of a browser request, except go-get, to a redirect target. Parameters already
+// present in the target are kept.
+func withQuery(target string, query url.Values) string {
+	query.Del("go-get")
+	if len(query) == 0 {
+		return target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+
+	merged := u.Query()
+	for key, values := range query {
+		if _, ok := merged[key]; !ok {
+			merged[key] = values
+		}
+	}
+	u.RawQuery = merged.Encode()
+
+	return u.String()
+}
+
+// samePath reports whether the paths are equal, ignoring case if CaseInsensitive is set.
+func (m GoPackage) samePath(a, b string) bool {
+	if m.CaseInsensitive {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+// latestVersion returns the latest version of the module at importPath below Host or the one of Hosts requested, or
+// an empty string if it is unknown. Unlike requestHost, a host only the client chose is never looked up.
+func (m GoPackage) latestVersion(r *http.Request, importPath string) string {
+	host, ok := m.Host, m.Host != ""
+	if !ok {
+		host, ok = m.matchHost(r, m.Hosts)
+	}
+	if !ok {
+		return ""
+	}
+	return m.LatestVersion.Version(host + importPath)
+}
+
+// serveProxy serves a module proxy request for the package or one of its submodules.
+func (m GoPackage) serveProxy(w http.ResponseWriter, r *http.Request, modPath, file string) error {
+	modPath, err := unescapeModulePath(modPath)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+
+	// Only modules we advertise are served, not arbitrary subpaths
+	genericPath, vars, ok := m.matchPathVars(modPath)
+	if !ok {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("no module at %s", modPath))
+	}
+	genericPath, _ = m.matchSubmoduleVars(genericPath, vars)
+	if target := m.ResolveTarget(genericPath); target.Reserved || !m.samePath(target.Path, genericPath) {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("no module at %s", modPath))
+	}
+
+	// The go command fetches whatever module it is given, so the host must be configured rather than requested
+	hosts := m.Hosts
+	if m.Host != "" {
+		hosts = append([]string{m.Host}, hosts...)
+	}
+	host, ok := m.matchHost(r, hosts)
+	if !ok {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("no modules of host %s", m.clientHost(r)))
+	}
+
+	return m.Proxy.serve(w, r, host+m.MountPrefix+modPath, file)
+}
+
+// groupImports returns the package and all of its submodules as imports, with the path variables expanded.
+func (m GoPackage) groupImports(vars map[string]string) []Target {
+	imports := []Target{{
+		Path: expandPathVars(m.importPath(Target{Path: m.Path}), vars),
+		Vcs:  m.Vcs,
+		URL:  m.stripPrefixURL(expandPathVars(m.URL, vars), expandPathVars(m.Path, vars)),
+	}}
+	for i, submodule := range m.Submodules {
+		// Submodules with path variables cannot be enumerated
+		if submodule.Path == WildcardSubmodule || submodule.Reserved || submodule.pathPattern != nil {
+			continue
+		}
+		target := Target{Path: m.Path + submodule.Path, Vcs: submodule.vcs(m.Vcs), URL: submodule.URL, Submodule: &m.Submodules[i]}
+		target.URL = expandPathVars(target.URL, vars)
+		if target.URL == "" {
+			target.URL = m.stripPrefixURL(expandPathVars(m.URL, vars), expandPathVars(target.Path, vars))
+		}
+		target.Path = expandPathVars(m.importPath(target), vars)
+		imports = append(imports, target)
+	}
+	return imports
+}
+
+// setCacheControl sets the configured Cache-Control header for the kind of response, one of the Response constants.
+func (m GoPackage) setCacheControl(w http.ResponseWriter, response string) {
+	if m.CacheControl == nil {
+		return
+	}
+	value := m.CacheControl.Meta
+	if response == ResponseRedirect {
+		value = m.CacheControl.Redirect
+	}
+	if value != "" {
+		w.Header().Set("Cache-Control", value)
+	}
+}
+
+// writeResponse writes a rendered response with the status, compressing it if enabled and accepted by the client.
+func (m GoPackage) writeResponse(w http.ResponseWriter, r *http.Request, status int, body []byte) error {
 	w.Header().Set("Content-Type", "text/html")
-	return nil
+	etag := responseETag(body)
+
+	if m.Compress {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			if _, err := gz.Write(body); err != nil {
+				return err
+			}
+			if err := gz.Close(); err != nil {
+				return err
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			body = buf.Bytes()
+			// The compressed representation needs a tag of its own
+			etag = etag[:len(etag)-1] + `-gzip"`
+		}
+	}
+
+	// CI systems fetch the same responses over and over, so clients having the response already get a 304
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	// The body is complete, so it is sent with its length instead of chunked. The status is written explicitly, so
+	// wrapping writers like the access log see it before the body.
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	return writeBody(w, r, body)
+}
+
+// writeBody writes the body of a response whose headers are written already. HEAD requests, which monitoring tools
+// send a lot, get the headers including Content-Length only.
+func writeBody(w http.ResponseWriter, r *http.Request, body []byte) error {
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of the request allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// serveError responds to a failed rendering with the error template, or returns the error for Caddy to handle if
+// there is none or it fails as well.
+func (m GoPackage) serveError(w http.ResponseWriter, r *http.Request, data TemplateData, err error) error {
+	if m.errorTemplate == nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	data.Error = err
+	var buf bytes.Buffer
+	if tplErr := m.errorTemplate.Execute(&buf, data); tplErr != nil {
+		m.logger.Error("rendering error template", zap.Error(tplErr))
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusInternalServerError)
+	return writeBody(w, r, buf.Bytes())
 }
 
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*GoPackage)(nil)
+	_ caddy.Validator             = (*GoPackage)(nil)
+	_ caddy.CleanerUpper          = (*GoPackage)(nil)
 	_ caddyhttp.MiddlewareHandler = (*GoPackage)(nil)
 	_ caddyfile.Unmarshaler       = (*GoPackage)(nil)
 )
@@ -0,0 +1,12 @@
+// +build gofuzz
+
+package gopkg
+
+// FuzzParseDirective checks that the Caddyfile parser returns errors rather than panicking on arbitrary input. The
+// seed corpus is in testdata/fuzz/corpus.
+func FuzzParseDirective(data []byte) int {
+	if _, err := ParseDirective(string(data)); err != nil {
+		return 0
+	}
+	return 1
+}
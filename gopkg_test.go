@@ -1,3 +1,1941 @@
 package gopkg
 
-// TODO
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// testContext is a provisioning context backed by a loaded config, which caddy.Context{} lacks (e.g. for loggers).
+var testContext caddy.Context
+
+// contextApp is an app that captures the context it is provisioned with into testContext.
+type contextApp struct{}
+
+func (contextApp) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "gopkg_test_context",
+		New: func() caddy.Module { return new(contextApp) },
+	}
+}
+
+func (contextApp) Provision(ctx caddy.Context) error {
+	testContext = ctx
+	return nil
+}
+
+func (contextApp) Start() error { return nil }
+func (contextApp) Stop() error  { return nil }
+
+func TestMain(m *testing.M) {
+	caddy.RegisterModule(contextApp{})
+
+	cfg := `{"admin": {"disabled": true, "config": {"persist": false}}, "apps": {"gopkg_test_context": {}}}`
+	if err := caddy.Load([]byte(cfg), true); err != nil {
+		fmt.Fprintf(os.Stderr, "loading test config: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Packages added at runtime are persisted, which must not write to the storage of the user
+	app, err := loadApp(testContext)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "loading gopkg app: %v\n", err)
+		os.Exit(1)
+	}
+	app.storage = newMemoryStorage()
+
+	code := m.Run()
+	caddy.Stop()
+	os.Exit(code)
+}
+
+// parseDirective parses a single gopkg directive into a GoPackage.
+func parseDirective(t *testing.T, input string) *GoPackage {
+	t.Helper()
+
+	m, err := ParseDirective(input)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", input, err)
+	}
+	return m
+}
+
+// provision provisions a GoPackage for use in tests.
+func provision(t *testing.T, m *GoPackage) *GoPackage {
+	t.Helper()
+
+	if err := m.Provision(testContext); err != nil {
+		t.Fatalf("provisioning: %v", err)
+	}
+	return m
+}
+
+// serve sends a request for target through the handler and returns the recorded response.
+func serve(t *testing.T, m *GoPackage, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, target, nil)
+	if err := m.ServeHTTP(w, r, next); err != nil {
+		t.Fatalf("serving %s %s: %v", method, target, err)
+	}
+	return w
+}
+
+func ExampleNew() {
+	m := New("/foo", "", "https://github.com/example/foo").
+		WithSubmodule("/bar", "https://github.com/example/bar").
+		WithSubmodule("/baz", "")
+
+	out, err := m.MarshalCaddyfile()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Print(string(out))
+	// Output:
+	// gopkg /foo https://github.com/example/foo {
+	// 	submodule /bar https://github.com/example/bar
+	// 	submodule /baz
+	// }
+}
+
+func TestMarshalCaddyfileRoundTrip(t *testing.T) {
+	tests := []string{
+		"gopkg /foo https://github.com/example/foo",
+		"gopkg /foo hg https://hg.example.com/foo",
+		`gopkg /foo git https://github.com/example/foo {
+			submodule /bar https://github.com/example/bar
+			submodule /hg hg https://hg.example.com/foo
+			submodule /baz
+			submodule /qux/v2 "https://example.com/with space"
+			submodule * https://github.com/example/monorepo
+			submodule /wip -
+			mirror https://gitlab.com/example/foo
+			mirror https://git.example.com/foo
+			submodule /server https://github.com/example/server {
+				browser_url "https://github.com/example/server#readme"
+				dir server
+				import_path /server
+				template /etc/caddy/server.html
+			}
+			mount_prefix /go
+			discover_submodules https://api.example.com
+			last_modified https://api.example.com 5m0s
+			template /etc/caddy/gopkg.html
+			error_template /etc/caddy/error.html
+			lenient_templates
+			compress
+			cors https://play.example.com
+			fallthrough
+			passthrough
+			group
+			case_insensitive
+			proxy /var/cache/gopkg {
+				upstream https://proxy.example.com
+			}
+			badge https://proxy.example.com 30m0s
+			insecure
+			redirect off
+			browser_redirect https://pkg.go.dev/example.com/foo
+			canonicalize
+			debug_headers
+			quiet_browser_assets
+			noindex
+			match go-get
+			form_go_get
+			canonical_link
+			get_suffix @latest
+			import_path /foo
+			strip_prefix /
+			validate_url strict 3s
+			host go.example.com
+			trusted_proxies 10.0.0.0/8 192.0.2.1
+			hosts example.com example.dev
+			redirect_hosts
+			redirect_code 308
+			meta_status 203
+			cache_control meta "public, max-age=3600"
+			cache_control redirect no-store
+			source auto
+		}`,
+		`gopkg /foo https://github.com/example/foo {
+			cors
+		}`,
+		`gopkg /foo https://github.com/example/foo {
+			redirect landing
+			description "A vanity package"
+			readme https://example.com/foo/README.md 30m0s
+		}`,
+		`gopkg /foo https://github.com/example/foo {
+			source https://example.com/foo "https://example.com/foo/tree{/dir}" "https://example.com/foo/blob{/dir}/{file}#L{line}"
+		}`,
+		`gopkg /foo https://github.com/example/foo {
+			last_modified
+		}`,
+		`gopkg /foo https://github.com/example/foo {
+			discover_submodules
+		}`,
+		`gopkg /foo https://github.com/example/foo {
+			verify_repo strict
+		}`,
+		`gopkg /foo https://github.com/example/foo {
+			readme
+		}`,
+		`gopkg /foo https://github.com/example/foo {
+			badge
+		}`,
+		`gopkg /foo https://github.com/example/foo {
+			latest_version https://proxy.example.com
+		}`,
+	}
+
+	for _, input := range tests {
+		want := parseDirective(t, input)
+
+		out, err := want.MarshalCaddyfile()
+		if err != nil {
+			t.Fatalf("marshaling %+v: %v", want, err)
+		}
+
+		got := parseDirective(t, string(out))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("round trip of %q via %q: got %+v, want %+v", input, out, got, want)
+		}
+	}
+}
+
+func TestServeHTTPMountPrefix(t *testing.T) {
+	m := provision(t, &GoPackage{
+		Path:        "/foo",
+		URL:         "https://github.com/example/foo",
+		Submodules:  []Submodule{{Path: "/bar", URL: "https://github.com/example/bar"}},
+		MountPrefix: "/go",
+	})
+
+	tests := []struct {
+		target   string
+		wantMeta string
+	}{
+		{"http://example.com/go/foo?go-get=1", `content="example.com/go/foo git https://github.com/example/foo"`},
+		{"http://example.com/go/foo/baz?go-get=1", `content="example.com/go/foo git https://github.com/example/foo"`},
+		{"http://example.com/go/foo/bar/baz?go-get=1", `content="example.com/go/foo/bar git https://github.com/example/bar"`},
+	}
+
+	for _, test := range tests {
+		w := serve(t, m, http.MethodGet, test.target)
+		if body := w.Body.String(); !strings.Contains(body, test.wantMeta) {
+			t.Errorf("%s: expected body to contain %s, got %s", test.target, test.wantMeta, body)
+		}
+	}
+
+	w := serve(t, m, http.MethodGet, "http://example.com/go/foo/bar")
+	if loc := w.Header().Get("Location"); loc != "https://github.com/example/bar" {
+		t.Errorf("expected redirect to submodule URL, got %q", loc)
+	}
+}
+
+// brokenTemplate writes the host and then fails.
+var brokenTemplate = template.Must(template.New("broken").Parse(`{{.Host}}{{template "missing"}}`))
+
+func TestServeHTTPTemplateError(t *testing.T) {
+	m := provision(t, New("/foo", "", "https://github.com/example/foo").WithTemplate(brokenTemplate))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/foo?go-get=1", nil)
+	err := m.ServeHTTP(w, r, nil)
+
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected handler error with status 500, got %v", err)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("expected empty body, got %q", w.Body.String())
+	}
+}
+
+func TestServeHTTPErrorTemplate(t *testing.T) {
+	f, err := ioutil.TempFile("", "gopkg-error-*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`<p>{{.Host}}{{.Path}} is unavailable</p>`)
+	f.Close()
+
+	m := New("/foo", "", "https://github.com/example/foo").WithTemplate(brokenTemplate)
+	m.ErrorTemplate = f.Name()
+	provision(t, m)
+
+	w := serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", w.Code)
+	}
+	if got, want := w.Body.String(), "<p>example.com/foo is unavailable</p>"; got != want {
+		t.Errorf("expected body %q, got %q", want, got)
+	}
+}
+
+func TestServeHTTPTemplateFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "gopkg-template-*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`<meta name="go-import" content="{{.Host}}{{.Path}} {{.Vcs}} {{.URL}}"><p>Docs: https://docs.example.com</p>`)
+	f.Close()
+
+	m := parseDirective(t, "gopkg /foo https://github.com/example/foo {\n\ttemplate "+f.Name()+"\n}")
+	provision(t, m)
+
+	want := `<meta name="go-import" content="example.com/foo git https://github.com/example/foo"><p>Docs: https://docs.example.com</p>`
+	if body := serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1").Body.String(); body != want {
+		t.Errorf("expected body %q, got %q", want, body)
+	}
+
+	broken := New("/foo", "", "https://github.com/example/foo")
+	broken.TemplateFile = f.Name() + ".missing"
+	if err := broken.Provision(testContext); err == nil {
+		t.Error("expected provisioning to fail on a missing template file")
+	}
+
+	broken.LenientTemplates = true
+	provision(t, broken)
+	if broken.Template != defaultTemplate {
+		t.Error("expected lenient provisioning to fall back to the default template")
+	}
+}
+
+func TestServeHTTPSubmoduleTemplate(t *testing.T) {
+	f, err := ioutil.TempFile("", "gopkg-template-*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`<meta name="go-import" content="{{.Host}}{{.Path}} {{.Vcs}} {{.URL}}"><p>Tools</p>`)
+	f.Close()
+
+	m := parseDirective(t, `gopkg /foo https://github.com/example/foo {
+		submodule /tools https://github.com/example/tools {
+			template `+f.Name()+`
+		}
+		submodule /bar https://github.com/example/bar
+		redirect landing
+	}`)
+	provision(t, m)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/foo/tools?go-get=1", "<p>Tools</p>"},
+		{"http://example.com/foo/tools/cmd", "<p>Tools</p>"},
+		{"http://example.com/foo/bar?go-get=1", "go get example.com/foo/bar"},
+		{"http://example.com/foo/bar", "<h1>example.com/foo/bar</h1>"},
+	}
+	for _, test := range tests {
+		if body := serve(t, m, http.MethodGet, test.target).Body.String(); !strings.Contains(body, test.want) {
+			t.Errorf("%s: expected body to contain %q, got %q", test.target, test.want, body)
+		}
+	}
+
+	broken := New("/foo", "", "https://github.com/example/foo")
+	broken.Submodules = []Submodule{{Path: "/tools", TemplateFile: f.Name() + ".missing"}}
+	if err := broken.Provision(testContext); err == nil {
+		t.Error("expected provisioning to fail on a missing submodule template file")
+	}
+}
+
+func TestProvisionTemplateParseFailure(t *testing.T) {
+	f, err := ioutil.TempFile("", "gopkg-error-*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`<p>{{.Host</p>`)
+	f.Close()
+
+	strict := New("/foo", "", "https://github.com/example/foo")
+	strict.ErrorTemplate = f.Name()
+	if err := strict.Provision(testContext); err == nil {
+		t.Error("expected strict provisioning to fail on a broken template")
+	}
+
+	lenient := New("/foo", "", "https://github.com/example/foo").WithTemplate(brokenTemplate)
+	lenient.ErrorTemplate = f.Name()
+	lenient.LenientTemplates = true
+	if err := lenient.Provision(testContext); err != nil {
+		t.Fatalf("expected lenient provisioning to succeed, got %v", err)
+	}
+
+	// Without the error template, the error is left to Caddy's error handling
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/foo?go-get=1", nil)
+	if err := lenient.ServeHTTP(w, r, nil); err == nil {
+		t.Error("expected the rendering error to be returned")
+	}
+}
+
+func TestServeHTTPCompress(t *testing.T) {
+	m := New("/foo", "", "https://github.com/example/foo")
+	m.Compress = true
+	provision(t, m)
+
+	const wantMeta = `<meta name="go-import" content="example.com/foo git https://github.com/example/foo">`
+
+	w := serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1")
+	if enc := w.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("expected no Content-Encoding without Accept-Encoding, got %q", enc)
+	}
+	if body := w.Body.String(); !strings.Contains(body, wantMeta) {
+		t.Errorf("expected uncompressed body to contain %s, got %s", wantMeta, body)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/foo?go-get=1", nil)
+	r.Header.Set("Accept-Encoding", "deflate, gzip;q=0.8")
+	if err := m.ServeHTTP(w, r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("expected gzip Content-Encoding, got %q", enc)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/html" {
+		t.Errorf("expected Content-Type text/html, got %q", ct)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("expected Content-Length of the compressed body %d, got %q", w.Body.Len(), cl)
+	}
+
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), wantMeta) {
+		t.Errorf("expected decompressed body to contain %s, got %s", wantMeta, body)
+	}
+}
+
+func TestServeHTTPContentLength(t *testing.T) {
+	m := provision(t, New("/foo", "", "https://github.com/example/foo"))
+
+	for _, accept := range []string{"", "application/json"} {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/foo?go-get=1", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		if err := m.ServeHTTP(w, r, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if cl := w.Header().Get("Content-Length"); cl == "" || cl != strconv.Itoa(w.Body.Len()) {
+			t.Errorf("Accept %q: expected Content-Length %d, got %q", accept, w.Body.Len(), cl)
+		}
+	}
+}
+
+func TestServeHTTPMetaStatus(t *testing.T) {
+	m := parseDirective(t, `gopkg /foo https://github.com/example/foo {
+		meta_status 203
+		source auto
+	}`)
+	provision(t, m)
+
+	if w := serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1"); w.Code != http.StatusNonAuthoritativeInfo {
+		t.Errorf("expected status 203, got %d", w.Code)
+	}
+
+	m = parseDirective(t, `gopkg /foo https://github.com/example/foo {
+		meta_status 404
+	}`)
+	if err := m.Provision(testContext); err == nil {
+		t.Error("expected error for non-2xx meta_status")
+	}
+}
+
+func TestServeHTTPRedirectCode(t *testing.T) {
+	m := provision(t, New("/foo", "", "https://github.com/example/foo"))
+	if w := serve(t, m, http.MethodGet, "http://example.com/foo"); w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected status 307 by default, got %d", w.Code)
+	}
+
+	for _, code := range []int{http.StatusMovedPermanently, http.StatusFound, http.StatusPermanentRedirect} {
+		m := parseDirective(t, fmt.Sprintf("gopkg /foo https://github.com/example/foo {\n\tredirect_code %d\n}", code))
+		provision(t, m)
+		w := serve(t, m, http.MethodGet, "http://example.com/foo")
+		if w.Code != code || w.Header().Get("Location") != "https://github.com/example/foo" {
+			t.Errorf("expected redirect with status %d, got %d to %q", code, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	for _, code := range []int{200, 303, 404} {
+		m := New("/foo", "", "https://github.com/example/foo")
+		m.RedirectCode = code
+		if err := m.Provision(testContext); err == nil {
+			t.Errorf("expected error for redirect_code %d", code)
+		}
+	}
+}
+
+func TestServeHTTPCacheControl(t *testing.T) {
+	m := provision(t, New("/foo", "", "https://github.com/example/foo"))
+	if cc := serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1").Header().Get("Cache-Control"); cc != "" {
+		t.Errorf("expected no Cache-Control by default, got %q", cc)
+	}
+
+	m = parseDirective(t, `gopkg /foo https://github.com/example/foo {
+		cache_control meta "public, max-age=3600"
+		cache_control redirect no-store
+	}`)
+	provision(t, m)
+	for target, want := range map[string]string{
+		"http://example.com/foo?go-get=1":     "public, max-age=3600",
+		"http://example.com/foo?format=json":  "public, max-age=3600",
+		"http://example.com/foo":              "no-store",
+		"http://example.com/foo/sub?go-get=1": "public, max-age=3600",
+	} {
+		if cc := serve(t, m, http.MethodGet, target).Header().Get("Cache-Control"); cc != want {
+			t.Errorf("%s: expected Cache-Control %q, got %q", target, want, cc)
+		}
+	}
+
+	// A single value applies to both
+	m = parseDirective(t, `gopkg /foo https://github.com/example/foo {
+		cache_control max-age=60
+	}`)
+	if m.CacheControl == nil || m.CacheControl.Meta != "max-age=60" || m.CacheControl.Redirect != "max-age=60" {
+		t.Errorf("expected max-age=60 for both, got %+v", m.CacheControl)
+	}
+}
+
+func TestServeHTTPCanonicalize(t *testing.T) {
+	m := parseDirective(t, `gopkg /mypkg https://github.com/example/mypkg {
+		submodule /sub https://github.com/example/sub
+		canonicalize
+		case_insensitive
+	}`)
+	provision(t, m)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/MyPkg/", "/mypkg"},
+		{"http://example.com/mypkg/?tab=doc", "/mypkg?tab=doc"},
+		{"http://example.com/mypkg/SUB", "/mypkg/sub"},
+	}
+	for _, test := range tests {
+		w := serve(t, m, http.MethodGet, test.target)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != test.want {
+			t.Errorf("%s: expected 301 to %s, got %d to %q", test.target, test.want, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	// Canonical paths are redirected to the repo as usual
+	if w := serve(t, m, http.MethodGet, "http://example.com/mypkg"); w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected repo redirect for canonical path, got %d", w.Code)
+	}
+
+	// The go tool is not sent on a redirect chain
+	if w := serve(t, m, http.MethodGet, "http://example.com/mypkg/?go-get=1"); w.Code != http.StatusOK {
+		t.Errorf("expected go-import page for go-get=1, got %d", w.Code)
+	}
+}
+
+func TestServeHTTPBrowserRedirect(t *testing.T) {
+	m := parseDirective(t, `gopkg /pkg https://github.com/example/pkg {
+		submodule /server {
+			browser_url "https://github.com/example/pkg/tree/master/server#readme"
+		}
+		submodule /client https://github.com/example/client
+	}`)
+	provision(t, m)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/pkg/server", "https://github.com/example/pkg/tree/master/server#readme"},
+		{"http://example.com/pkg/client", "https://github.com/example/client"},
+		{"http://example.com/pkg", "https://github.com/example/pkg"},
+	}
+	for _, test := range tests {
+		if loc := serve(t, m, http.MethodGet, test.target).Header().Get("Location"); loc != test.want {
+			t.Errorf("%s: expected redirect to %s, got %q", test.target, test.want, loc)
+		}
+	}
+
+	// The package-level setting applies to submodules without their own
+	m.BrowserRedirect = "https://pkg.go.dev/example.com/pkg"
+	tests[1].want = m.BrowserRedirect
+	tests[2].want = m.BrowserRedirect
+	for _, test := range tests {
+		if loc := serve(t, m, http.MethodGet, test.target).Header().Get("Location"); loc != test.want {
+			t.Errorf("%s: expected redirect to %s, got %q", test.target, test.want, loc)
+		}
+	}
+}
+
+func TestServeHTTPBrowserRedirectKeywords(t *testing.T) {
+	m := parseDirective(t, `gopkg /pkg https://github.com/example/pkg {
+		browser_redirect pkgsite
+		submodule /client https://github.com/example/client {
+			browser_url repo
+		}
+		submodule /server
+	}`)
+	provision(t, m)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/pkg", "https://pkg.go.dev/example.com/pkg"},
+		{"http://example.com/pkg/internal/x", "https://pkg.go.dev/example.com/pkg"},
+		{"http://example.com/pkg/server/x", "https://pkg.go.dev/example.com/pkg/server"},
+		{"http://example.com/pkg/client?tab=doc", "https://github.com/example/client?tab=doc"},
+	}
+	for _, test := range tests {
+		if loc := serve(t, m, http.MethodGet, test.target).Header().Get("Location"); loc != test.want {
+			t.Errorf("%s: expected redirect to %s, got %q", test.target, test.want, loc)
+		}
+	}
+}
+
+func TestServeHTTPDebugHeaders(t *testing.T) {
+	m := provision(t, New("/foo", "", "https://github.com/example/foo").WithSubmodule("/bar", "https://github.com/example/bar"))
+
+	for _, target := range []string{"http://example.com/foo/bar/x", "http://example.com/foo/bar/x?go-get=1"} {
+		if header := serve(t, m, http.MethodGet, target).Header().Get("X-Gopkg-URL"); header != "" {
+			t.Errorf("%s: expected no debug headers by default, got X-Gopkg-URL %q", target, header)
+		}
+	}
+
+	m.DebugHeaders = true
+	want := http.Header{
+		"X-Gopkg-Path":      {"/foo/bar"},
+		"X-Gopkg-Vcs":       {"git"},
+		"X-Gopkg-Url":       {"https://github.com/example/bar"},
+		"X-Gopkg-Submodule": {"/bar"},
+	}
+	for _, target := range []string{"http://example.com/foo/bar/x", "http://example.com/foo/bar/x?go-get=1"} {
+		header := serve(t, m, http.MethodGet, target).Header()
+		for name, values := range want {
+			if !reflect.DeepEqual(header[name], values) {
+				t.Errorf("%s: expected %s %v, got %v", target, name, values, header[name])
+			}
+		}
+	}
+
+	if header := serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1").Header(); header.Get("X-Gopkg-Submodule") != "" {
+		t.Errorf("expected no X-Gopkg-Submodule for the package itself, got %q", header.Get("X-Gopkg-Submodule"))
+	}
+}
+
+func TestServeHTTPBrowserRedirectPlaceholders(t *testing.T) {
+	m := New("/foo", "", "https://github.com/example/foo")
+	m.BrowserRedirect = "https://docs.{http.request.host}/foo"
+	provision(t, m)
+
+	for _, host := range []string{"example.com", "example.dev"} {
+		r := httptest.NewRequest(http.MethodGet, "http://"+host+"/foo", nil)
+		caddyhttp.NewTestReplacer(r)
+		w := httptest.NewRecorder()
+		if err := m.ServeHTTP(w, r, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if loc, want := w.Header().Get("Location"), "https://docs."+host+"/foo"; loc != want {
+			t.Errorf("Host %s: expected redirect to %s, got %q", host, want, loc)
+		}
+	}
+}
+
+func TestServeHTTPMethodNotAllowed(t *testing.T) {
+	m := provision(t, New("/foo", "", "https://github.com/example/foo"))
+
+	for _, method := range []string{http.MethodPost, http.MethodPut} {
+		w := httptest.NewRecorder()
+		err := m.ServeHTTP(w, httptest.NewRequest(method, "http://example.com/foo?go-get=1", nil), nil)
+
+		var handlerErr caddyhttp.HandlerError
+		if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("%s: expected handler error with status 405, got %v", method, err)
+		}
+		if allow := w.Header().Get("Allow"); allow != "GET, HEAD" {
+			t.Errorf("%s: expected Allow header GET, HEAD, got %q", method, allow)
+		}
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		if w := serve(t, m, method, "http://example.com/foo?go-get=1"); w.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", method, w.Code)
+		}
+	}
+
+	m.Fallthrough = true
+	if w := serve(t, m, http.MethodPost, "http://example.com/foo"); w.Code != http.StatusTeapot {
+		t.Errorf("expected POST to pass to the next handler with fallthrough, got %d", w.Code)
+	}
+}
+
+func TestIsGoGet(t *testing.T) {
+	form := func() *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "http://example.com/foo", strings.NewReader("go-get=1"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	var m GoPackage
+	for target, want := range map[string]bool{
+		"http://example.com/foo?go-get=1":     true,
+		"http://example.com/foo?x=1&go-get=1": true,
+		"http://example.com/foo?go-get=0":     false,
+		"http://example.com/foo?go-getter=1":  false,
+		"http://example.com/foo":              false,
+		"http://example.com/foo?format=json":  false,
+	} {
+		if got := m.isGoGet(httptest.NewRequest(http.MethodGet, target, nil)); got != want {
+			t.Errorf("%s: expected %t, got %t", target, want, got)
+		}
+	}
+	if r := form(); m.isGoGet(r) || r.PostForm != nil {
+		t.Error("expected the form body not to be parsed")
+	}
+
+	m.FormGoGet = true
+	if !m.isGoGet(form()) {
+		t.Error("expected go-get in the form body to be detected with form_go_get")
+	}
+
+	m.FormGoGet = false
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+	r.Header.Set("Accept", "text/html")
+	if allocs := testing.AllocsPerRun(100, func() { wantsJSON(r); m.isGoGet(r) }); allocs != 0 {
+		t.Errorf("expected no allocations without a query, got %v", allocs)
+	}
+}
+
+func TestServeHTTPHead(t *testing.T) {
+	m := parseDirective(t, `gopkg /foo https://github.com/example/foo {
+		cache_control meta max-age=60
+	}`)
+	provision(t, m)
+
+	for _, target := range []string{
+		"http://example.com/foo?go-get=1",
+		"http://example.com/foo?format=json",
+	} {
+		get := serve(t, m, http.MethodGet, target)
+		head := serve(t, m, http.MethodHead, target)
+		if head.Code != get.Code || head.Body.Len() != 0 {
+			t.Errorf("%s: expected status %d without body, got %d with %d bytes", target, get.Code, head.Code, head.Body.Len())
+		}
+		for _, header := range []string{"Content-Type", "Content-Length", "Cache-Control"} {
+			if head.Header().Get(header) != get.Header().Get(header) {
+				t.Errorf("%s: expected %s %q, got %q", target, header, get.Header().Get(header), head.Header().Get(header))
+			}
+		}
+	}
+}
+
+func TestServeHTTPGetSuffix(t *testing.T) {
+	m := New("/foo", "", "https://github.com/example/foo")
+	m.GetSuffix = "@v1.2.3"
+	provision(t, m)
+
+	body := serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1").Body.String()
+	if want := `<meta name="go-import" content="example.com/foo git https://github.com/example/foo">`; !strings.Contains(body, want) {
+		t.Errorf("expected unaffected meta tag %s, got %s", want, body)
+	}
+	if want := "go get example.com/foo@v1.2.3\n"; !strings.Contains(body, want) {
+		t.Errorf("expected body to contain %q, got %s", want, body)
+	}
+}
+
+func TestServeHTTPCanonicalLink(t *testing.T) {
+	m := provision(t, New("/foo", "", "https://github.com/example/foo").WithSubmodule("/bar", "https://github.com/example/bar"))
+
+	if link := serve(t, m, http.MethodGet, "http://example.com/foo/bar?go-get=1").Header().Get("Link"); link != "" {
+		t.Errorf("expected no Link header by default, got %q", link)
+	}
+
+	m.CanonicalLink = true
+	for _, target := range []string{"http://example.com/foo/bar/x?go-get=1", "http://example.com/foo/bar/x"} {
+		want := `<https://pkg.go.dev/example.com/foo/bar>; rel="canonical"`
+		if link := serve(t, m, http.MethodGet, target).Header().Get("Link"); link != want {
+			t.Errorf("%s: expected Link header %s, got %q", target, want, link)
+		}
+	}
+}
+
+func TestServeHTTPQuietBrowserAssets(t *testing.T) {
+	m := provision(t, New("/foo", "", "https://github.com/example/foo"))
+
+	if w := serve(t, m, http.MethodGet, "http://example.com/foo/favicon.ico"); w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected favicon to be redirected by default, got %d", w.Code)
+	}
+
+	m.QuietBrowserAssets = true
+	for _, target := range []string{"http://example.com/foo/favicon.ico", "http://example.com/foo/robots.txt"} {
+		w := serve(t, m, http.MethodGet, target)
+		if w.Code != http.StatusNoContent || w.Header().Get("Location") != "" {
+			t.Errorf("%s: expected 204 without redirect, got %d to %q", target, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	if w := serve(t, m, http.MethodGet, "http://example.com/foo/bar"); w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected other subpaths to be redirected, got %d", w.Code)
+	}
+}
+
+func TestServeHTTPPlaceholderURL(t *testing.T) {
+	m := provision(t, New("/foo", "", "{http.vars.gopkg_url}"))
+
+	request := func(vars map[string]interface{}) (*httptest.ResponseRecorder, error) {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/foo?go-get=1", nil)
+		r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, vars))
+		caddyhttp.NewTestReplacer(r)
+		w := httptest.NewRecorder()
+		return w, m.ServeHTTP(w, r, nil)
+	}
+
+	w, err := request(map[string]interface{}{"gopkg_url": "github.com/example/dynamic"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `content="example.com/foo git https://github.com/example/dynamic"`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("expected %s, got %s", want, w.Body.String())
+	}
+
+	_, err = request(map[string]interface{}{})
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected handler error with status 502 for unset var, got %v", err)
+	}
+}
+
+func TestServeHTTPPlaceholders(t *testing.T) {
+	os.Setenv("GOPKG_TEST_PREFIX", "libs")
+	os.Setenv("GOPKG_TEST_GIT_HOST", "git.example.com")
+	os.Setenv("GOPKG_TEST_SECRET", "secret")
+	defer os.Unsetenv("GOPKG_TEST_PREFIX")
+	defer os.Unsetenv("GOPKG_TEST_GIT_HOST")
+	defer os.Unsetenv("GOPKG_TEST_SECRET")
+
+	tpl := template.Must(template.New("Package").Parse(
+		`<meta name="go-import" content="{{.Host}}{{.Path}} {{.Vcs}} {{.URL}}">{{.Placeholder "http.request.host.labels.1"}}`))
+	m := New("/{env.GOPKG_TEST_PREFIX}/~{user}", "", "https://{env.GOPKG_TEST_GIT_HOST}/{http.request.host.labels.1}/{user}")
+	m.BrowserRedirect = "https://docs.{http.request.host.labels.1}.com/{user}"
+	provision(t, m.WithTemplate(tpl))
+	if m.Path != "/libs/~{user}" {
+		t.Errorf("expected placeholder in path to be replaced, got %s", m.Path)
+	}
+
+	request := func(target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		caddyhttp.NewTestReplacer(r)
+		w := httptest.NewRecorder()
+		if err := m.ServeHTTP(w, r, nil); err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		return w
+	}
+
+	want := `<meta name="go-import" content="go.example.com/libs/~alice git https://git.example.com/example/alice">example`
+	if body := request("http://go.example.com/libs/~alice?go-get=1").Body.String(); body != want {
+		t.Errorf("expected body %q, got %q", want, body)
+	}
+	if location := request("http://go.example.com/libs/~alice").Header().Get("Location"); location != "https://docs.example.com/alice" {
+		t.Errorf("expected redirect to https://docs.example.com/alice, got %s", location)
+	}
+
+	// Placeholders in the request path are not replaced
+	w := request("http://go.example.com/libs/~%7Benv.GOPKG_TEST_SECRET%7D?go-get=1")
+	if body := w.Body.String(); strings.Contains(body, "secret") || !strings.Contains(body, "{env.GOPKG_TEST_SECRET}") {
+		t.Errorf("expected placeholder from the request path to be kept, got %s", body)
+	}
+	w = request("http://go.example.com/libs/~%7Benv.GOPKG_TEST_SECRET%7D")
+	if location := w.Header().Get("Location"); strings.Contains(location, "secret") {
+		t.Errorf("expected placeholder from the request path not to be replaced in the redirect, got %s", location)
+	}
+}
+
+func TestProvisionEnvURL(t *testing.T) {
+	os.Setenv("GOPKG_TEST_GITLAB_BASE", "https://gitlab.staging.example.com")
+	defer os.Unsetenv("GOPKG_TEST_GITLAB_BASE")
+
+	m := New("/foo", "", "{$GOPKG_TEST_GITLAB_BASE}/group/foo.git").WithSubmodule("/bar", "{$GOPKG_TEST_GITLAB_BASE}/group/bar.git")
+	m.Mirrors = []string{"{$GOPKG_TEST_GITLAB_BASE}/mirror/foo.git"}
+	provision(t, m)
+
+	if want := "https://gitlab.staging.example.com/group/foo.git"; m.URL != want {
+		t.Errorf("expected url %s, got %s", want, m.URL)
+	}
+	if want := "https://gitlab.staging.example.com/group/bar.git"; m.Submodules[0].URL != want {
+		t.Errorf("expected submodule url %s, got %s", want, m.Submodules[0].URL)
+	}
+	if want := "https://gitlab.staging.example.com/mirror/foo.git"; m.Mirrors[0] != want {
+		t.Errorf("expected mirror %s, got %s", want, m.Mirrors[0])
+	}
+
+	unset := New("/foo", "", "{$GOPKG_TEST_UNSET}/group/foo.git")
+	if err := unset.Provision(testContext); err == nil || !strings.Contains(err.Error(), "GOPKG_TEST_UNSET") {
+		t.Errorf("expected error for unset environment variable, got %v", err)
+	}
+}
+
+func TestServeHTTPRequestVars(t *testing.T) {
+	m := provision(t, New("/foo", "hg", "https://hg.example.com/foo").WithSubmodule("/bar", ""))
+
+	tests := []struct {
+		target string
+		accept string
+		want   map[string]interface{}
+	}{
+		{"http://example.com/foo?go-get=1", "", map[string]interface{}{
+			VarPackage: "/foo", VarVcs: "hg", VarResponse: ResponseMeta,
+		}},
+		{"http://example.com/foo/bar", "", map[string]interface{}{
+			VarPackage: "/foo", VarSubmodule: "/foo/bar", VarVcs: "hg", VarResponse: ResponseRedirect,
+		}},
+		{"http://example.com/foo", "application/json", map[string]interface{}{
+			VarPackage: "/foo", VarVcs: "hg", VarResponse: ResponseJSON,
+		}},
+	}
+
+	for _, test := range tests {
+		vars := make(map[string]interface{})
+		r := httptest.NewRequest(http.MethodGet, test.target, nil)
+		r.Header.Set("Accept", test.accept)
+		r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, vars))
+		if err := m.ServeHTTP(httptest.NewRecorder(), r, nil); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vars, test.want) {
+			t.Errorf("expected vars %v for %s, got %v", test.want, test.target, vars)
+		}
+	}
+}
+
+func TestServeHTTPMirrors(t *testing.T) {
+	m := parseDirective(t, `gopkg /foo https://github.com/example/foo {
+		mirror gitlab.com/example/foo
+		mirror https://git.example.com/foo
+		submodule /bar https://github.com/example/bar
+	}`)
+	provision(t, m)
+
+	body := serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1").Body.String()
+	if want := `<meta name="go-import" content="example.com/foo git https://github.com/example/foo">`; !strings.Contains(body, want) {
+		t.Errorf("expected go-import of the primary url %s, got %s", want, body)
+	}
+	want := `<p>Mirrors: <a href="https://gitlab.com/example/foo">https://gitlab.com/example/foo</a> ` +
+		`<a href="https://git.example.com/foo">https://git.example.com/foo</a></p>`
+	if !strings.Contains(body, want) {
+		t.Errorf("expected mirrors in order %s, got %s", want, body)
+	}
+
+	if body := serve(t, m, http.MethodGet, "http://example.com/foo/bar?go-get=1").Body.String(); strings.Contains(body, "Mirrors") {
+		t.Errorf("expected no mirrors for submodule with its own repository, got %s", body)
+	}
+}
+
+// headerRecorder records the status codes passed to WriteHeader.
+type headerRecorder struct {
+	*httptest.ResponseRecorder
+	statuses []int
+}
+
+func (w *headerRecorder) WriteHeader(status int) {
+	w.statuses = append(w.statuses, status)
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+func TestServeHTTPWriteHeader(t *testing.T) {
+	m := provision(t, New("/foo", "", "https://github.com/example/foo"))
+
+	for _, accept := range []string{"", "application/json"} {
+		w := &headerRecorder{ResponseRecorder: httptest.NewRecorder()}
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/foo?go-get=1", nil)
+		r.Header.Set("Accept", accept)
+		if err := m.ServeHTTP(w, r, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(w.statuses, []int{http.StatusOK}) {
+			t.Errorf("Accept %q: expected WriteHeader(200) to be called once, got %v", accept, w.statuses)
+		}
+	}
+}
+
+func TestServeHTTPCORS(t *testing.T) {
+	m := provision(t, New("/foo", "", "https://github.com/example/foo"))
+	w := serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1")
+	if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("expected no CORS headers by default, got origin %q", origin)
+	}
+
+	m = New("/foo", "", "https://github.com/example/foo")
+	m.CORSOrigin = "*"
+	provision(t, m)
+
+	w = serve(t, m, http.MethodOptions, "http://example.com/foo?go-get=1")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected preflight status 204, got %d", w.Code)
+	}
+	if methods := w.Header().Get("Access-Control-Allow-Methods"); methods != "GET, HEAD" {
+		t.Errorf("expected allowed methods GET, HEAD, got %q", methods)
+	}
+	if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("expected preflight origin *, got %q", origin)
+	}
+
+	w = serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1")
+	if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("expected origin *, got %q", origin)
+	}
+	if !strings.Contains(w.Body.String(), `name="go-import"`) {
+		t.Errorf("expected go-import page, got %s", w.Body.String())
+	}
+}
+
+func TestServeHTTPFallthrough(t *testing.T) {
+	tests := []struct {
+		enabled  bool
+		target   string
+		wantCode int
+	}{
+		{false, "http://example.com/foo/docs/index.html", http.StatusTemporaryRedirect},
+		{true, "http://example.com/foo/docs/index.html", http.StatusTeapot},
+		{true, "http://example.com/foo/docs/index.html?go-get=1", http.StatusOK},
+		{true, "http://example.com/foo", http.StatusTemporaryRedirect},
+		{true, "http://example.com/foo/", http.StatusTemporaryRedirect},
+		{true, "http://example.com/foo/bar/baz", http.StatusTemporaryRedirect},
+	}
+
+	for _, test := range tests {
+		m := New("/foo", "", "https://github.com/example/foo").WithSubmodule("/bar", "")
+		m.Fallthrough = test.enabled
+		provision(t, m)
+
+		if w := serve(t, m, http.MethodGet, test.target); w.Code != test.wantCode {
+			t.Errorf("fallthrough=%v %s: expected status %d, got %d", test.enabled, test.target, test.wantCode, w.Code)
+		}
+	}
+}
+
+func TestServeHTTPStripPrefix(t *testing.T) {
+	m := parseDirective(t, `gopkg /go https://github.com/example {
+		strip_prefix /go
+		mirror https://git.example.com
+		submodule /foo
+		submodule /bar https://gitlab.com/example/bar
+		submodule *
+	}`)
+	provision(t, m)
+
+	tests := []struct {
+		target   string
+		wantMeta string
+		wantURL  string
+	}{
+		{"/go/foo/pkg", "example.com/go/foo git https://github.com/example/foo", "https://github.com/example/foo"},
+		{"/go/foo/v2/pkg", "example.com/go/foo/v2 git https://github.com/example/foo", "https://github.com/example/foo"},
+		{"/go/baz", "example.com/go/baz git https://github.com/example/baz", "https://github.com/example/baz"},
+		{"/go", "example.com/go git https://github.com/example", "https://github.com/example"},
+		// A submodule with its own URL is not stripped
+		{"/go/bar", "example.com/go/bar git https://gitlab.com/example/bar", "https://gitlab.com/example/bar"},
+	}
+	for _, test := range tests {
+		body := serve(t, m, http.MethodGet, "http://example.com"+test.target+"?go-get=1").Body.String()
+		if !strings.Contains(body, `content="`+test.wantMeta+`"`) {
+			t.Errorf("%s: expected %s, got %s", test.target, test.wantMeta, body)
+		}
+		if loc := serve(t, m, http.MethodGet, "http://example.com"+test.target).Header().Get("Location"); loc != test.wantURL {
+			t.Errorf("%s: expected redirect to %s, got %q", test.target, test.wantURL, loc)
+		}
+	}
+	if body := serve(t, m, http.MethodGet, "http://example.com/go/foo?go-get=1").Body.String(); !strings.Contains(body, "https://git.example.com/foo") {
+		t.Errorf("expected stripped mirror, got %s", body)
+	}
+
+	// Without strip_prefix, the repo uri is used as is
+	m = provision(t, New("/go", "", "https://github.com/example/go").WithSubmodule("/foo", ""))
+	if loc := serve(t, m, http.MethodGet, "http://example.com/go/foo").Header().Get("Location"); loc != "https://github.com/example/go" {
+		t.Errorf("expected redirect to the unstripped repo uri, got %q", loc)
+	}
+
+	// A path below the prefix is appended too
+	m = New("/go/chrisify", "", "https://github.com/zikes")
+	m.StripPrefix = "/go/"
+	provision(t, m)
+	if loc := serve(t, m, http.MethodGet, "http://example.com/go/chrisify/pkg").Header().Get("Location"); loc != "https://github.com/zikes/chrisify" {
+		t.Errorf("expected redirect to https://github.com/zikes/chrisify, got %q", loc)
+	}
+
+	for _, prefix := range []string{"go", "/g", "/go/chrisify/sub", "/other"} {
+		m := New("/go/chrisify", "", "https://github.com/zikes")
+		m.StripPrefix = prefix
+		if err := m.Provision(testContext); err == nil {
+			t.Errorf("expected error for strip_prefix %s", prefix)
+		}
+	}
+}
+
+func TestServeHTTPPassthrough(t *testing.T) {
+	m := New("/foo", "", "https://github.com/example/foo").WithSubmodule("/bar", "")
+	m.Passthrough = true
+	provision(t, m)
+
+	for target, want := range map[string]int{
+		"http://example.com/foo/docs/logo.png":          http.StatusTeapot,
+		"http://example.com/foo/docs/logo.png?go-get=1": http.StatusOK,
+		"http://example.com/foo":                        http.StatusTemporaryRedirect,
+		"http://example.com/foo/bar/baz":                http.StatusTemporaryRedirect,
+	} {
+		if w := serve(t, m, http.MethodGet, target); w.Code != want {
+			t.Errorf("%s: expected status %d, got %d", target, want, w.Code)
+		}
+	}
+
+	// Unlike fallthrough, other methods are still rejected
+	w := httptest.NewRecorder()
+	err := m.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://example.com/foo/docs/logo.png", nil), nil)
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected handler error with status 405, got %v", err)
+	}
+}
+
+func TestServeHTTPGroup(t *testing.T) {
+	m := New("/foo", "", "https://github.com/example/foo").
+		WithSubmodule("/bar", "https://github.com/example/bar").
+		WithSubmodule("/baz", "")
+	m.Group = true
+	provision(t, m)
+
+	body := serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1").Body.String()
+	for _, want := range []string{
+		`<meta name="go-import" content="example.com/foo git https://github.com/example/foo">`,
+		`<meta name="go-import" content="example.com/foo/bar git https://github.com/example/bar">`,
+		`<meta name="go-import" content="example.com/foo/baz git https://github.com/example/foo">`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected grouped response to contain %s, got %s", want, body)
+		}
+	}
+
+	body = serve(t, m, http.MethodGet, "http://example.com/foo/bar?go-get=1").Body.String()
+	if n := strings.Count(body, `name="go-import"`); n != 1 {
+		t.Errorf("expected a single go-import tag for a submodule, got %d in %s", n, body)
+	}
+}
+
+func TestServeHTTPSubmoduleVcs(t *testing.T) {
+	m := parseDirective(t, `gopkg /foo https://github.com/example/foo {
+		submodule /legacy hg https://hg.example.com/legacy
+		submodule /bar https://github.com/example/bar
+		group
+	}`)
+	provision(t, m)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/foo/legacy/pkg?go-get=1", "example.com/foo/legacy hg https://hg.example.com/legacy"},
+		{"http://example.com/foo/bar?go-get=1", "example.com/foo/bar git https://github.com/example/bar"},
+		{"http://example.com/foo?go-get=1", "example.com/foo/legacy hg https://hg.example.com/legacy"},
+	}
+	for _, test := range tests {
+		if body := serve(t, m, http.MethodGet, test.target).Body.String(); !strings.Contains(body, `content="`+test.want+`"`) {
+			t.Errorf("%s: expected go-import %q, got %s", test.target, test.want, body)
+		}
+	}
+
+	for _, submodule := range []Submodule{
+		{Path: "/legacy", Vcs: "hg"},
+		{Path: "/legacy", Vcs: "hg", URL: "git+ssh://git@example.com/legacy"},
+	} {
+		m := New("/foo", "", "https://github.com/example/foo")
+		m.Submodules = []Submodule{submodule}
+		if err := m.Provision(testContext); err == nil {
+			t.Errorf("expected error for submodule %+v", submodule)
+		}
+	}
+}
+
+func TestServeHTTPCaseInsensitive(t *testing.T) {
+	m := New("/MyPkg", "", "https://github.com/example/mypkg").
+		WithSubmodule("/Sub", "https://github.com/example/sub").
+		WithSubmodule("/Sub/Deep", "https://github.com/example/deep")
+	provision(t, m)
+
+	if target := m.ResolveTarget("/mypkg/sub"); target.Path != "/MyPkg" {
+		t.Errorf("expected case-sensitive resolution to fall back to the package, got %+v", target)
+	}
+
+	m.CaseInsensitive = true
+	tests := map[string]string{
+		"http://example.com/mypkg?go-get=1":            `content="example.com/MyPkg git https://github.com/example/mypkg"`,
+		"http://example.com/MYPKG/sub/x?go-get=1":      `content="example.com/MyPkg/Sub git https://github.com/example/sub"`,
+		"http://example.com/mypkg/SUB/deep/x?go-get=1": `content="example.com/MyPkg/Sub/Deep git https://github.com/example/deep"`,
+	}
+	for target, want := range tests {
+		if body := serve(t, m, http.MethodGet, target).Body.String(); !strings.Contains(body, want) {
+			t.Errorf("%s: expected body to contain %s, got %s", target, want, body)
+		}
+	}
+}
+
+func TestResolveTargetWildcard(t *testing.T) {
+	m := New("/foo", "", "https://github.com/example/foo").
+		WithSubmodule(WildcardSubmodule, "https://github.com/example/monorepo").
+		WithSubmodule("/bar", "https://github.com/example/bar").
+		WithSubmodule("/bar/baz", "https://github.com/example/baz")
+
+	tests := map[string]Target{
+		"/foo":            {Path: "/foo", URL: "https://github.com/example/foo"},
+		"/foo/":           {Path: "/foo", URL: "https://github.com/example/foo"},
+		"/foo/bar":        {Path: "/foo/bar", URL: "https://github.com/example/bar", Submodule: &m.Submodules[1]},
+		"/foo/bar/qux":    {Path: "/foo/bar", URL: "https://github.com/example/bar", Submodule: &m.Submodules[1]},
+		"/foo/bar/baz/x":  {Path: "/foo/bar/baz", URL: "https://github.com/example/baz", Submodule: &m.Submodules[2]},
+		"/foo/barn":       {Path: "/foo/barn", URL: "https://github.com/example/monorepo", Submodule: &m.Submodules[0]},
+		"/foo/other/deep": {Path: "/foo/other", URL: "https://github.com/example/monorepo", Submodule: &m.Submodules[0]},
+	}
+	for reqPath, want := range tests {
+		if got := m.ResolveTarget(reqPath); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %+v, got %+v", reqPath, want, got)
+		}
+	}
+}
+
+func TestResolveTargetMajorVersion(t *testing.T) {
+	m := New("/foo", "", "https://github.com/example/foo").
+		WithSubmodule("/client", "https://github.com/example/client").
+		WithSubmodule("/server", "https://github.com/example/server").
+		WithSubmodule("/server/v3", "https://github.com/example/server-v3")
+
+	tests := []struct {
+		reqPath  string
+		wantPath string
+		wantURL  string
+	}{
+		{"/foo/client/pkg", "/foo/client", "https://github.com/example/client"},
+		{"/foo/client/v2", "/foo/client/v2", "https://github.com/example/client"},
+		{"/foo/client/v2/pkg", "/foo/client/v2", "https://github.com/example/client"},
+		{"/foo/client/v1/pkg", "/foo/client", "https://github.com/example/client"},
+		{"/foo/client/v2beta", "/foo/client", "https://github.com/example/client"},
+		{"/foo/server/v3/pkg", "/foo/server/v3", "https://github.com/example/server-v3"},
+		{"/foo/v2", "/foo", "https://github.com/example/foo"},
+	}
+	for _, test := range tests {
+		if got := m.ResolveTarget(test.reqPath); got.Path != test.wantPath || got.URL != test.wantURL {
+			t.Errorf("%s: expected %s from %s, got %s from %s", test.reqPath, test.wantPath, test.wantURL, got.Path, got.URL)
+		}
+	}
+}
+
+func TestResolveTargetSubmodule(t *testing.T) {
+	for _, n := range []int{0, 10} {
+		// Enough submodules use the trie instead of the linear scan
+		m := newSubmodulePackage(n).
+			WithSubmodule("/api", "https://github.com/example/api").
+			WithSubmodule("/api/v2", "https://github.com/example/api-v2").
+			WithSubmodule("/apis", "https://github.com/example/apis")
+		provision(t, m)
+
+		tests := []struct {
+			reqPath string
+			want    *Submodule
+		}{
+			{"/foo/api/x", &m.Submodules[len(m.Submodules)-3]},
+			{"/foo/api/v2/x", &m.Submodules[len(m.Submodules)-2]},
+			{"/foo/apis", &m.Submodules[len(m.Submodules)-1]},
+			{"/foo/apix", nil},
+		}
+		for _, test := range tests {
+			if got := m.ResolveTarget(test.reqPath).Submodule; got != test.want {
+				t.Errorf("%d submodules, %s: expected submodule %+v, got %+v", n, test.reqPath, test.want, got)
+			}
+		}
+
+		m.Template = template.Must(template.New("submodule").Parse(`{{with .Submodule}}submodule {{.Path}}{{end}}`))
+		if body := serve(t, m, http.MethodGet, "http://example.com/foo/api/v2/x?go-get=1").Body.String(); body != "submodule /api/v2" {
+			t.Errorf("expected template to render the matched submodule, got %q", body)
+		}
+	}
+}
+
+func TestServeHTTPInsecure(t *testing.T) {
+	m := New("/foo", "", "git.internal/example/foo").
+		WithSubmodule("/bar", "https://git.example.com/example/bar")
+	m.Insecure = true
+	provision(t, m)
+
+	body := serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1").Body.String()
+	if want := `content="example.com/foo git http://git.internal/example/foo"`; !strings.Contains(body, want) {
+		t.Errorf("expected body to contain %s, got %s", want, body)
+	}
+	if want := "GOINSECURE=example.com/foo go get example.com/foo"; !strings.Contains(body, want) {
+		t.Errorf("expected body to contain %s, got %s", want, body)
+	}
+
+	body = serve(t, m, http.MethodGet, "http://example.com/foo/bar?go-get=1").Body.String()
+	if want := `content="example.com/foo/bar git https://git.example.com/example/bar"`; !strings.Contains(body, want) {
+		t.Errorf("expected explicit scheme to be kept, got %s", body)
+	}
+
+	m = provision(t, New("/foo", "", "git.internal/example/foo"))
+	body = serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1").Body.String()
+	if want := `content="example.com/foo git https://git.internal/example/foo"`; !strings.Contains(body, want) {
+		t.Errorf("expected body to contain %s, got %s", want, body)
+	}
+	if strings.Contains(body, "GOINSECURE") {
+		t.Errorf("expected no GOINSECURE hint for secure sources, got %s", body)
+	}
+}
+
+func TestServeHTTPRedirectOff(t *testing.T) {
+	m := New("/foo", "", "https://git.internal/example/foo")
+	m.DisableRedirect = true
+	provision(t, m)
+
+	w := serve(t, m, http.MethodGet, "http://example.com/foo")
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "" {
+		t.Errorf("expected no redirect, got Location %q", loc)
+	}
+	if want := `content="example.com/foo git https://git.internal/example/foo"`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("expected body to contain %s, got %s", want, w.Body.String())
+	}
+}
+
+func TestServeHTTPLanding(t *testing.T) {
+	m := parseDirective(t, `gopkg /foo https://github.com/example/foo {
+		redirect landing
+		description "Tools for <foo>"
+		meta_status 203
+	}`)
+	provision(t, m)
+
+	w := serve(t, m, http.MethodGet, "http://example.com/foo/cmd")
+	if w.Code != http.StatusOK || w.Header().Get("Location") != "" {
+		t.Errorf("expected landing page with status 200, got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`<meta name="go-import" content="example.com/foo git https://github.com/example/foo">`,
+		"<h1>example.com/foo</h1>",
+		"<p>Tools for &lt;foo&gt;</p>",
+		"go get example.com/foo\n",
+		"go install example.com/foo@latest",
+		`<a href="https://pkg.go.dev/example.com/foo">Documentation</a>`,
+		`<a href="https://github.com/example/foo">Source</a>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected landing page to contain %s, got %s", want, body)
+		}
+	}
+
+	w = serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1")
+	if w.Code != http.StatusNonAuthoritativeInfo || strings.Contains(w.Body.String(), "<h1>") {
+		t.Errorf("expected the go tool to get the go-import page with status 203, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestServeHTTPHost(t *testing.T) {
+	const remote = "192.0.2.1:1234" // the remote address of httptest requests
+
+	tests := []struct {
+		host           string
+		trustedProxies []string
+		fwdHost        string
+		wantHost       string
+	}{
+		{"", nil, "", "internal.example.com"},
+		{"", nil, "forged.example.com", "internal.example.com"},
+		{"", []string{"10.0.0.0/8"}, "forged.example.com", "internal.example.com"},
+		{"", []string{"192.0.2.0/24"}, "public.example.com", "public.example.com"},
+		{"", []string{"192.0.2.1"}, "public.example.com, cdn.example.com", "public.example.com"},
+		{"go.example.com", []string{"192.0.2.1"}, "public.example.com", "go.example.com"},
+	}
+
+	for _, test := range tests {
+		m := New("/foo", "", "https://github.com/example/foo")
+		m.Host = test.host
+		m.TrustedProxies = test.trustedProxies
+		provision(t, m)
+
+		r := httptest.NewRequest(http.MethodGet, "http://internal.example.com/foo?go-get=1", nil)
+		r.RemoteAddr = remote
+		if test.fwdHost != "" {
+			r.Header.Set("X-Forwarded-Host", test.fwdHost)
+		}
+		w := httptest.NewRecorder()
+		if err := m.ServeHTTP(w, r, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		want := `content="` + test.wantHost + `/foo git https://github.com/example/foo"`
+		if body := w.Body.String(); !strings.Contains(body, want) {
+			t.Errorf("%+v: expected body to contain %s, got %s", test, want, body)
+		}
+	}
+}
+
+func TestServeHTTPHosts(t *testing.T) {
+	m := provision(t, New("/foo", "", "https://github.com/example/foo"))
+
+	// All hosts are served by default
+	if w := serve(t, m, http.MethodGet, "http://attacker.example/foo?go-get=1"); w.Code != http.StatusOK {
+		t.Errorf("expected any host to be served without hosts, got %d", w.Code)
+	}
+
+	m.Hosts = []string{"example.com", "example.dev"}
+	for _, target := range []string{"http://example.com/foo?go-get=1", "http://EXAMPLE.dev:8080/foo?go-get=1"} {
+		if w := serve(t, m, http.MethodGet, target); w.Code != http.StatusOK {
+			t.Errorf("%s: expected allowed host to be served, got %d", target, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	err := m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://attacker.example/foo?go-get=1", nil), nil)
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusMisdirectedRequest {
+		t.Errorf("expected handler error with status 421 for disallowed host, got %v", err)
+	}
+
+	m.Fallthrough = true
+	if w := serve(t, m, http.MethodGet, "http://attacker.example/foo?go-get=1"); w.Code != http.StatusTeapot {
+		t.Errorf("expected disallowed host to pass to the next handler with fallthrough, got %d", w.Code)
+	}
+
+	m.RedirectHosts = true
+	w = serve(t, m, http.MethodGet, "http://internal.example:8080/foo/sub?go-get=1")
+	if want := "http://example.com/foo/sub?go-get=1"; w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != want {
+		t.Errorf("expected disallowed host to redirect to %s, got %d %s", want, w.Code, w.Header().Get("Location"))
+	}
+	if w := serve(t, m, http.MethodGet, "http://example.dev/foo?go-get=1"); w.Code != http.StatusOK {
+		t.Errorf("expected allowed host not to redirect, got %d", w.Code)
+	}
+
+	invalid := New("/foo", "", "https://github.com/example/foo")
+	invalid.RedirectHosts = true
+	if err := invalid.Provision(testContext); err == nil {
+		t.Error("expected error for redirect_hosts without hosts")
+	}
+}
+
+func TestServeHTTPImportPathMismatch(t *testing.T) {
+	tests := []struct {
+		host     string
+		target   string
+		wantWarn bool
+	}{
+		{"", "http://example.com/foo?go-get=1", false},
+		{"", "http://example.com/foo/sub/pkg?go-get=1", false},
+		{"", "http://example.com/foobar?go-get=1", true},
+		{"foo.example.com", "http://bar.example.com/foo?go-get=1", false},
+	}
+
+	for _, test := range tests {
+		m := New("/foo", "", "https://github.com/example/foo")
+		m.Host = test.host
+		provision(t, m)
+
+		core, logs := observer.New(zapcore.WarnLevel)
+		m.logger = zap.New(core)
+
+		serve(t, m, http.MethodGet, test.target)
+
+		if warned := logs.Len() > 0; warned != test.wantWarn {
+			t.Errorf("%s with host %q: expected warning %v, got %v", test.target, test.host, test.wantWarn, logs.All())
+		}
+	}
+
+	// Behind a trusted proxy, the host requested by the client is compared
+	m := New("/foo", "", "https://github.com/example/foo")
+	m.TrustedProxies = []string{"192.0.2.0/24"}
+	provision(t, m)
+	core, logs := observer.New(zapcore.WarnLevel)
+	m.logger = zap.New(core)
+
+	r := httptest.NewRequest(http.MethodGet, "http://backend.internal/foo?go-get=1", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-Host", "example.com")
+	if err := m.ServeHTTP(httptest.NewRecorder(), r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if logs.Len() > 0 {
+		t.Errorf("expected no warning for X-Forwarded-Host of a trusted proxy, got %v", logs.All())
+	}
+
+	// The advertised import path is compared with the path requested before a rewrite to the package
+	m = New("/internal/foo", "", "https://github.com/example/foo")
+	m.ImportPath = "/foo"
+	provision(t, m)
+	core, logs = observer.New(zapcore.WarnLevel)
+	m.logger = zap.New(core)
+
+	r = httptest.NewRequest(http.MethodGet, "http://example.com/foo?go-get=1", nil)
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.OriginalRequestCtxKey, *r))
+	rewritten := *r.URL
+	rewritten.Path = "/internal/foo"
+	r.URL = &rewritten
+	if err := m.ServeHTTP(httptest.NewRecorder(), r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if logs.Len() > 0 {
+		t.Errorf("expected no warning for the import path of a rewritten request, got %v", logs.All())
+	}
+}
+
+func TestServeHTTPLogsGoGet(t *testing.T) {
+	m := provision(t, New("/foo", "", "https://github.com/example/foo").WithSubmodule("/bar", "https://github.com/example/bar"))
+	core, logs := observer.New(zapcore.InfoLevel)
+	m.logger = zap.New(core)
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/foo/bar/pkg?go-get=1", nil)
+	r.Header.Set("User-Agent", "Go-http-client/1.1")
+	if err := m.ServeHTTP(httptest.NewRecorder(), r, nil); err != nil {
+		t.Fatal(err)
+	}
+	serve(t, m, http.MethodGet, "http://example.com/foo")
+
+	entries := logs.FilterMessage("resolved go-get request").AllUntimed()
+	if len(entries) != 1 {
+		t.Fatalf("expected one logged resolution, got %v", logs.AllUntimed())
+	}
+	want := map[string]interface{}{
+		"import_path": "example.com/foo/bar",
+		"url":         "https://github.com/example/bar",
+		"submodule":   "/bar",
+		"user_agent":  "Go-http-client/1.1",
+	}
+	if got := entries[0].ContextMap(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected logged fields %v, got %v", want, got)
+	}
+}
+
+func TestServeHTTPImportPathOverride(t *testing.T) {
+	m := parseDirective(t, `gopkg /internal/foo https://github.com/example/foo {
+		import_path /foo
+		submodule /bar https://github.com/example/bar {
+			import_path /bar
+		}
+		submodule /baz https://github.com/example/baz
+	}`)
+	provision(t, m)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/internal/foo?go-get=1", "example.com/foo git https://github.com/example/foo"},
+		{"http://example.com/internal/foo/pkg?go-get=1", "example.com/foo git https://github.com/example/foo"},
+		{"http://example.com/internal/foo/bar?go-get=1", "example.com/bar git https://github.com/example/bar"},
+		{"http://example.com/internal/foo/bar/v2?go-get=1", "example.com/bar/v2 git https://github.com/example/bar"},
+		{"http://example.com/internal/foo/baz?go-get=1", "example.com/foo/baz git https://github.com/example/baz"},
+	}
+	for _, test := range tests {
+		body := serve(t, m, http.MethodGet, test.target).Body.String()
+		if want := `<meta name="go-import" content="` + test.want + `">`; !strings.Contains(body, want) {
+			t.Errorf("%s: expected %s, got %s", test.target, want, body)
+		}
+	}
+}
+
+func TestParseExtraArguments(t *testing.T) {
+	for _, subdirective := range []string{"mount_prefix /go /other", "error_template error.html other.html"} {
+		input := "gopkg /foo https://github.com/example/foo {\n\t" + subdirective + "\n}"
+		if _, err := ParseDirective(input); err == nil {
+			t.Errorf("%s: expected error", subdirective)
+		}
+	}
+}
+
+func TestParseImportPrefix(t *testing.T) {
+	tests := []struct {
+		prefix     string
+		host       string
+		importPath string
+	}{
+		{"go.example.com", "go.example.com", ""},
+		{"go.example.com:8443", "go.example.com:8443", ""},
+		{"go.example.com/foo", "go.example.com", "/foo"},
+	}
+	for _, test := range tests {
+		m := parseDirective(t, "gopkg /internal/foo https://github.com/example/foo {\n\timport_prefix "+test.prefix+"\n}")
+		if m.Host != test.host || m.ImportPath != test.importPath {
+			t.Errorf("%s: expected host %q and import path %q, got %q and %q", test.prefix, test.host,
+				test.importPath, m.Host, m.ImportPath)
+		}
+	}
+
+	m := provision(t, parseDirective(t, `gopkg /internal/foo https://github.com/example/foo {
+		import_prefix go.example.com/foo
+	}`))
+	body := serve(t, m, http.MethodGet, "http://10.0.0.1:8080/internal/foo/pkg?go-get=1").Body.String()
+	if want := `content="go.example.com/foo git https://github.com/example/foo"`; !strings.Contains(body, want) {
+		t.Errorf("expected %s, got %s", want, body)
+	}
+
+	for _, prefix := range []string{"https://go.example.com", "/foo"} {
+		input := "gopkg /foo https://github.com/example/foo {\n\timport_prefix " + prefix + "\n}"
+		if _, err := ParseDirective(input); err == nil {
+			t.Errorf("%s: expected error", prefix)
+		}
+	}
+}
+
+func TestProvisionImportPath(t *testing.T) {
+	for _, importPath := range []string{"/foo", "/foo/v2", "/{user}/lib"} {
+		m := New("/~{user}/lib", "", "https://github.com/{user}/lib")
+		m.ImportPath = importPath
+		if err := m.Provision(testContext); err != nil {
+			t.Errorf("%s: unexpected error: %v", importPath, err)
+		}
+	}
+
+	for _, importPath := range []string{"example.com/foo", "/", "/foo/", "/foo//bar", "/foo bar", "/{group}"} {
+		m := New("/~{user}/lib", "", "https://github.com/{user}/lib")
+		m.ImportPath = importPath
+		if err := m.Provision(testContext); err == nil {
+			t.Errorf("%s: expected error", importPath)
+		}
+	}
+
+	m := New("/foo", "", "https://github.com/example/foo")
+	m.Submodules = []Submodule{{Path: WildcardSubmodule, ImportPath: "/bar"}}
+	if err := m.Provision(testContext); err == nil {
+		t.Error("expected error for import_path on the wildcard submodule")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := []*GoPackage{
+		New("/foo", "", "https://github.com/example/foo").
+			WithSubmodule("/client", "").
+			WithSubmodule("/client/v2", "https://github.com/example/client").
+			WithSubmodule(WildcardSubmodule, "https://github.com/example/monorepo"),
+		New("/~{user}/lib", "", "https://github.com/{user}/lib"),
+		New("/", "", "github.com/example/root"),
+	}
+	for _, m := range valid {
+		provision(t, m)
+		if err := m.Validate(); err != nil {
+			t.Errorf("%s: unexpected error: %v", m.Path, err)
+		}
+	}
+
+	invalid := []*GoPackage{
+		New("", "", "https://github.com/example/foo"),
+		New("foo", "", "https://github.com/example/foo"),
+		New("/foo", "", "https:///example/foo"),
+		New("/foo", "", "https://github.com/example/foo").WithSubmodule("bar", ""),
+		New("/foo", "", "https://github.com/example/foo").WithSubmodule("/", ""),
+		New("/foo", "", "https://github.com/example/foo").WithSubmodule("/bar/", ""),
+		New("/foo", "", "https://github.com/example/foo").WithSubmodule("/bar", "").WithSubmodule("/bar", "https://github.com/example/bar"),
+		New("/foo", "", "https://github.com/example/foo").WithSubmodule("/bar", "https://"),
+	}
+	for _, m := range invalid {
+		if err := m.Provision(testContext); err != nil {
+			continue
+		}
+		if err := m.Validate(); err == nil {
+			t.Errorf("%s %+v: expected error", m.Path, m.Submodules)
+		}
+		m.Cleanup()
+	}
+
+	m := New("/Foo", "", "https://github.com/example/foo").WithSubmodule("/Bar", "").WithSubmodule("/bar", "")
+	m.CaseInsensitive = true
+	provision(t, m)
+	if err := m.Validate(); err == nil {
+		t.Error("expected error for submodules differing only in case")
+	}
+
+	m = New("/foo", "", "https://github.com/example/foo")
+	m.Proxy = &Proxy{fetcher: fakeFetcher{}}
+	provision(t, m)
+	if err := m.Validate(); err == nil {
+		t.Error("expected error for proxy without host or hosts")
+	}
+	m.Hosts = []string{"example.com"}
+	if err := m.Validate(); err != nil {
+		t.Errorf("unexpected error for proxy with hosts: %v", err)
+	}
+}
+
+func TestParseDirectiveCorpus(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "fuzz", "corpus", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("empty seed corpus")
+	}
+
+	for _, file := range files {
+		input, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = ParseDirective(string(input))
+		if wantErr := strings.HasPrefix(filepath.Base(file), "invalid"); (err != nil) != wantErr {
+			t.Errorf("%s: expected error %v, got %v", file, wantErr, err)
+		}
+	}
+}
+
+func TestServeHTTPRedirectQuery(t *testing.T) {
+	tests := []struct {
+		url    string
+		target string
+		want   string
+	}{
+		{"https://github.com/example/foo", "http://example.com/foo", "https://github.com/example/foo"},
+		{"https://github.com/example/foo", "http://example.com/foo?go-get=0", "https://github.com/example/foo"},
+		{"https://github.com/example/foo", "http://example.com/foo?tab=versions&go-get=0", "https://github.com/example/foo?tab=versions"},
+		{"https://docs.example.com/foo?lang=en", "http://example.com/foo?tab=versions&lang=de", "https://docs.example.com/foo?lang=en&tab=versions"},
+	}
+
+	for _, test := range tests {
+		m := provision(t, New("/foo", "", test.url))
+		if loc := serve(t, m, http.MethodGet, test.target).Header().Get("Location"); loc != test.want {
+			t.Errorf("%s: expected redirect to %s, got %s", test.target, test.want, loc)
+		}
+	}
+}
+
+func TestServeHTTPJSON(t *testing.T) {
+	m := provision(t, New("/foo", "", "https://github.com/example/foo").WithSubmodule("/bar", "https://github.com/example/bar"))
+
+	tests := []struct {
+		accept   string
+		wantJSON bool
+	}{
+		{"application/json", true},
+		{"application/json, text/plain;q=0.5", true},
+		{"text/html,application/xhtml+xml,application/json;q=0.9", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/foo/bar/baz?go-get=1", nil)
+		r.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		if err := m.ServeHTTP(w, r, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if !test.wantJSON {
+			if ct := w.Header().Get("Content-Type"); ct != "text/html" {
+				t.Errorf("Accept %q: expected HTML, got %q", test.accept, ct)
+			}
+			continue
+		}
+
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Accept %q: expected JSON, got %q", test.accept, ct)
+		}
+		want := `{"host":"example.com","path":"/foo/bar","vcs":"git","url":"https://github.com/example/bar"}`
+		if body := w.Body.String(); body != want {
+			t.Errorf("Accept %q: expected body %s, got %s", test.accept, want, body)
+		}
+	}
+
+	w := serve(t, m, http.MethodGet, "http://example.com/foo?format=json")
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("format=json: expected JSON, got %q", ct)
+	}
+	want := `{"host":"example.com","path":"/foo","vcs":"git","url":"https://github.com/example/foo",` +
+		`"submodules":[{"host":"example.com","path":"/foo/bar","vcs":"git","url":"https://github.com/example/bar"}]}`
+	if body := w.Body.String(); body != want {
+		t.Errorf("format=json: expected body %s, got %s", want, body)
+	}
+}
+
+func TestServeHTTPReservedSubmodule(t *testing.T) {
+	m := parseDirective(t, `gopkg /foo https://github.com/example/foo {
+		submodule /wip -
+		submodule /wip/ready https://github.com/example/ready
+	}`)
+	provision(t, m)
+
+	for _, target := range []string{"http://example.com/foo/wip?go-get=1", "http://example.com/foo/wip/sub", "http://example.com/foo/wip/@v/list"} {
+		w := httptest.NewRecorder()
+		err := m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil), nil)
+
+		var handlerErr caddyhttp.HandlerError
+		if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected handler error with status 404, got %v", target, err)
+		}
+	}
+
+	body := serve(t, m, http.MethodGet, "http://example.com/foo/wip/ready?go-get=1").Body.String()
+	if want := `content="example.com/foo/wip/ready git https://github.com/example/ready"`; !strings.Contains(body, want) {
+		t.Errorf("expected more specific submodule to be served, got %s", body)
+	}
+
+	body = serve(t, m, http.MethodGet, "http://example.com/foo/other?go-get=1").Body.String()
+	if want := `content="example.com/foo git https://github.com/example/foo"`; !strings.Contains(body, want) {
+		t.Errorf("expected parent fallback for other subpaths, got %s", body)
+	}
+}
+
+func TestServeHTTPConcurrentProvision(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"commit": {"committer": {"date": "2020-05-04T10:20:30Z"}}}]`))
+	}))
+	defer srv.Close()
+
+	cfg := New("/foo", "", "github.com/example/foo").
+		WithSubmodule("/bar", "github.com/example/bar").
+		WithSubmodule("/baz", "").
+		WithSubmodule("/qux", "")
+	cfg.LastModified = &LastModified{API: srv.URL}
+	cfg.Group = true
+
+	// Like a config reload, provision new instances from the same config while the previous one serves requests
+	old := *cfg
+	provision(t, &old)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				for _, target := range []string{"http://example.com/foo?go-get=1", "http://example.com/foo/bar/x?go-get=1"} {
+					w := httptest.NewRecorder()
+					if err := old.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil), nil); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		reloaded := old
+		if err := reloaded.Provision(testContext); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestParseCaddyFileMatchGoGet(t *testing.T) {
+	blocks, err := caddyfile.Parse("Caddyfile", []byte(`:80 {
+		gopkg /pkg https://github.com/example/pkg {
+			submodule /sub https://github.com/example/sub
+			match go-get
+			proxy
+			badge
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := parseCaddyFile(httpcaddyfile.Helper{Dispenser: caddyfile.NewDispenser(blocks[0].Segments[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := routes[0].Value.(caddyhttp.Route)
+
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"http://example.com/pkg", true},
+		{"http://example.com/pkg/", true},
+		{"http://example.com/pkg/docs/index.html", false},
+		{"http://example.com/pkg/docs?go-get=1", true},
+		{"http://example.com/pkg/@v/list", true},
+		{"http://example.com/pkg/sub/@v/v1.0.0.info", true},
+		{"http://example.com/pkg/@latest", true},
+		{"http://example.com/pkg/sub/@latest", true},
+		{"http://example.com/pkg/badge.svg", true},
+		{"http://example.com/pkg/sub/badge.svg", true},
+		{"http://example.com/other?go-get=1", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.target, nil)
+		caddyhttp.NewTestReplacer(r)
+		if got := routeMatches(t, route, r); got != test.want {
+			t.Errorf("%s: expected match %v, got %v", test.target, test.want, got)
+		}
+	}
+}
+
+// routeMatches reports whether any matcher set of the route matches the request.
+func routeMatches(t *testing.T, route caddyhttp.Route, r *http.Request) bool {
+	t.Helper()
+
+	for _, set := range route.MatcherSetsRaw {
+		matched := true
+		for name, raw := range set {
+			var matcher caddyhttp.RequestMatcher
+			switch name {
+			case "path":
+				matcher = new(caddyhttp.MatchPath)
+			case "query":
+				matcher = new(caddyhttp.MatchQuery)
+			default:
+				t.Fatalf("unexpected matcher %s", name)
+			}
+			if err := json.Unmarshal(raw, matcher); err != nil {
+				t.Fatal(err)
+			}
+			matched = matched && matcher.Match(r)
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func BenchmarkProvision(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		m := New(fmt.Sprintf("/pkg%d", i), "", "https://github.com/example/pkg")
+		if err := m.Provision(testContext); err != nil {
+			b.Fatal(err)
+		}
+		m.Cleanup()
+	}
+}
@@ -0,0 +1,54 @@
+// Package gopkgtest provides helpers for testing responses of vanity import path servers like gopkg.
+package gopkgtest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ParseGoImport extracts the first go-import meta tag from an HTML body, the way the go command reads it. The import
+// prefix of the tag is split into its host and path, e.g. `example.com` and `/pkg` for `example.com/pkg`.
+func ParseGoImport(body string) (host, path, vcs, url string, err error) {
+	d := xml.NewDecoder(strings.NewReader(body))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			return "", "", "", "", fmt.Errorf("no go-import meta tag")
+		}
+		if err != nil {
+			return "", "", "", "", fmt.Errorf("parsing HTML: %v", err)
+		}
+
+		e, ok := tok.(xml.StartElement)
+		if !ok || !strings.EqualFold(e.Name.Local, "meta") || attrValue(e.Attr, "name") != "go-import" {
+			continue
+		}
+
+		fields := strings.Fields(attrValue(e.Attr, "content"))
+		if len(fields) != 3 {
+			return "", "", "", "", fmt.Errorf("malformed go-import content %q", attrValue(e.Attr, "content"))
+		}
+
+		host, path = fields[0], ""
+		if i := strings.Index(host, "/"); i >= 0 {
+			host, path = host[:i], host[i:]
+		}
+		return host, path, fields[1], fields[2], nil
+	}
+}
+
+// attrValue returns the value of the attribute with the given name, or the empty string.
+func attrValue(attrs []xml.Attr, name string) string {
+	for _, a := range attrs {
+		if strings.EqualFold(a.Name.Local, name) {
+			return a.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,49 @@
+package gopkgtest
+
+import "testing"
+
+func TestParseGoImport(t *testing.T) {
+	tests := []struct {
+		body                 string
+		host, path, vcs, url string
+	}{
+		{
+			`<html><head><meta name="go-import" content="example.com/foo git https://github.com/example/foo"></head></html>`,
+			"example.com", "/foo", "git", "https://github.com/example/foo",
+		},
+		{
+			// Unclosed tags, upper-case names and entities as in real-world HTML
+			"<html>\n<HEAD>\n<meta charset=utf-8>\n<META NAME=\"go-import\" CONTENT=\"example.com/a/b bzr bzr&#43;ssh://example.com/b\">\n",
+			"example.com", "/a/b", "bzr", "bzr+ssh://example.com/b",
+		},
+		{
+			`<meta name="go-source" content="x y z w"><meta name="go-import" content="example.com mod https://proxy.example.com">`,
+			"example.com", "", "mod", "https://proxy.example.com",
+		},
+	}
+
+	for _, test := range tests {
+		host, path, vcs, url, err := ParseGoImport(test.body)
+		if err != nil {
+			t.Errorf("%q: %v", test.body, err)
+			continue
+		}
+		if host != test.host || path != test.path || vcs != test.vcs || url != test.url {
+			t.Errorf("%q: expected %s %s %s %s, got %s %s %s %s", test.body, test.host, test.path, test.vcs, test.url, host, path, vcs, url)
+		}
+	}
+}
+
+func TestParseGoImportMalformed(t *testing.T) {
+	for _, body := range []string{
+		"",
+		`<html><head><meta name="description" content="no go-import"></head></html>`,
+		`<meta name="go-import" content="example.com/foo git">`,
+		`<meta name="go-import" content="example.com/foo git https://github.com/example/foo extra">`,
+		`<meta name="go-import" content="example.com/foo git https://github.com/example/foo`,
+	} {
+		if _, _, _, _, err := ParseGoImport(body); err == nil {
+			t.Errorf("%q: expected error", body)
+		}
+	}
+}
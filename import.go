@@ -0,0 +1,193 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name: "gopkg-import",
+		Func: cmdImport,
+		Usage: "--domain <domain> (--github <org> | --gitlab <group>) [--prefix <path>] [--token <token>] " +
+			"[--api <url>] [--format caddyfile|json] [--all]",
+		Short: "Prints the config serving the Go repositories of an organization",
+		Long: `
+Lists the repositories of a GitHub organization or a GitLab group and its
+subgroups, and prints a site block for the domain with a gopkg directive for
+every Go repository, ready to paste into a Caddyfile. With --format json, it
+prints a JSON config serving them with a gopkg_packages handler instead.
+
+The packages are served at <prefix>/<repo>, or at the root of the domain if no
+prefix is given. Repositories are Go repositories if Go is their main
+language as detected by the forge; --all includes the other ones too.
+
+The token may be a placeholder like {env.GITHUB_TOKEN}. --api points to a
+GitHub Enterprise API or a self-hosted GitLab instance.`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("gopkg-import", flag.ExitOnError)
+			fs.String("domain", "", "Vanity domain serving the packages")
+			fs.String("github", "", "GitHub organization to import")
+			fs.String("gitlab", "", "GitLab group to import")
+			fs.String("prefix", "", "Path the packages are served below")
+			fs.String("token", "", "Access token of the API")
+			fs.String("api", "", "Base URL of the GitHub API or GitLab instance")
+			fs.String("format", "caddyfile", "Output format, caddyfile or json")
+			fs.Bool("all", false, "Import repositories of other languages too")
+			return fs
+		}(),
+	})
+}
+
+// importOptions configure the repositories listed by writeImport, and how.
+type importOptions struct {
+	Domain string
+	GitHub string
+	GitLab string
+	Prefix string
+	Token  string
+	API    string
+	Format string
+	All    bool
+}
+
+// cmdImport implements the gopkg-import command.
+func cmdImport(fl caddycmd.Flags) (int, error) {
+	err := writeImport(os.Stdout, importOptions{
+		Domain: fl.String("domain"),
+		GitHub: fl.String("github"),
+		GitLab: fl.String("gitlab"),
+		Prefix: fl.String("prefix"),
+		Token:  fl.String("token"),
+		API:    fl.String("api"),
+		Format: fl.String("format"),
+		All:    fl.Bool("all"),
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// writeImport lists the repositories of the organization or group and writes the config serving them to w.
+func writeImport(w io.Writer, opts importOptions) error {
+	if opts.Domain == "" {
+		return fmt.Errorf("missing domain (use --domain)")
+	}
+	if (opts.GitHub == "") == (opts.GitLab == "") {
+		return fmt.Errorf("either a GitHub organization or a GitLab group is required (use --github or --gitlab)")
+	}
+	if opts.Format != "caddyfile" && opts.Format != "json" {
+		return fmt.Errorf("unrecognized format: %s", opts.Format)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	token := caddy.NewReplacer().ReplaceAll(opts.Token, "")
+
+	var repos []discoveredRepo
+	var err error
+	if opts.GitHub != "" {
+		g := &GitHubOrg{Org: opts.GitHub, API: opts.API, client: client, token: token}
+		if g.API == "" {
+			g.API = DefaultGitHubAPI
+		}
+		repos, err = g.fetch()
+	} else {
+		g := &GitLabGroup{Group: strings.Trim(opts.GitLab, "/"), URL: opts.API, client: client, token: token}
+		if g.URL == "" {
+			g.URL = DefaultGitLabURL
+		}
+		if repos, err = g.fetch(); err == nil && !opts.All {
+			for i, repo := range repos {
+				if repos[i].language, err = g.language(repo); err != nil {
+					err = fmt.Errorf("project %s: %v", repo.path, err)
+					break
+				}
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("listing repositories: %v", err)
+	}
+
+	prefix := strings.TrimSuffix(opts.Prefix, "/")
+	var packages []*GoPackage
+	for _, repo := range repos {
+		if opts.All || repo.language == "Go" {
+			m := &GoPackage{Path: prefix + "/" + repo.path, URL: repo.url, Description: repo.description}
+			packages = append(packages, m)
+		}
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		return packages[i].Path < packages[j].Path
+	})
+
+	if opts.Format == "json" {
+		return writeImportJSON(w, opts.Domain, packages)
+	}
+	return writeImportCaddyfile(w, opts.Domain, packages)
+}
+
+// writeImportCaddyfile writes a site block for the domain with a gopkg directive per package.
+func writeImportCaddyfile(w io.Writer, domain string, packages []*GoPackage) error {
+	var b strings.Builder
+	b.WriteString(quoteCaddyfileToken(domain) + " {\n")
+	for _, m := range packages {
+		directive, err := m.MarshalCaddyfile()
+		if err != nil {
+			return fmt.Errorf("package %s: %v", m.Path, err)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(string(directive), "\n"), "\n") {
+			b.WriteString("\t" + line + "\n")
+		}
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeImportJSON writes a config with an HTTPS server serving the packages for the domain with a gopkg_packages
+// handler.
+func writeImportJSON(w io.Writer, domain string, packages []*GoPackage) error {
+	handler := struct {
+		Handler string `json:"handler"`
+		Packages
+	}{"gopkg_packages", Packages{Packages: packages}}
+
+	cfg := map[string]interface{}{
+		"apps": map[string]interface{}{
+			"http": map[string]interface{}{
+				"servers": map[string]interface{}{
+					"gopkg": map[string]interface{}{
+						"listen": []string{":443"},
+						"routes": []interface{}{
+							map[string]interface{}{
+								"match":    []interface{}{map[string][]string{"host": {domain}}},
+								"handle":   []interface{}{handler},
+								"terminal": true,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	out, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(out, '\n'))
+	return err
+}
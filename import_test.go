@@ -0,0 +1,90 @@
+package gopkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteImport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/orgs/myorg/repos":
+			w.Write([]byte(`[
+				{"name": "foo", "html_url": "https://github.com/myorg/foo", "description": "Foo does things", "language": "Go"},
+				{"name": "site", "html_url": "https://github.com/myorg/site", "language": "JavaScript"},
+				{"name": "bar", "html_url": "https://github.com/myorg/bar", "language": "Go"}
+			]`))
+		case "/api/v4/groups/mygroup/projects":
+			w.Write([]byte(`[
+				{"path_with_namespace": "mygroup/sub/lib", "web_url": "https://gitlab.com/mygroup/sub/lib"},
+				{"path_with_namespace": "mygroup/docs", "web_url": "https://gitlab.com/mygroup/docs"}
+			]`))
+		case "/api/v4/projects/mygroup%2Fsub%2Flib/languages":
+			w.Write([]byte(`{"Go": 80.5, "Shell": 19.5}`))
+		case "/api/v4/projects/mygroup%2Fdocs/languages":
+			w.Write([]byte(`{"Go": 10, "HTML": 90}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	if err := writeImport(&out, importOptions{Domain: "zikes.me", GitHub: "myorg", Prefix: "/libs/", API: srv.URL, Format: "caddyfile"}); err != nil {
+		t.Fatal(err)
+	}
+	want := `zikes.me {
+	gopkg /libs/bar https://github.com/myorg/bar
+	gopkg /libs/foo https://github.com/myorg/foo {
+		description "Foo does things"
+	}
+}
+`
+	if out.String() != want {
+		t.Errorf("expected GitHub import\n%s\ngot\n%s", want, out.String())
+	}
+
+	out.Reset()
+	if err := writeImport(&out, importOptions{Domain: "zikes.me", GitLab: "mygroup", API: srv.URL, Format: "caddyfile"}); err != nil {
+		t.Fatal(err)
+	}
+	want = "zikes.me {\n\tgopkg /sub/lib https://gitlab.com/mygroup/sub/lib\n}\n"
+	if out.String() != want {
+		t.Errorf("expected GitLab import\n%s\ngot\n%s", want, out.String())
+	}
+
+	out.Reset()
+	if err := writeImport(&out, importOptions{Domain: "zikes.me", GitLab: "mygroup", API: srv.URL, Format: "json", All: true}); err != nil {
+		t.Fatal(err)
+	}
+	var cfg struct {
+		Apps struct {
+			HTTP struct {
+				Servers map[string]struct {
+					Routes []checkRoute `json:"routes"`
+				} `json:"servers"`
+			} `json:"http"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	found := findPackages(cfg.Apps.HTTP.Servers["gopkg"].Routes, "")
+	if len(found) != 1 || found[0].host != "zikes.me" || found[0].handler != "gopkg_packages" {
+		t.Fatalf("expected a gopkg_packages handler for zikes.me, got %+v", found)
+	}
+	var p Packages
+	if err := json.Unmarshal(found[0].raw, &p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Packages) != 2 || p.Packages[0].Path != "/docs" || p.Packages[1].URL != "https://gitlab.com/mygroup/sub/lib" {
+		t.Errorf("expected all projects with --all, got %d packages", len(p.Packages))
+	}
+
+	if err := writeImport(&out, importOptions{Domain: "zikes.me", GitHub: "myorg", GitLab: "mygroup", Format: "caddyfile"}); err == nil {
+		t.Error("expected error for both an organization and a group")
+	}
+}
@@ -0,0 +1,186 @@
+package gopkg
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(Index{})
+	httpcaddyfile.RegisterDirective("gopkg_index", parseIndex)
+}
+
+// DefaultIndexTemplate is the HTML template of the index page. It lists the packages with their import path, VCS and
+// description.
+const DefaultIndexTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Host}}</title>
+</head>
+<body>
+<h1>{{.Host}}</h1>
+<table>
+{{range .Packages}}<tr><td><a href="{{.Path}}">{{.ImportPath}}</a></td><td>{{.Vcs}}</td><td>{{.Description}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`
+
+var indexTemplate = template.Must(template.New("Index").Parse(DefaultIndexTemplate))
+
+// Index serves an HTML page listing the packages registered with the gopkg app, i.e. all packages of the loaded
+// config, that are served for the host of the request. Packages with path variables are left out, as their import
+// paths cannot be enumerated.
+type Index struct {
+	app *App
+}
+
+// IndexData is the data passed to the index template.
+type IndexData struct {
+	// Host is the host of the request, e.g. `web.site`. Like for the import paths, it is the X-Forwarded-Host header
+	// set by a proxy that the listed packages trust.
+	Host string
+
+	// Packages are the listed packages, sorted by import path.
+	Packages []IndexEntry
+}
+
+// IndexEntry is a package listed on the index page.
+type IndexEntry struct {
+	// ImportPath is the import path of the package, e.g. `web.site/package/name`.
+	ImportPath string
+
+	// Path is the HTTP path of the package, which links to its landing page or source.
+	Path string
+
+	// Vcs is the version control system of the package.
+	Vcs string
+
+	// URL is the source URL of the package.
+	URL string
+
+	// Description is the description of the package.
+	Description string
+}
+
+// CaddyModule returns the Caddy module information.
+func (Index) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.gopkg_index",
+		New: func() caddy.Module {
+			return new(Index)
+		},
+	}
+}
+
+// parseIndex parses the gopkg_index directive in a caddyfile. Syntax:
+//
+//     gopkg_index [<path>]
+//
+// The index is served at <path>, which defaults to `/`.
+func parseIndex(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	path := "/"
+	for h.Next() {
+		if h.NextArg() {
+			path = h.Val()
+		}
+		if h.NextArg() || h.NextBlock(0) {
+			return nil, h.ArgErr()
+		}
+	}
+
+	matcher := caddy.ModuleMap{"path": h.JSON(caddyhttp.MatchPath{path})}
+	return h.NewRoute(matcher, new(Index)), nil
+}
+
+// Provision implements caddy.Provisioner.
+func (idx *Index) Provision(ctx caddy.Context) error {
+	app, err := loadApp(ctx)
+	if err != nil {
+		return err
+	}
+	idx.app = app
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (idx Index) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+
+	packages := listedPackages(idx.app, r)
+	data := IndexData{Host: r.Host, Packages: entries(r, packages)}
+
+	// The heading shows the host the import paths are listed with
+	var trustedProxies []*net.IPNet
+	for _, m := range packages {
+		trustedProxies = append(trustedProxies, m.trustedProxies...)
+	}
+	if fwdHost := forwardedHeader(r, trustedProxies, "X-Forwarded-Host"); fwdHost != "" {
+		data.Host = fwdHost
+	}
+
+	var buf bytes.Buffer
+	if err := indexTemplate.Execute(&buf, data); err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// listedPackages returns the packages of the app that are served for the host of the request and can be listed,
+// i.e. have no path variables.
+func listedPackages(app *App, r *http.Request) []*GoPackage {
+	var packages []*GoPackage
+	for _, m := range app.Packages() {
+		if len(m.pathVars) == 0 && m.allowedHost(r) {
+			packages = append(packages, m)
+		}
+	}
+	return packages
+}
+
+// entries returns the index entries of the packages listed for the request.
+func entries(r *http.Request, packages []*GoPackage) []IndexEntry {
+	seen := make(map[string]bool)
+	var entries []IndexEntry
+	for _, m := range packages {
+		importPath := m.requestHost(r) + m.importPath(Target{Path: m.Path})
+		if seen[importPath] {
+			continue
+		}
+		seen[importPath] = true
+
+		entries = append(entries, IndexEntry{
+			ImportPath:  importPath,
+			Path:        m.MountPrefix + m.Path,
+			Vcs:         m.Vcs,
+			URL:         m.stripPrefixURL(m.URL, m.Path),
+			Description: m.Description,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ImportPath < entries[j].ImportPath
+	})
+	return entries
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Index)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Index)(nil)
+)
@@ -0,0 +1,64 @@
+package gopkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	foo := New("/index/foo", "", "https://github.com/example/foo")
+	foo.Description = "Foo <does> things"
+	foo.Hosts = []string{"example.com"}
+	bar := New("/index/bar", "hg", "https://hg.example.com/bar")
+	bar.Hosts = []string{"example.com"}
+	other := New("/index/other", "", "https://github.com/example/other")
+	other.Hosts = []string{"other.example.com"}
+	user := New("/index/~{user}", "", "https://github.com/{user}/lib")
+	for _, m := range []*GoPackage{foo, bar, other, user} {
+		provision(t, m)
+		defer m.Cleanup()
+	}
+
+	idx := new(Index)
+	if err := idx.Provision(testContext); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := idx.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil), nil); err != nil {
+		t.Fatal(err)
+	}
+	body := w.Body.String()
+
+	wantBar := `<tr><td><a href="/index/bar">example.com/index/bar</a></td><td>hg</td><td></td></tr>`
+	wantFoo := `<tr><td><a href="/index/foo">example.com/index/foo</a></td><td>git</td><td>Foo &lt;does&gt; things</td></tr>`
+	if i, j := strings.Index(body, wantBar), strings.Index(body, wantFoo); i < 0 || j < i {
+		t.Errorf("expected index to list %q and %q in order, got %q", wantBar, wantFoo, body)
+	}
+	for _, unwanted := range []string{"/index/other", "/index/~"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("expected index not to list %s, got %q", unwanted, body)
+		}
+	}
+
+	// Behind a trusted proxy, the heading shows the same host as the import paths
+	proxied := New("/index/proxied", "", "https://github.com/example/proxied")
+	proxied.Hosts = []string{"proxied.example.com"}
+	proxied.TrustedProxies = []string{"192.0.2.0/24"}
+	provision(t, proxied)
+	defer proxied.Cleanup()
+
+	r := httptest.NewRequest(http.MethodGet, "http://backend.internal/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-Host", "proxied.example.com")
+	w = httptest.NewRecorder()
+	if err := idx.ServeHTTP(w, r, nil); err != nil {
+		t.Fatal(err)
+	}
+	body = w.Body.String()
+	if !strings.Contains(body, "<h1>proxied.example.com</h1>") || !strings.Contains(body, ">proxied.example.com/index/proxied<") {
+		t.Errorf("expected heading and import path with the forwarded host, got %q", body)
+	}
+}
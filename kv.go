@@ -0,0 +1,107 @@
+package gopkg
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// kvPackages serves the packages stored as JSON package configs in a key-value store, keyed by a prefix and the
+// package path. It is shared by the handlers reading the packages from Redis, Consul and etcd.
+type kvPackages struct {
+	digest   [sha256.Size]byte
+	packages *packageSet
+	ctx      caddy.Context
+}
+
+// init prepares serving the packages.
+func (kv *kvPackages) init(ctx caddy.Context) {
+	kv.ctx = ctx
+	kv.packages = new(packageSet)
+}
+
+// apply provisions the packages of the values by key and replaces the served ones with them, unless no key or value
+// changed since the last call. If a package is invalid, the served packages are kept.
+func (kv *kvPackages) apply(prefix string, values map[string]string) error {
+	entries := make(map[string]string, len(values))
+	for key, value := range values {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		path := strings.TrimPrefix(key, prefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		entries[path] = value
+	}
+
+	paths := make([]string, 0, len(entries))
+	for path := range entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, path := range paths {
+		fmt.Fprintf(h, "%d:%s%d:%s", len(path), path, len(entries[path]), entries[path])
+	}
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+	if digest == kv.digest {
+		return nil
+	}
+
+	packages := make([]*GoPackage, 0, len(paths))
+	for _, path := range paths {
+		m, err := kv.provisionEntry(path, entries[path])
+		if err != nil {
+			for _, provisioned := range packages {
+				provisioned.Cleanup()
+			}
+			return fmt.Errorf("package %q: %v", path, err)
+		}
+		packages = append(packages, m)
+	}
+
+	for _, m := range kv.packages.swap(sortMostSpecific(packages)) {
+		m.Cleanup()
+	}
+	kv.digest = digest
+	return nil
+}
+
+// provisionEntry decodes and provisions the package stored at the path.
+func (kv *kvPackages) provisionEntry(path, value string) (*GoPackage, error) {
+	m := new(GoPackage)
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(m); err != nil {
+		return nil, err
+	}
+	m.Path = path
+	if err := validatePackageEntry(m); err != nil {
+		return nil, err
+	}
+	return m, provisionPackage(kv.ctx, m)
+}
+
+// serve serves the request with the package it is for, or passes it to the next handler.
+func (kv *kvPackages) serve(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	return servePackages(kv.packages.get(), w, r, next)
+}
+
+// cleanup deregisters the packages.
+func (kv *kvPackages) cleanup() {
+	if kv.packages == nil {
+		return
+	}
+	for _, m := range kv.packages.swap(nil) {
+		m.Cleanup()
+	}
+}
@@ -0,0 +1,170 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// DefaultLastModifiedAPI is the API used to look up commit times if none is configured.
+const DefaultLastModifiedAPI = "https://api.github.com"
+
+// DefaultLastModifiedTTL is how long commit times are cached if no TTL is configured.
+const DefaultLastModifiedTTL = caddy.Duration(10 * time.Minute)
+
+// maxCachedCommitTimes bounds the number of repositories whose commit times are cached. Repo URLs with path
+// variables depend on the request, so the cache is dropped once it is full.
+const maxCachedCommitTimes = 1024
+
+// LastModified derives the Last-Modified header of go-import responses from the latest commit in the source
+// repository, so conditional requests reflect actual source changes.
+//
+// Commit times are looked up in the background using a GitHub compatible API and cached, so requests never wait for
+// the API. Until the first lookup of a repository completes, and if it fails, the header is omitted. If a later
+// lookup fails, the previously cached time is used.
+type LastModified struct {
+	// API is the base URL of the GitHub compatible API used to look up commits.
+	//
+	// If empty, the default is `https://api.github.com`.
+	API string `json:"api,omitempty"`
+
+	// TTL is how long a commit time is cached before it is looked up again.
+	//
+	// If zero, the default is 10 minutes.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	client *http.Client
+	logger *zap.Logger
+
+	mu    sync.Mutex
+	cache map[string]commitTime
+}
+
+// commitTime is a cached commit time of a repository.
+type commitTime struct {
+	time    time.Time
+	fetched time.Time
+	pending bool
+}
+
+// provision sets the defaults and prepares the cache.
+func (lm *LastModified) provision(logger *zap.Logger) {
+	if lm.API == "" {
+		lm.API = DefaultLastModifiedAPI
+	}
+	if lm.TTL == 0 {
+		lm.TTL = DefaultLastModifiedTTL
+	}
+	lm.client = &http.Client{Timeout: 5 * time.Second}
+	lm.logger = logger
+	lm.cache = make(map[string]commitTime)
+}
+
+// CommitTime returns the time of the latest commit in the repository at repoURL, or the zero time if it is unknown.
+// A lookup is started in the background if the cached time is missing or expired, unless one is running already.
+func (lm *LastModified) CommitTime(repoURL string) time.Time {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	cached, ok := lm.cache[repoURL]
+	if (!ok || time.Since(cached.fetched) >= time.Duration(lm.TTL)) && !cached.pending {
+		if !ok && len(lm.cache) >= maxCachedCommitTimes {
+			lm.cache = make(map[string]commitTime)
+		}
+		cached.pending = true
+		lm.cache[repoURL] = cached
+		go lm.refresh(repoURL)
+	}
+	return cached.time
+}
+
+// refresh looks up the time of the latest commit in the repository at repoURL into the cache.
+func (lm *LastModified) refresh(repoURL string) {
+	t, err := lm.fetch(repoURL)
+	if err != nil {
+		lm.logger.Warn("looking up latest commit",
+			zap.String("url", repoURL),
+			zap.Error(err))
+	}
+
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	cached, ok := lm.cache[repoURL]
+	if !ok && len(lm.cache) >= maxCachedCommitTimes {
+		// The cache filled up again after it was dropped meanwhile
+		return
+	}
+	// Keep serving the stale time, but don't retry before the TTL expires again
+	if err == nil {
+		cached.time = t
+	}
+	cached.fetched = time.Now()
+	cached.pending = false
+	lm.cache[repoURL] = cached
+}
+
+// fetch looks up the time of the latest commit in the repository at repoURL.
+func (lm *LastModified) fetch(repoURL string) (time.Time, error) {
+	repo, err := repoName(repoURL)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	resp, err := lm.client.Get(strings.TrimSuffix(lm.API, "/") + "/repos/" + repo + "/commits?per_page=1")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var commits []struct {
+		Commit struct {
+			Committer struct {
+				Date time.Time `json:"date"`
+			} `json:"committer"`
+		} `json:"commit"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&commits); err != nil {
+		return time.Time{}, fmt.Errorf("decoding commits: %v", err)
+	}
+	if len(commits) == 0 {
+		return time.Time{}, fmt.Errorf("repository has no commits")
+	}
+
+	return commits[0].Commit.Committer.Date, nil
+}
+
+// repoName extracts the `owner/repo` name from a repository URL such as `https://github.com/owner/repo.git`.
+func repoName(repoURL string) (string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", err
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("no repository name in URL %q", repoURL)
+	}
+
+	return parts[0] + "/" + strings.TrimSuffix(parts[1], ".git"), nil
+}
+
+// notModified reports whether the request's If-Modified-Since header is not before modTime.
+func notModified(r *http.Request, modTime time.Time) bool {
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(ims)
+}
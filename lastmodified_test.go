@@ -0,0 +1,150 @@
+package gopkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// commitAPI is a mock GitHub compatible API that reports the latest commit time of a repository.
+type commitAPI struct {
+	date     string
+	status   int32
+	requests int32
+	block    chan struct{}
+}
+
+func (api *commitAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&api.requests, 1)
+	if api.block != nil {
+		<-api.block
+	}
+	if r.URL.Path != "/repos/example/foo/commits" {
+		http.NotFound(w, r)
+		return
+	}
+	if status := atomic.LoadInt32(&api.status); status != 0 {
+		w.WriteHeader(int(status))
+		return
+	}
+	w.Write([]byte(`[{"commit": {"committer": {"date": "` + api.date + `"}}}]`))
+}
+
+func TestLastModified(t *testing.T) {
+	api := &commitAPI{date: "2020-05-04T10:20:30Z"}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	m := provision(t, &GoPackage{
+		Path:         "/foo",
+		URL:          "https://github.com/example/foo.git",
+		LastModified: &LastModified{API: srv.URL},
+	})
+
+	// The commit time is looked up in the background, so the first responses are sent without it
+	var w *httptest.ResponseRecorder
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		w = serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1")
+		if w.Header().Get("Last-Modified") != "" {
+			break
+		}
+	}
+	if got, want := w.Header().Get("Last-Modified"), "Mon, 04 May 2020 10:20:30 GMT"; got != want {
+		t.Errorf("expected Last-Modified %q, got %q", want, got)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/foo?go-get=1", nil)
+	r.Header.Set("If-Modified-Since", "Mon, 04 May 2020 10:20:30 GMT")
+	w = httptest.NewRecorder()
+	if err := m.ServeHTTP(w, r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected status %d for unchanged source, got %d", http.StatusNotModified, w.Code)
+	}
+
+	if n := atomic.LoadInt32(&api.requests); n != 1 {
+		t.Errorf("expected the commit time to be cached, got %d API requests", n)
+	}
+}
+
+func TestLastModifiedFallback(t *testing.T) {
+	api := &commitAPI{date: "2020-05-04T10:20:30Z"}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	m := provision(t, &GoPackage{Path: "/foo", URL: "https://github.com/example/foo", LastModified: &LastModified{API: srv.URL, TTL: 1}})
+	lm := m.LastModified
+
+	want := time.Date(2020, 5, 4, 10, 20, 30, 0, time.UTC)
+	lm.refresh("https://github.com/example/foo")
+	if got := lm.CommitTime("https://github.com/example/foo"); !got.Equal(want) {
+		t.Fatalf("expected commit time %v, got %v", want, got)
+	}
+
+	// The cached time is served if the API fails after the TTL expired
+	atomic.StoreInt32(&api.status, http.StatusInternalServerError)
+	time.Sleep(time.Millisecond)
+	lm.refresh("https://github.com/example/foo")
+	if got := lm.CommitTime("https://github.com/example/foo"); !got.Equal(want) {
+		t.Errorf("expected stale commit time %v, got %v", want, got)
+	}
+
+	// Without a cached time, the header is omitted
+	lm.refresh("https://github.com/example/bar")
+	if got := lm.CommitTime("https://github.com/example/bar"); !got.IsZero() {
+		t.Errorf("expected zero time for unknown repository, got %v", got)
+	}
+}
+
+func TestLastModifiedConcurrentMisses(t *testing.T) {
+	api := &commitAPI{date: "2020-05-04T10:20:30Z", block: make(chan struct{})}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	m := provision(t, &GoPackage{Path: "/foo", URL: "https://github.com/example/foo", LastModified: &LastModified{API: srv.URL}})
+	lm := m.LastModified
+
+	// Misses neither wait for the API nor look up the same repository twice
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := lm.CommitTime("https://github.com/example/foo"); !got.IsZero() {
+				t.Errorf("expected zero time while the lookup is pending, got %v", got)
+			}
+		}()
+	}
+	wg.Wait()
+	close(api.block)
+
+	for deadline := time.Now().Add(5 * time.Second); lm.CommitTime("https://github.com/example/foo").IsZero(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the commit time to be looked up")
+		}
+	}
+	if n := atomic.LoadInt32(&api.requests); n != 1 {
+		t.Errorf("expected one API request, got %d", n)
+	}
+}
+
+func TestLastModifiedCacheBound(t *testing.T) {
+	lm := &LastModified{API: "http://127.0.0.1:0"}
+	lm.provision(zap.NewNop())
+	for i := 0; i < maxCachedCommitTimes+10; i++ {
+		lm.CommitTime("https://github.com/example/" + strconv.Itoa(i))
+	}
+
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if len(lm.cache) > maxCachedCommitTimes {
+		t.Errorf("expected at most %d cached commit times, got %d", maxCachedCommitTimes, len(lm.cache))
+	}
+}
@@ -0,0 +1,149 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// DefaultLatestVersionProxy is the module proxy used to look up latest versions if none is configured.
+const DefaultLatestVersionProxy = "https://proxy.golang.org"
+
+// DefaultLatestVersionTTL is how long latest versions are cached if no TTL is configured.
+const DefaultLatestVersionTTL = caddy.Duration(time.Hour)
+
+// maxCachedLatestVersions bounds the number of modules whose latest versions are cached. Module paths with path
+// variables depend on the request, so the cache is dropped once it is full.
+const maxCachedLatestVersions = 1024
+
+// LatestVersion looks up the latest version of modules from a module proxy, e.g. for the version badge.
+//
+// Versions are looked up in the background and cached, so requests never wait for the proxy. Until the first lookup
+// of a module completes, and if it fails, the version is unknown. If a later lookup fails, the previously cached
+// version is used.
+type LatestVersion struct {
+	// Proxy is the base URL of the module proxy used to look up versions.
+	//
+	// If empty, the default is `https://proxy.golang.org`.
+	Proxy string `json:"proxy,omitempty"`
+
+	// TTL is how long a version is cached before it is looked up again.
+	//
+	// If zero, the default is 1 hour.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	client *http.Client
+	logger *zap.Logger
+
+	mu    sync.Mutex
+	cache map[string]moduleVersion
+}
+
+// moduleVersion is a cached latest version of a module.
+type moduleVersion struct {
+	version string
+	fetched time.Time
+	pending bool
+}
+
+// provision sets the defaults and prepares the cache.
+func (lv *LatestVersion) provision(logger *zap.Logger) {
+	if lv.Proxy == "" {
+		lv.Proxy = DefaultLatestVersionProxy
+	}
+	if lv.TTL == 0 {
+		lv.TTL = DefaultLatestVersionTTL
+	}
+	lv.client = &http.Client{Timeout: 5 * time.Second}
+	lv.logger = logger
+	lv.cache = make(map[string]moduleVersion)
+}
+
+// Version returns the latest version of the module at modPath, e.g. `example.com/foo`, or an empty string if it is
+// unknown. A lookup is started in the background if the cached version is missing or expired, unless one is running
+// already.
+func (lv *LatestVersion) Version(modPath string) string {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+
+	cached, ok := lv.cache[modPath]
+	if (!ok || time.Since(cached.fetched) >= time.Duration(lv.TTL)) && !cached.pending {
+		if !ok && len(lv.cache) >= maxCachedLatestVersions {
+			lv.cache = make(map[string]moduleVersion)
+		}
+		cached.pending = true
+		lv.cache[modPath] = cached
+		go lv.refresh(modPath)
+	}
+	return cached.version
+}
+
+// refresh looks up the latest version of the module at modPath into the cache.
+func (lv *LatestVersion) refresh(modPath string) {
+	version, err := lv.fetch(modPath)
+	if err != nil {
+		lv.logger.Warn("looking up latest version",
+			zap.String("module", modPath),
+			zap.Error(err))
+	}
+
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+
+	cached, ok := lv.cache[modPath]
+	if !ok && len(lv.cache) >= maxCachedLatestVersions {
+		// The cache filled up again after it was dropped meanwhile
+		return
+	}
+	// Keep serving the stale version, but don't retry before the TTL expires again
+	if err == nil {
+		cached.version = version
+	}
+	cached.fetched = time.Now()
+	cached.pending = false
+	lv.cache[modPath] = cached
+}
+
+// fetch looks up the latest version of the module at modPath.
+func (lv *LatestVersion) fetch(modPath string) (string, error) {
+	resp, err := lv.client.Get(strings.TrimSuffix(lv.Proxy, "/") + "/" + escapeModulePath(modPath) + "/@latest")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var info struct {
+		Version string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("decoding version info: %v", err)
+	}
+	if !versionRegexp.MatchString(info.Version) {
+		return "", fmt.Errorf("invalid version %q", info.Version)
+	}
+
+	return info.Version, nil
+}
+
+// escapeModulePath applies the case-encoding of module paths in proxy requests, the inverse of unescapeModulePath.
+func escapeModulePath(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if c >= 'A' && c <= 'Z' {
+			b.WriteByte('!')
+			c += 'a' - 'A'
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,115 @@
+package gopkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestServeHTTPLatestVersion(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/example.com/foo/@latest" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"Version": "v1.2.3"}`))
+	}))
+	defer srv.Close()
+
+	m := parseDirective(t, `gopkg /foo https://github.com/example/foo {
+		host example.com
+		redirect landing
+		latest_version `+srv.URL+`
+	}`)
+	provision(t, m)
+
+	// The version is looked up in the background, so the first pages are rendered without it
+	var body string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		body = serve(t, m, http.MethodGet, "http://internal.example.com/foo").Body.String()
+		if strings.Contains(body, "v1.2.3") {
+			break
+		}
+	}
+	if !strings.Contains(body, "<p>Latest version: v1.2.3</p>") {
+		t.Errorf("expected landing page to show the latest version of the configured host, got %q", body)
+	}
+	serve(t, m, http.MethodGet, "http://example.com/foo")
+	serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1")
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected the version to be cached and not looked up for the go tool, got %d requests", n)
+	}
+	if m.Badge {
+		t.Error("expected latest_version not to enable the badge")
+	}
+
+	// Without host or hosts, the module would be looked up below whatever host the client sends
+	m = parseDirective(t, `gopkg /foo https://github.com/example/foo {
+		latest_version `+srv.URL+`
+	}`)
+	provision(t, m)
+	if err := m.Validate(); err == nil {
+		t.Error("expected error for latest_version without host or hosts")
+	}
+}
+
+func TestLatestVersionConcurrentMisses(t *testing.T) {
+	var requests int32
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-block
+		w.Write([]byte(`{"Version": "v1.2.3"}`))
+	}))
+	defer srv.Close()
+
+	lv := &LatestVersion{Proxy: srv.URL}
+	lv.provision(zap.NewNop())
+
+	// Misses neither wait for the proxy nor look up the same module twice
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := lv.Version("example.com/foo"); got != "" {
+				t.Errorf("expected no version while the lookup is pending, got %q", got)
+			}
+		}()
+	}
+	wg.Wait()
+	close(block)
+
+	for deadline := time.Now().Add(5 * time.Second); lv.Version("example.com/foo") == ""; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the version to be looked up")
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected one proxy request, got %d", n)
+	}
+}
+
+func TestLatestVersionCacheBound(t *testing.T) {
+	lv := &LatestVersion{Proxy: "http://127.0.0.1:0"}
+	lv.provision(zap.NewNop())
+	for i := 0; i < maxCachedLatestVersions+10; i++ {
+		lv.Version("example.com/" + strconv.Itoa(i))
+	}
+
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	if len(lv.cache) > maxCachedLatestVersions {
+		t.Errorf("expected at most %d cached versions, got %d", maxCachedLatestVersions, len(lv.cache))
+	}
+}
@@ -0,0 +1,93 @@
+package gopkg
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// adminMetricsPath is the admin API endpoint serving the metrics in the Prometheus text format.
+const adminMetricsPath = "/gopkg/metrics"
+
+// packageMetrics are counters of the requests served by all packages, keyed by the path of the package, or of the
+// submodule for submodule hits. Paths are counted as configured, so path variables don't create a counter per value.
+//
+// They are published as the expvar `gopkg` at `/debug/vars` of Caddy's admin endpoint, and in the Prometheus text
+// format at `/gopkg/metrics`.
+type packageMetrics struct {
+	goGet            *expvar.Map
+	browserRedirects *expvar.Map
+	submoduleHits    *expvar.Map
+	templateErrors   *expvar.Map
+}
+
+var metrics = packageMetrics{
+	goGet:            new(expvar.Map).Init(),
+	browserRedirects: new(expvar.Map).Init(),
+	submoduleHits:    new(expvar.Map).Init(),
+	templateErrors:   new(expvar.Map).Init(),
+}
+
+func init() {
+	vars := expvar.NewMap("gopkg")
+	vars.Set("go_get_requests", metrics.goGet)
+	vars.Set("browser_redirects", metrics.browserRedirects)
+	vars.Set("submodule_hits", metrics.submoduleHits)
+	vars.Set("template_errors", metrics.templateErrors)
+}
+
+// counter is a counter with its Prometheus metric name and help text.
+type counter struct {
+	name   string
+	help   string
+	values *expvar.Map
+}
+
+// counters lists the counters in the order they are exported.
+func (pm packageMetrics) counters() []counter {
+	return []counter{
+		{"gopkg_go_get_requests_total", "Requests of the go tool by package path.", pm.goGet},
+		{"gopkg_browser_redirects_total", "Browser requests redirected by package path.", pm.browserRedirects},
+		{"gopkg_submodule_hits_total", "Requests resolved to a submodule by submodule path.", pm.submoduleHits},
+		{"gopkg_template_errors_total", "Failures to render the response template by package path.", pm.templateErrors},
+	}
+}
+
+// writePrometheus writes the counters in the Prometheus text exposition format.
+func (pm packageMetrics) writePrometheus(w io.Writer) error {
+	for _, c := range pm.counters() {
+		var paths []string
+		c.values.Do(func(kv expvar.KeyValue) {
+			paths = append(paths, kv.Key)
+		})
+		sort.Strings(paths)
+
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name); err != nil {
+			return err
+		}
+		for _, path := range paths {
+			if _, err := fmt.Fprintf(w, "%s{path=\"%s\"} %s\n", c.name, prometheusLabelReplacer.Replace(path),
+				c.values.Get(path).String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prometheusLabelReplacer escapes label values for the Prometheus text format.
+var prometheusLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// handleMetrics serves the metrics endpoint of the admin API.
+func (adminAPI) handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{Code: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	return metrics.writePrometheus(w)
+}
@@ -0,0 +1,46 @@
+package gopkg
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	for _, c := range metrics.counters() {
+		for _, path := range []string{"/metrics", "/metrics/sub", "/metrics-broken"} {
+			c.values.Delete(path)
+		}
+	}
+
+	m := provision(t, New("/metrics", "", "https://github.com/example/metrics").WithSubmodule("/sub", ""))
+	broken := provision(t, New("/metrics-broken", "", "https://github.com/example/broken").
+		WithTemplate(template.Must(template.New("Package").Parse(`{{.Missing}}`))))
+
+	serve(t, m, http.MethodGet, "http://example.com/metrics?go-get=1")
+	serve(t, m, http.MethodGet, "http://example.com/metrics/sub?go-get=1")
+	serve(t, m, http.MethodGet, "http://example.com/metrics")
+	if err := broken.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/metrics-broken?go-get=1", nil), nil); err == nil {
+		t.Fatal("expected broken template to fail")
+	}
+
+	w := httptest.NewRecorder()
+	if err := (adminAPI{}).handleMetrics(w, httptest.NewRequest(http.MethodGet, adminMetricsPath, nil)); err != nil {
+		t.Fatal(err)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE gopkg_go_get_requests_total counter\n",
+		`gopkg_go_get_requests_total{path="/metrics"} 2` + "\n",
+		`gopkg_go_get_requests_total{path="/metrics-broken"} 1` + "\n",
+		`gopkg_browser_redirects_total{path="/metrics"} 1` + "\n",
+		`gopkg_submodule_hits_total{path="/metrics/sub"} 1` + "\n",
+		`gopkg_template_errors_total{path="/metrics-broken"} 1` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %q, got %q", want, body)
+		}
+	}
+}
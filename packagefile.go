@@ -0,0 +1,335 @@
+package gopkg
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(PackageFile{})
+}
+
+// DefaultWatchInterval is how often a watched package file is checked for changes if no interval is configured.
+const DefaultWatchInterval = caddy.Duration(10 * time.Second)
+
+// parsePackageFile parses the gopkg_file directive in a caddyfile. Syntax:
+//
+//     gopkg_file <file> {
+//         watch [<interval>]
+//     }
+//
+// Every package defined in the file is mounted at its own path, just like a gopkg directive. The file is read when
+// the config is loaded, so a malformed entry fails the (re)load rather than a request.
+//
+// With watch, the file is instead served by a single PackageFile handler, which reloads it when it changes.
+func parsePackageFile(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	var filename string
+	var watch *caddy.Duration
+	for h.Next() {
+		if !h.Args(&filename) {
+			return nil, h.ArgErr()
+		}
+		if h.NextArg() {
+			return nil, h.ArgErr()
+		}
+		for h.NextBlock(0) {
+			switch h.Val() {
+			case "watch":
+				interval := DefaultWatchInterval
+				if h.NextArg() {
+					d, err := time.ParseDuration(h.Val())
+					if err != nil || d <= 0 {
+						return nil, h.Errf("invalid watch interval '%s'", h.Val())
+					}
+					interval = caddy.Duration(d)
+				}
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				watch = &interval
+			default:
+				return nil, h.Errf("unrecognized gopkg_file subdirective '%s'", h.Val())
+			}
+		}
+	}
+
+	if watch != nil {
+		return h.NewRoute(nil, &PackageFile{File: filename, Watch: *watch}), nil
+	}
+
+	packages, err := LoadPackageFile(filename)
+	if err != nil {
+		return nil, h.Errf("loading packages: %v", err)
+	}
+
+	var routes []httpcaddyfile.ConfigValue
+	for _, m := range packages {
+		routes = append(routes, packageRoute(h, m)...)
+	}
+
+	return routes, nil
+}
+
+// LoadPackageFile reads package definitions from a JSON or CSV file. The packages are returned sorted by path.
+//
+// A JSON file maps package paths to package configs, using the same fields as the JSON config of the handler:
+//
+//     {
+//         "/foo": {"url": "https://github.com/example/foo"},
+//         "/bar": {"vcs": "hg", "url": "https://hg.example.com/bar", "submodules": [{"path": "/baz"}]}
+//     }
+//
+// A file with a `.csv` extension contains one package per record in the form `<path>,<vcs>,<url>`, where vcs may be
+// empty. Submodules can not be defined in CSV files.
+func LoadPackageFile(filename string) ([]*GoPackage, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var packages []*GoPackage
+	if strings.EqualFold(filepath.Ext(filename), ".csv") {
+		packages, err = readPackageCSV(f)
+	} else {
+		packages, err = readPackageJSON(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	sort.Slice(packages, func(i, j int) bool {
+		return packages[i].Path < packages[j].Path
+	})
+
+	for _, m := range packages {
+		if err := validatePackageEntry(m); err != nil {
+			return nil, fmt.Errorf("%s: package %q: %v", filename, m.Path, err)
+		}
+	}
+
+	return packages, nil
+}
+
+// PackageFile serves the packages defined in a file, see LoadPackageFile, and reloads them when the file changes. This
+// allows managing many packages outside the Caddy config without reloading it.
+//
+// Requests not matching any of the packages are passed to the next handler.
+type PackageFile struct {
+	// File is the JSON or CSV file defining the packages.
+	File string `json:"file"`
+
+	// Watch is how often the modification time of the file is checked. If the file changed, its packages replace the
+	// served ones. If it fails to load, the previous packages keep being served.
+	//
+	// If zero, the file is only read once.
+	Watch caddy.Duration `json:"watch,omitempty"`
+
+	packages *packageSet
+	ctx      caddy.Context
+	logger   *zap.Logger
+}
+
+// packageSet is a set of packages replaced as a whole.
+type packageSet struct {
+	mu       sync.RWMutex
+	packages []*GoPackage
+}
+
+// get returns the packages, most specific first. The returned slice must not be modified.
+func (s *packageSet) get() []*GoPackage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.packages
+}
+
+// swap replaces the packages and returns the previous ones.
+func (s *packageSet) swap(packages []*GoPackage) []*GoPackage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.packages
+	s.packages = packages
+	return old
+}
+
+// CaddyModule returns the Caddy module information.
+func (PackageFile) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.gopkg_file",
+		New: func() caddy.Module {
+			return new(PackageFile)
+		},
+	}
+}
+
+// Provision implements caddy.Provisioner. It fails if the file cannot be loaded, and starts watching it.
+func (p *PackageFile) Provision(ctx caddy.Context) error {
+	p.ctx = ctx
+	p.logger = ctx.Logger(p)
+	p.packages = new(packageSet)
+
+	fi, err := os.Stat(p.File)
+	if err != nil {
+		return err
+	}
+	if err := p.load(); err != nil {
+		return err
+	}
+
+	if p.Watch > 0 {
+		go p.watch(fi.ModTime())
+	}
+
+	return nil
+}
+
+// load loads and provisions the packages of the file and replaces the served ones with them.
+func (p *PackageFile) load() error {
+	packages, err := LoadPackageFile(p.File)
+	if err != nil {
+		return err
+	}
+	for i, m := range packages {
+		if err := provisionPackage(p.ctx, m); err != nil {
+			for _, provisioned := range packages[:i] {
+				provisioned.Cleanup()
+			}
+			return fmt.Errorf("%s: package %q: %v", p.File, m.Path, err)
+		}
+	}
+
+	for _, m := range p.packages.swap(sortMostSpecific(packages)) {
+		m.Cleanup()
+	}
+	return nil
+}
+
+// watch reloads the file whenever its modification time changes, until the config is unloaded.
+func (p *PackageFile) watch(modTime time.Time) {
+	ticker := time.NewTicker(time.Duration(p.Watch))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(p.File)
+		if err != nil {
+			p.logger.Warn("checking package file", zap.String("file", p.File), zap.Error(err))
+			continue
+		}
+		if fi.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = fi.ModTime()
+
+		if err := p.load(); err != nil {
+			p.logger.Warn("reloading package file, keeping the previous packages",
+				zap.String("file", p.File),
+				zap.Error(err))
+			continue
+		}
+		p.logger.Info("reloaded package file", zap.String("file", p.File))
+	}
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (p PackageFile) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	return servePackages(p.packages.get(), w, r, next)
+}
+
+// Cleanup implements caddy.CleanerUpper. It deregisters the packages of the file.
+func (p *PackageFile) Cleanup() error {
+	if p.packages == nil {
+		return nil
+	}
+	for _, m := range p.packages.swap(nil) {
+		m.Cleanup()
+	}
+	return nil
+}
+
+// readPackageJSON reads packages from a JSON object mapping paths to package configs.
+func readPackageJSON(r io.Reader) ([]*GoPackage, error) {
+	var entries map[string]*GoPackage
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	packages := make([]*GoPackage, 0, len(entries))
+	for path, m := range entries {
+		if m == nil {
+			return nil, fmt.Errorf("package %q: missing config", path)
+		}
+		m.Path = path
+		packages = append(packages, m)
+	}
+
+	return packages, nil
+}
+
+// readPackageCSV reads packages from CSV records of the form `<path>,<vcs>,<url>`.
+func readPackageCSV(r io.Reader) ([]*GoPackage, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 3
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+
+	var packages []*GoPackage
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, New(record[0], record[1], record[2]))
+	}
+
+	return packages, nil
+}
+
+// validatePackageEntry checks that a package loaded from a file can be served.
+func validatePackageEntry(m *GoPackage) error {
+	if !strings.HasPrefix(m.Path, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+	if m.URL == "" {
+		return fmt.Errorf("missing url")
+	}
+	for _, submodule := range m.Submodules {
+		if err := validateSubmodulePath(submodule.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*PackageFile)(nil)
+	_ caddy.CleanerUpper          = (*PackageFile)(nil)
+	_ caddyhttp.MiddlewareHandler = (*PackageFile)(nil)
+)
@@ -0,0 +1,252 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// writePackageFile writes content to a file with the given name in a temporary directory.
+func writePackageFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "gopkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadPackageFileJSON(t *testing.T) {
+	filename := writePackageFile(t, "packages.json", `{
+		"/foo": {"url": "https://github.com/example/foo"},
+		"/bar": {"vcs": "hg", "url": "https://hg.example.com/bar", "submodules": [{"path": "/baz"}, {"path": "*"}]}
+	}`)
+
+	packages, err := LoadPackageFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*GoPackage{
+		{Path: "/bar", Vcs: "hg", URL: "https://hg.example.com/bar", Submodules: []Submodule{{Path: "/baz"}, {Path: WildcardSubmodule}}},
+		{Path: "/foo", URL: "https://github.com/example/foo"},
+	}
+	if !reflect.DeepEqual(packages, want) {
+		t.Errorf("expected %+v, got %+v", want, packages)
+	}
+}
+
+func TestLoadPackageFileCSV(t *testing.T) {
+	filename := writePackageFile(t, "packages.csv", "# path,vcs,url\n/foo,,https://github.com/example/foo\n/bar,hg,https://hg.example.com/bar\n")
+
+	packages, err := LoadPackageFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*GoPackage{
+		New("/bar", "hg", "https://hg.example.com/bar"),
+		New("/foo", "", "https://github.com/example/foo"),
+	}
+	if !reflect.DeepEqual(packages, want) {
+		t.Errorf("expected %+v, got %+v", want, packages)
+	}
+}
+
+func TestLoadPackageFileMalformed(t *testing.T) {
+	tests := map[string]string{
+		"packages.json": `{"/foo": {"url": "https://github.com/example/foo"}, "bar": {"url": "https://github.com/example/bar"}}`,
+		"missing.json":  `{"/foo": {}}`,
+		"subpath.json":  `{"/foo": {"url": "https://github.com/example/foo", "submodules": [{"path": "bar"}]}}`,
+		"unknown.json":  `{"/foo": {"url": "https://github.com/example/foo", "repo": "foo"}}`,
+		"syntax.json":   `{"/foo": `,
+		"fields.csv":    "/foo,https://github.com/example/foo\n",
+	}
+
+	for name, content := range tests {
+		if _, err := LoadPackageFile(writePackageFile(t, name, content)); err == nil {
+			t.Errorf("%s: expected error for %s", name, content)
+		}
+	}
+}
+
+func TestParsePackageFile(t *testing.T) {
+	filename := writePackageFile(t, "packages.json", `{
+		"/foo": {"url": "https://github.com/example/foo"},
+		"/bar": {"url": "https://github.com/example/bar"}
+	}`)
+
+	blocks, err := caddyfile.Parse("Caddyfile", []byte(":80 {\ngopkg_file "+filename+"\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := parsePackageFile(httpcaddyfile.Helper{Dispenser: caddyfile.NewDispenser(blocks[0].Segments[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(routes))
+	}
+
+	for i, want := range []string{`["/bar","/bar/","/bar/*"]`, `["/foo","/foo/","/foo/*"]`} {
+		route := routes[i].Value.(caddyhttp.Route)
+		if got := string(route.MatcherSetsRaw[0]["path"]); got != want {
+			t.Errorf("route %d: expected path matcher %s, got %s", i, want, got)
+		}
+	}
+}
+
+func TestParsePackageFileWatch(t *testing.T) {
+	for input, want := range map[string]caddy.Duration{
+		"gopkg_file packages.json {\n\twatch\n}":    DefaultWatchInterval,
+		"gopkg_file packages.json {\n\twatch 1m\n}": caddy.Duration(time.Minute),
+	} {
+		blocks, err := caddyfile.Parse("Caddyfile", []byte(":80 {\n"+input+"\n}\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		routes, err := parsePackageFile(httpcaddyfile.Helper{Dispenser: caddyfile.NewDispenser(blocks[0].Segments[0])})
+		if err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+		if len(routes) != 1 {
+			t.Fatalf("%q: expected a single route, got %d", input, len(routes))
+		}
+
+		var handler PackageFile
+		if err := json.Unmarshal(routes[0].Value.(caddyhttp.Route).HandlersRaw[0], &handler); err != nil {
+			t.Fatal(err)
+		}
+		if handler.File != "packages.json" || handler.Watch != want {
+			t.Errorf("%q: expected file packages.json watched every %v, got %+v", input, want, handler)
+		}
+	}
+
+	for _, input := range []string{"gopkg_file packages.json {\n\twatch 0s\n}", "gopkg_file packages.json {\n\tpoll\n}"} {
+		blocks, err := caddyfile.Parse("Caddyfile", []byte(":80 {\n"+input+"\n}\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parsePackageFile(httpcaddyfile.Helper{Dispenser: caddyfile.NewDispenser(blocks[0].Segments[0])}); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
+
+func TestPackageFileWatch(t *testing.T) {
+	filename := writePackageFile(t, "packages.json", `{"/foo": {"url": "https://github.com/example/foo"}}`)
+
+	ctx, cancel := caddy.NewContext(testContext)
+	defer cancel()
+
+	p := &PackageFile{File: filename, Watch: caddy.Duration(10 * time.Millisecond)}
+	if err := p.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Cleanup()
+
+	serveFile := func(target string) *httptest.ResponseRecorder {
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusTeapot)
+			return nil
+		})
+		w := httptest.NewRecorder()
+		if err := p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil), next); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	// update writes the file with a new modification time, so the change is seen regardless of the timestamp
+	// resolution of the file system.
+	modTime := time.Now()
+	update := func(content string) {
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// eventually waits for the packages of the file to be reloaded.
+	eventually := func(target string, wantCode int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for serveFile(target).Code != wantCode {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: expected status %d after reloading", target, wantCode)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if w := serveFile("http://example.com/foo?go-get=1"); w.Code != http.StatusOK {
+		t.Errorf("expected package from the file to be served, got %d", w.Code)
+	}
+	if w := serveFile("http://example.com/bar?go-get=1"); w.Code != http.StatusTeapot {
+		t.Errorf("expected unknown package to pass to the next handler, got %d", w.Code)
+	}
+
+	update(`{"/bar": {"url": "https://github.com/example/bar"}}`)
+	eventually("http://example.com/bar?go-get=1", http.StatusOK)
+	if w := serveFile("http://example.com/foo?go-get=1"); w.Code != http.StatusTeapot {
+		t.Errorf("expected removed package to pass to the next handler, got %d", w.Code)
+	}
+
+	// A broken file keeps the previous packages
+	update(`{"/bar": `)
+	time.Sleep(100 * time.Millisecond)
+	if w := serveFile("http://example.com/bar?go-get=1"); w.Code != http.StatusOK {
+		t.Errorf("expected previous packages to be served after a failed reload, got %d", w.Code)
+	}
+}
+
+func TestPackageFileReloadInvalid(t *testing.T) {
+	filename := writePackageFile(t, "packages.json", `{"/foo": {"url": "https://github.com/example/foo"}}`)
+
+	ctx, cancel := caddy.NewContext(testContext)
+	defer cancel()
+
+	p := &PackageFile{File: filename}
+	if err := p.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Cleanup()
+	app := p.packages.get()[0].app
+
+	// The second package fails to provision, so the first one must not stay registered
+	content := `{"/reloaded": {"url": "https://github.com/example/reloaded"}, "/reloaded/invalid": {"url": "https://github.com/example/invalid", "redirect_code": 200}}`
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.load(); err == nil {
+		t.Fatal("expected error for invalid package")
+	}
+	for _, m := range app.Packages() {
+		if m.Path == "/reloaded" {
+			t.Error("expected package of the failed reload to be deregistered")
+		}
+	}
+	if packages := p.packages.get(); len(packages) != 1 || packages[0].Path != "/foo" {
+		t.Errorf("expected previous packages to be kept, got %v", packages)
+	}
+}
@@ -0,0 +1,251 @@
+package gopkg
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(Packages{})
+	httpcaddyfile.RegisterDirective("gopkg_packages", parsePackages)
+}
+
+// Packages serves many packages from a single handler, instead of a route and handler per package. A request is
+// matched to its package by looking up the request path and its parent paths in a map, so routing does not slow down
+// with the number of packages.
+//
+// Packages with path variables or CaseInsensitive set cannot be looked up by path, and are matched one by one.
+// Requests not matching any of the packages are passed to the next handler.
+//
+// Hosts have packages of their own, so one handler can serve several vanity domains with isolated packages.
+type Packages struct {
+	// Packages are the served packages. If several packages have the same path, the first one wins.
+	Packages []*GoPackage `json:"packages,omitempty"`
+
+	// Hosts are the packages served for a host, by hostname. Requests for one of the hosts are served from its
+	// packages only, while requests for any other host are served from Packages.
+	Hosts map[string][]*GoPackage `json:"hosts,omitempty"`
+
+	index packageIndex
+	hosts map[string]*packageIndex
+
+	// trustedProxies are the trusted proxies of all packages, whose X-Forwarded-Host selects the host.
+	trustedProxies []*net.IPNet
+}
+
+// packageIndex looks packages up by path.
+type packageIndex struct {
+	byPath   map[string]*GoPackage
+	patterns []*GoPackage
+}
+
+// CaddyModule returns the Caddy module information.
+func (Packages) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.gopkg_packages",
+		New: func() caddy.Module {
+			return new(Packages)
+		},
+	}
+}
+
+// parsePackages parses the gopkg_packages directive in a caddyfile. Syntax:
+//
+//     gopkg_packages {
+//         <path> [<vcs>] <uri> {
+//             <options>
+//         }
+//         host <hostname> {
+//             <path> [<vcs>] <uri> {
+//                 <options>
+//             }
+//         }
+//     }
+//
+// Each line of the block defines a package like a gopkg directive, starting from the gopkg_defaults, and takes the
+// same options except match, as the packages share a single route. The packages in a host block are only served for
+// that host.
+func parsePackages(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	p := new(Packages)
+	for h.Next() {
+		if h.NextArg() {
+			return nil, h.ArgErr()
+		}
+		for h.NextBlock(0) {
+			if h.Val() != "host" {
+				m, err := parsePackagesEntry(h)
+				if err != nil {
+					return nil, err
+				}
+				p.Packages = append(p.Packages, m)
+				continue
+			}
+
+			var host string
+			if !h.Args(&host) || h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			host = strings.ToLower(host)
+			if _, ok := p.Hosts[host]; ok {
+				return nil, h.Errf("duplicate host %s", host)
+			}
+			if p.Hosts == nil {
+				p.Hosts = make(map[string][]*GoPackage)
+			}
+			p.Hosts[host] = []*GoPackage{}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				m, err := parsePackagesEntry(h)
+				if err != nil {
+					return nil, err
+				}
+				p.Hosts[host] = append(p.Hosts[host], m)
+			}
+		}
+	}
+	return h.NewRoute(nil, p), nil
+}
+
+// parsePackagesEntry parses a package in the block of a gopkg_packages directive.
+func parsePackagesEntry(h httpcaddyfile.Helper) (*GoPackage, error) {
+	m := packageDefaults(h)
+	m.Path = h.Val()
+	if err := m.unmarshalPackage(h.Dispenser); err != nil {
+		return nil, err
+	}
+	if m.Match != "" {
+		return nil, h.Errf("package %s: match is not supported by gopkg_packages", m.Path)
+	}
+	return m, nil
+}
+
+// Provision implements caddy.Provisioner. It provisions and validates the packages and indexes them by path.
+func (p *Packages) Provision(ctx caddy.Context) error {
+	if err := p.index.provision(ctx, p.Packages); err != nil {
+		return err
+	}
+
+	p.trustedProxies = nil
+	for _, m := range p.Packages {
+		p.trustedProxies = append(p.trustedProxies, m.trustedProxies...)
+	}
+
+	p.hosts = make(map[string]*packageIndex, len(p.Hosts))
+	for host, packages := range p.Hosts {
+		index := new(packageIndex)
+		if err := index.provision(ctx, packages); err != nil {
+			return fmt.Errorf("host %s: %v", host, err)
+		}
+		p.hosts[strings.ToLower(host)] = index
+		for _, m := range packages {
+			p.trustedProxies = append(p.trustedProxies, m.trustedProxies...)
+		}
+	}
+
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (p Packages) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if m := p.lookup(p.requestHost(r), r.URL.Path); m != nil {
+		return m.ServeHTTP(w, r, next)
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// requestHost returns the host the packages are looked up for, resolved like the packages do: the X-Forwarded-Host
+// header set by a proxy one of the packages trusts, or the Host of the request itself.
+func (p Packages) requestHost(r *http.Request) string {
+	if fwdHost := forwardedHeader(r, p.trustedProxies, "X-Forwarded-Host"); fwdHost != "" {
+		return fwdHost
+	}
+	return r.Host
+}
+
+// lookup returns the most specific package handling the request path for the host, or nil if there is none.
+func (p Packages) lookup(host, reqPath string) *GoPackage {
+	if len(p.hosts) > 0 {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if index, ok := p.hosts[strings.ToLower(host)]; ok {
+			return index.lookup(reqPath)
+		}
+	}
+	return p.index.lookup(reqPath)
+}
+
+// provision provisions and validates the packages and indexes them by path.
+func (x *packageIndex) provision(ctx caddy.Context, packages []*GoPackage) error {
+	x.byPath = make(map[string]*GoPackage, len(packages))
+	x.patterns = nil
+
+	for _, m := range packages {
+		if err := provisionPackage(ctx, m); err != nil {
+			return fmt.Errorf("package %q: %v", m.Path, err)
+		}
+
+		if m.pathPattern != nil || m.CaseInsensitive {
+			x.patterns = append(x.patterns, m)
+			continue
+		}
+		if _, ok := x.byPath[m.MountPrefix+m.Path]; !ok {
+			x.byPath[m.MountPrefix+m.Path] = m
+		}
+	}
+	sortMostSpecific(x.patterns)
+
+	return nil
+}
+
+// lookup returns the most specific package handling the request path, or nil if there is none.
+func (x *packageIndex) lookup(reqPath string) *GoPackage {
+	var found *GoPackage
+	for prefix := reqPath; prefix != ""; {
+		if m, ok := x.byPath[prefix]; ok {
+			found = m
+			break
+		}
+		i := strings.LastIndexByte(prefix, '/')
+		if i < 0 {
+			break
+		}
+		prefix = prefix[:i]
+	}
+
+	// Packages matched one by one only win if they are more specific
+	for _, m := range x.patterns {
+		if found != nil && len(m.MountPrefix+m.Path) <= len(found.MountPrefix+found.Path) {
+			break
+		}
+		if m.handles(reqPath) {
+			return m
+		}
+	}
+	return found
+}
+
+// Cleanup implements caddy.CleanerUpper. It deregisters the packages.
+func (p *Packages) Cleanup() error {
+	for _, m := range p.Packages {
+		m.Cleanup()
+	}
+	for _, packages := range p.Hosts {
+		for _, m := range packages {
+			m.Cleanup()
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Packages)(nil)
+	_ caddy.CleanerUpper          = (*Packages)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Packages)(nil)
+)
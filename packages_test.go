@@ -0,0 +1,173 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// parsePackagesDirective parses a gopkg_packages directive into its handler.
+func parsePackagesDirective(t *testing.T, input string) (*Packages, error) {
+	t.Helper()
+
+	blocks, err := caddyfile.Parse("Caddyfile", []byte(":80 {\n"+input+"\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := parsePackages(httpcaddyfile.Helper{Dispenser: caddyfile.NewDispenser(blocks[0].Segments[0])})
+	if err != nil {
+		return nil, err
+	}
+	if len(routes) != 1 {
+		t.Fatalf("expected a single route, got %d", len(routes))
+	}
+
+	p := new(Packages)
+	if err := json.Unmarshal(routes[0].Value.(caddyhttp.Route).HandlersRaw[0], p); err != nil {
+		t.Fatal(err)
+	}
+	return p, nil
+}
+
+func TestServePackages(t *testing.T) {
+	p, err := parsePackagesDirective(t, `gopkg_packages {
+		/foo https://github.com/example/foo
+		/foo/bar hg https://hg.example.com/bar {
+			submodule /baz https://hg.example.com/baz
+		}
+		/~{user}/lib https://github.com/{user}/lib
+		/foo/* https://github.com/example/{1}
+		/foo https://github.com/example/duplicate
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Packages) != 5 {
+		t.Fatalf("expected 5 packages, got %d", len(p.Packages))
+	}
+	if err := p.Provision(testContext); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Cleanup()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/foo?go-get=1", "example.com/foo git https://github.com/example/foo"},
+		{"http://example.com/foo/?go-get=1", "example.com/foo git https://github.com/example/foo"},
+		{"http://example.com/foo/bar/pkg?go-get=1", "example.com/foo/bar hg https://hg.example.com/bar"},
+		{"http://example.com/foo/bar/baz?go-get=1", "example.com/foo/bar/baz hg https://hg.example.com/baz"},
+		{"http://example.com/foo/qux/pkg?go-get=1", "example.com/foo/qux git https://github.com/example/qux"},
+		{"http://example.com/~alice/lib?go-get=1", "example.com/~alice/lib git https://github.com/alice/lib"},
+		{"http://example.com/foobar?go-get=1", ""},
+		{"http://example.com/other?go-get=1", ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		if err := p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.target, nil), next); err != nil {
+			t.Fatalf("%s: %v", test.target, err)
+		}
+		if test.want == "" {
+			if w.Code != http.StatusTeapot {
+				t.Errorf("%s: expected request to pass to the next handler, got %d", test.target, w.Code)
+			}
+			continue
+		}
+		if body := w.Body.String(); !strings.Contains(body, `content="`+test.want+`"`) {
+			t.Errorf("%s: expected go-import %q, got %s", test.target, test.want, body)
+		}
+	}
+}
+
+func TestServePackagesHosts(t *testing.T) {
+	p, err := parsePackagesDirective(t, `gopkg_packages {
+		/foo https://github.com/example/foo
+		host go.example.org {
+			/foo https://github.com/example-org/foo
+			/bar https://github.com/example-org/bar {
+				trusted_proxies 192.0.2.0/24
+			}
+		}
+		host Go.Example.NET {
+			/foo https://github.com/example-net/foo
+		}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Provision(testContext); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Cleanup()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/foo?go-get=1", "example.com/foo git https://github.com/example/foo"},
+		{"http://go.example.org/foo?go-get=1", "go.example.org/foo git https://github.com/example-org/foo"},
+		{"http://go.example.org:8080/bar?go-get=1", "go.example.org:8080/bar git https://github.com/example-org/bar"},
+		{"http://GO.example.net/foo?go-get=1", "GO.example.net/foo git https://github.com/example-net/foo"},
+		{"http://example.com/bar?go-get=1", ""},
+		{"http://go.example.net/bar?go-get=1", ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		if err := p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.target, nil), next); err != nil {
+			t.Fatalf("%s: %v", test.target, err)
+		}
+		if test.want == "" {
+			if w.Code != http.StatusTeapot {
+				t.Errorf("%s: expected request to pass to the next handler, got %d", test.target, w.Code)
+			}
+			continue
+		}
+		if body := w.Body.String(); !strings.Contains(body, `content="`+test.want+`"`) {
+			t.Errorf("%s: expected go-import %q, got %s", test.target, test.want, body)
+		}
+	}
+
+	// Behind a trusted proxy, the packages of the host requested by the client are served
+	r := httptest.NewRequest(http.MethodGet, "http://backend.internal/bar?go-get=1", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-Host", "go.example.org")
+	w := httptest.NewRecorder()
+	if err := p.ServeHTTP(w, r, next); err != nil {
+		t.Fatal(err)
+	}
+	if want := "go.example.org/bar git https://github.com/example-org/bar"; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("expected go-import %q for X-Forwarded-Host of a trusted proxy, got %s", want, w.Body.String())
+	}
+}
+
+func TestParsePackagesErrors(t *testing.T) {
+	for _, input := range []string{
+		"gopkg_packages /foo",
+		"gopkg_packages {\n\t/foo\n}",
+		"gopkg_packages {\n\t/foo https://github.com/example/foo {\n\t\tmatch go-get\n\t}\n}",
+		"gopkg_packages {\n\thost {\n\t\t/foo https://github.com/example/foo\n\t}\n}",
+		"gopkg_packages {\n\thost a.example b.example {\n\t}\n}",
+		"gopkg_packages {\n\thost a.example {\n\t}\n\thost A.example {\n\t}\n}",
+	} {
+		if _, err := parsePackagesDirective(t, input); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package gopkg
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pathVarRegexp matches a path variable like `{user}`, or `{1}` for a wildcard segment. Caddy placeholders like
+// `{http.request.host}` contain dots and are no path variables.
+var pathVarRegexp = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*|[1-9][0-9]*)\}`)
+
+// numberWildcards replaces the wildcard segments `*` of a path with the positional variables `{n+1}`, `{n+2}`,
+// etc., continuing after the n wildcards numbered before. It returns the path and the number of wildcards numbered
+// so far.
+func numberWildcards(p string, n int) (string, int) {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		if segment == "*" {
+			n++
+			segments[i] = "{" + strconv.Itoa(n) + "}"
+		}
+	}
+	return strings.Join(segments, "/"), n
+}
+
+// compilePathPattern compiles the pattern matching a path with variables and its prefixes, returning the variable
+// names in order. defined holds the variables defined so far and is extended by those of p.
+func compilePathPattern(p string, caseInsensitive bool, defined map[string]bool) (*regexp.Regexp, []string, error) {
+	var names []string
+	pattern := "^"
+	last := 0
+	for _, loc := range pathVarRegexp.FindAllStringSubmatchIndex(p, -1) {
+		name := p[loc[2]:loc[3]]
+		if defined[name] {
+			return nil, nil, fmt.Errorf("path variable {%s} is used more than once in %s", name, p)
+		}
+		defined[name] = true
+		names = append(names, name)
+
+		pattern += regexp.QuoteMeta(p[last:loc[0]]) + "([^/]+)"
+		last = loc[1]
+	}
+	pattern += regexp.QuoteMeta(p[last:]) + "(?:/|$)"
+
+	if len(names) == 0 {
+		return nil, nil, nil
+	}
+
+	if caseInsensitive {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, nil, fmt.Errorf("compiling path pattern: %v", err)
+	}
+	return re, names, nil
+}
+
+// compilePathVars compiles the patterns matching request paths if the package path or submodule paths contain
+// variables, and checks that the URLs and import paths only use variables defined by the path. Wildcard segments of
+// the paths are turned into positional variables first, numbering those of submodules after those of the package.
+func (m *GoPackage) compilePathVars() error {
+	var numbered int
+	m.Path, numbered = numberWildcards(m.Path, 0)
+
+	defined := make(map[string]bool)
+	var err error
+	m.pathPattern, m.pathVars, err = compilePathPattern(m.Path, m.CaseInsensitive, defined)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range append([]string{m.URL, m.BrowserRedirect, m.ImportPath}, m.Mirrors...) {
+		if err := checkPathVars(u, m.Path, defined); err != nil {
+			return err
+		}
+	}
+
+	for i := range m.Submodules {
+		submodule := &m.Submodules[i]
+		if submodule.Path == WildcardSubmodule {
+			continue
+		}
+		submodule.Path, _ = numberWildcards(submodule.Path, numbered)
+
+		submoduleDefined := make(map[string]bool, len(defined))
+		for name := range defined {
+			submoduleDefined[name] = true
+		}
+		submodule.pathPattern, submodule.pathVars, err = compilePathPattern(submodule.Path, m.CaseInsensitive, submoduleDefined)
+		if err != nil {
+			return err
+		}
+
+		for _, u := range []string{submodule.URL, submodule.BrowserURL, submodule.ImportPath} {
+			if err := checkPathVars(u, m.Path+submodule.Path, submoduleDefined); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkPathVars checks that u only uses the variables defined by path p.
+func checkPathVars(u, p string, defined map[string]bool) error {
+	for _, match := range pathVarRegexp.FindAllStringSubmatch(u, -1) {
+		if !defined[match[1]] {
+			return fmt.Errorf("variable {%s} in %s does not appear in path %s", match[1], u, p)
+		}
+	}
+	return nil
+}
+
+// matchPathVars matches a request path against a package path with variables. It returns the request path with the
+// matched prefix replaced by the generic package path, e.g. `/~{user}/lib/sub` for `/~alice/lib/sub`, along with the
+// variable values. ok is false if the path does not match.
+//
+// Request paths are returned unchanged for packages without path variables.
+func (m GoPackage) matchPathVars(reqPath string) (genericPath string, vars map[string]string, ok bool) {
+	if m.pathPattern == nil {
+		return reqPath, nil, true
+	}
+
+	match := m.pathPattern.FindStringSubmatch(reqPath)
+	if match == nil {
+		return "", nil, false
+	}
+
+	vars = make(map[string]string, len(m.pathVars))
+	for i, name := range m.pathVars {
+		vars[name] = match[i+1]
+	}
+
+	rest := reqPath[len(strings.TrimSuffix(match[0], "/")):]
+	return m.Path + rest, vars, true
+}
+
+// matchSubmoduleVars matches a request path in the generic form of the package path against the submodules with
+// path variables. If one of them matches a longer prefix than any literal submodule, the request path is returned
+// with the matched prefix replaced by the generic submodule path, e.g. `/tools/{1}/cmd` for `/tools/lint/cmd`, along
+// with vars extended by the values of the submodule variables. Otherwise the request path and vars are returned
+// unchanged.
+func (m GoPackage) matchSubmoduleVars(reqPath string, vars map[string]string) (string, map[string]string) {
+	if len(m.submodulePatterns) == 0 || len(reqPath) <= len(m.Path) || !m.samePath(reqPath[:len(m.Path)+1], m.Path+"/") {
+		return reqPath, vars
+	}
+
+	// Literal submodules take precedence over patterns matching the same prefix
+	longest := 0
+	if target := m.ResolveTarget(reqPath); target.Submodule != nil && target.Submodule.Path != WildcardSubmodule {
+		longest = len(target.Submodule.Path)
+	}
+
+	rest := reqPath[len(m.Path):]
+	var best *Submodule
+	var bestMatch []string
+	for _, submodule := range m.submodulePatterns {
+		match := submodule.pathPattern.FindStringSubmatch(rest)
+		if match == nil || len(strings.TrimSuffix(match[0], "/")) <= longest {
+			continue
+		}
+		longest = len(strings.TrimSuffix(match[0], "/"))
+		best = submodule
+		bestMatch = match
+	}
+	if best == nil {
+		return reqPath, vars
+	}
+
+	merged := make(map[string]string, len(vars)+len(best.pathVars))
+	for name, value := range vars {
+		merged[name] = value
+	}
+	for i, name := range best.pathVars {
+		merged[name] = bestMatch[i+1]
+	}
+	return m.Path + best.Path + rest[longest:], merged
+}
+
+// expandPathVars substitutes the values of path variables in s.
+func expandPathVars(s string, vars map[string]string) string {
+	if len(vars) == 0 {
+		return s
+	}
+	return pathVarRegexp.ReplaceAllStringFunc(s, func(v string) string {
+		if value, ok := vars[v[1:len(v)-1]]; ok {
+			return value
+		}
+		return v
+	})
+}
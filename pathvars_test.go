@@ -0,0 +1,155 @@
+package gopkg
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServeHTTPPathVars(t *testing.T) {
+	m := parseDirective(t, `gopkg /~{user}/lib https://github.com/{user}/lib {
+		submodule /sub https://github.com/{user}/lib-sub
+	}`)
+	provision(t, m)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/~alice/lib?go-get=1", `content="example.com/~alice/lib git https://github.com/alice/lib"`},
+		{"http://example.com/~bob/lib/pkg?go-get=1", `content="example.com/~bob/lib git https://github.com/bob/lib"`},
+		{"http://example.com/~bob/lib/sub/pkg?go-get=1", `content="example.com/~bob/lib/sub git https://github.com/bob/lib-sub"`},
+	}
+	for _, test := range tests {
+		if body := serve(t, m, http.MethodGet, test.target).Body.String(); !strings.Contains(body, test.want) {
+			t.Errorf("%s: expected %s, got %s", test.target, test.want, body)
+		}
+	}
+
+	w := serve(t, m, http.MethodGet, "http://example.com/~alice/lib/sub")
+	if loc := w.Header().Get("Location"); loc != "https://github.com/alice/lib-sub" {
+		t.Errorf("expected redirect to expanded url, got %q", loc)
+	}
+
+	if w := serve(t, m, http.MethodGet, "http://example.com/~alice/other?go-get=1"); w.Code != http.StatusTeapot {
+		t.Errorf("expected non-matching path to pass to the next handler, got %d", w.Code)
+	}
+}
+
+func TestProvisionPathVarsUndefined(t *testing.T) {
+	for _, input := range []string{
+		"gopkg /~{user}/lib https://github.com/{owner}/lib",
+		"gopkg /{a}/{a} https://github.com/{a}/lib",
+		`gopkg /lib https://github.com/example/lib {
+			submodule /sub https://github.com/{user}/sub
+		}`,
+	} {
+		if err := parseDirective(t, input).Provision(testContext); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
+
+func TestServeHTTPPathVarsPrefix(t *testing.T) {
+	m := provision(t, New("/go/{repo}", "", "https://github.com/example/{repo}").WithSubmodule("/v2", "https://github.com/example/{repo}-v2"))
+
+	tests := []struct {
+		target   string
+		wantMeta string
+		wantURL  string
+	}{
+		{"http://example.com/go/chrisify/pkg", `content="example.com/go/chrisify git https://github.com/example/chrisify"`, "https://github.com/example/chrisify"},
+		{"http://example.com/go/chrisify/v2/pkg", `content="example.com/go/chrisify/v2 git https://github.com/example/chrisify-v2"`, "https://github.com/example/chrisify-v2"},
+	}
+	for _, test := range tests {
+		if body := serve(t, m, http.MethodGet, test.target+"?go-get=1").Body.String(); !strings.Contains(body, test.wantMeta) {
+			t.Errorf("%s: expected %s, got %s", test.target, test.wantMeta, body)
+		}
+		if loc := serve(t, m, http.MethodGet, test.target).Header().Get("Location"); loc != test.wantURL {
+			t.Errorf("%s: expected redirect to %s, got %q", test.target, test.wantURL, loc)
+		}
+	}
+}
+
+func TestServeHTTPPathVarsWildcard(t *testing.T) {
+	m := parseDirective(t, "gopkg /x/* git https://github.com/myorg/{1}")
+	provision(t, m)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/x/tool?go-get=1", `content="example.com/x/tool git https://github.com/myorg/tool"`},
+		{"http://example.com/x/lib/pkg?go-get=1", `content="example.com/x/lib git https://github.com/myorg/lib"`},
+	}
+	for _, test := range tests {
+		if body := serve(t, m, http.MethodGet, test.target).Body.String(); !strings.Contains(body, test.want) {
+			t.Errorf("%s: expected %s, got %s", test.target, test.want, body)
+		}
+	}
+
+	if w := serve(t, m, http.MethodGet, "http://example.com/x?go-get=1"); w.Code != http.StatusTeapot {
+		t.Errorf("expected path without the wildcard segment to pass to the next handler, got %d", w.Code)
+	}
+
+	m = provision(t, New("/*/*", "", "https://github.com/{2}/{1}"))
+	want := `content="example.com/repo/team git https://github.com/team/repo"`
+	if body := serve(t, m, http.MethodGet, "http://example.com/repo/team?go-get=1").Body.String(); !strings.Contains(body, want) {
+		t.Errorf("expected wildcards to be numbered in order %s, got %s", want, body)
+	}
+
+	if err := New("/x/*", "", "https://github.com/myorg/{2}").Provision(testContext); err == nil {
+		t.Error("expected error for undefined positional variable")
+	}
+}
+
+func TestServeHTTPSubmodulePathVars(t *testing.T) {
+	m := parseDirective(t, `gopkg /foo https://github.com/org/foo {
+		submodule /tools/* https://github.com/org/tools-{1}
+		submodule /tools/special https://github.com/org/special
+		submodule /{team}/lib https://github.com/{team}/lib
+		submodule /a https://github.com/org/a
+	}`)
+	provision(t, m)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/foo/tools/lint?go-get=1", `content="example.com/foo/tools/lint git https://github.com/org/tools-lint"`},
+		{"http://example.com/foo/tools/fmt/cmd?go-get=1", `content="example.com/foo/tools/fmt git https://github.com/org/tools-fmt"`},
+		{"http://example.com/foo/tools/fmt/v2?go-get=1", `content="example.com/foo/tools/fmt/v2 git https://github.com/org/tools-fmt"`},
+		{"http://example.com/foo/tools/special/cmd?go-get=1", `content="example.com/foo/tools/special git https://github.com/org/special"`},
+		{"http://example.com/foo/infra/lib?go-get=1", `content="example.com/foo/infra/lib git https://github.com/infra/lib"`},
+		{"http://example.com/foo/tools?go-get=1", `content="example.com/foo git https://github.com/org/foo"`},
+	}
+	for _, test := range tests {
+		if body := serve(t, m, http.MethodGet, test.target).Body.String(); !strings.Contains(body, test.want) {
+			t.Errorf("%s: expected %s, got %s", test.target, test.want, body)
+		}
+	}
+
+	if loc := serve(t, m, http.MethodGet, "http://example.com/foo/tools/lint").Header().Get("Location"); loc != "https://github.com/org/tools-lint" {
+		t.Errorf("expected redirect to expanded url, got %q", loc)
+	}
+
+	// Wildcards of submodules are numbered after those of the package
+	m = provision(t, New("/x/*", "", "https://github.com/{1}/main").WithSubmodule("/tools/*", "https://github.com/{1}/tools-{2}"))
+	want := `content="example.com/x/org/tools/lint git https://github.com/org/tools-lint"`
+	if body := serve(t, m, http.MethodGet, "http://example.com/x/org/tools/lint?go-get=1").Body.String(); !strings.Contains(body, want) {
+		t.Errorf("expected %s, got %s", want, body)
+	}
+
+	for _, input := range []string{
+		`gopkg /foo https://github.com/org/foo {
+			submodule /tools/* https://github.com/org/tools-{2}
+		}`,
+		`gopkg /{team} https://github.com/{team}/foo {
+			submodule /{team} https://github.com/{team}/sub
+		}`,
+	} {
+		if err := parseDirective(t, input).Provision(testContext); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
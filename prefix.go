@@ -0,0 +1,37 @@
+package gopkg
+
+import (
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func init() {
+	httpcaddyfile.RegisterDirective("gopkg_prefix", parsePrefix)
+}
+
+// parsePrefix parses the gopkg_prefix directive in a caddyfile. Syntax:
+//
+//     gopkg_prefix <prefix> [<vcs>] <base_uri> {
+//         <options>
+//     }
+//
+// It maps every repository below the prefix to the repository of the same name below the base uri, e.g.
+// `/libs/<name>` to `https://github.com/myorg/<name>` for `gopkg_prefix /libs github.com/myorg`. It is a shorthand
+// for `gopkg <prefix>/* [<vcs>] <base_uri>/{1}` and takes the same options.
+func parsePrefix(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	m := packageDefaults(h)
+	var prefix string
+	for h.Next() {
+		if !h.Args(&prefix) {
+			return nil, h.ArgErr()
+		}
+		if err := m.unmarshalPackage(h.Dispenser); err != nil {
+			return nil, err
+		}
+	}
+
+	m.Path = strings.TrimSuffix(prefix, "/") + "/*"
+	m.URL = strings.TrimSuffix(m.URL, "/") + "/{1}"
+	return packageRoute(h, m), nil
+}
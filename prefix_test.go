@@ -0,0 +1,57 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestParsePrefix(t *testing.T) {
+	blocks, err := caddyfile.Parse("Caddyfile", []byte(":80 {\ngopkg_prefix /libs/ github.com/myorg {\n\tsubmodule /v2\n}\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := parsePrefix(httpcaddyfile.Helper{Dispenser: caddyfile.NewDispenser(blocks[0].Segments[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := routes[0].Value.(caddyhttp.Route)
+	if got, want := string(route.MatcherSetsRaw[0]["path"]), `["/libs/*","/libs/*/","/libs/*/*"]`; got != want {
+		t.Errorf("expected path matcher %s, got %s", want, got)
+	}
+
+	m := new(GoPackage)
+	if err := json.Unmarshal(route.HandlersRaw[0], m); err != nil {
+		t.Fatal(err)
+	}
+	provision(t, m)
+	defer m.Cleanup()
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/libs/foo?go-get=1", `content="example.com/libs/foo git https://github.com/myorg/foo"`},
+		{"http://example.com/libs/bar/v2/pkg?go-get=1", `content="example.com/libs/bar/v2 git https://github.com/myorg/bar"`},
+	}
+	for _, test := range tests {
+		if body := serve(t, m, http.MethodGet, test.target).Body.String(); !strings.Contains(body, test.want) {
+			t.Errorf("%s: expected %s, got %s", test.target, test.want, body)
+		}
+	}
+
+	for _, input := range []string{"gopkg_prefix /libs", "gopkg_prefix"} {
+		blocks, err := caddyfile.Parse("Caddyfile", []byte(":80 {\n"+input+"\n}\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parsePrefix(httpcaddyfile.Helper{Dispenser: caddyfile.NewDispenser(blocks[0].Segments[0])}); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
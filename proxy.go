@@ -0,0 +1,385 @@
+package gopkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Proxy serves the module proxy protocol (GOPROXY) for the package and its submodules, so clients can fetch the
+// go-import metadata and the modules themselves from the same host.
+//
+// Modules are downloaded with the go command, which must be installed, from their source or an upstream proxy, and kept
+// in a module cache that serves as a read-through cache for later requests. Concurrent requests of the same file
+// share one go command, only a few go commands run at a time, and version lists are cached for a minute.
+type Proxy struct {
+	// CacheDir is the GOPATH of the go command, which keeps the module cache in its `pkg/mod` directory. GOMODCACHE
+	// is not used, as Go 1.14 ignores it.
+	//
+	// If empty, the default is `gopkg/modcache` in Caddy's data directory.
+	CacheDir string `json:"cache_dir,omitempty"`
+
+	// GoBin is the go command used to download modules.
+	//
+	// If empty, the default is `go` from the PATH.
+	GoBin string `json:"go_bin,omitempty"`
+
+	// Upstream is the module proxy modules are downloaded from, e.g. a company-wide proxy with access to the private
+	// repositories. The checksum database is not consulted for the modules.
+	//
+	// If empty, modules are downloaded directly from their source repositories.
+	Upstream string `json:"upstream,omitempty"`
+
+	fetcher moduleFetcher
+	logger  *zap.Logger
+}
+
+// moduleFetcher provides the module files served by a Proxy.
+type moduleFetcher interface {
+	// Versions returns the known versions of the module.
+	Versions(ctx context.Context, modPath string) ([]string, error)
+
+	// Download makes a version of the module available locally.
+	Download(ctx context.Context, modPath, version string) (*moduleFiles, error)
+}
+
+// moduleFiles are the paths of the local files of a module version.
+type moduleFiles struct {
+	Info  string
+	GoMod string
+	Zip   string
+}
+
+// proxyTimeout bounds the time spent downloading a module for a single request.
+const proxyTimeout = 2 * time.Minute
+
+// maxGoCommands bounds the number of go commands the proxy of a package runs at the same time.
+const maxGoCommands = 4
+
+// proxyListTTL is how long the version list of a module is cached.
+const proxyListTTL = time.Minute
+
+// maxCachedVersionLists bounds the number of cached version lists, after which the cache is dropped.
+const maxCachedVersionLists = 1024
+
+// versionRegexp matches the (escaped) versions accepted in proxy requests.
+var versionRegexp = regexp.MustCompile(`^v[0-9A-Za-z.+!-]+$`)
+
+// provision sets the defaults and prepares the go command.
+func (p *Proxy) provision(logger *zap.Logger) {
+	if p.CacheDir == "" {
+		p.CacheDir = filepath.Join(caddy.AppDataDir(), "gopkg", "modcache")
+	}
+	// The go command rejects a relative GOPATH
+	if dir, err := filepath.Abs(p.CacheDir); err == nil {
+		p.CacheDir = dir
+	}
+	if p.GoBin == "" {
+		p.GoBin = "go"
+	}
+	p.logger = logger
+	if p.fetcher == nil {
+		p.fetcher = goCommand{bin: p.GoBin, cacheDir: p.CacheDir, upstream: p.Upstream}
+	}
+	if _, ok := p.fetcher.(*sharedFetcher); !ok {
+		p.fetcher = newSharedFetcher(p.fetcher, maxGoCommands)
+	}
+}
+
+// latestFile is the file name splitProxyPath returns for requests of the latest version, like `/foo/@latest`.
+const latestFile = "@latest"
+
+// splitProxyPath splits a proxy request path like `/foo/@v/v1.0.0.info` into the module path `/foo` and the file
+// `v1.0.0.info`. ok is false if the path is not a proxy request.
+func splitProxyPath(reqPath string) (modPath, file string, ok bool) {
+	if strings.HasSuffix(reqPath, "/"+latestFile) {
+		return strings.TrimSuffix(reqPath, "/"+latestFile), latestFile, true
+	}
+
+	i := strings.Index(reqPath, "/@v/")
+	if i < 0 {
+		return "", "", false
+	}
+	return reqPath[:i], reqPath[i+len("/@v/"):], true
+}
+
+// serve handles a proxy request for a file of the module at modPath, e.g. `example.com/foo`.
+func (p *Proxy) serve(w http.ResponseWriter, r *http.Request, modPath, file string) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), proxyTimeout)
+	defer cancel()
+
+	if file == "list" {
+		versions, err := p.fetcher.Versions(ctx, modPath)
+		if err != nil {
+			return p.notFound(modPath, err)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, v := range versions {
+			fmt.Fprintln(w, v)
+		}
+		return nil
+	}
+
+	ext := filepath.Ext(file)
+	version, err := unescapeModulePath(strings.TrimSuffix(file, ext))
+	if file == latestFile {
+		// The go command resolves the query to the info of the latest version
+		ext, version, err = ".info", "latest", nil
+	} else if err != nil || !versionRegexp.MatchString(strings.TrimSuffix(file, ext)) {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("invalid version %q", file))
+	}
+
+	files, err := p.fetcher.Download(ctx, modPath, version)
+	if err != nil {
+		return p.notFound(modPath+"@"+version, err)
+	}
+
+	var name, contentType string
+	switch ext {
+	case ".info":
+		name, contentType = files.Info, "application/json"
+	case ".mod":
+		name, contentType = files.GoMod, "text/plain; charset=utf-8"
+	case ".zip":
+		name, contentType = files.Zip, "application/zip"
+	default:
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("unknown proxy file %q", file))
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return p.notFound(modPath+"@"+version, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+	return nil
+}
+
+// notFound logs a failed module lookup and returns a 404, which makes the go command try the next proxy.
+func (p *Proxy) notFound(module string, err error) error {
+	p.logger.Warn("module not available", zap.String("module", module), zap.Error(err))
+	return caddyhttp.Error(http.StatusNotFound, err)
+}
+
+// unescapeModulePath reverses the case-encoding of module paths and versions in proxy requests, where upper-case
+// letters are written as `!` followed by the lower-case letter.
+func unescapeModulePath(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '!' {
+			if i+1 >= len(s) || s[i+1] < 'a' || s[i+1] > 'z' {
+				return "", fmt.Errorf("invalid escape in %q", s)
+			}
+			i++
+			c = s[i] - 'a' + 'A'
+		} else if c >= 'A' && c <= 'Z' {
+			return "", fmt.Errorf("unescaped upper-case letter in %q", s)
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+// sharedFetcher limits the fetches of a moduleFetcher, as every fetch of the go command starts a process. Concurrent
+// fetches of the same module file share one fetch, at most a number of fetches run at a time, and version lists are
+// cached for proxyListTTL.
+type sharedFetcher struct {
+	fetcher moduleFetcher
+	slots   chan struct{}
+
+	mu       sync.Mutex
+	calls    map[string]*fetchCall
+	versions map[string]cachedVersions
+}
+
+// fetchCall is a fetch shared by the requests waiting for it.
+type fetchCall struct {
+	done     chan struct{}
+	versions []string
+	files    *moduleFiles
+	err      error
+}
+
+// cachedVersions is a cached version list.
+type cachedVersions struct {
+	versions []string
+	fetched  time.Time
+}
+
+// newSharedFetcher returns a sharedFetcher running at most n fetches of f at a time.
+func newSharedFetcher(f moduleFetcher, n int) *sharedFetcher {
+	return &sharedFetcher{
+		fetcher:  f,
+		slots:    make(chan struct{}, n),
+		calls:    make(map[string]*fetchCall),
+		versions: make(map[string]cachedVersions),
+	}
+}
+
+func (s *sharedFetcher) Versions(ctx context.Context, modPath string) ([]string, error) {
+	s.mu.Lock()
+	cached, ok := s.versions[modPath]
+	s.mu.Unlock()
+	if ok && time.Since(cached.fetched) < proxyListTTL {
+		return cached.versions, nil
+	}
+
+	call, err := s.do(ctx, "list "+modPath, func(ctx context.Context, call *fetchCall) {
+		if call.versions, call.err = s.fetcher.Versions(ctx, modPath); call.err != nil {
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(s.versions) >= maxCachedVersionLists {
+			s.versions = make(map[string]cachedVersions)
+		}
+		s.versions[modPath] = cachedVersions{versions: call.versions, fetched: time.Now()}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return call.versions, call.err
+}
+
+func (s *sharedFetcher) Download(ctx context.Context, modPath, version string) (*moduleFiles, error) {
+	call, err := s.do(ctx, "download "+modPath+"@"+version, func(ctx context.Context, call *fetchCall) {
+		call.files, call.err = s.fetcher.Download(ctx, modPath, version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return call.files, call.err
+}
+
+// do waits for the fetch with the key, and starts it if it is not running yet. The fetch is not bound to ctx, as
+// other requests may wait for it as well.
+func (s *sharedFetcher) do(ctx context.Context, key string, fetch func(context.Context, *fetchCall)) (*fetchCall, error) {
+	s.mu.Lock()
+	call, ok := s.calls[key]
+	if !ok {
+		call = &fetchCall{done: make(chan struct{})}
+		s.calls[key] = call
+		go s.run(key, call, fetch)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// run runs a fetch once a slot is free.
+func (s *sharedFetcher) run(key string, call *fetchCall, fetch func(context.Context, *fetchCall)) {
+	ctx, cancel := context.WithTimeout(context.Background(), proxyTimeout)
+	defer cancel()
+
+	select {
+	case s.slots <- struct{}{}:
+		fetch(ctx, call)
+		<-s.slots
+	case <-ctx.Done():
+		call.err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	delete(s.calls, key)
+	s.mu.Unlock()
+	close(call.done)
+}
+
+// goCommand fetches modules from their source with the go command.
+type goCommand struct {
+	bin      string
+	cacheDir string
+	upstream string
+}
+
+func (g goCommand) Versions(ctx context.Context, modPath string) ([]string, error) {
+	var result struct {
+		Versions []string
+		Error    *struct{ Err string }
+	}
+	if err := g.run(ctx, modPath, &result, "list", "-m", "-versions", "-json", modPath); err != nil {
+		return nil, err
+	}
+	if result.Error != nil {
+		return nil, fmt.Errorf("%s", result.Error.Err)
+	}
+	return result.Versions, nil
+}
+
+func (g goCommand) Download(ctx context.Context, modPath, version string) (*moduleFiles, error) {
+	var result struct {
+		moduleFiles
+		Error string
+	}
+	if err := g.run(ctx, modPath, &result, "mod", "download", "-json", modPath+"@"+version); err != nil {
+		return nil, err
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("%s", result.Error)
+	}
+	return &result.moduleFiles, nil
+}
+
+// run runs the go command for the module at modPath and decodes its JSON output into v.
+func (g goCommand) run(ctx context.Context, modPath string, v interface{}, args ...string) error {
+	cmd := exec.CommandContext(ctx, g.bin, args...)
+	cmd.Dir = os.TempDir()
+	cmd.Env = append(os.Environ(),
+		"GO111MODULE=on",
+		"GOFLAGS=-mod=mod",
+		"GOPATH="+g.cacheDir,
+		"GOMODCACHE=",
+	)
+	if g.upstream != "" {
+		// GOPRIVATE would bypass the upstream, so only skip the checksum database
+		cmd.Env = append(cmd.Env, "GOPROXY="+g.upstream, "GONOPROXY=", "GONOSUMDB="+modPath, "GOPRIVATE=")
+	} else {
+		// The module is served by ourselves, so go directly to its source and don't consult the checksum database
+		cmd.Env = append(cmd.Env, "GOPROXY=direct", "GOPRIVATE="+modPath)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	runErr := cmd.Run()
+	if stdout.Len() > 0 {
+		if err := json.Unmarshal(stdout.Bytes(), v); err == nil {
+			return nil
+		}
+	}
+	if runErr != nil {
+		return fmt.Errorf("%v: %s", runErr, strings.TrimSpace(stderr.String()))
+	}
+	return fmt.Errorf("unexpected output of go %s", strings.Join(args, " "))
+}
@@ -0,0 +1,268 @@
+package gopkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// fakeFetcher serves module files from a directory, with one file set per known module version.
+type fakeFetcher struct {
+	dir      string
+	versions map[string][]string
+}
+
+func (f fakeFetcher) Versions(ctx context.Context, modPath string) ([]string, error) {
+	versions, ok := f.versions[modPath]
+	if !ok {
+		return nil, fmt.Errorf("unknown module %s", modPath)
+	}
+	return versions, nil
+}
+
+func (f fakeFetcher) Download(ctx context.Context, modPath, version string) (*moduleFiles, error) {
+	if versions := f.versions[modPath]; version == "latest" && len(versions) > 0 {
+		version = versions[len(versions)-1]
+	}
+	for _, v := range f.versions[modPath] {
+		if v == version {
+			base := filepath.Join(f.dir, version)
+			return &moduleFiles{Info: base + ".info", GoMod: base + ".mod", Zip: base + ".zip"}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown version %s@%s", modPath, version)
+}
+
+// newProxyPackage returns a provisioned package with a proxy backed by a fakeFetcher.
+func newProxyPackage(t *testing.T) *GoPackage {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "gopkg-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, content := range map[string]string{
+		"v1.0.0.info":    `{"Version":"v1.0.0","Time":"2020-05-04T10:20:30Z"}`,
+		"v1.0.0.mod":     "module example.com/foo\n",
+		"v1.0.0.zip":     "PK",
+		"v1.1.0-RC.info": `{"Version":"v1.1.0-RC","Time":"2020-05-05T10:20:30Z"}`,
+		"v1.1.0-RC.mod":  "module example.com/foo\n",
+		"v1.1.0-RC.zip":  "PK",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := New("/foo", "", "https://github.com/example/foo").WithSubmodule("/bar", "")
+	m.Host = "example.com"
+	m.Proxy = &Proxy{fetcher: fakeFetcher{dir: dir, versions: map[string][]string{
+		"example.com/foo": {"v1.0.0", "v1.1.0-RC"},
+	}}}
+	return provision(t, m)
+}
+
+func TestServeHTTPProxy(t *testing.T) {
+	m := newProxyPackage(t)
+
+	tests := []struct {
+		target      string
+		wantBody    string
+		contentType string
+	}{
+		{"http://example.com/foo/@v/list", "v1.0.0\nv1.1.0-RC\n", "text/plain; charset=utf-8"},
+		{"http://example.com/foo/@v/v1.0.0.info", `{"Version":"v1.0.0","Time":"2020-05-04T10:20:30Z"}`, "application/json"},
+		{"http://example.com/foo/@v/v1.0.0.mod", "module example.com/foo\n", "text/plain; charset=utf-8"},
+		{"http://example.com/foo/@v/v1.0.0.zip", "PK", "application/zip"},
+		{"http://example.com/foo/@v/v1.1.0-!r!c.mod", "module example.com/foo\n", "text/plain; charset=utf-8"},
+		{"http://example.com/foo/@latest", `{"Version":"v1.1.0-RC","Time":"2020-05-05T10:20:30Z"}`, "application/json"},
+	}
+
+	for _, test := range tests {
+		w := serve(t, m, http.MethodGet, test.target)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", test.target, w.Code)
+		}
+		if got := w.Body.String(); got != test.wantBody {
+			t.Errorf("%s: expected body %q, got %q", test.target, test.wantBody, got)
+		}
+		if got := w.Header().Get("Content-Type"); got != test.contentType {
+			t.Errorf("%s: expected Content-Type %q, got %q", test.target, test.contentType, got)
+		}
+	}
+}
+
+func TestServeHTTPProxyNotFound(t *testing.T) {
+	m := newProxyPackage(t)
+
+	for _, target := range []string{
+		"http://example.com/foo/@v/v2.0.0.info",
+		"http://example.com/foo/@v/v1.0.0.txt",
+		"http://example.com/foo/@v/-v1.0.0.zip",
+		"http://example.com/foo/@v/v1.1.0-RC.mod",
+		"http://example.com/foo/bar/@v/list",
+		"http://example.com/foo/baz/@v/list",
+		"http://example.com/foo/bar/@latest",
+		"http://other.example.com/foo/@v/list",
+	} {
+		w := httptest.NewRecorder()
+		err := m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil), nil)
+
+		var handlerErr caddyhttp.HandlerError
+		if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected handler error with status 404, got %v", target, err)
+		}
+	}
+}
+
+// countingFetcher counts the fetches of a moduleFetcher and how many run at the same time, blocking each until
+// release is closed.
+type countingFetcher struct {
+	release chan struct{}
+
+	mu               sync.Mutex
+	fetches, running int
+	maxRunning       int
+}
+
+func (f *countingFetcher) fetch() {
+	f.mu.Lock()
+	f.fetches++
+	f.running++
+	if f.running > f.maxRunning {
+		f.maxRunning = f.running
+	}
+	f.mu.Unlock()
+
+	<-f.release
+
+	f.mu.Lock()
+	f.running--
+	f.mu.Unlock()
+}
+
+func (f *countingFetcher) Versions(ctx context.Context, modPath string) ([]string, error) {
+	f.fetch()
+	return []string{"v1.0.0"}, nil
+}
+
+func (f *countingFetcher) Download(ctx context.Context, modPath, version string) (*moduleFiles, error) {
+	f.fetch()
+	return &moduleFiles{Info: version + ".info"}, nil
+}
+
+func TestSharedFetcher(t *testing.T) {
+	f := &countingFetcher{release: make(chan struct{})}
+	s := newSharedFetcher(f, 2)
+
+	// Requests of the same file share a fetch, and at most two fetches run at a time
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		version := fmt.Sprintf("v1.0.%d", i%4)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			files, err := s.Download(context.Background(), "example.com/foo", version)
+			if err != nil || files.Info != version+".info" {
+				t.Errorf("%s: expected files of the version, got %v, %v", version, files, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(f.release)
+	wg.Wait()
+
+	f.mu.Lock()
+	if f.fetches != 4 || f.maxRunning > 2 {
+		t.Errorf("expected 4 fetches with at most 2 at a time, got %d with %d at a time", f.fetches, f.maxRunning)
+	}
+	f.mu.Unlock()
+
+	// A request that gives up does not cancel the shared fetch
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Download(ctx, "example.com/foo", "v2.0.0"); err != context.Canceled {
+		t.Errorf("expected the canceled request to give up, got %v", err)
+	}
+
+	// Version lists are cached
+	for i := 0; i < 3; i++ {
+		if versions, err := s.Versions(context.Background(), "example.com/foo"); err != nil || len(versions) != 1 {
+			t.Fatalf("expected the version list, got %v, %v", versions, err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		f.mu.Lock()
+		fetches := f.fetches
+		f.mu.Unlock()
+		if fetches == 6 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the abandoned download and one version list fetch, got %d fetches", fetches)
+		}
+	}
+}
+
+func TestGoCommandUpstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopkg-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A fake go command reporting its environment as the download result
+	bin := filepath.Join(dir, "go")
+	script := "#!/bin/sh\nprintf '{\"Info\": \"%s|%s|%s|%s\", \"GoMod\": \"%s\"}' \"$GOPROXY\" \"$GONOPROXY\" \"$GONOSUMDB\" \"$GOPRIVATE\" \"$GOPATH\"\n"
+	if err := ioutil.WriteFile(bin, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"":                          "direct|||example.com/foo",
+		"https://proxy.example.com": "https://proxy.example.com||example.com/foo|",
+	}
+	for upstream, want := range tests {
+		files, err := goCommand{bin: bin, cacheDir: dir, upstream: upstream}.Download(context.Background(), "example.com/foo", "v1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files.Info != want {
+			t.Errorf("upstream %q: expected GOPROXY|GONOPROXY|GONOSUMDB|GOPRIVATE %q, got %q", upstream, want, files.Info)
+		}
+		if files.GoMod != dir {
+			t.Errorf("upstream %q: expected GOPATH %q, got %q", upstream, dir, files.GoMod)
+		}
+	}
+}
+
+func TestUnescapeModulePath(t *testing.T) {
+	tests := map[string]string{
+		"github.com/!azure/go":  "github.com/Azure/go",
+		"v1.0.0-!r!c1":          "v1.0.0-RC1",
+		"example.com/plain/mod": "example.com/plain/mod",
+	}
+	for in, want := range tests {
+		if got, err := unescapeModulePath(in); err != nil || got != want {
+			t.Errorf("unescapeModulePath(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"github.com/Azure", "trailing!", "!1"} {
+		if _, err := unescapeModulePath(in); err == nil {
+			t.Errorf("unescapeModulePath(%q): expected error", in)
+		}
+	}
+}
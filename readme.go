@@ -0,0 +1,171 @@
+package gopkg
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/russross/blackfriday"
+	"go.uber.org/zap"
+)
+
+// DefaultReadmeTTL is how long rendered READMEs are cached if no TTL is configured.
+const DefaultReadmeTTL = caddy.Duration(time.Hour)
+
+// maxReadmeSize bounds the size of a README that is rendered.
+const maxReadmeSize = 1 << 20
+
+// maxCachedReadmes bounds the number of cached READMEs. README URLs with path variables depend on the request, so the
+// cache is dropped once it is full.
+const maxCachedReadmes = 256
+
+// Readme shows the README of the source repository on the landing page, which turns the vanity host into a
+// lightweight project page.
+//
+// READMEs are fetched in the background and rendered from Markdown to HTML, leaving out raw HTML. Until the first
+// fetch completes the page is rendered without the README; if a fetch fails, the previously rendered README is kept.
+type Readme struct {
+	// URL is the URL of the raw Markdown README. It may contain the path variables of the package.
+	//
+	// If empty, it is derived from the source URL for repositories on GitHub and GitLab, e.g.
+	// `https://raw.githubusercontent.com/owner/repo/HEAD/README.md`.
+	URL string `json:"url,omitempty"`
+
+	// TTL is how long a rendered README is cached before it is fetched again.
+	//
+	// If zero, the default is 1 hour.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	client *http.Client
+	logger *zap.Logger
+
+	mu    sync.Mutex
+	cache map[string]renderedReadme
+}
+
+// renderedReadme is a cached README.
+type renderedReadme struct {
+	html    template.HTML
+	fetched time.Time
+	pending bool
+}
+
+// readmePresets are the raw URLs of the README in the default branch of known forges, relative to the repository
+// home page.
+var readmePresets = map[string]func(u *url.URL) string{
+	"github.com": func(u *url.URL) string {
+		return "https://raw.githubusercontent.com" + u.Path + "/HEAD/README.md"
+	},
+	"gitlab.com": func(u *url.URL) string {
+		return u.String() + "/-/raw/HEAD/README.md"
+	},
+}
+
+// provision sets the defaults and prepares the cache.
+func (rm *Readme) provision(logger *zap.Logger) {
+	if rm.TTL == 0 {
+		rm.TTL = DefaultReadmeTTL
+	}
+	rm.client = &http.Client{Timeout: 10 * time.Second}
+	rm.logger = logger
+	rm.cache = make(map[string]renderedReadme)
+}
+
+// rawURL returns the URL of the README of the repository at repoURL, or an empty string if it cannot be derived.
+func (rm *Readme) rawURL(repoURL string, vars map[string]string) string {
+	if rm.URL != "" {
+		return expandPathVars(rm.URL, vars)
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(strings.TrimSuffix(repoURL, "/"), ".git"))
+	if err != nil {
+		return ""
+	}
+	preset, ok := readmePresets[strings.TrimPrefix(strings.ToLower(u.Host), "www.")]
+	if !ok {
+		return ""
+	}
+	return preset(u)
+}
+
+// HTML returns the rendered README at rawURL, or an empty string if it has not been fetched yet. A fetch is started
+// in the background if the cached README is missing or expired.
+func (rm *Readme) HTML(rawURL string) template.HTML {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	cached, ok := rm.cache[rawURL]
+	if (!ok || time.Since(cached.fetched) >= time.Duration(rm.TTL)) && !cached.pending {
+		if !ok && len(rm.cache) >= maxCachedReadmes {
+			rm.cache = make(map[string]renderedReadme)
+		}
+		cached.pending = true
+		rm.cache[rawURL] = cached
+		go rm.refresh(rawURL)
+	}
+	return cached.html
+}
+
+// refresh fetches and renders the README at rawURL into the cache.
+func (rm *Readme) refresh(rawURL string) {
+	html, err := rm.fetch(rawURL)
+	if err != nil {
+		rm.logger.Warn("fetching readme",
+			zap.String("url", rawURL),
+			zap.Error(err))
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	cached, ok := rm.cache[rawURL]
+	if !ok && len(rm.cache) >= maxCachedReadmes {
+		// The cache filled up again after it was dropped meanwhile
+		return
+	}
+	// Keep serving the stale README, but don't retry before the TTL expires again
+	if err == nil {
+		cached.html = html
+	}
+	cached.fetched = time.Now()
+	cached.pending = false
+	rm.cache[rawURL] = cached
+}
+
+// fetch downloads the README at rawURL and renders it to HTML.
+func (rm *Readme) fetch(rawURL string) (template.HTML, error) {
+	resp, err := rm.client.Get(rawURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	markdown, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxReadmeSize))
+	if err != nil {
+		return "", err
+	}
+	return renderMarkdown(markdown), nil
+}
+
+// renderMarkdown renders a README to HTML. Raw HTML is left out and only links with safe protocols are rendered,
+// so the result can be embedded in the page as is.
+func renderMarkdown(markdown []byte) template.HTML {
+	renderer := blackfriday.HtmlRenderer(blackfriday.HTML_SKIP_HTML|blackfriday.HTML_SKIP_STYLE|
+		blackfriday.HTML_SAFELINK|blackfriday.HTML_NOFOLLOW_LINKS|blackfriday.HTML_NOREFERRER_LINKS, "", "")
+	extensions := blackfriday.EXTENSION_NO_INTRA_EMPHASIS | blackfriday.EXTENSION_TABLES |
+		blackfriday.EXTENSION_FENCED_CODE | blackfriday.EXTENSION_AUTOLINK | blackfriday.EXTENSION_STRIKETHROUGH |
+		blackfriday.EXTENSION_SPACE_HEADERS
+
+	return template.HTML(blackfriday.Markdown(markdown, renderer, extensions))
+}
@@ -0,0 +1,119 @@
+package gopkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestServeHTTPReadme(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/example/foo/README.md" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("# Foo\n\nFoo does *things*.\n\n<script>alert(1)</script>\n"))
+	}))
+	defer srv.Close()
+
+	m := provision(t, &GoPackage{
+		Path:    "/foo",
+		URL:     "https://github.com/example/foo",
+		Landing: true,
+		Readme:  &Readme{URL: srv.URL + "/example/foo/README.md"},
+	})
+
+	// The README is fetched in the background, so the first pages are rendered without it
+	var body string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		body = serve(t, m, http.MethodGet, "http://example.com/foo").Body.String()
+		if strings.Contains(body, "<article>") {
+			break
+		}
+	}
+
+	for _, want := range []string{"<h1>Foo</h1>", "<p>Foo does <em>things</em>.</p>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected landing page to contain %q, got %q", want, body)
+		}
+	}
+	if strings.Contains(body, "<script>") {
+		t.Errorf("expected raw HTML to be left out, got %q", body)
+	}
+
+	// go get requests don't need the README
+	if body := serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1").Body.String(); strings.Contains(body, "<h1>Foo</h1>") {
+		t.Errorf("expected no README in go-import response, got %q", body)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected the README to be cached, got %d requests", n)
+	}
+}
+
+func TestReadmeFallback(t *testing.T) {
+	status := int32(http.StatusOK)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		w.Write([]byte("Hello"))
+	}))
+	defer srv.Close()
+
+	m := provision(t, &GoPackage{Path: "/foo", URL: "https://github.com/example/foo", Readme: &Readme{TTL: 1}})
+	rm := m.Readme
+
+	rm.refresh(srv.URL)
+	if got, want := rm.HTML(srv.URL), "<p>Hello</p>\n"; string(got) != want {
+		t.Fatalf("expected README %q, got %q", want, got)
+	}
+
+	// The rendered README is kept if a fetch fails after the TTL expired
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	time.Sleep(time.Millisecond)
+	rm.refresh(srv.URL)
+	if got, want := rm.HTML(srv.URL), "<p>Hello</p>\n"; string(got) != want {
+		t.Errorf("expected stale README %q, got %q", want, got)
+	}
+}
+
+func TestReadmeCacheBound(t *testing.T) {
+	rm := &Readme{}
+	rm.provision(zap.NewNop())
+	for i := 0; i < maxCachedReadmes+10; i++ {
+		rm.HTML("http://127.0.0.1:0/" + strconv.Itoa(i) + "/README.md")
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if len(rm.cache) > maxCachedReadmes {
+		t.Errorf("expected at most %d cached READMEs, got %d", maxCachedReadmes, len(rm.cache))
+	}
+}
+
+func TestReadmeRawURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		repoURL string
+		want    string
+	}{
+		{"", "https://github.com/example/foo.git", "https://raw.githubusercontent.com/example/foo/HEAD/README.md"},
+		{"", "https://gitlab.com/group/sub/foo", "https://gitlab.com/group/sub/foo/-/raw/HEAD/README.md"},
+		{"", "https://git.example.com/foo", ""},
+		{"https://example.com/{1}/README.md", "https://git.example.com/foo", "https://example.com/bar/README.md"},
+	}
+
+	for _, test := range tests {
+		rm := &Readme{URL: test.url}
+		if got := rm.rawURL(test.repoURL, map[string]string{"1": "bar"}); got != test.want {
+			t.Errorf("expected README URL %q for %s, got %q", test.want, test.repoURL, got)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package gopkg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(RedisPackages{})
+	httpcaddyfile.RegisterDirective("gopkg_redis", parseRedisPackages)
+}
+
+// DefaultRedisAddress is the address of the Redis server packages are loaded from if none is configured.
+const DefaultRedisAddress = "localhost:6379"
+
+// DefaultRedisKeyPrefix is the prefix of the Redis keys holding packages if none is configured.
+const DefaultRedisKeyPrefix = "gopkg:"
+
+// redisTimeout bounds the connection to Redis and each command.
+const redisTimeout = 5 * time.Second
+
+// RedisPackages serves the packages stored in Redis, so several Caddy instances share packages that can be changed
+// without reloading them. Each package is stored as the JSON config of a package at a key of the prefix and its path,
+// e.g.
+//
+//     SET gopkg:/foo '{"url": "https://github.com/example/foo"}'
+//
+// The keys are read when the config is loaded and then again at an interval. The packages are only replaced if any
+// of the keys or values changed. If Redis is unreachable or a package is invalid, the previous packages keep being
+// served. Requests not matching any of the packages are passed to the next handler.
+type RedisPackages struct {
+	// Address is the host and port of the Redis server.
+	//
+	// If empty, the default is `localhost:6379`.
+	Address string `json:"address,omitempty"`
+
+	// Password authenticates the connection. It may be a placeholder like `{env.REDIS_PASSWORD}`.
+	Password string `json:"password,omitempty"`
+
+	// DB is the number of the Redis database holding the packages.
+	DB int `json:"db,omitempty"`
+
+	// KeyPrefix is the prefix of the keys holding the packages, which is followed by the package path.
+	//
+	// If empty, the default is `gopkg:`.
+	KeyPrefix string `json:"key_prefix,omitempty"`
+
+	// Refresh is how often the keys are read again.
+	//
+	// If zero, the default is 10 seconds.
+	Refresh caddy.Duration `json:"refresh,omitempty"`
+
+	password string
+	logger   *zap.Logger
+	kvPackages
+}
+
+// CaddyModule returns the Caddy module information.
+func (RedisPackages) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.gopkg_redis",
+		New: func() caddy.Module {
+			return new(RedisPackages)
+		},
+	}
+}
+
+// parseRedisPackages parses the gopkg_redis directive in a caddyfile. Syntax:
+//
+//     gopkg_redis [<address>] {
+//         password <password>
+//         db <number>
+//         key_prefix <prefix>
+//         refresh <interval>
+//     }
+//
+// Without an address, the server at `localhost:6379` is used.
+func parseRedisPackages(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	p := new(RedisPackages)
+	for h.Next() {
+		if h.NextArg() {
+			p.Address = h.Val()
+		}
+		if h.NextArg() {
+			return nil, h.ArgErr()
+		}
+		for h.NextBlock(0) {
+			switch h.Val() {
+			case "password":
+				if !h.Args(&p.Password) {
+					return nil, h.ArgErr()
+				}
+			case "db":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				db, err := strconv.Atoi(h.Val())
+				if err != nil || db < 0 {
+					return nil, h.Errf("invalid db '%s'", h.Val())
+				}
+				p.DB = db
+			case "key_prefix":
+				if !h.Args(&p.KeyPrefix) {
+					return nil, h.ArgErr()
+				}
+			case "refresh":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				d, err := time.ParseDuration(h.Val())
+				if err != nil || d <= 0 {
+					return nil, h.Errf("invalid refresh interval '%s'", h.Val())
+				}
+				p.Refresh = caddy.Duration(d)
+			default:
+				return nil, h.Errf("unrecognized gopkg_redis subdirective '%s'", h.Val())
+			}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+		}
+	}
+
+	return h.NewRoute(nil, p), nil
+}
+
+// Provision implements caddy.Provisioner. It loads the packages and starts refreshing them. A failure to load them
+// is logged rather than failing the config, as Redis may only be unreachable for a while.
+func (p *RedisPackages) Provision(ctx caddy.Context) error {
+	if p.Address == "" {
+		p.Address = DefaultRedisAddress
+	}
+	if p.KeyPrefix == "" {
+		p.KeyPrefix = DefaultRedisKeyPrefix
+	}
+	if p.Refresh == 0 {
+		p.Refresh = DefaultWatchInterval
+	}
+	p.password = caddy.NewReplacer().ReplaceAll(p.Password, "")
+	p.logger = ctx.Logger(p)
+	p.init(ctx)
+
+	if err := p.load(); err != nil {
+		p.logger.Warn("loading packages from redis", zap.String("address", p.Address), zap.Error(err))
+	}
+	go p.refresh()
+
+	return nil
+}
+
+// load reads the packages from Redis and, if they changed, provisions them and replaces the served ones with them.
+func (p *RedisPackages) load() error {
+	values, err := p.fetch()
+	if err != nil {
+		return err
+	}
+	return p.apply(p.KeyPrefix, values)
+}
+
+// fetch reads all keys with the prefix and returns their values by key.
+func (p *RedisPackages) fetch() (map[string]string, error) {
+	c, err := dialRedis(p.Address, p.password, p.DB)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var keys []string
+	for cursor := "0"; ; {
+		reply, err := c.do("SCAN", cursor, "MATCH", redisPattern(p.KeyPrefix)+"*", "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("unexpected SCAN reply")
+		}
+		cursor, _ = page[0].(string)
+		found, _ := page[1].([]interface{})
+		for _, key := range found {
+			if key, ok := key.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		reply, err := c.do("GET", key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", key, err)
+		}
+		value, ok := reply.(string)
+		if !ok {
+			// The key was deleted since it was scanned
+			continue
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// refresh reloads the packages at the interval, until the config is unloaded.
+func (p *RedisPackages) refresh() {
+	ticker := time.NewTicker(time.Duration(p.Refresh))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := p.load(); err != nil {
+			p.logger.Warn("reloading packages from redis, keeping the previous packages",
+				zap.String("address", p.Address),
+				zap.Error(err))
+		}
+	}
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (p *RedisPackages) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	return p.serve(w, r, next)
+}
+
+// Cleanup implements caddy.CleanerUpper. It deregisters the packages.
+func (p *RedisPackages) Cleanup() error {
+	p.cleanup()
+	return nil
+}
+
+// redisPattern escapes the glob characters of a key prefix for the MATCH option of SCAN.
+func redisPattern(prefix string) string {
+	var b strings.Builder
+	for _, c := range prefix {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// redisConn is a minimal client of the Redis protocol, which is all that is needed to read the packages.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialRedis connects to the Redis server, authenticates and selects the database.
+func dialRedis(address, password string, db int) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", address, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	if password != "" {
+		if _, err := c.do("AUTH", password); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("authenticating: %v", err)
+		}
+	}
+	if db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(db)); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("selecting db %d: %v", db, err)
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and reads its reply, which is a string, an int64, nil or a slice of those. Error replies are
+// returned as errors.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
+}
+
+// readReply reads a reply in the Redis serialization protocol.
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("malformed bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("malformed array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unexpected reply type %q", kind)
+}
+
+// Close closes the connection.
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*RedisPackages)(nil)
+	_ caddy.CleanerUpper          = (*RedisPackages)(nil)
+	_ caddyhttp.MiddlewareHandler = (*RedisPackages)(nil)
+)
@@ -0,0 +1,210 @@
+package gopkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// fakeRedis is a Redis server supporting the commands used by RedisPackages.
+type fakeRedis struct {
+	mu       sync.Mutex
+	values   map[string]string
+	password string
+	ln       net.Listener
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{values: make(map[string]string), password: password, ln: ln}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) set(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[key] = value
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := f.password == ""
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			r.ReadString('\n')
+			arg, _ := r.ReadString('\n')
+			args[i] = strings.TrimSuffix(arg, "\r\n")
+		}
+
+		f.mu.Lock()
+		switch {
+		case args[0] == "AUTH":
+			authenticated = args[1] == f.password
+			if authenticated {
+				fmt.Fprint(conn, "+OK\r\n")
+			} else {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+			}
+		case !authenticated:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		case args[0] == "SCAN":
+			// Return one key per page to exercise the cursor
+			var keys []string
+			for key := range f.values {
+				if strings.HasPrefix(key, strings.TrimSuffix(args[3], "*")) {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			cursor, _ := strconv.Atoi(args[1])
+			if cursor >= len(keys) {
+				fmt.Fprint(conn, "*2\r\n$1\r\n0\r\n*0\r\n")
+				break
+			}
+			next := strconv.Itoa((cursor + 1) % len(keys))
+			fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n*1\r\n$%d\r\n%s\r\n", len(next), next, len(keys[cursor]), keys[cursor])
+		case args[0] == "GET":
+			if value, ok := f.values[args[1]]; ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+			} else {
+				fmt.Fprint(conn, "$-1\r\n")
+			}
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		f.mu.Unlock()
+	}
+}
+
+func TestRedisPackages(t *testing.T) {
+	redis := newFakeRedis(t, "secret")
+	redis.set("gopkg:/foo", `{"url": "https://github.com/example/foo"}`)
+	redis.set("gopkg:bar", `{"vcs": "hg", "url": "https://hg.example.com/bar"}`)
+	redis.set("other:/baz", `{"url": "https://github.com/example/baz"}`)
+
+	ctx, cancel := caddy.NewContext(testContext)
+	defer cancel()
+
+	p := &RedisPackages{Address: redis.ln.Addr().String(), Password: "secret"}
+	if err := p.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Cleanup()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+	serveRedis := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		if err := p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil), next); err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		return w
+	}
+
+	want := `content="example.com/bar hg https://hg.example.com/bar"`
+	if body := serveRedis("http://example.com/bar/pkg?go-get=1").Body.String(); !strings.Contains(body, want) {
+		t.Errorf("expected %s, got %s", want, body)
+	}
+	if w := serveRedis("http://example.com/baz?go-get=1"); w.Code != http.StatusTeapot {
+		t.Errorf("expected key of another prefix to pass to the next handler, got %d", w.Code)
+	}
+
+	// Unchanged keys keep the provisioned packages
+	packages := p.packages.get()
+	if err := p.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.packages.get(); len(got) != 2 || got[0] != packages[0] {
+		t.Error("expected unchanged packages not to be replaced")
+	}
+
+	// An invalid package keeps the previous packages
+	redis.set("gopkg:/broken", `{"vcs": "git"}`)
+	if err := p.load(); err == nil {
+		t.Error("expected error for package without url")
+	}
+	if w := serveRedis("http://example.com/foo?go-get=1"); w.Code != http.StatusOK {
+		t.Errorf("expected previous packages to be served, got %d", w.Code)
+	}
+
+	redis.set("gopkg:/broken", `{"url": "https://github.com/example/fixed"}`)
+	if err := p.load(); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveRedis("http://example.com/broken?go-get=1"); w.Code != http.StatusOK {
+		t.Errorf("expected changed package to be served, got %d", w.Code)
+	}
+
+	wrong := &RedisPackages{Address: redis.ln.Addr().String(), password: "wrong", KeyPrefix: "gopkg:"}
+	if _, err := wrong.fetch(); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("expected authentication error, got %v", err)
+	}
+}
+
+func TestParseRedisPackages(t *testing.T) {
+	input := `gopkg_redis redis:6379 {
+		password {env.REDIS_PASSWORD}
+		db 2
+		key_prefix go:
+		refresh 1m
+	}`
+	blocks, err := caddyfile.Parse("Caddyfile", []byte(":80 {\n"+input+"\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := parseRedisPackages(httpcaddyfile.Helper{Dispenser: caddyfile.NewDispenser(blocks[0].Segments[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := new(RedisPackages)
+	if err := json.Unmarshal(routes[0].Value.(caddyhttp.Route).HandlersRaw[0], p); err != nil {
+		t.Fatal(err)
+	}
+	want := RedisPackages{Address: "redis:6379", Password: "{env.REDIS_PASSWORD}", DB: 2, KeyPrefix: "go:",
+		Refresh: caddy.Duration(time.Minute)}
+	if !reflect.DeepEqual(*p, want) {
+		t.Errorf("expected %+v, got %+v", want, *p)
+	}
+}
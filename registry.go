@@ -0,0 +1,91 @@
+package gopkg
+
+import "sync"
+
+// registry keeps track of the provisioned packages of an App. Packages remove themselves on Cleanup, so the packages
+// of a replaced config don't linger after a reload.
+type registry struct {
+	mu       sync.RWMutex
+	packages []*GoPackage
+
+	// dynamic are the packages added at runtime through the admin API, by path, sorted by descending path length
+	// so the most specific package is found first.
+	dynamic []*GoPackage
+}
+
+// add registers a package, unless it is registered already.
+func (r *registry) add(m *GoPackage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.packages {
+		if p == m {
+			return
+		}
+	}
+	r.packages = append(r.packages, m)
+}
+
+// remove deregisters a package.
+func (r *registry) remove(m *GoPackage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, p := range r.packages {
+		if p == m {
+			r.packages = append(r.packages[:i], r.packages[i+1:]...)
+			return
+		}
+	}
+}
+
+// list returns the registered packages.
+func (r *registry) list() []*GoPackage {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]*GoPackage(nil), r.packages...)
+}
+
+// setDynamic adds a provisioned package to the dynamic packages, replacing the one with the same path. It returns
+// the replaced package, if any.
+//
+// The list is replaced rather than modified, so requests being served keep a consistent view.
+func (r *registry) setDynamic(m *GoPackage) (replaced *GoPackage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dynamic := make([]*GoPackage, 0, len(r.dynamic)+1)
+	for _, p := range r.dynamic {
+		if p.Path == m.Path {
+			replaced = p
+			continue
+		}
+		dynamic = append(dynamic, p)
+	}
+	r.dynamic = sortMostSpecific(append(dynamic, m))
+
+	return replaced
+}
+
+// removeDynamic removes the dynamic package with the path and returns it, or nil if there is none.
+func (r *registry) removeDynamic(path string) *GoPackage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, p := range r.dynamic {
+		if p.Path == path {
+			r.dynamic = append(append([]*GoPackage(nil), r.dynamic[:i]...), r.dynamic[i+1:]...)
+			return p
+		}
+	}
+	return nil
+}
+
+// dynamicPackages returns the dynamic packages, most specific first. The returned slice must not be modified.
+func (r *registry) dynamicPackages() []*GoPackage {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.dynamic
+}
@@ -0,0 +1,29 @@
+package gopkg
+
+import "testing"
+
+func TestRegistryCleanup(t *testing.T) {
+	registered := func(m *GoPackage) int {
+		n := 0
+		for _, p := range m.app.Packages() {
+			if p == m {
+				n++
+			}
+		}
+		return n
+	}
+
+	m := New("/foo", "", "https://github.com/example/foo")
+	provision(t, m)
+	provision(t, m)
+	if n := registered(m); n != 1 {
+		t.Fatalf("expected provisioned package to be registered once, got %d", n)
+	}
+
+	if err := m.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if n := registered(m); n != 0 {
+		t.Errorf("expected package to be deregistered after cleanup, got %d", n)
+	}
+}
@@ -0,0 +1,282 @@
+package gopkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(RemotePackages{})
+	httpcaddyfile.RegisterDirective("gopkg_remote", parseRemotePackages)
+}
+
+// DefaultRemoteRefresh is how often remote packages are fetched again if no interval is configured.
+const DefaultRemoteRefresh = caddy.Duration(time.Minute)
+
+// maxRemoteBody limits the size of the package list fetched from a remote source.
+const maxRemoteBody = 10 << 20
+
+// RemotePackages serves the packages listed by an HTTP(S) endpoint, so that an internal service can be the source of
+// truth for them. The endpoint responds with the packages in JSON, either as an object mapping paths to package
+// configs like a package file (see LoadPackageFile), or as a list of package configs including their paths:
+//
+//     [
+//         {"path": "/foo", "url": "https://github.com/example/foo"},
+//         {"path": "/bar", "vcs": "hg", "url": "https://hg.example.com/bar"}
+//     ]
+//
+// The packages are fetched when the config is loaded and then again at an interval. Requests are conditional on the
+// ETag of the previous response, so an unchanged list is neither transferred nor provisioned again. If the endpoint
+// fails or lists an invalid package, the previous packages keep being served. Requests not matching any of the
+// packages are passed to the next handler.
+type RemotePackages struct {
+	// SourceURL is the HTTP(S) URL of the package list.
+	SourceURL string `json:"source_url"`
+
+	// Headers are added to the requests, e.g. to authenticate them. The values may be placeholders like
+	// `{env.PACKAGES_TOKEN}`.
+	Headers http.Header `json:"headers,omitempty"`
+
+	// Refresh is how often the list is fetched again.
+	//
+	// If zero, the default is 1 minute.
+	Refresh caddy.Duration `json:"refresh,omitempty"`
+
+	client   *http.Client
+	packages *packageSet
+	ctx      caddy.Context
+	logger   *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (RemotePackages) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.gopkg_remote",
+		New: func() caddy.Module {
+			return new(RemotePackages)
+		},
+	}
+}
+
+// parseRemotePackages parses the gopkg_remote directive in a caddyfile. Syntax:
+//
+//     gopkg_remote [<source_url>] {
+//         source_url <url>
+//         header <field> <value>
+//         refresh <interval>
+//     }
+//
+// The source url is given either as the argument or in the block.
+func parseRemotePackages(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	p := new(RemotePackages)
+	for h.Next() {
+		if h.NextArg() {
+			p.SourceURL = h.Val()
+		}
+		if h.NextArg() {
+			return nil, h.ArgErr()
+		}
+		for h.NextBlock(0) {
+			switch h.Val() {
+			case "source_url":
+				if !h.Args(&p.SourceURL) {
+					return nil, h.ArgErr()
+				}
+			case "header":
+				var field, value string
+				if !h.Args(&field, &value) {
+					return nil, h.ArgErr()
+				}
+				if p.Headers == nil {
+					p.Headers = make(http.Header)
+				}
+				p.Headers.Add(field, value)
+			case "refresh":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				d, err := time.ParseDuration(h.Val())
+				if err != nil || d <= 0 {
+					return nil, h.Errf("invalid refresh interval '%s'", h.Val())
+				}
+				p.Refresh = caddy.Duration(d)
+			default:
+				return nil, h.Errf("unrecognized gopkg_remote subdirective '%s'", h.Val())
+			}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+		}
+	}
+	if p.SourceURL == "" {
+		return nil, h.Err("missing source_url")
+	}
+
+	return h.NewRoute(nil, p), nil
+}
+
+// Provision implements caddy.Provisioner. It fetches the packages and starts refreshing them. A failure to fetch
+// them is logged rather than failing the config, as the endpoint may only be unreachable for a while.
+func (p *RemotePackages) Provision(ctx caddy.Context) error {
+	if p.SourceURL == "" {
+		return fmt.Errorf("missing source_url")
+	}
+	if p.Refresh == 0 {
+		p.Refresh = DefaultRemoteRefresh
+	}
+	p.client = &http.Client{Timeout: 10 * time.Second}
+	p.ctx = ctx
+	p.logger = ctx.Logger(p)
+	p.packages = new(packageSet)
+
+	etag, err := p.load("")
+	if err != nil {
+		p.logger.Warn("fetching packages", zap.String("source_url", p.SourceURL), zap.Error(err))
+	}
+	go p.refresh(etag)
+
+	return nil
+}
+
+// load fetches the packages and, if they changed since the list with the ETag, provisions them and replaces the
+// served ones with them. It returns the ETag of the served list.
+func (p *RemotePackages) load(etag string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, p.SourceURL, nil)
+	if err != nil {
+		return etag, err
+	}
+	repl := caddy.NewReplacer()
+	for field, values := range p.Headers {
+		for _, value := range values {
+			req.Header.Add(field, repl.ReplaceAll(value, ""))
+		}
+	}
+	req.Header.Set("Accept", "application/json")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := p.client.Do(req.WithContext(p.ctx))
+	if err != nil {
+		return etag, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return etag, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return etag, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRemoteBody))
+	if err != nil {
+		return etag, err
+	}
+
+	packages, err := decodeRemotePackages(body)
+	if err != nil {
+		return etag, err
+	}
+	for i, m := range packages {
+		if err := provisionPackage(p.ctx, m); err != nil {
+			for _, provisioned := range packages[:i] {
+				provisioned.Cleanup()
+			}
+			return etag, fmt.Errorf("package %q: %v", m.Path, err)
+		}
+	}
+
+	for _, m := range p.packages.swap(sortMostSpecific(packages)) {
+		m.Cleanup()
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// decodeRemotePackages decodes and validates a package list, which is either a JSON object mapping paths to package
+// configs or a JSON list of package configs.
+func decodeRemotePackages(body []byte) ([]*GoPackage, error) {
+	var packages []*GoPackage
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&packages); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if packages, err = readPackageJSON(bytes.NewReader(body)); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, m := range packages {
+		if m == nil {
+			return nil, fmt.Errorf("package %d: missing config", i)
+		}
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		return packages[i].Path < packages[j].Path
+	})
+	for _, m := range packages {
+		if err := validatePackageEntry(m); err != nil {
+			return nil, fmt.Errorf("package %q: %v", m.Path, err)
+		}
+	}
+	return packages, nil
+}
+
+// refresh fetches the packages again at the interval, until the config is unloaded. The ETag of the served list is
+// only used by refresh, so conditional requests need no locking.
+func (p *RemotePackages) refresh(etag string) {
+	ticker := time.NewTicker(time.Duration(p.Refresh))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var err error
+		if etag, err = p.load(etag); err != nil {
+			p.logger.Warn("refreshing packages, keeping the previous packages",
+				zap.String("source_url", p.SourceURL),
+				zap.Error(err))
+		}
+	}
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (p *RemotePackages) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	return servePackages(p.packages.get(), w, r, next)
+}
+
+// Cleanup implements caddy.CleanerUpper. It deregisters the packages.
+func (p *RemotePackages) Cleanup() error {
+	if p.packages == nil {
+		return nil
+	}
+	for _, m := range p.packages.swap(nil) {
+		m.Cleanup()
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*RemotePackages)(nil)
+	_ caddy.CleanerUpper          = (*RemotePackages)(nil)
+	_ caddyhttp.MiddlewareHandler = (*RemotePackages)(nil)
+)
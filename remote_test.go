@@ -0,0 +1,142 @@
+package gopkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestRemotePackages(t *testing.T) {
+	var mu sync.Mutex
+	body, etag := `[{"path": "/foo", "url": "https://github.com/example/foo"}]`, `"v1"`
+	var fetches, notModified int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		atomic.AddInt32(&fetches, 1)
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	setBody := func(b, e string) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, etag = b, e
+	}
+
+	ctx, cancel := caddy.NewContext(testContext)
+	defer cancel()
+
+	p := &RemotePackages{SourceURL: srv.URL, Headers: http.Header{"Authorization": {"Bearer secret"}}}
+	if err := p.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Cleanup()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+	serveRemote := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		if err := p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil), next); err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		return w
+	}
+
+	want := `content="example.com/foo git https://github.com/example/foo"`
+	if body := serveRemote("http://example.com/foo?go-get=1").Body.String(); !strings.Contains(body, want) {
+		t.Errorf("expected %s, got %s", want, body)
+	}
+
+	// An unchanged list is not provisioned again
+	packages := p.packages.get()
+	if _, err := p.load(`"v1"`); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&notModified) != 1 || p.packages.get()[0] != packages[0] {
+		t.Error("expected conditional request to keep the packages")
+	}
+
+	// An invalid list keeps the previous packages
+	setBody(`{"/bar": {"vcs": "hg"}}`, `"v2"`)
+	if tag, err := p.load(`"v1"`); err == nil || tag != `"v1"` {
+		t.Errorf("expected error for package without url keeping the etag, got %s, %v", tag, err)
+	}
+	if w := serveRemote("http://example.com/foo?go-get=1"); w.Code != http.StatusOK {
+		t.Errorf("expected previous packages to be served, got %d", w.Code)
+	}
+
+	setBody(`{"/bar": {"vcs": "hg", "url": "https://hg.example.com/bar"}}`, `"v3"`)
+	tag, err := p.load(`"v1"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serveRemote("http://example.com/foo?go-get=1"); w.Code != http.StatusTeapot {
+		t.Errorf("expected removed package to pass to the next handler, got %d", w.Code)
+	}
+	if w := serveRemote("http://example.com/bar?go-get=1"); w.Code != http.StatusOK {
+		t.Errorf("expected added package to be served, got %d", w.Code)
+	}
+	if tag != `"v3"` {
+		t.Errorf("expected etag of the last list, got %s", tag)
+	}
+}
+
+func TestDecodeRemotePackages(t *testing.T) {
+	for _, body := range []string{`[null]`, `[{"path": "foo", "url": "https://github.com/example/foo"}]`, `{"/foo": {"unknown": 1}}`} {
+		if _, err := decodeRemotePackages([]byte(body)); err == nil {
+			t.Errorf("expected error for %s", body)
+		}
+	}
+}
+
+func TestParseRemotePackages(t *testing.T) {
+	input := `gopkg_remote {
+		source_url https://packages.internal/gopkg.json
+		header Authorization "Bearer {env.PACKAGES_TOKEN}"
+		refresh 5m
+	}`
+	blocks, err := caddyfile.Parse("Caddyfile", []byte(":80 {\n"+input+"\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := parseRemotePackages(httpcaddyfile.Helper{Dispenser: caddyfile.NewDispenser(blocks[0].Segments[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := new(RemotePackages)
+	if err := json.Unmarshal(routes[0].Value.(caddyhttp.Route).HandlersRaw[0], p); err != nil {
+		t.Fatal(err)
+	}
+	want := RemotePackages{
+		SourceURL: "https://packages.internal/gopkg.json",
+		Headers:   http.Header{"Authorization": {"Bearer {env.PACKAGES_TOKEN}"}},
+		Refresh:   caddy.Duration(5 * time.Minute),
+	}
+	if !reflect.DeepEqual(*p, want) {
+		t.Errorf("expected %+v, got %+v", want, *p)
+	}
+}
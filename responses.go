@@ -0,0 +1,81 @@
+package gopkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// maxCachedResponses bounds the number of rendered go-import responses cached per package. Packages with path
+// variables, placeholders or many hosts resolve to any number of targets, so the cache is dropped once it is full.
+const maxCachedResponses = 1024
+
+// responseCache caches rendered go-import responses. Their template data only depends on the host and the resolved
+// target, so the template is executed once per host and target instead of on every request of the go tool.
+type responseCache struct {
+	mu     sync.RWMutex
+	bodies map[responseKey][]byte
+}
+
+// responseKey identifies a rendered go-import response.
+type responseKey struct {
+	host string
+	path string
+	vcs  string
+	url  string
+}
+
+// newResponseCache returns an empty response cache.
+func newResponseCache() *responseCache {
+	return &responseCache{bodies: make(map[responseKey][]byte)}
+}
+
+// get returns the cached response for key, if any.
+func (c *responseCache) get(key responseKey) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	body, ok := c.bodies[key]
+	return body, ok
+}
+
+// put caches the response for key.
+func (c *responseCache) put(key responseKey, body []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.bodies) >= maxCachedResponses {
+		c.bodies = make(map[responseKey][]byte)
+	}
+	c.bodies[key] = body
+}
+
+// responseETag returns a strong ETag for a rendered response, derived from its body.
+func responseETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches the ETag, using the weak comparison that applies to
+// conditional GET requests.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package gopkg
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestServeHTTPCachesGoImport(t *testing.T) {
+	m := provision(t, New("/foo", "", "https://github.com/example/foo").WithSubmodule("/bar", "https://github.com/example/bar"))
+
+	first := serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1").Body.String()
+
+	// Swapping the template shows which responses are rendered again
+	m.Template = template.Must(template.New("changed").Parse("changed {{.Path}}"))
+
+	if body := serve(t, m, http.MethodGet, "http://example.com/foo/pkg?go-get=1").Body.String(); body != first {
+		t.Errorf("expected cached response %q, got %q", first, body)
+	}
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/foo/bar?go-get=1", "changed /foo/bar"},
+		{"http://other.example.com/foo?go-get=1", "changed /foo"},
+	}
+	for _, test := range tests {
+		if body := serve(t, m, http.MethodGet, test.target).Body.String(); !strings.Contains(body, test.want) || strings.Contains(body, "<meta") {
+			t.Errorf("%s: expected a rendered response containing %q, got %q", test.target, test.want, body)
+		}
+	}
+}
+
+func TestResponseCacheBounded(t *testing.T) {
+	c := newResponseCache()
+	for i := 0; i <= maxCachedResponses; i++ {
+		c.put(responseKey{path: "/" + strconv.Itoa(i)}, nil)
+	}
+	if n := len(c.bodies); n > maxCachedResponses {
+		t.Errorf("expected at most %d cached responses, got %d", maxCachedResponses, n)
+	}
+}
+
+func TestServeHTTPETag(t *testing.T) {
+	m := New("/foo", "", "https://github.com/example/foo")
+	m.Compress = true
+	provision(t, m)
+
+	request := func(ifNoneMatch, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/foo?go-get=1", nil)
+		r.Header.Set("If-None-Match", ifNoneMatch)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		if err := m.ServeHTTP(w, r, nil); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	w := request("", "")
+	etag := w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+		t.Fatalf("expected strong ETag, got %q", etag)
+	}
+	if again := request("", "").Header().Get("ETag"); again != etag {
+		t.Errorf("expected stable ETag %s, got %s", etag, again)
+	}
+
+	for _, ifNoneMatch := range []string{etag, `"other", ` + etag, "W/" + etag, "*"} {
+		if w := request(ifNoneMatch, ""); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: expected 304 without body, got %d with %d bytes", ifNoneMatch, w.Code, w.Body.Len())
+		}
+	}
+	if w := request(`"other"`, ""); w.Code != http.StatusOK {
+		t.Errorf("expected 200 for another ETag, got %d", w.Code)
+	}
+
+	gzipped := request("", "gzip").Header().Get("ETag")
+	if gzipped == etag {
+		t.Error("expected the gzipped response to have another ETag")
+	}
+	if w := request(etag, "gzip"); w.Code != http.StatusOK {
+		t.Errorf("expected 200 for the ETag of the uncompressed response, got %d", w.Code)
+	}
+	if w := request(gzipped, "gzip"); w.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for the ETag of the gzipped response, got %d", w.Code)
+	}
+}
@@ -0,0 +1,116 @@
+package gopkg
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(Robots{})
+	httpcaddyfile.RegisterDirective("gopkg_robots", parseRobots)
+}
+
+// Robots serves a robots.txt disallowing crawlers from the packages with NoIndex that are registered with the gopkg
+// app and served for the host of the request. Path variables are written as `*` wildcards.
+type Robots struct {
+	// Sitemap is the URL of a sitemap advertised in the robots.txt, e.g. the one served by a Sitemap handler.
+	Sitemap string `json:"sitemap,omitempty"`
+
+	app *App
+}
+
+// CaddyModule returns the Caddy module information.
+func (Robots) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.gopkg_robots",
+		New: func() caddy.Module {
+			return new(Robots)
+		},
+	}
+}
+
+// parseRobots parses the gopkg_robots directive in a caddyfile. Syntax:
+//
+//     gopkg_robots [<sitemap_url>]
+//
+// The robots.txt is served at `/robots.txt`.
+func parseRobots(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	robots := new(Robots)
+	for h.Next() {
+		if h.NextArg() {
+			robots.Sitemap = h.Val()
+		}
+		if h.NextArg() || h.NextBlock(0) {
+			return nil, h.ArgErr()
+		}
+	}
+
+	matcher := caddy.ModuleMap{"path": h.JSON(caddyhttp.MatchPath{"/robots.txt"})}
+	return h.NewRoute(matcher, robots), nil
+}
+
+// Provision implements caddy.Provisioner.
+func (rb *Robots) Provision(ctx caddy.Context) error {
+	app, err := loadApp(ctx)
+	if err != nil {
+		return err
+	}
+	rb.app = app
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (rb Robots) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+	disallowed := rb.disallowed(r)
+	for _, path := range disallowed {
+		b.WriteString("Disallow: " + path + "\n")
+	}
+	if len(disallowed) == 0 {
+		// An empty Disallow allows everything
+		b.WriteString("Disallow:\n")
+	}
+	if rb.Sitemap != "" {
+		b.WriteString("\nSitemap: " + rb.Sitemap + "\n")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := w.Write([]byte(b.String()))
+	return err
+}
+
+// disallowed returns the sorted paths of the packages with NoIndex served for the request.
+func (rb Robots) disallowed(r *http.Request) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, m := range rb.app.Packages() {
+		if !m.NoIndex || !m.allowedHost(r) {
+			continue
+		}
+		path := m.MountPrefix + pathVarRegexp.ReplaceAllString(m.Path, "*")
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Robots)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Robots)(nil)
+)
@@ -0,0 +1,65 @@
+package gopkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRobots(t *testing.T) {
+	internal := New("/robots/internal", "", "https://git.example.com/internal")
+	internal.NoIndex = true
+	internal.Hosts = []string{"robots.example.com"}
+	user := New("/robots/~{user}", "", "https://git.example.com/{user}")
+	user.NoIndex = true
+	user.Hosts = []string{"robots.example.com"}
+	public := New("/robots/public", "", "https://github.com/example/public")
+	public.Hosts = []string{"robots.example.com"}
+	for _, m := range []*GoPackage{internal, user, public} {
+		provision(t, m)
+		defer m.Cleanup()
+	}
+
+	rb := &Robots{Sitemap: "https://robots.example.com/sitemap.xml"}
+	if err := rb.Provision(testContext); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(target string) string {
+		w := httptest.NewRecorder()
+		if err := rb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil), nil); err != nil {
+			t.Fatal(err)
+		}
+		return w.Body.String()
+	}
+
+	want := "User-agent: *\nDisallow: /robots/internal\nDisallow: /robots/~*\n\nSitemap: https://robots.example.com/sitemap.xml\n"
+	if got := request("http://robots.example.com/robots.txt"); got != want {
+		t.Errorf("expected robots.txt %q, got %q", want, got)
+	}
+
+	// Other hosts don't serve the packages
+	if got := request("http://other.example.com/robots.txt"); !strings.Contains(got, "Disallow:\n") {
+		t.Errorf("expected robots.txt allowing everything, got %q", got)
+	}
+}
+
+func TestServeHTTPNoIndex(t *testing.T) {
+	m := New("/foo", "", "https://github.com/example/foo")
+	m.NoIndex = true
+	provision(t, m)
+	defer m.Cleanup()
+
+	w := serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1")
+	if got := w.Header().Get("X-Robots-Tag"); got != "noindex" {
+		t.Errorf("expected X-Robots-Tag noindex, got %q", got)
+	}
+	if want := `<meta name="robots" content="noindex">`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("expected %s in body, got %q", want, w.Body.String())
+	}
+
+	if got := serve(t, m, http.MethodGet, "http://example.com/foo").Header().Get("X-Robots-Tag"); got != "noindex" {
+		t.Errorf("expected X-Robots-Tag noindex on redirects, got %q", got)
+	}
+}
@@ -0,0 +1,134 @@
+package gopkg
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(Sitemap{})
+	httpcaddyfile.RegisterDirective("gopkg_sitemap", parseSitemap)
+}
+
+// DefaultSitemapPath is the path the sitemap is served at if none is given in the Caddyfile.
+const DefaultSitemapPath = "/sitemap.xml"
+
+// Sitemap serves a sitemap.xml with the pages of the packages registered with the gopkg app that are served for the
+// host of the request, and of their submodules, so search engines index the vanity host rather than the source
+// host. Packages with NoIndex, packages and submodules with path variables, and wildcard and reserved submodules are
+// left out.
+type Sitemap struct {
+	app *App
+}
+
+// sitemapURLSet is the root element of a sitemap.
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// sitemapURL is a page listed in a sitemap.
+type sitemapURL struct {
+	Loc string `xml:"loc"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (Sitemap) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.gopkg_sitemap",
+		New: func() caddy.Module {
+			return new(Sitemap)
+		},
+	}
+}
+
+// parseSitemap parses the gopkg_sitemap directive in a caddyfile. Syntax:
+//
+//     gopkg_sitemap [<path>]
+//
+// The sitemap is served at <path>, which defaults to `/sitemap.xml`.
+func parseSitemap(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	path := DefaultSitemapPath
+	for h.Next() {
+		if h.NextArg() {
+			path = h.Val()
+		}
+		if h.NextArg() || h.NextBlock(0) {
+			return nil, h.ArgErr()
+		}
+	}
+
+	matcher := caddy.ModuleMap{"path": h.JSON(caddyhttp.MatchPath{path})}
+	return h.NewRoute(matcher, new(Sitemap)), nil
+}
+
+// Provision implements caddy.Provisioner.
+func (s *Sitemap) Provision(ctx caddy.Context) error {
+	app, err := loadApp(ctx)
+	if err != nil {
+		return err
+	}
+	s.app = app
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (s Sitemap) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+
+	out, err := xml.MarshalIndent(sitemapURLSet{URLs: s.urls(r)}, "", "  ")
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	_, err = w.Write(append([]byte(xml.Header), out...))
+	return err
+}
+
+// urls returns the pages listed for the request, sorted. The pages are listed with the scheme and host each package
+// resolves for the request, like for its go-import tags, so trusted proxies and pinned hosts are taken into account.
+func (s Sitemap) urls(r *http.Request) []sitemapURL {
+	seen := make(map[string]bool)
+	var urls []sitemapURL
+	add := func(m *GoPackage, path string) {
+		loc := (&url.URL{Scheme: m.requestScheme(r), Host: m.requestHost(r), Path: path}).String()
+		if !seen[loc] {
+			seen[loc] = true
+			urls = append(urls, sitemapURL{Loc: loc})
+		}
+	}
+
+	for _, m := range listedPackages(s.app, r) {
+		if m.NoIndex {
+			continue
+		}
+		add(m, m.MountPrefix+m.Path)
+		for _, submodule := range m.Submodules {
+			if submodule.Path != WildcardSubmodule && !submodule.Reserved && !pathVarRegexp.MatchString(submodule.Path) {
+				add(m, m.MountPrefix+m.Path+submodule.Path)
+			}
+		}
+	}
+
+	sort.Slice(urls, func(i, j int) bool {
+		return urls[i].Loc < urls[j].Loc
+	})
+	return urls
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Sitemap)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Sitemap)(nil)
+)
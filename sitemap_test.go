@@ -0,0 +1,70 @@
+package gopkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSitemap(t *testing.T) {
+	foo := New("/sitemap/foo", "", "https://github.com/example/foo").
+		WithSubmodule("/bar", "").
+		WithSubmodule("/{name}", "").
+		WithSubmodule(WildcardSubmodule, "https://github.com/example/monorepo")
+	foo.Hosts = []string{"example.com"}
+	foo.Submodules = append(foo.Submodules, Submodule{Path: "/wip", Reserved: true})
+	other := New("/sitemap/other", "", "https://github.com/example/other")
+	other.Hosts = []string{"other.example.com"}
+	internal := New("/sitemap/internal", "", "https://git.example.com/internal")
+	internal.NoIndex = true
+	proxied := New("/sitemap/proxied", "", "https://github.com/example/proxied")
+	proxied.Hosts = []string{"example.com"}
+	proxied.TrustedProxies = []string{"192.0.2.0/24"}
+	for _, m := range []*GoPackage{foo, other, internal, proxied} {
+		provision(t, m)
+		defer m.Cleanup()
+	}
+
+	s := new(Sitemap)
+	if err := s.Provision(testContext); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://example.com/sitemap.xml", nil), nil); err != nil {
+		t.Fatal(err)
+	}
+	body := w.Body.String()
+
+	if !strings.HasPrefix(body, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">`) {
+		t.Errorf("expected a sitemap, got %q", body)
+	}
+	for _, want := range []string{
+		"<loc>https://example.com/sitemap/foo</loc>",
+		"<loc>https://example.com/sitemap/foo/bar</loc>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected sitemap to contain %s, got %q", want, body)
+		}
+	}
+	for _, unwanted := range []string{"/sitemap/other", "/sitemap/internal", "/sitemap/foo/%7Bname%7D", "/sitemap/foo/%2A", "/sitemap/foo/*", "/sitemap/foo/wip"} {
+		if strings.Contains(body, unwanted+"<") {
+			t.Errorf("expected sitemap not to list %s, got %q", unwanted, body)
+		}
+	}
+
+	// Behind a TLS-terminating trusted proxy, the pages are listed with the host and scheme of the client
+	r := httptest.NewRequest(http.MethodGet, "http://backend.internal/sitemap.xml", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-Host", "example.com")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w = httptest.NewRecorder()
+	if err := s.ServeHTTP(w, r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "<loc>https://example.com/sitemap/proxied</loc>") ||
+		strings.Contains(body, "backend.internal/sitemap/proxied") {
+		t.Errorf("expected sitemap to list the forwarded host and scheme, got %q", body)
+	}
+}
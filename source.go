@@ -0,0 +1,90 @@
+package gopkg
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Source configures the go-source meta tag, which tells documentation tools like godoc where to browse the source
+// of the package.
+//
+// The Dir and File templates may contain the substitutions `{dir}`, `{/dir}`, `{file}` and `{line}` described in
+// https://github.com/golang/gddo/wiki/Source-Code-Links.
+type Source struct {
+	// Auto fills in the templates of the recognized forge of the repository URL: GitHub, GitLab, Bitbucket or
+	// SourceHut. Templates that are set explicitly take precedence.
+	Auto bool `json:"auto,omitempty"`
+
+	// Home is the URL of the repository's home page.
+	Home string `json:"home,omitempty"`
+
+	// Dir is the URL template of a directory listing.
+	Dir string `json:"dir,omitempty"`
+
+	// File is the URL template of a line in a file.
+	File string `json:"file,omitempty"`
+}
+
+// sourcePresets are the directory and file templates of known forges, relative to the repository home page.
+var sourcePresets = map[string]struct{ dir, file string }{
+	"github.com":    {"/tree/master{/dir}", "/blob/master{/dir}/{file}#L{line}"},
+	"gitlab.com":    {"/-/tree/master{/dir}", "/-/blob/master{/dir}/{file}#L{line}"},
+	"bitbucket.org": {"/src/default{/dir}", "/src/default{/dir}/{file}#lines-{line}"},
+	"git.sr.ht":     {"/tree/master/item{/dir}", "/tree/master/item{/dir}/{file}#L{line}"},
+}
+
+// sourceTemplateReplacer restores the go-source substitutions that the Caddyfile adapter expands as placeholder
+// shorthands.
+var sourceTemplateReplacer = strings.NewReplacer(
+	"{http.request.uri.path.dir}", "{dir}",
+	"{http.request.uri.path.file}", "{file}",
+)
+
+// provision validates the configuration.
+func (s *Source) provision() error {
+	if !s.Auto && s.Home == "" {
+		return fmt.Errorf("source needs a home URL unless it is detected automatically")
+	}
+	return nil
+}
+
+// resolve returns the templates for a package in the directory dir of the repository at repoURL. ok is false if they
+// cannot be detected and are not set.
+func (s *Source) resolve(repoURL, dir string) (templates Source, ok bool) {
+	templates = Source{Home: s.Home, Dir: s.Dir, File: s.File}
+
+	if s.Auto {
+		home := strings.TrimSuffix(strings.TrimSuffix(repoURL, "/"), ".git")
+		if u, err := url.Parse(home); err == nil {
+			if preset, known := sourcePresets[strings.TrimPrefix(strings.ToLower(u.Host), "www.")]; known {
+				if dir = strings.Trim(dir, "/"); dir != "" {
+					preset.dir = strings.Replace(preset.dir, "{/dir}", "/"+dir+"{/dir}", 1)
+					preset.file = strings.Replace(preset.file, "{/dir}", "/"+dir+"{/dir}", 1)
+				}
+				if templates.Home == "" {
+					templates.Home = home
+				}
+				if templates.Dir == "" {
+					templates.Dir = home + preset.dir
+				}
+				if templates.File == "" {
+					templates.File = home + preset.file
+				}
+			}
+		}
+	}
+
+	if templates.Home == "" {
+		return Source{}, false
+	}
+
+	// Templates that are not available are written as `_`
+	if templates.Dir == "" {
+		templates.Dir = "_"
+	}
+	if templates.File == "" {
+		templates.File = "_"
+	}
+	return templates, true
+}
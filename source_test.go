@@ -0,0 +1,101 @@
+package gopkg
+
+import (
+	"html"
+	"html/template"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServeHTTPSourceAuto(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{
+			"https://github.com/example/foo",
+			"https://github.com/example/foo https://github.com/example/foo/tree/master{/dir} https://github.com/example/foo/blob/master{/dir}/{file}#L{line}",
+		},
+		{
+			"https://gitlab.com/example/foo.git",
+			"https://gitlab.com/example/foo https://gitlab.com/example/foo/-/tree/master{/dir} https://gitlab.com/example/foo/-/blob/master{/dir}/{file}#L{line}",
+		},
+		{
+			"https://bitbucket.org/example/foo",
+			"https://bitbucket.org/example/foo https://bitbucket.org/example/foo/src/default{/dir} https://bitbucket.org/example/foo/src/default{/dir}/{file}#lines-{line}",
+		},
+		{
+			"https://git.sr.ht/~example/foo",
+			"https://git.sr.ht/~example/foo https://git.sr.ht/~example/foo/tree/master/item{/dir} https://git.sr.ht/~example/foo/tree/master/item{/dir}/{file}#L{line}",
+		},
+	}
+
+	for _, test := range tests {
+		m := New("/foo", "", test.url)
+		m.Source = &Source{Auto: true}
+		provision(t, m)
+
+		body := html.UnescapeString(serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1").Body.String())
+		if want := `<meta name="go-source" content="example.com/foo ` + test.want + `">`; !strings.Contains(body, want) {
+			t.Errorf("%s: expected %s, got %s", test.url, want, body)
+		}
+	}
+}
+
+func TestServeHTTPSourceOverride(t *testing.T) {
+	m := New("/foo", "", "https://github.com/example/foo")
+	m.Source = &Source{Auto: true, File: "https://example.com/{file}"}
+	provision(t, m)
+
+	body := html.UnescapeString(serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1").Body.String())
+	want := `content="example.com/foo https://github.com/example/foo https://github.com/example/foo/tree/master{/dir} https://example.com/{file}"`
+	if !strings.Contains(body, want) {
+		t.Errorf("expected %s, got %s", want, body)
+	}
+
+	// Unknown forges get no go-source tag
+	m = New("/foo", "", "https://git.example.com/foo")
+	m.Source = &Source{Auto: true}
+	provision(t, m)
+
+	if body := serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1").Body.String(); strings.Contains(body, "go-source") {
+		t.Errorf("expected no go-source tag for unknown forge, got %s", body)
+	}
+}
+
+func TestUnmarshalCaddyfileSourceShorthands(t *testing.T) {
+	// The Caddyfile adapter expands {dir} and {file} before the directive is parsed
+	m := parseDirective(t, `gopkg /foo https://git.example.com/foo {
+		source https://git.example.com/foo https://git.example.com/foo/{http.request.uri.path.dir} "https://git.example.com/foo/{http.request.uri.path.file}#{line}"
+	}`)
+
+	want := Source{Home: "https://git.example.com/foo", Dir: "https://git.example.com/foo/{dir}", File: "https://git.example.com/foo/{file}#{line}"}
+	if *m.Source != want {
+		t.Errorf("expected %+v, got %+v", want, *m.Source)
+	}
+}
+
+func TestServeHTTPSubmoduleDir(t *testing.T) {
+	m := parseDirective(t, `gopkg /foo https://github.com/example/foo {
+		submodule /sub {
+			dir sub
+		}
+		source auto
+	}`)
+	m.Template = template.Must(template.New("dir").Parse(`{{.Path}} {{.URL}} dir={{.Dir}} {{with .Source}}{{.Dir}}{{end}}`))
+	provision(t, m)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://example.com/foo/sub/pkg?go-get=1", "/foo/sub https://github.com/example/foo dir=sub https://github.com/example/foo/tree/master/sub{/dir}"},
+		{"http://example.com/foo/pkg?go-get=1", "/foo https://github.com/example/foo dir= https://github.com/example/foo/tree/master{/dir}"},
+	}
+	for _, test := range tests {
+		if body := html.UnescapeString(serve(t, m, http.MethodGet, test.target).Body.String()); body != test.want {
+			t.Errorf("%s: expected %q, got %q", test.target, test.want, body)
+		}
+	}
+}
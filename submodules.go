@@ -0,0 +1,105 @@
+package gopkg
+
+import (
+	"strings"
+)
+
+// linearScanLimit is the number of submodules up to which scanning all of them is faster than a trie lookup, as
+// measured by BenchmarkResolveTarget.
+const linearScanLimit = 2
+
+// submoduleTrie indexes submodules by their path segments, so that the longest matching submodule is found in time
+// proportional to the depth of the request path rather than the number of submodules.
+type submoduleTrie struct {
+	submodule *Submodule
+	children  map[string]*submoduleTrie
+}
+
+// indexSubmodules finds the wildcard submodule and the submodules with path variables and, if there are enough
+// submodules for it to pay off, builds the trie used to resolve them. Submodules with path variables are indexed by
+// their generic path, which matchSubmoduleVars turns request paths into, so only they are matched one by one.
+func (m *GoPackage) indexSubmodules() {
+	m.wildcard = nil
+	m.submoduleIndex = nil
+	m.submodulePatterns = nil
+
+	for i, submodule := range m.Submodules {
+		if submodule.Path == WildcardSubmodule && m.wildcard == nil {
+			m.wildcard = &m.Submodules[i]
+		}
+		if submodule.pathPattern != nil {
+			m.submodulePatterns = append(m.submodulePatterns, &m.Submodules[i])
+		}
+	}
+
+	if len(m.Submodules) <= linearScanLimit {
+		return
+	}
+
+	root := new(submoduleTrie)
+	for i, submodule := range m.Submodules {
+		if submodule.Path == WildcardSubmodule {
+			continue
+		}
+
+		node := root
+		for _, segment := range m.pathSegments(submodule.Path) {
+			child, ok := node.children[segment]
+			if !ok {
+				child = new(submoduleTrie)
+				if node.children == nil {
+					node.children = make(map[string]*submoduleTrie)
+				}
+				node.children[segment] = child
+			}
+			node = child
+		}
+
+		// Like the linear scan, the first of several submodules with the same path wins
+		if node.submodule == nil {
+			node.submodule = &m.Submodules[i]
+		}
+	}
+	m.submoduleIndex = root
+}
+
+// lookup finds the longest submodule of m matching the request path.
+func (t *submoduleTrie) lookup(m GoPackage, reqPath string) (string, *Submodule) {
+	if len(reqPath) <= len(m.Path) || !m.samePath(reqPath[:len(m.Path)+1], m.Path+"/") {
+		return "", nil
+	}
+
+	var best *Submodule
+	node := t
+	for _, segment := range m.pathSegments(reqPath[len(m.Path):]) {
+		node = node.children[segment]
+		if node == nil {
+			break
+		}
+		if node.submodule != nil {
+			best = node.submodule
+		}
+	}
+
+	if best == nil {
+		return "", nil
+	}
+	return m.Path + best.Path, best
+}
+
+// pathSegments splits a path into its non-empty segments, lower-cased if CaseInsensitive is set.
+func (m GoPackage) pathSegments(p string) []string {
+	if m.CaseInsensitive {
+		p = strings.ToLower(p)
+	}
+
+	segments := strings.Split(p, "/")
+	n := 0
+	for _, segment := range segments {
+		if segment != "" {
+			segments[n] = segment
+			n++
+		}
+	}
+	return segments[:n]
+}
@@ -0,0 +1,88 @@
+package gopkg
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// newSubmodulePackage returns a package with n submodules at /mod<i>, every tenth of which has a nested /v2 submodule.
+func newSubmodulePackage(n int) *GoPackage {
+	m := New("/foo", "git", "https://github.com/example/foo")
+	for i := 0; i < n; i++ {
+		m.WithSubmodule(fmt.Sprintf("/mod%d", i), fmt.Sprintf("https://github.com/example/mod%d", i))
+		if i%10 == 0 {
+			m.WithSubmodule(fmt.Sprintf("/mod%d/v2", i), fmt.Sprintf("https://github.com/example/mod%d-v2", i))
+		}
+	}
+	return m
+}
+
+func TestSubmoduleTrieMatchesScan(t *testing.T) {
+	for _, caseInsensitive := range []bool{false, true} {
+		m := newSubmodulePackage(100).
+			WithSubmodule(WildcardSubmodule, "https://github.com/example/monorepo").
+			WithSubmodule("/Mixed/Case", "https://github.com/example/mixed").
+			WithSubmodule("/mod5", "https://github.com/example/duplicate")
+		m.CaseInsensitive = caseInsensitive
+		m.indexSubmodules()
+		if m.submoduleIndex == nil {
+			t.Fatal("expected a trie for 100 submodules")
+		}
+
+		linear := *m
+		linear.submoduleIndex = nil
+
+		for _, reqPath := range []string{
+			"/foo", "/foo/", "/foo/mod1", "/foo/mod1/", "/foo/mod1/pkg", "/foo/mod10/v2", "/foo/mod10/v2/pkg",
+			"/foo/mod10/v3", "/foo/mod11/v2", "/foo/mod5", "/foo/mod100", "/foo/other/pkg", "/foo/mixed/case/pkg",
+			"/foo/Mixed/Case", "/FOO/mod1", "/foobar/mod1", "/bar",
+		} {
+			if got, want := m.ResolveTarget(reqPath), linear.ResolveTarget(reqPath); !reflect.DeepEqual(got, want) {
+				t.Errorf("case insensitive %v, %s: trie resolved %+v, scan resolved %+v", caseInsensitive, reqPath, got, want)
+			}
+		}
+	}
+}
+
+func BenchmarkResolveTarget(b *testing.B) {
+	for _, n := range []int{1, 10, 100, 1000} {
+		m := newSubmodulePackage(n)
+		m.indexSubmodules()
+		reqPath := fmt.Sprintf("/foo/mod%d/v2/pkg", n/10*9)
+
+		linear := *m
+		linear.submoduleIndex = nil
+
+		b.Run(fmt.Sprintf("scan/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				linear.ResolveTarget(reqPath)
+			}
+		})
+		b.Run(fmt.Sprintf("trie/%d", n), func(b *testing.B) {
+			trie := *m
+			trie.indexSubmodules()
+			if n > linearScanLimit && trie.submoduleIndex == nil {
+				b.Fatal("expected a trie")
+			}
+			for i := 0; i < b.N; i++ {
+				trie.ResolveTarget(reqPath)
+			}
+		})
+	}
+}
+
+func TestIndexSubmodulePatterns(t *testing.T) {
+	m := provision(t, newSubmodulePackage(100).WithSubmodule("/tools/*", "https://github.com/example/tools-{1}"))
+	if len(m.submodulePatterns) != 1 || m.submodulePatterns[0].Path != "/tools/{1}" {
+		t.Fatalf("expected only the submodule with path variables to be matched one by one, got %d", len(m.submodulePatterns))
+	}
+
+	reqPath, vars := m.matchSubmoduleVars("/foo/tools/lint/cmd", nil)
+	if reqPath != "/foo/tools/{1}/cmd" || vars["1"] != "lint" {
+		t.Errorf("expected generic path with variables, got %s %v", reqPath, vars)
+	}
+	if target := m.ResolveTarget(reqPath); target.Path != "/foo/tools/{1}" {
+		t.Errorf("expected the trie to resolve the generic path, got %s", target.Path)
+	}
+}
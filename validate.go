@@ -0,0 +1,116 @@
+package gopkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// DefaultValidateURLTimeout is how long a source URL may take to respond if no timeout is configured.
+const DefaultValidateURLTimeout = caddy.Duration(5 * time.Second)
+
+// ValidateURL checks at provision time that the source URLs respond to a HEAD request, to catch typos early. With
+// Repo set, git repositories are probed like `git ls-remote` does instead.
+//
+// Unreachable URLs are logged as warnings, unless Strict is set.
+type ValidateURL struct {
+	// Strict fails provisioning if a source URL is unreachable, instead of logging a warning.
+	Strict bool `json:"strict,omitempty"`
+
+	// Repo requests the refs of git repositories over the smart HTTP protocol, which fails for a URL that serves a
+	// page but no repository, e.g. a web page of the forge rather than a repository. Other sources are still checked
+	// with a HEAD request.
+	Repo bool `json:"repo,omitempty"`
+
+	// Timeout bounds the check of each URL, so an unreachable host cannot hold up the start of Caddy.
+	//
+	// If zero, the default is 5 seconds.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// check probes each of the sources with an HTTP(S) url.
+func (v *ValidateURL) check(ctx context.Context, logger *zap.Logger, sources []Target) error {
+	timeout := time.Duration(v.Timeout)
+	if timeout == 0 {
+		timeout = time.Duration(DefaultValidateURLTimeout)
+	}
+
+	checked := make(map[string]bool)
+	for _, source := range sources {
+		// URLs with path variables or placeholders are only known per request
+		u := source.URL
+		if checked[u] || pathVarRegexp.MatchString(u) || placeholderRegexp.MatchString(u) || !(strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")) {
+			continue
+		}
+		checked[u] = true
+
+		probe := headURL
+		if v.Repo && source.Vcs == "git" {
+			probe = probeGitRepo
+		}
+		if err := probe(ctx, u, timeout); err != nil {
+			if v.Strict {
+				return fmt.Errorf("validating url %s: %v", u, err)
+			}
+			logger.Warn("source url not reachable", zap.String("url", u), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// headURL sends a HEAD request to u and checks that it does not respond with an error status.
+func headURL(ctx context.Context, u string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodHead, u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// gitAdvertisement is the content type of the refs a git server advertises over the smart HTTP protocol.
+const gitAdvertisement = "application/x-git-upload-pack-advertisement"
+
+// probeGitRepo requests the refs of the git repository at u over the smart HTTP protocol, like `git ls-remote`, and
+// checks that the server advertises them.
+func probeGitRepo(ctx context.Context, u string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(u, "/")+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != gitAdvertisement {
+		return fmt.Errorf("no git repository, got content type %q", ct)
+	}
+	return nil
+}
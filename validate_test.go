@@ -0,0 +1,95 @@
+package gopkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestValidateURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("expected HEAD request, got %s", r.Method)
+		}
+		if r.URL.Path != "/example/foo" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	v := &ValidateURL{Strict: true}
+	if err := v.check(context.Background(), zap.NewNop(), []Target{{URL: srv.URL + "/example/foo"}, {URL: ""}, {URL: "git@example.com:foo"}, {URL: srv.URL + "/{user}/foo"}}); err != nil {
+		t.Errorf("expected reachable url to pass, got %v", err)
+	}
+	if err := v.check(context.Background(), zap.NewNop(), []Target{{URL: srv.URL + "/example/typo"}}); err == nil {
+		t.Error("expected error for url responding with 404")
+	}
+}
+
+func TestValidateURLTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	v := &ValidateURL{Timeout: caddy.Duration(50 * time.Millisecond)}
+	core, logs := observer.New(zapcore.WarnLevel)
+
+	start := time.Now()
+	if err := v.check(context.Background(), zap.New(core), []Target{{URL: srv.URL}}); err != nil {
+		t.Errorf("expected timeout to be a warning, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected check to give up after the timeout, took %v", elapsed)
+	}
+	if logs.Len() != 1 {
+		t.Errorf("expected one warning, got %v", logs.All())
+	}
+
+	v.Strict = true
+	if err := v.check(context.Background(), zap.NewNop(), []Target{{URL: srv.URL}}); err == nil {
+		t.Error("expected strict check to fail on timeout")
+	}
+}
+
+func TestValidateURLRepo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/example/foo.git/info/refs":
+			if r.FormValue("service") != "git-upload-pack" {
+				t.Errorf("expected refs for git-upload-pack, got %s", r.URL.RawQuery)
+			}
+			w.Header().Set("Content-Type", gitAdvertisement)
+		case "/example/page/info/refs", "/example/hg":
+			w.Header().Set("Content-Type", "text/html")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	v := &ValidateURL{Strict: true, Repo: true}
+	if err := v.check(context.Background(), zap.NewNop(), []Target{
+		{Vcs: "git", URL: srv.URL + "/example/foo.git"},
+		{Vcs: "hg", URL: srv.URL + "/example/hg"},
+	}); err != nil {
+		t.Errorf("expected repositories to pass, got %v", err)
+	}
+	for _, u := range []string{srv.URL + "/example/page", srv.URL + "/example/typo"} {
+		if err := v.check(context.Background(), zap.NewNop(), []Target{{Vcs: "git", URL: u}}); err == nil {
+			t.Errorf("%s: expected error for url without a git repository", u)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package gopkg
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// vcsSchemes are the version control systems the go command supports in go-import tags, with the URL schemes it
+// accepts for each. The `mod` vcs denotes a module proxy instead of a repository.
+var vcsSchemes = map[string][]string{
+	"git":    {"https", "http", "git+ssh", "ssh", "git"},
+	"hg":     {"https", "http", "ssh"},
+	"svn":    {"https", "http", "svn", "svn+ssh"},
+	"bzr":    {"https", "http", "bzr", "bzr+ssh"},
+	"fossil": {"https", "http"},
+	"mod":    {"https", "http"},
+}
+
+// validateVcs checks that the go command can fetch from repoURL with the given vcs.
+func validateVcs(vcs, repoURL string) error {
+	schemes, ok := vcsSchemes[vcs]
+	if !ok {
+		return fmt.Errorf("unsupported vcs %q", vcs)
+	}
+
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return fmt.Errorf("parsing url: %v", err)
+	}
+
+	supported := false
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return fmt.Errorf("%s does not support %s urls, only %s", vcs, u.Scheme, strings.Join(schemes, ", "))
+	}
+
+	// The go command appends the module path and the proxy protocol paths to the base URL of a module proxy
+	if vcs == "mod" && (u.RawQuery != "" || u.Fragment != "" || strings.Contains(u.Path, "/@v")) {
+		return fmt.Errorf("url %s must be the base url of the module proxy", repoURL)
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package gopkg
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mschneider82/gopkg/gopkgtest"
+)
+
+func TestServeHTTPVcs(t *testing.T) {
+	tests := []struct {
+		vcs string
+		url string
+	}{
+		{"git", "https://github.com/example/foo"},
+		{"git", "ssh://git@example.com/foo.git"},
+		{"hg", "https://hg.example.com/foo"},
+		{"svn", "svn://svn.example.com/foo/trunk"},
+		{"bzr", "bzr+ssh://bzr.example.com/foo"},
+		{"fossil", "https://fossil.example.com/foo"},
+		{"mod", "https://proxy.example.com"},
+	}
+
+	for _, test := range tests {
+		m := provision(t, New("/foo", test.vcs, test.url))
+
+		host, path, vcs, url, err := gopkgtest.ParseGoImport(serve(t, m, http.MethodGet, "http://example.com/foo?go-get=1").Body.String())
+		if err != nil {
+			t.Fatalf("%s %s: %v", test.vcs, test.url, err)
+		}
+		if host != "example.com" || path != "/foo" || vcs != test.vcs || url != test.url {
+			t.Errorf("%s %s: got go-import %s%s %s %s", test.vcs, test.url, host, path, vcs, url)
+		}
+	}
+}
+
+func TestProvisionVcsInvalid(t *testing.T) {
+	tests := []struct {
+		vcs string
+		url string
+	}{
+		{"cvs", "https://cvs.example.com/foo"},
+		{"hg", "git://example.com/foo"},
+		{"svn", "ssh://svn.example.com/foo"},
+		{"mod", "ssh://proxy.example.com"},
+		{"mod", "https://proxy.example.com/example.com/foo/@v/list"},
+		{"mod", "https://proxy.example.com?token=secret"},
+	}
+
+	for _, test := range tests {
+		if err := New("/foo", test.vcs, test.url).Provision(testContext); err == nil {
+			t.Errorf("%s %s: expected error", test.vcs, test.url)
+		}
+	}
+}